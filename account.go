@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Account struct {
@@ -19,13 +20,18 @@ type IAccountDB interface {
 	Get(int) (Account, error)
 	// Return err if account could not be updated
 	Set(Account) error
+	// Return every account in the order they are stored
+	All() ([]Account, error)
 }
 
 type AccountDB struct {
 	DBFile string
+	// Metrics records the duration of reads and writes, nothing is recorded if not set
+	Metrics *Metrics
 }
 
 func (a AccountDB) read() ([]Account, error) {
+	defer a.Metrics.observeStore(metricStoreAccounts, metricOperationRead, time.Now())
 	file, err := os.Open(a.DBFile)
 	if err != nil {
 		return []Account{}, err
@@ -80,29 +86,16 @@ func (a AccountDB) read() ([]Account, error) {
 	return accounts, nil
 }
 
+// write replaces the accounts file through a temporary file so a crash never leaves it half written
 func (a AccountDB) write(accounts []Account) error {
-	file, err := os.OpenFile(a.DBFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
+	defer a.Metrics.observeStore(metricStoreAccounts, metricOperationWrite, time.Now())
 
-	datawriter := bufio.NewWriter(file)
-	// Write the header
-	datawriter.WriteString("ACCOUNT_ID,PIN,BALANCE\n")
-
-	// Write each account to the file
+	var content strings.Builder
+	content.WriteString("ACCOUNT_ID,PIN,BALANCE\n")
 	for _, account := range accounts {
-		line := fmt.Sprintf("%d,%s,%.2f\n", account.AccountID, account.PIN, account.Balance)
-		_, err = datawriter.WriteString(line)
-		if err != nil {
-			return err
-		}
+		content.WriteString(fmt.Sprintf("%d,%s,%.2f\n", account.AccountID, account.PIN, account.Balance))
 	}
-
-	datawriter.Flush()
-	file.Close()
-
-	return nil
+	return writeFileAtomic(a.DBFile, []byte(content.String()))
 }
 
 // Get returns a specific account from the CSV file
@@ -121,6 +114,12 @@ func (a AccountDB) Get(accountID int) (Account, error) {
 	return Account{}, ErrAccountNotFound
 }
 
+// All returns every account from the CSV file
+// An error is returned on failure to read the CSV file
+func (a AccountDB) All() ([]Account, error) {
+	return a.read()
+}
+
 // Set returns an error if the account was not updated in the CSV file
 // set will override the CSV row that represents this account
 func (a AccountDB) Set(account Account) error {
@@ -143,7 +142,7 @@ func (a AccountDB) Set(account Account) error {
 
 	err = a.write(accounts)
 	if err != nil {
-		return fmt.Errorf("Failed to write account to database. %s", err.Error())
+		return fmt.Errorf("Failed to write account to database. %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,341 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alert kinds
+const (
+	AlertLowBalance       = "low_balance"
+	AlertLargeTransaction = "large_transaction"
+)
+
+// AlertPreferences are the alerts a customer wants for an account. A zero amount disables its alert
+type AlertPreferences struct {
+	AccountID int
+	Email     string
+	// LowBalance alerts when a withdrawal takes the balance below the amount
+	LowBalance float64
+	// LargeTransaction alerts on withdrawals and deposits over the amount
+	LargeTransaction float64
+}
+
+// Validate returns an error if the email address is not a single address or an amount is negative
+func (p AlertPreferences) Validate() error {
+	address, err := mail.ParseAddress(p.Email)
+	if err != nil || address.Address != p.Email || strings.ContainsAny(p.Email, ",\r\n") {
+		return ErrAlertEmailInvalid
+	}
+	if p.LowBalance < 0 || p.LargeTransaction < 0 {
+		return ErrAlertThresholdInvalid
+	}
+	return nil
+}
+
+// String describes the preferences for the customer
+func (p AlertPreferences) String() string {
+	describe := func(amount float64) string {
+		if amount == 0 {
+			return "off"
+		}
+		return fmt.Sprintf("%.2f", amount)
+	}
+	return fmt.Sprintf("Email: %s, low balance: %s, large transaction: %s", p.Email, describe(p.LowBalance), describe(p.LargeTransaction))
+}
+
+// Alert is a notification sent to a customer
+type Alert struct {
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+	// AccountID is masked to the last 4 digits
+	AccountID     string  `json:"account_id"`
+	Email         string  `json:"email"`
+	Subject       string  `json:"subject"`
+	Message       string  `json:"message"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	Amount        float64 `json:"amount,omitempty"`
+	Balance       float64 `json:"balance"`
+	// Threshold is the amount of the preference that raised the alert
+	Threshold float64 `json:"threshold"`
+}
+
+// EvaluateAlerts returns the alerts the preferences raise for a withdrawal or deposit event
+func EvaluateAlerts(preferences AlertPreferences, event Event) []Alert {
+	alerts := []Alert{}
+	if event.Balance == nil || (event.Type != EventWithdrawal && event.Type != EventDeposit) {
+		return alerts
+	}
+	balance := *event.Balance
+	account := maskAccount(event.AccountID)
+	alert := func(kind string, threshold float64, subject string, message string) Alert {
+		return Alert{
+			Kind:          kind,
+			Time:          event.Time,
+			AccountID:     account,
+			Email:         preferences.Email,
+			Subject:       subject,
+			Message:       message,
+			TransactionID: event.TransactionID,
+			Amount:        event.Amount,
+			Balance:       balance,
+			Threshold:     threshold,
+		}
+	}
+
+	if preferences.LargeTransaction > 0 && event.Amount > preferences.LargeTransaction {
+		message := fmt.Sprintf("A %s of %.2f was made from account %s, over your alert of %.2f.", event.Type, event.Amount, account, preferences.LargeTransaction)
+		if event.Type == EventDeposit {
+			message = fmt.Sprintf("A %s of %.2f was made to account %s, over your alert of %.2f.", event.Type, event.Amount, account, preferences.LargeTransaction)
+		}
+		alerts = append(alerts, alert(AlertLargeTransaction, preferences.LargeTransaction, "ATM alert: large "+event.Type, message))
+	}
+
+	// only the withdrawal that crosses the amount alerts, not every withdrawal after it
+	previous := roundCents(balance + event.Amount + event.Fee)
+	if event.Type == EventWithdrawal && preferences.LowBalance > 0 && balance < preferences.LowBalance && previous >= preferences.LowBalance {
+		message := fmt.Sprintf("The balance of account %s is %.2f after a withdrawal of %.2f, below your alert of %.2f.", account, balance, event.Amount, preferences.LowBalance)
+		alerts = append(alerts, alert(AlertLowBalance, preferences.LowBalance, "ATM alert: low balance", message))
+	}
+	return alerts
+}
+
+// INotifier sends alerts to customers
+type INotifier interface {
+	Notify(Alert) error
+}
+
+// DefaultAlertQueueSize is the most alerts waiting to be sent if QueueSize is zero
+const DefaultAlertQueueSize = 100
+
+// AlertEvaluator raises the alerts of the account of each withdrawal and deposit event and queues them to be sent with the notifier.
+// Subscribe its Publish to the event bus of the terminal and start Run to send the queued alerts
+type AlertEvaluator struct {
+	AlertDB  IAlertDB
+	Notifier INotifier
+	// QueueSize is the most alerts waiting to be sent, DefaultAlertQueueSize if zero
+	QueueSize int
+	// Logger records the alerts that were sent or failed, nothing is logged if not set
+	Logger *slog.Logger
+
+	mutex sync.Mutex
+	queue chan Alert
+}
+
+// Publish evaluates the rules for the event and queues its alerts, so a slow notifier does not hold up the transaction.
+// An error is returned if the preferences could not be read or the queue is full, the alert is then dropped
+func (e *AlertEvaluator) Publish(event Event) error {
+	if event.Type != EventWithdrawal && event.Type != EventDeposit {
+		return nil
+	}
+	preferences, ok, err := e.AlertDB.Get(event.AccountID)
+	if err != nil || !ok {
+		return err
+	}
+
+	queue := e.queueChannel()
+	errs := []error{}
+	for _, alert := range EvaluateAlerts(preferences, event) {
+		select {
+		case queue <- alert:
+		default:
+			errs = append(errs, fmt.Errorf("Alert %s of %s was not sent, the alert queue is full.", alert.Kind, alert.AccountID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Send sends every queued alert without waiting for more and returns the number sent.
+// A failed alert is logged and not sent again
+func (e *AlertEvaluator) Send() int {
+	queue := e.queueChannel()
+	sent := 0
+	for {
+		select {
+		case alert := <-queue:
+			if e.send(alert) {
+				sent++
+			}
+		default:
+			return sent
+		}
+	}
+}
+
+// Run sends the alerts as they are queued until the context is done.
+// Alerts still queued when it returns are sent by Send
+func (e *AlertEvaluator) Run(ctx context.Context) {
+	queue := e.queueChannel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case alert := <-queue:
+			e.send(alert)
+		}
+	}
+}
+
+// send notifies the customer of the alert. Returns false if it was not sent
+func (e *AlertEvaluator) send(alert Alert) bool {
+	logger := orDiscard(e.Logger)
+	if err := e.Notifier.Notify(alert); err != nil {
+		logger.Error("alert not sent", "alert", alert.Kind, LogKeyAccount, alert.AccountID, LogKeyTransactionID, alert.TransactionID, logError(err))
+		return false
+	}
+	logger.Info("alert sent", "alert", alert.Kind, LogKeyAccount, alert.AccountID, LogKeyTransactionID, alert.TransactionID)
+	return true
+}
+
+func (e *AlertEvaluator) queueChannel() chan Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.queue == nil {
+		size := e.QueueSize
+		if size <= 0 {
+			size = DefaultAlertQueueSize
+		}
+		e.queue = make(chan Alert, size)
+	}
+	return e.queue
+}
+
+type IAlertDB interface {
+	// Return the preferences of the account and false if the account has no alerts
+	Get(int) (AlertPreferences, bool, error)
+	// Store the preferences of the account
+	Set(AlertPreferences) error
+	// Remove the preferences of the account
+	Delete(int) error
+}
+
+// AlertDB stores the alert preferences of the accounts in a CSV file
+type AlertDB struct {
+	DBFile string
+}
+
+func (d AlertDB) read() ([]AlertPreferences, error) {
+	rows, err := readCSVRows(d.DBFile, 4)
+	if err != nil {
+		return []AlertPreferences{}, err
+	}
+
+	preferences := []AlertPreferences{}
+	for _, columns := range rows {
+		accountID, err := strconv.Atoi(columns[0])
+		if err != nil {
+			return []AlertPreferences{}, ErrAccountIDNotInteger
+		}
+		lowBalance, err := strconv.ParseFloat(columns[2], 64)
+		if err != nil {
+			return []AlertPreferences{}, ErrAlertThresholdInvalid
+		}
+		largeTransaction, err := strconv.ParseFloat(columns[3], 64)
+		if err != nil {
+			return []AlertPreferences{}, ErrAlertThresholdInvalid
+		}
+		preferences = append(preferences, AlertPreferences{
+			AccountID:        accountID,
+			Email:            columns[1],
+			LowBalance:       lowBalance,
+			LargeTransaction: largeTransaction,
+		})
+	}
+	return preferences, nil
+}
+
+func (d AlertDB) write(preferences []AlertPreferences) error {
+	var content strings.Builder
+	content.WriteString("ACCOUNT_ID,EMAIL,LOW_BALANCE,LARGE_TRANSACTION\n")
+	for _, p := range preferences {
+		content.WriteString(fmt.Sprintf("%d,%s,%.2f,%.2f\n", p.AccountID, p.Email, p.LowBalance, p.LargeTransaction))
+	}
+	return writeFileAtomic(d.DBFile, []byte(content.String()))
+}
+
+// Get returns the preferences of the account from the CSV file
+// false is returned if the account has no alerts
+func (d AlertDB) Get(accountID int) (AlertPreferences, bool, error) {
+	preferences, err := d.read()
+	if err != nil {
+		return AlertPreferences{}, false, err
+	}
+	for _, p := range preferences {
+		if p.AccountID == accountID {
+			return p, true, nil
+		}
+	}
+	return AlertPreferences{}, false, nil
+}
+
+// Set stores the preferences in the CSV file in place of the preferences of the same account
+func (d AlertDB) Set(preferences AlertPreferences) error {
+	if err := preferences.Validate(); err != nil {
+		return err
+	}
+	return d.replace(preferences.AccountID, &preferences)
+}
+
+// Delete removes the preferences of the account from the CSV file
+func (d AlertDB) Delete(accountID int) error {
+	return d.replace(accountID, nil)
+}
+
+// replace writes the preferences without the account, followed by the new preferences if not nil
+func (d AlertDB) replace(accountID int, preferences *AlertPreferences) error {
+	existing, err := d.read()
+	if err != nil {
+		return err
+	}
+	kept := []AlertPreferences{}
+	for _, p := range existing {
+		if p.AccountID != accountID {
+			kept = append(kept, p)
+		}
+	}
+	if preferences != nil {
+		kept = append(kept, *preferences)
+	}
+	// removing alerts that were never set up writes nothing
+	if preferences == nil && len(kept) == len(existing) {
+		return nil
+	}
+	return d.write(kept)
+}
+
+// Alerts returns the alert preferences of the authorized account and false if it has no alerts
+// An error is returned if no active session or the terminal has no alerts
+func (atm *ATM) Alerts() (AlertPreferences, bool, error) {
+	if atm.AlertDB == nil {
+		return AlertPreferences{}, false, ErrAlertsUnavailable
+	}
+	accountID := atm.Session.AccountID
+	if err := atm.Session.Valid(accountID); err != nil {
+		return AlertPreferences{}, false, err
+	}
+	return atm.AlertDB.Get(accountID)
+}
+
+// SetAlerts stores the alert preferences of the authorized account, nil preferences remove its alerts
+// An error is returned if no active session, the terminal has no alerts or the preferences are not valid
+func (atm *ATM) SetAlerts(preferences *AlertPreferences) error {
+	if atm.AlertDB == nil {
+		return ErrAlertsUnavailable
+	}
+	accountID := atm.Session.AccountID
+	if err := atm.Session.Valid(accountID); err != nil {
+		return err
+	}
+	if preferences == nil {
+		return atm.AlertDB.Delete(accountID)
+	}
+	preferences.AccountID = accountID
+	return atm.AlertDB.Set(*preferences)
+}
@@ -0,0 +1,244 @@
+package atm_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+type testNotifier struct {
+	alerts []atm.Alert
+	err    error
+}
+
+func (n *testNotifier) Notify(alert atm.Alert) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+// blockingNotifier hands every alert to the channel and waits until it is received
+type blockingNotifier struct {
+	sent chan atm.Alert
+}
+
+func (n *blockingNotifier) Notify(alert atm.Alert) error {
+	n.sent <- alert
+	return nil
+}
+
+func alertBalance(balance float64) *float64 {
+	return &balance
+}
+
+func TestEvaluateAlerts(t *testing.T) {
+	preferences := atm.AlertPreferences{AccountID: 12345678, Email: "jane@example.com", LowBalance: 50, LargeTransaction: 200}
+
+	// a withdrawal over the amount that takes the balance below 50 raises both alerts
+	alerts := atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventWithdrawal, AccountID: 12345678, Amount: 220, Balance: alertBalance(40), TransactionID: "TX1"})
+	if len(alerts) != 2 || alerts[0].Kind != atm.AlertLargeTransaction || alerts[1].Kind != atm.AlertLowBalance {
+		t.Fatalf("Alerts are incorrect. %+v", alerts)
+	}
+	low := alerts[1]
+	if low.Email != "jane@example.com" || low.AccountID != "****5678" || low.Balance != 40 || low.Threshold != 50 || low.TransactionID != "TX1" {
+		t.Errorf("Low balance alert is incorrect. %+v", low)
+	}
+	if strings.Contains(low.Message, "12345678") {
+		t.Errorf("Alert message must mask the account. %s", low.Message)
+	}
+
+	// only the withdrawal that crosses the amount alerts
+	alerts = atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventWithdrawal, AccountID: 12345678, Amount: 20, Balance: alertBalance(20)})
+	if len(alerts) != 0 {
+		t.Errorf("Balance already below the amount should not alert. %+v", alerts)
+	}
+	// the fee counts towards crossing the amount
+	alerts = atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventWithdrawal, AccountID: 12345678, Amount: 20, Fee: 2.5, Balance: alertBalance(49)})
+	if len(alerts) != 1 || alerts[0].Kind != atm.AlertLowBalance {
+		t.Errorf("Withdrawal and fee crossing the amount should alert. %+v", alerts)
+	}
+
+	// deposits only raise large transaction alerts
+	alerts = atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventDeposit, AccountID: 12345678, Amount: 500, Balance: alertBalance(30)})
+	if len(alerts) != 1 || alerts[0].Kind != atm.AlertLargeTransaction {
+		t.Errorf("Large deposit alert is incorrect. %+v", alerts)
+	}
+	// an amount equal to the alert does not raise it
+	alerts = atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventDeposit, AccountID: 12345678, Amount: 200, Balance: alertBalance(300)})
+	if len(alerts) != 0 {
+		t.Errorf("Deposit of the alert amount should not alert. %+v", alerts)
+	}
+
+	// zero disables an alert and other events raise nothing
+	alerts = atm.EvaluateAlerts(atm.AlertPreferences{Email: "jane@example.com"}, atm.Event{Type: atm.EventWithdrawal, Amount: 1000, Balance: alertBalance(0)})
+	if len(alerts) != 0 {
+		t.Errorf("Disabled alerts should not alert. %+v", alerts)
+	}
+	alerts = atm.EvaluateAlerts(preferences, atm.Event{Type: atm.EventReversal, Amount: 1000, Balance: alertBalance(0)})
+	if len(alerts) != 0 {
+		t.Errorf("Reversal should not alert. %+v", alerts)
+	}
+}
+
+func TestAlertPreferencesValidate(t *testing.T) {
+	assertNoError(t, atm.AlertPreferences{Email: "jane@example.com", LowBalance: 50}.Validate())
+	assertErrorIsError(t, atm.AlertPreferences{Email: "jane"}.Validate(), atm.ErrAlertEmailInvalid)
+	assertErrorIsError(t, atm.AlertPreferences{Email: "Jane <jane@example.com>"}.Validate(), atm.ErrAlertEmailInvalid)
+	assertErrorIsError(t, atm.AlertPreferences{Email: "jane@example.com,bob@example.com"}.Validate(), atm.ErrAlertEmailInvalid)
+	assertErrorIsError(t, atm.AlertPreferences{Email: "jane@example.com", LargeTransaction: -1}.Validate(), atm.ErrAlertThresholdInvalid)
+}
+
+func TestAlertDB(t *testing.T) {
+	alertDB := atm.AlertDB{DBFile: filepath.Join(t.TempDir(), "alerts.csv")}
+
+	// a missing file has no alerts
+	_, ok, err := alertDB.Get(12345678)
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("Account should have no alerts")
+	}
+	assertNoError(t, alertDB.Delete(12345678))
+
+	assertNoError(t, alertDB.Set(atm.AlertPreferences{AccountID: 12345678, Email: "jane@example.com", LowBalance: 50}))
+	assertNoError(t, alertDB.Set(atm.AlertPreferences{AccountID: 11111111, Email: "bob@example.com", LargeTransaction: 200}))
+	assertNoError(t, alertDB.Set(atm.AlertPreferences{AccountID: 12345678, Email: "jane@example.org", LowBalance: 25.5}))
+	assertErrorIsError(t, alertDB.Set(atm.AlertPreferences{AccountID: 12345678, Email: "not an email"}), atm.ErrAlertEmailInvalid)
+
+	preferences, ok, err := alertDB.Get(12345678)
+	assertNoError(t, err)
+	if !ok || preferences.Email != "jane@example.org" || preferences.LowBalance != 25.5 || preferences.LargeTransaction != 0 {
+		t.Errorf("Preferences are incorrect. %+v", preferences)
+	}
+
+	assertNoError(t, alertDB.Delete(12345678))
+	_, ok, err = alertDB.Get(12345678)
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("Alerts of the account should have been removed")
+	}
+	preferences, ok, err = alertDB.Get(11111111)
+	assertNoError(t, err)
+	if !ok || preferences.LargeTransaction != 200 {
+		t.Errorf("Alerts of the other account should have been kept. %+v", preferences)
+	}
+}
+
+func TestAlertsCommand(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	output := &bytes.Buffer{}
+
+	// the terminal has no alerts
+	assertNoError(t, atm.RunCommand(testATM, output, "authorize 12345678 1234"))
+	assertErrorIsError(t, atm.RunCommand(testATM, output, "alerts"), atm.ErrAlertsUnavailable)
+
+	testATM.AlertDB = atm.AlertDB{DBFile: filepath.Join(t.TempDir(), "alerts.csv")}
+	output.Reset()
+	assertNoError(t, atm.RunCommand(testATM, output, "alerts"))
+	if !strings.Contains(output.String(), "No alerts set up.") {
+		t.Errorf("Alerts output is incorrect. %s", output.String())
+	}
+
+	assertErrorIsError(t, atm.RunCommand(testATM, output, "alerts jane"), atm.ErrAlertEmailInvalid)
+	assertErrorIsError(t, atm.RunCommand(testATM, output, "alerts jane@example.com fifty"), atm.ErrAlertThresholdInvalid)
+	assertNoError(t, atm.RunCommand(testATM, output, "alerts jane@example.com 50 200"))
+
+	output.Reset()
+	assertNoError(t, atm.RunCommand(testATM, output, "alerts"))
+	if !strings.Contains(output.String(), "Email: jane@example.com, low balance: 50.00, large transaction: 200.00") {
+		t.Errorf("Alerts output is incorrect. %s", output.String())
+	}
+
+	assertNoError(t, atm.RunCommand(testATM, output, "alerts off"))
+	_, ok, err := testATM.Alerts()
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("Alerts should have been removed")
+	}
+
+	// alerts belong to the authorized account
+	assertNoError(t, atm.RunCommand(testATM, output, "logout"))
+	assertError(t, atm.RunCommand(testATM, output, "alerts"))
+	_, _, err = testATM.Alerts()
+	assertError(t, err)
+}
+
+func TestAlertEvaluator(t *testing.T) {
+	alertDB := atm.AlertDB{DBFile: filepath.Join(t.TempDir(), "alerts.csv")}
+	notifier := &testNotifier{}
+	evaluator := &atm.AlertEvaluator{AlertDB: alertDB, Notifier: notifier}
+	bus := &atm.EventBus{}
+	bus.Subscribe(evaluator.Publish, atm.EventWithdrawal, atm.EventDeposit)
+	testATM := newTestFlowATM(t)
+	testATM.Events = bus
+	testATM.AlertDB = alertDB
+
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+	assertNoError(t, testATM.SetAlerts(&atm.AlertPreferences{Email: "jane@example.com", LowBalance: 50, LargeTransaction: 100}))
+
+	_, err := testATM.Withdraw(12345678, 40)
+	assertNoError(t, err)
+	if sent := evaluator.Send(); sent != 0 || len(notifier.alerts) != 0 {
+		t.Errorf("Withdrawal should not alert. %+v", notifier.alerts)
+	}
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	assertNoError(t, testATM.Deposit(12345678, 150))
+	// alerts are queued by the event and only sent by the evaluator
+	if len(notifier.alerts) != 0 {
+		t.Errorf("Alerts should be queued and not sent while publishing. %+v", notifier.alerts)
+	}
+	if sent := evaluator.Send(); sent != 2 || len(notifier.alerts) != 2 || notifier.alerts[0].Kind != atm.AlertLowBalance || notifier.alerts[1].Kind != atm.AlertLargeTransaction {
+		t.Fatalf("Alerts are incorrect. %d %+v", sent, notifier.alerts)
+	}
+	if notifier.alerts[0].Balance != 40 || notifier.alerts[0].TransactionID == "" {
+		t.Errorf("Low balance alert is incorrect. %+v", notifier.alerts[0])
+	}
+
+	// a notifier failure does not fail the transaction and the alert is not sent again
+	notifier.err = errors.New("mail server down")
+	assertNoError(t, testATM.Deposit(12345678, 150))
+	if sent := evaluator.Send(); sent != 0 {
+		t.Errorf("Alert should have failed. %d", sent)
+	}
+	notifier.err = nil
+	if sent := evaluator.Send(); sent != 0 || len(notifier.alerts) != 2 {
+		t.Errorf("Failed alert should not be sent again. %d %+v", sent, notifier.alerts)
+	}
+
+	// an alert is dropped if the queue is full
+	full := &atm.AlertEvaluator{AlertDB: alertDB, Notifier: notifier, QueueSize: 1}
+	err = full.Publish(atm.Event{Type: atm.EventWithdrawal, AccountID: 12345678, Amount: 150, Balance: alertBalance(10)})
+	assertErrorContains(t, err, "the alert queue is full")
+	if sent := full.Send(); sent != 1 {
+		t.Errorf("Queued alert should have been sent. %d", sent)
+	}
+}
+
+func TestAlertEvaluatorRun(t *testing.T) {
+	alertDB := atm.AlertDB{DBFile: filepath.Join(t.TempDir(), "alerts.csv")}
+	assertNoError(t, alertDB.Set(atm.AlertPreferences{AccountID: 12345678, Email: "jane@example.com", LargeTransaction: 100}))
+	notifier := &blockingNotifier{sent: make(chan atm.Alert)}
+	evaluator := &atm.AlertEvaluator{AlertDB: alertDB, Notifier: notifier}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go evaluator.Run(ctx)
+
+	// publishing returns before the notifier has sent the alert
+	assertNoError(t, evaluator.Publish(atm.Event{Type: atm.EventDeposit, AccountID: 12345678, Amount: 150, Balance: alertBalance(300)}))
+	select {
+	case alert := <-notifier.sent:
+		if alert.Kind != atm.AlertLargeTransaction {
+			t.Errorf("Alert is incorrect. %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Alert was not sent by Run")
+	}
+}
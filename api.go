@@ -0,0 +1,172 @@
+package atm
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminAPI serves back office requests over HTTP. Every request must carry the token as a bearer token.
+//
+//	GET /accounts/{account_id}/statement?from=YYYY-MM-DD&to=YYYY-MM-DD&format=csv|json|ofx|qif
+//	POST /transactions/{transaction_id}/reversal {"reason": "...", "operator": "..."}
+//	GET /metrics
+type AdminAPI struct {
+	// Host serves the statements and reversals, they are not found if not set
+	Host *Host
+	// Metrics are served in the Prometheus text format, /metrics is not found if not set
+	Metrics *Metrics
+	// AuditLog records every reversal with its operator, reversals are not recorded if not set
+	AuditLog IAuditLog
+	// Token the requests are authorized with, every request is refused if empty
+	Token string
+	// Currency is the ISO 4217 code of the accounts printed on statements, DefaultCurrency if empty
+	Currency string
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, ErrAuthorizationRequired)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "metrics" && a.Metrics != nil {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed.", r.Method))
+			return
+		}
+		a.Metrics.ServeHTTP(w, r)
+		return
+	}
+	if len(parts) == 3 && parts[0] == "accounts" && parts[2] == "statement" && a.Host != nil {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed.", r.Method))
+			return
+		}
+		a.statement(w, r, parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[0] == "transactions" && parts[2] == "reversal" && a.Host != nil {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed.", r.Method))
+			return
+		}
+		a.reverse(w, r, parts[1])
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Errorf("%s was not found.", r.URL.Path))
+}
+
+// statement exports the statement of an account, the format defaults to csv
+func (a *AdminAPI) statement(w http.ResponseWriter, r *http.Request, account string) {
+	accountID, err := strconv.Atoi(account)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ErrAccountIDNotInteger)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	formatter, err := LookupStatementFormatter(format)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	from, to, err := ParseStatementPeriod(query.Get("from"), query.Get("to"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	statement, err := a.Host.Statement(accountID, from, to)
+	if err == ErrAccountNotFound {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statement.Currency = a.Currency
+
+	// the statement is formatted before the response is written so a failure is answered with an error
+	body := &bytes.Buffer{}
+	if err := formatter.Format(body, statement); err != nil {
+		a.Host.logger().Error("statement not formatted", logAccount(accountID), "format", format, logError(err))
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", formatter.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%d.%s\"", accountID, formatter.Extension()))
+	w.Write(body.Bytes())
+}
+
+// reversalRequest is the body of a reversal, the operator is recorded in the audit log
+type reversalRequest struct {
+	Reason   string `json:"reason"`
+	Operator string `json:"operator"`
+}
+
+// reverse posts a compensating transaction for the transaction and answers with the result of the reversal
+func (a *AdminAPI) reverse(w http.ResponseWriter, r *http.Request, transactionID string) {
+	request := reversalRequest{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil || strings.TrimSpace(request.Reason) == "" || strings.TrimSpace(request.Operator) == "" {
+		writeAPIError(w, http.StatusBadRequest, ErrReversalInvalidRequest)
+		return
+	}
+
+	result, err := a.Host.Reverse(transactionID, request.Reason)
+	if a.AuditLog != nil {
+		if recordErr := a.AuditLog.Record(ReversalAuditEntry(request.Operator, transactionID, err)); recordErr != nil {
+			a.Host.logger().Error("audit entry not recorded", LogKeyCommand, AuditCommandReverse, logError(recordErr))
+		}
+	}
+	switch err {
+	case nil:
+	case ErrTransactionNotFound:
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	case ErrTransactionAlreadyReversed, ErrTransactionNotReversible:
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	WriteJSONResult(w, Result{
+		Command:       AuditCommandReverse,
+		TransactionID: result.TransactionID,
+		Balance:       &result.Balance,
+		Message:       fmt.Sprintf("Transaction %s reversed by %s.", transactionID, result.TransactionID),
+	}, nil)
+}
+
+func (a *AdminAPI) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// writeAPIError writes the error with its stable error code as JSON
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error jsonError `json:"error"`
+	}{jsonError{Code: ErrorCode(err), Message: err.Error()}})
+}
@@ -0,0 +1,180 @@
+package atm_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// failingStatementFormatter fails after writing part of the statement
+type failingStatementFormatter struct{}
+
+func (failingStatementFormatter) ContentType() string { return "text/plain" }
+func (failingStatementFormatter) Extension() string   { return "txt" }
+func (failingStatementFormatter) Format(w io.Writer, statement atm.Statement) error {
+	io.WriteString(w, "partial")
+	return io.ErrShortWrite
+}
+
+func TestAdminAPIStatement(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+	_, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	server := httptest.NewServer(&atm.AdminAPI{Host: host, Token: "secret", Currency: "EUR"})
+	defer server.Close()
+
+	get := func(path string, token string) (*http.Response, string) {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body := &strings.Builder{}
+		buffer := make([]byte, 4096)
+		for {
+			n, err := response.Body.Read(buffer)
+			body.Write(buffer[:n])
+			if err != nil {
+				break
+			}
+		}
+		return response, body.String()
+	}
+
+	response, body := get("/accounts/12345678/statement", "")
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Request without a token was not refused. %d %s", response.StatusCode, body)
+	}
+	response, _ = get("/accounts/12345678/statement", "wrong")
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Request with a wrong token was not refused. %d", response.StatusCode)
+	}
+
+	response, body = get("/accounts/12345678/statement", "secret")
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/csv" || !strings.Contains(body, "withdrawal,-40.00,0.00,60.00") {
+		t.Errorf("CSV statement is incorrect. %d %s", response.StatusCode, body)
+	}
+	response, body = get("/accounts/12345678/statement?format=ofx&from=2020-01-01", "secret")
+	if response.StatusCode != http.StatusOK || !strings.Contains(response.Header.Get("Content-Disposition"), "statement-12345678.ofx") || !strings.Contains(body, "<BALAMT>60.00") || !strings.Contains(body, "<CURDEF>EUR") {
+		t.Errorf("OFX statement is incorrect. %d %s", response.StatusCode, body)
+	}
+
+	atm.RegisterStatementFormatter("failing", failingStatementFormatter{})
+	errors := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/accounts/12345678/statement?format=pdf", http.StatusBadRequest, "statement_unknown_format"},
+		{"/accounts/12345678/statement?from=yesterday", http.StatusBadRequest, "statement_invalid_period"},
+		{"/accounts/abc/statement", http.StatusBadRequest, "account_id_not_integer"},
+		{"/accounts/87654321/statement", http.StatusNotFound, "account_not_found"},
+		{"/accounts", http.StatusNotFound, "internal_error"},
+		{"/accounts/12345678/statement?format=failing", http.StatusInternalServerError, "internal_error"},
+	}
+	for _, test := range errors {
+		response, body = get(test.path, "secret")
+		if response.StatusCode != test.status || !strings.Contains(body, `"code":"`+test.code+`"`) {
+			t.Errorf("%s returned %d %s and should return %d %s", test.path, response.StatusCode, body, test.status, test.code)
+		}
+	}
+}
+
+func TestAdminAPIMetrics(t *testing.T) {
+	metrics := atm.NewMetrics()
+	metrics.SetCash(200)
+	api := &atm.AdminAPI{Token: "secret", Metrics: metrics}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+	api.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("Scrape without a token was not refused. %d", response.Code)
+	}
+
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	api.ServeHTTP(response, request)
+	if response.Code != http.StatusOK || !strings.HasPrefix(response.Header().Get("Content-Type"), "text/plain; version=0.0.4") || !strings.Contains(response.Body.String(), "atm_cash_dollars 200\n") {
+		t.Errorf("Metrics are incorrect. %d %s", response.Code, response.Body)
+	}
+
+	// an API without a host, as served by a terminal, only serves the metrics
+	request = httptest.NewRequest(http.MethodGet, "/accounts/12345678/statement", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	api.ServeHTTP(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Statements should not be found without a host. %d", response.Code)
+	}
+}
+
+func TestAdminAPIReversal(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+	withdrawal, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	auditLog := &atm.AuditLog{File: filepath.Join(t.TempDir(), "audit.jsonl")}
+	server := httptest.NewServer(&atm.AdminAPI{Host: host, Token: "secret", AuditLog: auditLog})
+	defer server.Close()
+
+	post := func(path string, token string, body string) (int, string) {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		content, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(content)
+	}
+	path := "/transactions/" + withdrawal.TransactionID + "/reversal"
+
+	tests := []struct {
+		path   string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{path, "wrong", `{"reason":"Cash failed to dispense","operator":"alice"}`, http.StatusUnauthorized, "authorization_required"},
+		{path, "secret", `{"reason":"Cash failed to dispense"}`, http.StatusBadRequest, "reversal_invalid_request"},
+		{path, "secret", `{"reason":"Cash failed to dispense","operator":"alice","amount":40}`, http.StatusBadRequest, "reversal_invalid_request"},
+		{"/transactions/UNKNOWN/reversal", "secret", `{"reason":"Undo","operator":"alice"}`, http.StatusNotFound, "transaction_not_found"},
+	}
+	for _, test := range tests {
+		status, body := post(test.path, test.token, test.body)
+		if status != test.status || !strings.Contains(body, `"code":"`+test.code+`"`) {
+			t.Errorf("%s returned %d %s and should return %d %s", test.body, status, body, test.status, test.code)
+		}
+	}
+
+	status, body := post(path, "secret", `{"reason":"Cash failed to dispense","operator":"alice"}`)
+	if status != http.StatusOK || !strings.Contains(body, `"ok":true`) || !strings.Contains(body, `"balance":100`) {
+		t.Errorf("Reversal failed. %d %s", status, body)
+	}
+	status, body = post(path, "secret", `{"reason":"Cash failed to dispense","operator":"alice"}`)
+	if status != http.StatusConflict || !strings.Contains(body, `"code":"transaction_already_reversed"`) {
+		t.Errorf("Reversing twice should conflict. %d %s", status, body)
+	}
+
+	// every reversal is recorded with its operator
+	content, err := os.ReadFile(auditLog.File)
+	assertNoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], `"operator":"alice","command":"reverse","transaction_id":"`+withdrawal.TransactionID+`","outcome":"ok"`) {
+		t.Errorf("Audit log is incorrect.\n%s", content)
+	}
+}
@@ -1,15 +1,14 @@
 package atm
 
 import (
-	"fmt"
+	"log/slog"
 	"time"
 )
 
 type IATM interface {
-	accountDB() IAccountDB
-	transactionDB() ITransactionDB
+	host() IHostClient
 	balance() float64
-	Authorize(int, string) bool
+	Authorize(int, string) error
 	Withdraw(Account, int) (bool, error)
 	Deposit(Account, float64) error
 	Balance(Account)
@@ -17,19 +16,69 @@ type IATM interface {
 	Logout(bool) error
 }
 
+// ATM is a terminal that handles cash and the customer session.
+// Accounts, the ledger and authorization are handled by the host
 type ATM struct {
+	// Host the terminal sends transactions to.
+	// If not set an in-process host is created from AccountDB and TransactionDB
+	Host          IHostClient
 	AccountDB     IAccountDB
 	TransactionDB ITransactionDB
 	ATMBalance    float64
 	Session       *Session
-}
+	// Flow is the customer flow shared by the front ends, commands may run in any order if not set
+	Flow *Flow
+	// TerminalID is printed on receipts
+	TerminalID string
+	// Currency is the ISO 4217 code amounts are printed in on receipts, DefaultCurrency if empty
+	Currency string
+	// WithdrawalLimit is the most a single withdrawal may dispense, no limit if zero
+	WithdrawalLimit float64
+	// Receipts saves printed receipts, receipts are not offered if not set
+	Receipts *ReceiptStore
+	// AuditLog records every command and flow event of the terminal, nothing is recorded if not set
+	AuditLog IAuditLog
+	// Logger records commands, transactions and failures of the terminal, nothing is logged if not set
+	Logger *slog.Logger
+	// Metrics counts the transactions, cash and sessions of the terminal, nothing is counted if not set
+	Metrics *Metrics
+	// Events receives an event after each committed withdrawal, deposit and reversal, lockout and low cash condition
+	Events IEventPublisher
+	// LowCashThreshold is the cash below which EventLowCash is published, disabled if zero
+	LowCashThreshold float64
+	// AlertDB stores the alert preferences customers set up, the alerts command is not available if not set
+	AlertDB IAlertDB
+	// Risk decides withdrawals before they are sent to the host, every withdrawal is allowed if not set
+	Risk *RiskEngine
+
+	// OfflineLimit is the most the terminal approves in stand-in per account while the host is unavailable.
+	// Stand-in is disabled if zero or StandIn is not set
+	OfflineLimit float64
+	// StandIn queues withdrawals approved in stand-in until the host is available
+	StandIn *StandInQueue
 
-func (atm *ATM) accountDB() IAccountDB {
-	return atm.AccountDB
+	// last balance of each account returned by the host
+	knownBalances map[int]float64
+	// amount of cash dispensed by this terminal for each withdrawal transaction ID
+	dispensed map[string]float64
+	// receipt of the last withdrawal or deposit until it is printed or the session ends
+	pendingReceipt *Receipt
+	// when a card of each account was last ejected after incorrect PINs
+	lockouts map[int]time.Time
+	// sessionCounted is true while the session is counted in the active sessions metric
+	sessionCounted bool
 }
 
-func (atm *ATM) transactionDB() ITransactionDB {
-	return atm.TransactionDB
+func (atm *ATM) host() IHostClient {
+	if atm.Host == nil {
+		atm.Host = &LocalHostClient{
+			Host: &Host{
+				AccountDB:     atm.AccountDB,
+				TransactionDB: atm.TransactionDB,
+			},
+		}
+	}
+	return atm.Host
 }
 
 func (atm *ATM) balance() float64 {
@@ -38,40 +87,48 @@ func (atm *ATM) balance() float64 {
 
 // Authorize authorizes the accountID with the accountPIM
 // If pin and accountID is correct then a session is created that should expire in 2 mins
-func (atm *ATM) Authorize(accountID int, accountPIN string) bool {
-	account, err := atm.accountDB().Get(accountID)
+// ErrAuthorizationUnsuccessful is returned if the pin is incorrect, any other error if the host failed
+func (atm *ATM) Authorize(accountID int, accountPIN string) error {
+	err := atm.host().Authorize(accountID, accountPIN)
 	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-
-	if account.PIN != accountPIN {
-		return false
+		atm.Metrics.observeAuthFailure(err)
+		return err
 	}
 
 	atm.Session.Authorize(accountID)
+	atm.observeSession()
+	atm.logger().Info("session started", logAccount(accountID))
+	atm.forwardStandIn()
+	// the balance is only remembered for stand-in
+	balance, err := atm.host().Balance(accountID)
+	if err != nil {
+		atm.logger().Warn("balance not remembered for stand-in", logAccount(accountID), logError(err))
+		return nil
+	}
+	atm.rememberBalance(accountID, balance)
 
-	return true
+	return nil
 }
 
-// Withdraw withraws a specific amount from an account and updates value in AccountsDB and TransactionDB
+// Withdraw withraws a specific amount from an account through the host
 // Withdrawl will fail if session not active or session timed out,
-// atm balance is 0, withdrawl amount is more than atm balance,
+// atm balance is 0, withdrawl amount is more than atm balance or the withdrawal limit,
 // account current balance is negative,
-// If withdrawl amount is more than account's balance then overdrawn boolean is true
-func (atm *ATM) Withdraw(accountID int, amount int) (bool, error) {
+// If withdrawl amount and fees are more than account's balance then overdrawn boolean is true
+// An optional idempotency key makes retries safe, a replayed withdrawal returns the original result without dispensing cash
+func (atm *ATM) Withdraw(accountID int, amount int, idempotencyKey ...string) (bool, error) {
+	overdrawn, err := atm.withdraw(accountID, amount, firstKey(idempotencyKey))
+	atm.Metrics.observeTransaction(TransactionKindWithdrawal, err)
+	return overdrawn, err
+}
+
+func (atm *ATM) withdraw(accountID int, amount int, idempotencyKey string) (bool, error) {
 	overdrawn := false
 	err := atm.Session.Valid(accountID)
 	if err != nil {
 		return overdrawn, err
 	}
 
-	account, err := atm.accountDB().Get(accountID)
-	// If account does not exist then return error
-	if err != nil {
-		return overdrawn, err
-	}
-
 	if atm.balance() == 0 {
 		return overdrawn, ErrWithdrawATMNoFunds
 	}
@@ -85,68 +142,179 @@ func (atm *ATM) Withdraw(accountID int, amount int) (bool, error) {
 		return overdrawn, ErrWithdrawATMInsufficientFunds
 	}
 
-	if account.Balance < 0 {
-		return overdrawn, ErrWithdrawAccountOverdrawn
+	if atm.WithdrawalLimit > 0 && float64(amount) > atm.WithdrawalLimit {
+		return overdrawn, ErrWithdrawLimitExceeded
 	}
 
-	newBalance := account.Balance - float64(amount)
-	if newBalance < 0 {
-		overdrawn = true
-		newBalance -= 5
+	if err := atm.assessRisk(accountID, float64(amount)); err != nil {
+		return overdrawn, err
 	}
 
-	transaction := Transaction{
-		AccountID: account.AccountID,
-		DateTime:  time.Now().Unix(),
-		Amount:    float64(amount * -1),
-		Balance:   newBalance,
+	atm.forwardStandIn()
+	result, err := atm.host().Withdraw(accountID, float64(amount), idempotencyKey)
+	if isHostOutage(err) && atm.standInEnabled() {
+		return overdrawn, atm.standInWithdraw(accountID, float64(amount))
+	}
+	if err != nil {
+		return overdrawn, err
 	}
-	atm.transactionDB().Set(transaction)
 
-	account.Balance = newBalance
-	atm.accountDB().Set(account)
-	atm.ATMBalance = atm.ATMBalance - float64(amount)
-	return overdrawn, nil
+	atm.rememberBalance(accountID, result.Balance)
+	atm.offerReceipt(accountID, TransactionKindWithdrawal, float64(amount), result)
+	atm.logger().Info("withdrawal approved", logAccount(accountID), LogKeyTransactionID, result.TransactionID, LogKeyAmount, amount, "replayed", result.Replayed)
+	if result.Replayed {
+		return result.Balance < 0, nil
+	}
+	if atm.dispensed == nil {
+		atm.dispensed = map[string]float64{}
+	}
+	atm.dispensed[result.TransactionID] = float64(amount)
+	atm.publishTransaction(EventWithdrawal, accountID, float64(amount), result)
+	atm.dispense(float64(amount))
+	return result.Balance < 0, nil
 }
 
-// Deposit deposits a specific amount to the account and updates the AccountDB and TransactionDB
-// An error is returned if no actives session or failure to interface with DBs
-func (atm *ATM) Deposit(accountID int, amount float64) error {
-	err := atm.Session.Valid(accountID)
-	if err != nil {
-		return err
+// standInWithdraw approves a withdrawal from the last known balance while the host is unavailable.
+// The withdrawal is queued on disk before cash is dispensed and forwarded once the host is available
+func (atm *ATM) standInWithdraw(accountID int, amount float64) error {
+	balance, ok := atm.knownBalances[accountID]
+	if !ok {
+		return ErrStandInNoBalance
 	}
 
-	account, err := atm.accountDB().Get(accountID)
+	pending, err := atm.StandIn.PendingAmount(accountID)
 	if err != nil {
 		return err
 	}
+	if pending+amount > atm.OfflineLimit {
+		return ErrStandInLimitExceeded
+	}
+	if balance-amount < 0 {
+		return ErrStandInInsufficientFunds
+	}
 
-	newBalance := account.Balance + amount
-	transaction := Transaction{
-		AccountID: account.AccountID,
+	err = atm.StandIn.Add(StandInTransaction{
+		AccountID: accountID,
 		DateTime:  time.Now().Unix(),
 		Amount:    amount,
-		Balance:   newBalance,
+	})
+	if err != nil {
+		return err
+	}
+
+	atm.rememberBalance(accountID, balance-amount)
+	atm.offerReceipt(accountID, TransactionKindWithdrawal, amount, HostResult{Balance: balance - amount})
+	atm.logger().Warn("withdrawal approved in stand-in", logAccount(accountID), LogKeyAmount, amount)
+	remaining := balance - amount
+	atm.publish(Event{Type: EventWithdrawal, AccountID: accountID, Amount: amount, Balance: &remaining, StandIn: true})
+	atm.dispense(amount)
+	return nil
+}
+
+// ForwardStandIn posts withdrawals approved in stand-in to the host
+// Withdrawals that leave an account with a negative balance are flagged for review
+func (atm *ATM) ForwardStandIn() (ForwardResult, error) {
+	if atm.StandIn == nil {
+		return ForwardResult{Conflicts: []StandInConflict{}}, nil
+	}
+	return atm.StandIn.Forward(atm.host())
+}
+
+// forwardStandIn forwards queued stand-in withdrawals before the next host request.
+// Failures are logged and not returned since the withdrawals stay queued for the next attempt
+func (atm *ATM) forwardStandIn() {
+	if atm.StandIn == nil {
+		return
+	}
+	pending, err := atm.StandIn.Pending()
+	if err != nil {
+		atm.logger().Error("stand-in queue not read", logError(err))
+		return
 	}
-	atm.transactionDB().Set(transaction)
+	if len(pending) == 0 {
+		return
+	}
+	result, err := atm.ForwardStandIn()
+	if err != nil {
+		atm.logger().Warn("stand-in withdrawals not forwarded", "pending", len(pending), logError(err))
+		return
+	}
+	atm.logger().Info("stand-in withdrawals forwarded", "forwarded", result.Forwarded, "remaining", result.Remaining)
+	for _, conflict := range result.Conflicts {
+		atm.logger().Warn("stand-in withdrawal flagged for review", logAccount(conflict.AccountID), LogKeyAmount, conflict.Amount, "reason", conflict.Reason)
+	}
+}
 
-	account.Balance = newBalance
-	atm.accountDB().Set(account)
+// firstKey returns the optional idempotency key or an empty key if none was given
+func firstKey(idempotencyKey []string) string {
+	if len(idempotencyKey) == 0 {
+		return ""
+	}
+	return idempotencyKey[0]
+}
 
+func (atm *ATM) standInEnabled() bool {
+	return atm.StandIn != nil && atm.OfflineLimit > 0
+}
+
+func (atm *ATM) rememberBalance(accountID int, balance float64) {
+	if atm.knownBalances == nil {
+		atm.knownBalances = map[int]float64{}
+	}
+	atm.knownBalances[accountID] = balance
+}
+
+// Deposit deposits a specific amount to the account through the host
+// An error is returned if no actives session or the host failed to post the deposit
+// An optional idempotency key makes retries safe, a replayed deposit is not credited again
+func (atm *ATM) Deposit(accountID int, amount float64, idempotencyKey ...string) error {
+	err := atm.deposit(accountID, amount, firstKey(idempotencyKey))
+	atm.Metrics.observeTransaction(TransactionKindDeposit, err)
+	return err
+}
+
+func (atm *ATM) deposit(accountID int, amount float64, idempotencyKey string) error {
+	err := atm.Session.Valid(accountID)
+	if err != nil {
+		return err
+	}
+
+	atm.forwardStandIn()
+	result, err := atm.host().Deposit(accountID, amount, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	atm.rememberBalance(accountID, result.Balance)
+	atm.offerReceipt(accountID, TransactionKindDeposit, amount, result)
+	atm.logger().Info("deposit accepted", logAccount(accountID), LogKeyTransactionID, result.TransactionID, LogKeyAmount, amount, "replayed", result.Replayed)
+	if !result.Replayed {
+		atm.publishTransaction(EventDeposit, accountID, amount, result)
+	}
 	return nil
 }
 
 // Balance returns the current balance
-// An error is returned if no active session or account balance could not be found in DB
+// In stand-in the last known balance is returned while the host is unavailable
+// An error is returned if no active session or account balance could not be retrieved from the host
 func (atm *ATM) Balance(accountID int) (float64, error) {
 	err := atm.Session.Valid(accountID)
 	if err != nil {
 		return 0.00, err
 	}
 
-	account, err := atm.accountDB().Get(accountID)
-	return account.Balance, err
+	atm.forwardStandIn()
+	balance, err := atm.host().Balance(accountID)
+	if isHostOutage(err) && atm.standInEnabled() {
+		if known, ok := atm.knownBalances[accountID]; ok {
+			return known, nil
+		}
+	}
+	if err != nil {
+		return balance, err
+	}
+
+	atm.rememberBalance(accountID, balance)
+	return balance, nil
 }
 
 // History returns the history of a specific account
@@ -156,7 +324,7 @@ func (atm *ATM) History(accountID int) []Transaction {
 	if err != nil {
 		return []Transaction{}
 	}
-	transactions, err := atm.transactionDB().Get(accountID)
+	transactions, err := atm.host().History(accountID)
 	if err != nil {
 		return []Transaction{}
 	}
@@ -164,8 +332,121 @@ func (atm *ATM) History(accountID int) []Transaction {
 	return transactions
 }
 
+// QueryHistory returns the transactions of the account of the query that match its filters
+// An error is returned if no active session, the query is invalid or the host failed
+func (atm *ATM) QueryHistory(query HistoryQuery) ([]Transaction, error) {
+	err := atm.Session.Valid(query.AccountID)
+	if err != nil {
+		return []Transaction{}, err
+	}
+	return atm.host().QueryHistory(query)
+}
+
+// MiniStatementLength is the number of transactions on a mini statement if no count is given
+const MiniStatementLength = 10
+
+// MiniStatement returns the last transactions of the authorized account, oldest first, with its balance
+// An error is returned if no active session or the host failed
+func (atm *ATM) MiniStatement(count int) (MiniStatement, error) {
+	accountID := atm.Session.AccountID
+	transactions, err := atm.QueryHistory(HistoryQuery{AccountID: accountID, Limit: count, Order: SortNewestFirst})
+	if err != nil {
+		return MiniStatement{}, err
+	}
+	balance, err := atm.Balance(accountID)
+	if err != nil {
+		return MiniStatement{}, err
+	}
+
+	for i, j := 0, len(transactions)-1; i < j; i, j = i+1, j-1 {
+		transactions[i], transactions[j] = transactions[j], transactions[i]
+	}
+	return MiniStatement{
+		TerminalID:   atm.TerminalID,
+		Currency:     atm.Currency,
+		DateTime:     time.Now().Unix(),
+		AccountID:    accountID,
+		Transactions: transactions,
+		Balance:      balance,
+	}, nil
+}
+
+// Reverse writes a compensating transaction for a transaction that failed to dispense or was entered wrongly.
+// The account balance is restored by the host. If the transaction is a withdrawal this terminal dispensed
+// then the cash is returned to the ATM balance
+// An error is returned if the transaction cannot be found or has already been reversed
+func (atm *ATM) Reverse(transactionID string, reason string) (string, error) {
+	result, err := atm.host().Reverse(transactionID, reason)
+	if err != nil {
+		return "", err
+	}
+
+	if amount, ok := atm.dispensed[transactionID]; ok {
+		atm.ATMBalance = atm.ATMBalance + amount
+		delete(atm.dispensed, transactionID)
+		atm.observeCash()
+	}
+	balance := result.Balance
+	atm.publish(Event{Type: EventReversal, AccountID: result.AccountID, Fee: result.Fee, Balance: &balance, TransactionID: result.TransactionID, ReversalOf: transactionID})
+	return result.TransactionID, nil
+}
+
 // Logout logouts of the current session
 // An error is returned if no active session could be closed
 func (atm *ATM) Logout() error {
-	return atm.Session.LogOut()
+	atm.pendingReceipt = nil
+	logger := atm.logger()
+	err := atm.Session.LogOut()
+	atm.observeSession()
+	if err != nil {
+		return err
+	}
+	logger.Info("session ended")
+	return nil
+}
+
+// offerReceipt keeps the receipt of a withdrawal or deposit until the customer asks for it
+func (atm *ATM) offerReceipt(accountID int, kind string, amount float64, result HostResult) {
+	atm.pendingReceipt = &Receipt{
+		TerminalID:    atm.TerminalID,
+		Currency:      atm.Currency,
+		DateTime:      time.Now().Unix(),
+		AccountID:     accountID,
+		Kind:          kind,
+		Amount:        amount,
+		Fee:           result.Fee,
+		Balance:       result.Balance,
+		TransactionID: result.TransactionID,
+	}
+}
+
+// LastFee returns the fee charged by the last withdrawal or deposit of the session, zero if there was none
+func (atm *ATM) LastFee() float64 {
+	if atm.pendingReceipt == nil {
+		return 0
+	}
+	return atm.pendingReceipt.Fee
+}
+
+// ReceiptOffered returns true if a receipt can be printed for the last withdrawal or deposit
+func (atm *ATM) ReceiptOffered() bool {
+	return atm.Receipts != nil && atm.pendingReceipt != nil
+}
+
+// PrintReceipt numbers and saves the receipt of the last withdrawal or deposit of the session.
+// A receipt is printed once, ErrReceiptNotAvailable is returned if there is no receipt to print
+func (atm *ATM) PrintReceipt() (Receipt, error) {
+	if atm.Receipts == nil {
+		return Receipt{}, ErrReceiptPrinterUnavailable
+	}
+	if atm.pendingReceipt == nil {
+		return Receipt{}, ErrReceiptNotAvailable
+	}
+
+	receipt := *atm.pendingReceipt
+	if err := atm.Receipts.Save(&receipt); err != nil {
+		return Receipt{}, err
+	}
+	atm.pendingReceipt = nil
+	return receipt, nil
 }
@@ -25,6 +25,10 @@ func (a AccountDBTest) Set(account atm.Account) error {
 	return a.setAccountError
 }
 
+func (a AccountDBTest) All() ([]atm.Account, error) {
+	return []atm.Account{a.getAccount}, a.getAccountError
+}
+
 type TransactionDBTest struct {
 	getTransactions      []atm.Transaction
 	getTransactionsError error
@@ -35,10 +39,25 @@ func (t TransactionDBTest) Get(accountID int) ([]atm.Transaction, error) {
 	return t.getTransactions, t.getTransactionsError
 }
 
+func (t TransactionDBTest) Query(query atm.HistoryQuery) ([]atm.Transaction, error) {
+	if t.getTransactionsError != nil {
+		return []atm.Transaction{}, t.getTransactionsError
+	}
+	return query.Apply(t.getTransactions)
+}
+
+func (t TransactionDBTest) All() ([]atm.Transaction, error) {
+	return t.getTransactions, t.getTransactionsError
+}
+
 func (t TransactionDBTest) Set(transaction atm.Transaction) error {
 	return t.setTransactionError
 }
 
+func (t TransactionDBTest) Append(transactions []atm.Transaction) error {
+	return t.setTransactionError
+}
+
 var defaultAccount = atm.Account{
 	AccountID: 12345678,
 	PIN:       "1234",
@@ -77,30 +96,30 @@ func defaultTestATM() atm.ATM {
 }
 
 func TestAuthorize(t *testing.T) {
-	atm := defaultTestATM()
+	testATM := defaultTestATM()
 
 	// Test invalid PIN
-	result := atm.Authorize(defaultAccount.AccountID, "0000")
-	if result {
-		t.Error("Authenticated but should not have authenticated")
-	}
+	err := testATM.Authorize(defaultAccount.AccountID, "0000")
+	assertErrorIsError(t, err, atm.ErrAuthorizationUnsuccessful)
 
 	// Test invalid database
 	invalidDatabase := defaultAccountDB
 	invalidDatabase.getAccountError = errors.New("Failed to get account")
-	atm = newTestATM(invalidDatabase, defaultTranscationDB)
-	result = atm.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
-	if result {
-		t.Error("Authenticated successful but database is not working")
+	testATM = newTestATM(invalidDatabase, defaultTranscationDB)
+	err = testATM.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
+	if !errors.Is(err, atm.ErrHostStoreUnavailable) {
+		t.Errorf("Authenticated successful but database is not working. %v", err)
+	}
+	// the error of the database is wrapped, not only its message
+	if !errors.Is(err, invalidDatabase.getAccountError) {
+		t.Errorf("Error of the database is not wrapped. %v", err)
 	}
-	atm = defaultTestATM()
+	testATM = defaultTestATM()
 
 	// Test valid PIN
-	result = atm.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
-	if !result {
-		t.Error("Failure to authorize")
-	}
-	err := atm.Session.Valid(defaultAccount.AccountID)
+	err = testATM.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
+	assertNoError(t, err)
+	err = testATM.Session.Valid(defaultAccount.AccountID)
 	assertNoError(t, err)
 }
 
@@ -131,6 +150,12 @@ func TestWithdraw(t *testing.T) {
 	_, err = testATM.Withdraw(defaultAccount.AccountID, 120)
 	assertErrorIsError(t, err, atm.ErrWithdrawATMInsufficientFunds)
 
+	// amount over the withdrawal limit of the atm
+	testATM.WithdrawalLimit = 60
+	_, err = testATM.Withdraw(defaultAccount.AccountID, 80)
+	assertErrorIsError(t, err, atm.ErrWithdrawLimitExceeded)
+	testATM.WithdrawalLimit = 0
+
 	// account is overdrawn
 	accountDB := AccountDBTest{
 		getAccount: atm.Account{
@@ -230,10 +255,82 @@ func TestLogout(t *testing.T) {
 	assertErrorIsError(t, err, atm.ErrSessionNoActiveSession)
 
 	// logout of atm with active session
-	authorized := testATM.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
-	if !authorized {
+	err = testATM.Authorize(defaultAccount.AccountID, defaultAccount.PIN)
+	if err != nil {
 		t.Error("Failed to authorize to ATM")
 	}
 	err = testATM.Logout()
 	assertNoError(t, err)
 }
+
+func TestReverse(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+	if err := testATM.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	_, err := testATM.Withdraw(12345678, 40)
+	assertNoError(t, err)
+	assertNoError(t, testATM.Deposit(12345678, 10))
+	transactions := testATM.History(12345678)
+	withdrawal, deposit := transactions[0], transactions[1]
+
+	// reversing a dispensed withdrawal returns the cash to the ATM
+	_, err = testATM.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertNoError(t, err)
+	if testATM.ATMBalance != 200 {
+		t.Errorf("ATM balance was not restored. %.2f", testATM.ATMBalance)
+	}
+
+	// reversing a deposit does not change the ATM balance
+	_, err = testATM.Reverse(deposit.TransactionID, "Deposit entered wrongly")
+	assertNoError(t, err)
+	if testATM.ATMBalance != 200 {
+		t.Errorf("ATM balance should not change. %.2f", testATM.ATMBalance)
+	}
+
+	balance, err := testATM.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 100 {
+		t.Errorf("Account balance was not restored. %.2f", balance)
+	}
+
+	_, err = testATM.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertErrorIsError(t, err, atm.ErrTransactionAlreadyReversed)
+	if testATM.ATMBalance != 200 {
+		t.Errorf("ATM balance should not change. %.2f", testATM.ATMBalance)
+	}
+}
+
+func TestWithdrawIdempotencyKey(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+	if err := testATM.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	_, err := testATM.Withdraw(12345678, 40, "retry-1")
+	assertNoError(t, err)
+	// a retry with the same key does not debit the account or dispense cash again
+	_, err = testATM.Withdraw(12345678, 40, "retry-1")
+	assertNoError(t, err)
+	if testATM.ATMBalance != 160 {
+		t.Errorf("Cash was dispensed twice. %.2f", testATM.ATMBalance)
+	}
+	balance, err := testATM.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 60 {
+		t.Errorf("Account was debited twice. %.2f", balance)
+	}
+
+	assertNoError(t, testATM.Deposit(12345678, 10, "retry-2"))
+	assertNoError(t, testATM.Deposit(12345678, 10, "retry-2"))
+	if transactions := testATM.History(12345678); len(transactions) != 2 {
+		t.Errorf("Invalid number of transactions. %d", len(transactions))
+	}
+
+	// the key cannot be reused for a different withdrawal
+	_, err = testATM.Withdraw(12345678, 60, "retry-1")
+	assertErrorIsError(t, err, atm.ErrIdempotencyKeyMismatch)
+}
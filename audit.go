@@ -0,0 +1,287 @@
+package atm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit outcomes
+const (
+	AuditOutcomeOK    = "ok"
+	AuditOutcomeError = "error"
+)
+
+// audit events recorded by the customer flow outside of commands
+const (
+	AuditEventTimeout      = "timeout"
+	AuditEventCardRetained = "card_retained"
+	// AuditCommandUnknown is recorded in place of the name of an unknown command
+	AuditCommandUnknown = "unknown"
+	// AuditCommandReverse is recorded for a reversal run by an operator from the back office
+	AuditCommandReverse = "reverse"
+)
+
+// AuditEntry records a command or event of a terminal. Arguments are never recorded so PINs cannot leak into the log
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	TerminalID string    `json:"terminal_id"`
+	// Operator is the supervisor who ran a back office command
+	Operator string `json:"operator,omitempty"`
+	// AccountID is masked to the last 4 digits
+	AccountID     string  `json:"account_id,omitempty"`
+	Command       string  `json:"command"`
+	Amount        float64 `json:"amount,omitempty"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	Outcome       string  `json:"outcome"`
+	ErrorCode     string  `json:"error_code,omitempty"`
+}
+
+// IAuditLog records audit entries, entries are never changed once recorded
+type IAuditLog interface {
+	Record(AuditEntry) error
+}
+
+// Audit logs the outcome of a command run by any front end and records it in the audit log
+func (atm *ATM) Audit(command string, accountID int, result Result, err error) {
+	if atm == nil {
+		return
+	}
+	if accountID == 0 {
+		accountID = result.AccountID
+	}
+	// ending the console is not a failure of the command
+	if err == ErrConsoleEnd {
+		err = nil
+	}
+	atm.logCommand(command, accountID, result, err)
+	atm.observeSession()
+	if atm.AuditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:          time.Now(),
+		TerminalID:    atm.TerminalID,
+		Command:       command,
+		Amount:        result.Amount,
+		TransactionID: result.TransactionID,
+		Outcome:       AuditOutcomeOK,
+	}
+	if accountID != 0 {
+		entry.AccountID = maskAccount(accountID)
+	}
+	if err != nil {
+		entry.Outcome = AuditOutcomeError
+		entry.ErrorCode = ErrorCode(err)
+	}
+	// the audit log must never stop a customer from using the terminal
+	if recordErr := atm.AuditLog.Record(entry); recordErr != nil {
+		atm.logger().Error("audit entry not recorded", LogKeyCommand, command, logError(recordErr))
+	}
+}
+
+// ReversalAuditEntry returns the audit entry of a transaction an operator reversed from the back office
+func ReversalAuditEntry(operator string, transactionID string, err error) AuditEntry {
+	entry := AuditEntry{
+		Time:          time.Now(),
+		Operator:      operator,
+		Command:       AuditCommandReverse,
+		TransactionID: transactionID,
+		Outcome:       AuditOutcomeOK,
+	}
+	if err != nil {
+		entry.Outcome = AuditOutcomeError
+		entry.ErrorCode = ErrorCode(err)
+	}
+	return entry
+}
+
+// auditAccount returns the account a command runs for, from its arguments or the session
+func (atm *ATM) auditAccount(args Args) int {
+	if args.Has("account_id") {
+		return args.Int("account_id")
+	}
+	if atm != nil && atm.Session != nil {
+		return atm.Session.AccountID
+	}
+	return 0
+}
+
+// AuditLog appends audit entries as JSON lines to a file.
+// The file is rotated to <name>-<date time><ext> when it grows over MaxSize or, if Daily, on the first entry of a day
+type AuditLog struct {
+	File string
+	// MaxSize is the most bytes of a file, files are not rotated by size if zero
+	MaxSize int64
+	Daily   bool
+
+	mutex sync.Mutex
+}
+
+// Record appends the entry to the log and rotates the file first if it is due
+// An error is returned on failure to rotate or write the file
+func (l *AuditLog) Record(entry AuditEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if err := l.rotate(entry.Time, int64(len(line))); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate renames the file if the next line makes it too large or it was last written on another day
+func (l *AuditLog) rotate(now time.Time, next int64) error {
+	info, err := os.Stat(l.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	tooLarge := l.MaxSize > 0 && info.Size()+next > l.MaxSize
+	newDay := l.Daily && info.ModTime().Format("2006-01-02") != now.Format("2006-01-02")
+	if !tooLarge && !newDay {
+		return nil
+	}
+
+	extension := filepath.Ext(l.File)
+	base := strings.TrimSuffix(l.File, extension)
+	rotated := fmt.Sprintf("%s-%s%s", base, info.ModTime().Format("20060102-150405"), extension)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s.%d%s", base, info.ModTime().Format("20060102-150405"), i, extension)
+	}
+	return os.Rename(l.File, rotated)
+}
+
+// files returns the rotated files oldest first followed by the current file
+func (l *AuditLog) files() ([]string, error) {
+	extension := filepath.Ext(l.File)
+	rotated, err := filepath.Glob(strings.TrimSuffix(l.File, extension) + "-*" + extension)
+	if err != nil {
+		return nil, err
+	}
+	// rotated files keep the modification time of their last entry
+	modified := map[string]time.Time{}
+	for _, path := range rotated {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime()
+		}
+	}
+	sort.SliceStable(rotated, func(i, j int) bool {
+		if !modified[rotated[i]].Equal(modified[rotated[j]]) {
+			return modified[rotated[i]].Before(modified[rotated[j]])
+		}
+		return rotated[i] < rotated[j]
+	})
+	return append(rotated, l.File), nil
+}
+
+// AuditQuery selects audit entries. Zero values do not filter
+type AuditQuery struct {
+	// From and To are the time range, both inclusive
+	From time.Time
+	To   time.Time
+	// AccountID matches the masked account of the entries
+	AccountID  int
+	TerminalID string
+	Command    string
+	Outcome    string
+	ErrorCode  string
+	// Limit is the most entries returned, the most recent are kept. No limit if zero
+	Limit int
+}
+
+// Match returns true if the entry passes every filter of the query
+func (q AuditQuery) Match(entry AuditEntry) bool {
+	switch {
+	case !q.From.IsZero() && entry.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && entry.Time.After(q.To):
+		return false
+	case q.AccountID != 0 && entry.AccountID != maskAccount(q.AccountID):
+		return false
+	case q.TerminalID != "" && entry.TerminalID != q.TerminalID:
+		return false
+	case q.Command != "" && entry.Command != q.Command:
+		return false
+	case q.Outcome != "" && entry.Outcome != q.Outcome:
+		return false
+	case q.ErrorCode != "" && entry.ErrorCode != q.ErrorCode:
+		return false
+	}
+	return true
+}
+
+// Query reads the entries of the current and rotated files that match the query oldest first
+// An error is returned on failure to read a file or if a line is not an audit entry
+func (l *AuditLog) Query(query AuditQuery) ([]AuditEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	files, err := l.files()
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	entries := []AuditEntry{}
+	for _, path := range files {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			entry := AuditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				file.Close()
+				return []AuditEntry{}, fmt.Errorf("Invalid audit entry in %s. %s", path, scanner.Text())
+			}
+			if query.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+	}
+
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,125 @@
+package atm_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestAuditATM(t *testing.T) (*atm.ATM, *atm.AuditLog) {
+	audit := &atm.AuditLog{File: filepath.Join(t.TempDir(), "audit.jsonl")}
+	testATM := newTestFlowATM(t)
+	testATM.TerminalID = "ATM00001"
+	testATM.AuditLog = audit
+	return testATM, audit
+}
+
+func TestAuditCommands(t *testing.T) {
+	testATM, audit := newTestAuditATM(t)
+	console := &atm.Console{ATM: testATM, Output: io.Discard}
+	for _, line := range []string{"authorize 12345678 9876", "authorize 12345678 1234", "withdraw 500", "withdraw 40", "9876", "logout"} {
+		console.Run(line)
+	}
+
+	entries, err := audit.Query(atm.AuditQuery{})
+	assertNoError(t, err)
+	expected := []struct {
+		command string
+		amount  float64
+		outcome string
+		code    string
+	}{
+		{"authorize", 0, atm.AuditOutcomeError, "console_authorization_failed"},
+		{"authorize", 0, atm.AuditOutcomeOK, ""},
+		{"withdraw", 500, atm.AuditOutcomeError, "withdraw_atm_insufficient_funds"},
+		{"withdraw", 40, atm.AuditOutcomeOK, ""},
+		{atm.AuditCommandUnknown, 0, atm.AuditOutcomeError, "console_unknown_command"},
+		{"logout", 0, atm.AuditOutcomeOK, ""},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Entries are incorrect. %+v", entries)
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Command != e.command || entry.Amount != e.amount || entry.Outcome != e.outcome || entry.ErrorCode != e.code || entry.AccountID != "****5678" || entry.TerminalID != "ATM00001" {
+			t.Errorf("Entry %d should be %+v but got %+v", i, e, entry)
+		}
+	}
+
+	// PINs and account numbers never reach the log
+	content, err := os.ReadFile(audit.File)
+	assertNoError(t, err)
+	// the digits of the time may match by chance
+	content = regexp.MustCompile(`"time":"[^"]*"`).ReplaceAll(content, nil)
+	for _, secret := range []string{"9876", "1234", "12345678"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("Audit log contains %s.\n%s", secret, content)
+		}
+	}
+}
+
+func TestAuditFlowTimeout(t *testing.T) {
+	testATM, audit := newTestAuditATM(t)
+	flow := testATM.Flow
+	assertNoError(t, flow.InsertCard(12345678))
+	assertNoError(t, flow.EnterPIN(testATM, "1234"))
+	flow.LastActivity = time.Now().Add(-time.Hour)
+	flow.Expire(testATM)
+	flow.LastActivity = time.Now().Add(-time.Hour)
+	flow.Expire(testATM)
+
+	entries, err := audit.Query(atm.AuditQuery{ErrorCode: "flow_timed_out"})
+	assertNoError(t, err)
+	if len(entries) != 2 || entries[0].Command != atm.AuditEventTimeout || entries[1].Command != atm.AuditEventCardRetained || entries[1].AccountID != "****5678" {
+		t.Errorf("Timeouts are incorrect. %+v", entries)
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	audit := &atm.AuditLog{File: filepath.Join(dir, "audit.jsonl"), MaxSize: 300, Daily: true}
+	record := func(when time.Time, command string) {
+		assertNoError(t, audit.Record(atm.AuditEntry{Time: when, TerminalID: "ATM00001", Command: command, Outcome: atm.AuditOutcomeOK}))
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	record(yesterday, "balance")
+	assertNoError(t, os.Chtimes(audit.File, yesterday, yesterday))
+	// the first entry of a day starts a new file
+	record(time.Now(), "history")
+	// entries that do not fit start a new file
+	for i := 0; i < 4; i++ {
+		record(time.Now(), "withdraw")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "audit*.jsonl"))
+	assertNoError(t, err)
+	if len(files) < 3 {
+		t.Errorf("Audit log was not rotated. %v", files)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		assertNoError(t, err)
+		if info.Size() > audit.MaxSize {
+			t.Errorf("%s is larger than the max size. %d", file, info.Size())
+		}
+	}
+
+	// queries read the rotated files oldest first
+	entries, err := audit.Query(atm.AuditQuery{})
+	assertNoError(t, err)
+	if len(entries) != 6 || entries[0].Command != "balance" || entries[1].Command != "history" {
+		t.Errorf("Entries are incorrect. %+v", entries)
+	}
+	entries, err = audit.Query(atm.AuditQuery{From: time.Now().Add(-time.Hour), Command: "withdraw", Limit: 3})
+	assertNoError(t, err)
+	if len(entries) != 3 {
+		t.Errorf("Query is incorrect. %+v", entries)
+	}
+}
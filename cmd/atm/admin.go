@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+var adminCommands = []command{
+	{Name: "accounts", Usage: "[flags]", Help: "List every account of the host with its balance.", Run: runAdminAccounts},
+	{Name: "reverse", Usage: "<transaction_id> <reason> [flags]", Help: "Reverse a transaction that failed to dispense or was entered wrongly, recorded in the audit log with the operator.", Run: runAdminReverse},
+}
+
+// adminAccount is an account as listed by atm admin accounts, without its PIN
+type adminAccount struct {
+	AccountID int     `json:"account_id"`
+	Balance   float64 `json:"balance"`
+}
+
+// runAdminAccounts prints every account of the host as text or one JSON account per line.
+// Returns the exit code of the process
+func runAdminAccounts(o *options, args []string) int {
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	accounts, err := o.host().AccountDB.All()
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+
+	encoder := json.NewEncoder(o.stdout)
+	for _, account := range accounts {
+		if o.output == atm.OutputJSON {
+			encoder.Encode(adminAccount{AccountID: account.AccountID, Balance: account.Balance})
+			continue
+		}
+		fmt.Fprintf(o.stdout, "%d %s\n", account.AccountID, atm.FormatAmount(o.config.Terminal.Currency, account.Balance))
+	}
+	return exitOK
+}
+
+// runAdminReverse reverses a transaction on the host, the reason is every argument after the transaction ID.
+// The reversal is recorded in the audit log with the operator who ran it.
+// Returns the exit code of the process
+func runAdminReverse(o *options, args []string) int {
+	operator := o.Flags.String("operator", o.getenv("USER"), "supervisor reversing the transaction, recorded in the audit log, defaults to $USER")
+	auditFile := o.Flags.String("audit-log", "./audit.jsonl", "file the reversal is recorded to, empty disables the audit log")
+	// the transaction ID and reason may come before or after the flags
+	positional := []string{}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	positional = append(positional, o.Flags.Args()...)
+	if len(positional) < 2 {
+		return o.usageError()
+	}
+	if strings.TrimSpace(*operator) == "" {
+		fmt.Fprintln(o.stderr, "A reversal requires -operator or $USER.")
+		return exitUsage
+	}
+
+	transactionID := positional[0]
+	result, err := o.host().Reverse(transactionID, strings.Join(positional[1:], " "))
+	if *auditFile != "" {
+		if recordErr := (&atm.AuditLog{File: *auditFile}).Record(atm.ReversalAuditEntry(*operator, transactionID, err)); recordErr != nil {
+			o.logger.Error("audit entry not recorded", "command", atm.AuditCommandReverse, "error", recordErr)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	message := fmt.Sprintf("Transaction %s reversed by %s.", transactionID, result.TransactionID)
+	if o.output == atm.OutputJSON {
+		json.NewEncoder(o.stdout).Encode(atm.Result{Command: "reverse", TransactionID: result.TransactionID, Balance: &result.Balance, Message: message})
+		return exitOK
+	}
+	fmt.Fprintln(o.stdout, message)
+	return exitOK
+}
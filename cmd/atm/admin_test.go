@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunAdmin(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,100.00\n87654321,4321,-5.50\n", "")
+	admin := func(args ...string) (int, string, string) {
+		return runTest("", append(append([]string{"admin"}, args...), stores...)...)
+	}
+
+	code, stdout, stderr := admin("accounts")
+	if code != exitOK || stdout != "12345678 $100.00\n87654321 $-5.50\n" {
+		t.Errorf("Accounts are incorrect. %d %s\n%s", code, stderr, stdout)
+	}
+	code, stdout, _ = admin("accounts", "-output", "json", "-currency", "EUR")
+	if code != exitOK || !strings.HasPrefix(stdout, `{"account_id":12345678,"balance":100}`+"\n") || strings.Contains(stdout, "1234,") {
+		t.Errorf("JSON accounts are incorrect. %d\n%s", code, stdout)
+	}
+
+	// reverse a deposit made at a terminal of the same stores
+	code, stdout, stderr = runTest("authorize 12345678 1234\ndeposit 20\n", append([]string{"run", "-"}, terminalTestFlags(stores)...)...)
+	if code != exitOK {
+		t.Fatalf("Deposit failed. %d %s", code, stderr)
+	}
+	content, err := os.ReadFile(stores[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactionID := strings.Split(strings.Split(string(content), "\n")[1], ",")[4]
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	if code, _, stderr = admin("reverse", transactionID, "entered", "twice", "-audit-log", auditFile); code != exitUsage || !strings.Contains(stderr, "-operator") {
+		t.Errorf("Reverse without an operator should be refused. %d %s", code, stderr)
+	}
+	code, stdout, stderr = admin("reverse", transactionID, "entered", "twice", "-operator", "alice", "-audit-log", auditFile)
+	if code != exitOK || !strings.HasPrefix(stdout, "Transaction "+transactionID+" reversed by ") {
+		t.Errorf("Reverse failed. %d %s %s", code, stdout, stderr)
+	}
+	content, err = os.ReadFile(auditFile)
+	if err != nil || !strings.Contains(string(content), `"operator":"alice","command":"reverse","transaction_id":"`+transactionID+`","outcome":"ok"`) {
+		t.Errorf("Reversal is not audited with its operator. %v %s", err, content)
+	}
+	if code, _, stderr = admin("reverse", transactionID, "again", "-operator", "alice", "-audit-log", ""); code != exitFailure || stderr == "" {
+		t.Errorf("Reversing twice should fail. %d %s", code, stderr)
+	}
+	if code, _, _ = admin("reverse", transactionID); code != exitUsage {
+		t.Errorf("Reverse without a reason should be refused. %d", code)
+	}
+	if code, stdout, _ = admin("accounts"); !strings.HasPrefix(stdout, "12345678 $100.00\n") {
+		t.Errorf("Reversed deposit should restore the balance. %d %s", code, stdout)
+	}
+}
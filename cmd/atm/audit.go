@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// runAudit prints the audit entries matching the filters as text or as one JSON entry per line.
+// Returns the exit code of the process
+func runAudit(o *options, args []string) int {
+	flags := o.Flags
+	file := flags.String("audit-log", "./audit.jsonl", "file of the audit log of the terminal")
+	from := flags.String("from", "", "first day of the entries")
+	to := flags.String("to", "", "last day of the entries")
+	query := atm.AuditQuery{}
+	flags.IntVar(&query.AccountID, "account", 0, "account ID of the entries")
+	flags.StringVar(&query.TerminalID, "terminal", "", "terminal ID of the entries")
+	flags.StringVar(&query.Command, "command", "", "command or event of the entries e.g. authorize or timeout")
+	flags.StringVar(&query.Outcome, "outcome", "", "outcome of the entries, ok or error")
+	flags.StringVar(&query.ErrorCode, "code", "", "error code of the entries e.g. authorization_unsuccessful")
+	flags.IntVar(&query.Limit, "limit", 100, "most recent entries shown, 0 shows every entry")
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if flags.NArg() != 0 || *file == "" {
+		return o.usageError()
+	}
+	for _, day := range []struct {
+		value string
+		time  *time.Time
+		end   bool
+	}{{*from, &query.From, false}, {*to, &query.To, true}} {
+		if day.value == "" {
+			continue
+		}
+		date, err := time.ParseInLocation("2006-01-02", day.value, time.Local)
+		if err != nil {
+			fmt.Fprintf(o.stderr, "%s is not a date formatted as YYYY-MM-DD.\n", day.value)
+			return exitUsage
+		}
+		if day.end {
+			date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		*day.time = date
+	}
+
+	entries, err := (&atm.AuditLog{File: *file}).Query(query)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	encoder := json.NewEncoder(o.stdout)
+	for _, entry := range entries {
+		if o.output == atm.OutputJSON {
+			encoder.Encode(entry)
+			continue
+		}
+		account := entry.AccountID
+		if account == "" {
+			account = "-"
+		}
+		line := fmt.Sprintf("%s %s %s %s", entry.Time.Format(time.RFC3339), entry.TerminalID, account, entry.Command)
+		if entry.Amount != 0 {
+			line += fmt.Sprintf(" %.2f", entry.Amount)
+		}
+		line += " " + entry.Outcome
+		if entry.ErrorCode != "" {
+			line += " " + entry.ErrorCode
+		}
+		fmt.Fprintln(o.stdout, line)
+	}
+	return exitOK
+}
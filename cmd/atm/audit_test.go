@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestRunAudit(t *testing.T) {
+	log := &atm.AuditLog{File: filepath.Join(t.TempDir(), "audit.jsonl")}
+	when := time.Date(2020, 10, 19, 14, 3, 12, 0, time.Local)
+	entries := []atm.AuditEntry{
+		{Time: when, TerminalID: "ATM00001", AccountID: "****5678", Command: "authorize", Outcome: atm.AuditOutcomeError, ErrorCode: "console_authorization_failed"},
+		{Time: when.Add(time.Minute), TerminalID: "ATM00001", AccountID: "****5678", Command: "withdraw", Amount: 40, Outcome: atm.AuditOutcomeOK},
+		{Time: when.AddDate(0, 0, 1), TerminalID: "ATM00002", Command: "help", Outcome: atm.AuditOutcomeOK},
+	}
+	for _, entry := range entries {
+		if err := log.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, stdout, stderr := runTest("", "report", "audit", "-audit-log", log.File, "-account", "12345678", "-to", "2020-10-19")
+	if code != exitOK {
+		t.Fatalf("Audit failed with %d. %s", code, stderr)
+	}
+	expected := when.Format(time.RFC3339) + " ATM00001 ****5678 authorize error console_authorization_failed\n" +
+		when.Add(time.Minute).Format(time.RFC3339) + " ATM00001 ****5678 withdraw 40.00 ok\n"
+	if stdout != expected {
+		t.Errorf("Output is incorrect.\n%s", stdout)
+	}
+
+	_, stdout, _ = runTest("", "report", "audit", "-audit-log", log.File, "-outcome", "ok", "-limit", "1", "-output", "json")
+	if strings.Count(stdout, "\n") != 1 || !strings.Contains(stdout, `"terminal_id":"ATM00002"`) {
+		t.Errorf("JSON output is incorrect.\n%s", stdout)
+	}
+
+	if code, _, _ := runTest("", "report", "audit", "-audit-log", log.File, "-from", "yesterday"); code != exitUsage {
+		t.Errorf("Invalid date should be refused. %d", code)
+	}
+}
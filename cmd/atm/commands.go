@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// command is a command of the atm binary, either run with its own flags or a group of commands
+type command struct {
+	Name    string
+	Aliases []string
+	// Usage is the arguments of the command after its name
+	Usage string
+	// Help is the description of the command shown by atm help
+	Help string
+	// Hidden commands are kept for compatibility and not listed by atm help
+	Hidden bool
+	// Run runs the command, it registers its flags on the options and parses the arguments.
+	// Returns the exit code of the process
+	Run func(o *options, args []string) int
+	// Commands of a group, Run is not used if set
+	Commands []command
+}
+
+var reportCommands = []command{
+	{Name: "statement", Usage: "<account_id> [flags]", Help: "Export the statement of an account as csv, json, ofx or qif.", Run: runStatement},
+	{Name: "audit", Usage: "[flags]", Help: "Query the audit log of the terminal.", Run: runAudit},
+	{Name: "reconcile", Aliases: []string{"fsck"}, Usage: "[-fix]", Help: "Check the accounts against the ledger.", Run: runReconcile},
+}
+
+var commands = []command{
+	{Name: "console", Usage: "[flags]", Help: "Run the console of a terminal, the command run if none is given.", Run: runConsole},
+	{Name: "tui", Usage: "[flags]", Help: "Run a full screen terminal with side keys and a keypad.", Run: runTUICommand},
+	{Name: "run", Usage: "<file> [flags]", Help: "Run a script of commands or JSONL requests, - reads from stdin.", Run: runScript},
+	{Name: "serve", Usage: "[flags]", Help: "Serve the host to ISO 8583 terminals and the admin HTTP API.", Run: runServe},
+	{Name: "admin", Help: "Manage the accounts and transactions of the host.", Commands: adminCommands},
+	{Name: "report", Help: "Export statements, query the audit log and reconcile the host.", Commands: reportCommands},
+	{Name: "migrate", Help: "Migrate the stores of the host to the current format.", Commands: migrateCommands},
+	{Name: "verify", Usage: "[flags]", Help: "Verify the hash chain of the ledger against its signed checkpoints.", Run: runVerify},
+
+	// report commands from before the report group
+	{Name: "statement", Hidden: true, Usage: "<account_id> [flags]", Run: runStatement},
+	{Name: "audit", Hidden: true, Usage: "[flags]", Run: runAudit},
+	{Name: "reconcile", Aliases: []string{"fsck"}, Hidden: true, Usage: "[-fix]", Run: runReconcile},
+}
+
+// runCommands runs the command of a group named by the first argument, help lists the commands of the group
+func runCommands(c *cli, group string, commands []command, args []string) int {
+	if len(args) == 0 {
+		printCommands(c.stderr, group, commands)
+		return exitUsage
+	}
+	if args[0] == "help" || isHelp(args[0]) {
+		if len(args) == 1 || isHelp(args[0]) {
+			printCommands(c.stdout, group, commands)
+			return exitOK
+		}
+		// atm help <command> runs the command with -h
+		return runCommands(c, group, commands, append(args[1:], "-h"))
+	}
+
+	cmd := lookupCommand(commands, args[0])
+	if cmd == nil {
+		fmt.Fprintf(c.stderr, "%s is not a command of %s.\n", args[0], group)
+		printCommands(c.stderr, group, commands)
+		return exitUsage
+	}
+	if cmd.Commands != nil {
+		return runCommands(c, group+" "+cmd.Name, cmd.Commands, args[1:])
+	}
+	return cmd.Run(newOptions(c, group+" "+cmd.Name, cmd), args[1:])
+}
+
+// lookupCommand returns the command with the name or alias, nil if there is none
+func lookupCommand(commands []command, name string) *command {
+	for i, cmd := range commands {
+		if cmd.Name == name {
+			return &commands[i]
+		}
+		for _, alias := range cmd.Aliases {
+			if alias == name {
+				return &commands[i]
+			}
+		}
+	}
+	return nil
+}
+
+// printCommands prints the usage of a group with every command that is not hidden
+func printCommands(w io.Writer, group string, commands []command) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", group)
+	for _, cmd := range commands {
+		if !cmd.Hidden {
+			fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Help)
+		}
+	}
+	fmt.Fprintf(w, "\nRun %s help <command> for the flags of a command.\n", group)
+	fmt.Fprintln(w, "Exit codes: 0 success, 1 the command failed or found a problem, 2 invalid usage or configuration.")
+}
+
+// isHelp is true for the flags that ask for help
+func isHelp(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
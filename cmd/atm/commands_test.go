@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNow is the clock of the commands under test, midday of today so the hours risk rule never fires
+func testNow() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 12, now.Minute(), now.Second(), now.Nanosecond(), now.Location())
+}
+
+// runTest runs the atm binary with the input on stdin, an empty environment and the clock at midday.
+// Returns the exit code, stdout and stderr
+func runTest(input string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	c := &cli{
+		stdin:  strings.NewReader(input),
+		stdout: stdout,
+		stderr: stderr,
+		lookup: func(string) (string, bool) { return "", false },
+		now:    testNow,
+	}
+	code := run(c, args)
+	return code, stdout.String(), stderr.String()
+}
+
+// writeTestStores writes the accounts and transactions CSV files to the directory and
+// returns the flags that keep every store of the host in it
+func writeTestStores(t *testing.T, dir string, accounts string, transactions string) []string {
+	files := map[string]string{
+		"accounts.csv":     "ACCOUNT_ID,PIN,BALANCE\n" + accounts,
+		"transactions.csv": "ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE\n" + transactions,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return []string{
+		"-accounts-db", filepath.Join(dir, "accounts.csv"),
+		"-transactions-db", filepath.Join(dir, "transactions.csv"),
+		"-checkpoints-db", filepath.Join(dir, "checkpoints.csv"),
+		"-idempotency-db", filepath.Join(dir, "idempotency.csv"),
+		"-standin-db", filepath.Join(dir, "standin.csv"),
+		"-standin-review-db", filepath.Join(dir, "standin_review.csv"),
+		"-reversals-db", filepath.Join(dir, "reversals.csv"),
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	code, stdout, _ := runTest("", "help")
+	if code != exitOK || !strings.Contains(stdout, "Usage: atm <command> [flags]") || !strings.Contains(stdout, "  migrate    Migrate the stores") {
+		t.Errorf("Help is incorrect. %d\n%s", code, stdout)
+	}
+	// commands kept for compatibility are not listed
+	if strings.Contains(stdout, "  statement") {
+		t.Errorf("Hidden commands should not be listed.\n%s", stdout)
+	}
+
+	code, stdout, _ = runTest("", "report", "-h")
+	if code != exitOK || !strings.Contains(stdout, "Usage: atm report <command> [flags]") || !strings.Contains(stdout, "  reconcile") {
+		t.Errorf("Help of a group is incorrect. %d\n%s", code, stdout)
+	}
+
+	// help of a command prints its flags
+	code, _, stderr := runTest("", "help", "report", "statement")
+	if code != exitOK || !strings.Contains(stderr, "Usage: atm report statement <account_id> [flags]") || !strings.Contains(stderr, "-format") || !strings.Contains(stderr, "-accounts-db") {
+		t.Errorf("Help of a command is incorrect. %d\n%s", code, stderr)
+	}
+
+	tests := []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"withdraw"}, "withdraw is not a command of atm."},
+		{[]string{"report"}, "Usage: atm report <command> [flags]"},
+		{[]string{"report", "balance"}, "balance is not a command of atm report."},
+		{[]string{"verify", "-unknown"}, "flag provided but not defined: -unknown"},
+		{[]string{"verify", "extra"}, "Usage: atm verify [flags]\nRun atm verify -h for its flags."},
+		{[]string{"verify", "-currency", "usd"}, `terminal.currency "usd" is not a 3 letter ISO 4217 code`},
+		{[]string{"verify", "-log-level", "loud"}, "Log level is not debug, info, warn or error"},
+	}
+	for _, test := range tests {
+		code, _, stderr := runTest("", test.args...)
+		if code != exitUsage || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%v returned %d and should return %d with %q. %s", test.args, code, exitUsage, test.stderr, stderr)
+		}
+	}
+}
+
+func TestRunCommandsAliases(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,0.00\n", "")
+
+	// fsck is an alias of reconcile and the report commands are kept at the top level
+	for _, args := range [][]string{{"report", "fsck"}, {"reconcile"}, {"fsck"}} {
+		code, stdout, stderr := runTest("", append(args, stores...)...)
+		if code != exitOK || !strings.HasSuffix(stdout, "No issues found.\n") {
+			t.Errorf("%v returned %d. %s %s", args, code, stdout, stderr)
+		}
+	}
+}
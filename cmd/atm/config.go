@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// options are the flags every command shares, the configuration, the ledger key, the output format and logging.
+// A command registers its own flags on Flags before calling parse, the stores are built from the configuration after
+type options struct {
+	*cli
+	Flags *flag.FlagSet
+	// name of the command e.g. atm report statement and usage of its arguments
+	name  string
+	usage string
+
+	configFile string
+	ledgerKey  string
+	output     string
+	logLevel   string
+	logFormat  string
+
+	config  atm.Config
+	logger  *slog.Logger
+	metrics *atm.Metrics
+}
+
+// newOptions returns the options of a command with the shared flags registered
+func newOptions(c *cli, name string, cmd *command) *options {
+	o := &options{cli: c, Flags: flag.NewFlagSet(name, flag.ContinueOnError), name: name, usage: cmd.Usage}
+	o.Flags.SetOutput(c.stderr)
+	o.Flags.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: %s %s\n", name, cmd.Usage)
+		if cmd.Help != "" {
+			fmt.Fprintf(c.stderr, "\n%s\n", cmd.Help)
+		}
+		fmt.Fprintln(c.stderr, "\nFlags:")
+		o.Flags.PrintDefaults()
+	}
+	o.Flags.StringVar(&o.configFile, "config", c.getenv("ATM_CONFIG"), "TOML file of the configuration, defaults to $ATM_CONFIG")
+	o.Flags.StringVar(&o.ledgerKey, "ledger-key", c.getenv("ATM_LEDGER_KEY"), "key the checkpoints of the transaction ledger are signed with, defaults to $ATM_LEDGER_KEY")
+	o.Flags.StringVar(&o.output, "output", atm.OutputText, "output format of commands, text or json")
+	o.Flags.StringVar(&o.logLevel, "log-level", "warn", "lowest level logged to stderr, debug, info, warn or error")
+	o.Flags.StringVar(&o.logFormat, "log-format", atm.LogFormatText, "format of the logs, text or json")
+	registerConfigFlags(o.Flags)
+	return o
+}
+
+// parse parses the flags of the command and loads the configuration and the logger.
+// Returns false with the exit code of the process if the command must not run
+func (o *options) parse(args []string) (int, bool) {
+	if err := o.Flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	config, err := loadConfig(o.configFile, o.lookup, o.Flags)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitUsage, false
+	}
+	logger, err := atm.NewLogger(o.stderr, o.logLevel, o.logFormat)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitUsage, false
+	}
+	o.config = config
+	o.logger = logger
+	o.metrics = atm.NewMetrics()
+	return exitOK, true
+}
+
+// usageError prints the usage of the arguments of the command and returns exitUsage
+func (o *options) usageError() int {
+	fmt.Fprintf(o.stderr, "Usage: %s %s\nRun %s -h for its flags.\n", o.name, o.usage, o.name)
+	return exitUsage
+}
+
+// transactionDB returns the ledger of the configuration
+func (o *options) transactionDB() atm.TransactionDB {
+	return atm.TransactionDB{
+		DBFile:         o.config.Store.Transactions,
+		CheckpointFile: o.config.Store.Checkpoints,
+		CheckpointKey:  []byte(o.ledgerKey),
+		Logger:         o.logger,
+		Metrics:        o.metrics,
+	}
+}
+
+// host returns a host of the stores of the configuration
+func (o *options) host() *atm.Host {
+	return &atm.Host{
+		AccountDB: atm.AccountDB{
+			DBFile:  o.config.Store.Accounts,
+			Metrics: o.metrics,
+		},
+		TransactionDB: o.transactionDB(),
+		IdempotencyDB: atm.IdempotencyDB{
+			DBFile: o.config.Store.Idempotency,
+		},
+		Logger: o.logger,
+		Fees:   &o.config.Fees,
+	}
+}
+
+// registerConfigFlags adds a flag for every setting of the configuration, flags left unset keep the value of the environment or the file
+func registerConfigFlags(flags *flag.FlagSet) {
+	for _, setting := range atm.ConfigSettings() {
+		flags.String(setting.Flag, "", setting.Usage+", overrides $"+setting.Env()+" and "+setting.Key+" of the config file")
+	}
+}
+
+// loadConfig returns the default configuration overridden by the file, then the environment and then the flags that were set.
+// An error is returned if the file cannot be read or the configuration is not valid
+func loadConfig(file string, lookup func(string) (string, bool), flags *flag.FlagSet) (atm.Config, error) {
+	config := atm.DefaultConfig()
+	if file != "" {
+		if err := config.LoadFile(file); err != nil {
+			return atm.Config{}, err
+		}
+	}
+	if err := config.LoadEnv(lookup); err != nil {
+		return atm.Config{}, err
+	}
+
+	keys := map[string]string{}
+	for _, setting := range atm.ConfigSettings() {
+		keys[setting.Flag] = setting.Key
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := keys[f.Name]; ok && err == nil {
+			err = config.Set(key, f.Value.String())
+		}
+	})
+	if err != nil {
+		return atm.Config{}, err
+	}
+	return config, config.Validate()
+}
+
+// flowTimeouts returns the default timeouts of the customer flow with the menu timing out with the session
+func flowTimeouts(sessionTimeout time.Duration) map[atm.FlowState]time.Duration {
+	timeouts := map[atm.FlowState]time.Duration{}
+	for state, timeout := range atm.DefaultFlowTimeouts {
+		timeouts[state] = timeout
+	}
+	timeouts[atm.FlowMenu] = sessionTimeout
+	return timeouts
+}
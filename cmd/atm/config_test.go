@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "atm.toml")
+	content := "[terminal]\nid = \"ATM00002\"\ncurrency = \"EUR\"\nsession_timeout = \"90s\"\n\n[limits]\nwithdrawal = 400\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"ATM_TERMINAL_ID": "ATM00003", "ATM_TERMINAL_CURRENCY": "GBP"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	// the environment overrides the file and the flags override the environment
+	flags := flag.NewFlagSet("atm", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse([]string{"-terminal-id", "ATM00004", "-cassettes", "100x20"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(file, lookup, flags)
+	if err != nil {
+		t.Fatalf("Failed to load config. %s", err)
+	}
+	if config.Terminal.ID != "ATM00004" || config.Terminal.Currency != "GBP" || config.Terminal.SessionTimeout != 90*time.Second {
+		t.Errorf("Terminal config is incorrect. %+v", config.Terminal)
+	}
+	if config.Limits.Withdrawal != 400 || config.Cash.Total() != 2000 || config.Store.Accounts != "./accounts.csv" {
+		t.Errorf("Config is incorrect. %+v", config)
+	}
+
+	// a flag that is not valid is reported with its setting
+	flags = flag.NewFlagSet("atm", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse([]string{"-session-timeout", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig("", lookup, flags)
+	if err == nil || !strings.Contains(err.Error(), "terminal.session_timeout 5s must be from 10s to 1h.") {
+		t.Errorf("Invalid session timeout should be reported. %v", err)
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), lookup, flag.NewFlagSet("atm", flag.ContinueOnError)); err == nil {
+		t.Errorf("Missing config file should be reported")
+	}
+}
+
+func TestFlowTimeouts(t *testing.T) {
+	timeouts := flowTimeouts(45 * time.Second)
+	if timeouts[atm.FlowMenu] != 45*time.Second || timeouts[atm.FlowPINEntry] != atm.DefaultFlowTimeouts[atm.FlowPINEntry] {
+		t.Errorf("Flow timeouts are incorrect. %v", timeouts)
+	}
+	if atm.DefaultFlowTimeouts[atm.FlowMenu] == 45*time.Second {
+		t.Errorf("Default flow timeouts should not be changed")
+	}
+}
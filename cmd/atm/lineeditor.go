@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// historyLimit is the number of lines kept in the history
+const historyLimit = 1000
+
+// errInterrupted is returned when ctrl-c is pressed, the line is discarded
+var errInterrupted = errors.New("Interrupted")
+
+// key codes read from a terminal in raw mode
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyTab       = 9
+	keyLineFeed  = 10
+	keyCtrlK     = 11
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads command lines from a terminal with editing, history and tab completion of the registered commands.
+// Arguments named pin are masked while typing and lines containing them are never saved to the history
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	registry *atm.Registry
+	// historyFile the history is loaded from and appended to, the history is not saved if empty
+	historyFile string
+	history     []string
+}
+
+func newLineEditor(in io.Reader, out io.Writer, registry *atm.Registry, historyFile string) *lineEditor {
+	e := &lineEditor{
+		in:          bufio.NewReader(in),
+		out:         out,
+		registry:    registry,
+		historyFile: historyFile,
+		history:     []string{},
+	}
+	e.loadHistory()
+	return e
+}
+
+// readTerminalLine puts the terminal in raw mode while a line is read
+func (e *lineEditor) readTerminalLine(fd int, prompt string) (string, error) {
+	state, err := makeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore(fd, state)
+	return e.readLine(prompt)
+}
+
+// readLine reads a line typed key by key
+// io.EOF is returned if ctrl-d is pressed on an empty line and errInterrupted if ctrl-c is pressed
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	line := []rune{}
+	pos := 0
+	historyIndex := len(e.history)
+	draft := ""
+
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, e.mask(string(line)))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(value string) {
+		line = []rune(value)
+		pos = len(line)
+	}
+	previous := func() {
+		if historyIndex == 0 {
+			return
+		}
+		if historyIndex == len(e.history) {
+			draft = string(line)
+		}
+		historyIndex--
+		setLine(e.history[historyIndex])
+	}
+	next := func() {
+		if historyIndex == len(e.history) {
+			return
+		}
+		historyIndex++
+		if historyIndex == len(e.history) {
+			setLine(draft)
+		} else {
+			setLine(e.history[historyIndex])
+		}
+	}
+
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = nil
+				fmt.Fprint(e.out, "\r\n")
+				e.addHistory(string(line))
+			}
+			return string(line), err
+		}
+
+		switch r {
+		case keyEnter, keyLineFeed:
+			fmt.Fprint(e.out, "\r\n")
+			e.addHistory(string(line))
+			return string(line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case keyCtrlA:
+			pos = 0
+		case keyCtrlE:
+			pos = len(line)
+		case keyCtrlB:
+			if pos > 0 {
+				pos--
+			}
+		case keyCtrlF:
+			if pos < len(line) {
+				pos++
+			}
+		case keyCtrlK:
+			line = line[:pos]
+		case keyCtrlU:
+			line = line[pos:]
+			pos = 0
+		case keyCtrlW:
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line = append(line[:start], line[pos:]...)
+			pos = start
+		case keyCtrlP:
+			previous()
+		case keyCtrlN:
+			next()
+		case keyTab:
+			if pos != len(line) {
+				break
+			}
+			completed, candidates := e.complete(string(line))
+			setLine(completed)
+			if len(candidates) > 1 {
+				fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+			}
+		case keyEscape:
+			switch e.readEscape() {
+			case "[A", "OA":
+				previous()
+			case "[B", "OB":
+				next()
+			case "[C", "OC":
+				if pos < len(line) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if !unicode.IsPrint(r) {
+				break
+			}
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		refresh()
+	}
+}
+
+// readEscape reads the rest of an escape sequence e.g. [A for the up arrow
+func (e *lineEditor) readEscape() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	sequence := []rune{r}
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		sequence = append(sequence, r)
+		if r < '0' || r > '9' {
+			return string(sequence)
+		}
+	}
+}
+
+// complete returns the line with the command name completed and the candidates if there is more than one.
+// The command of help is completed as well
+func (e *lineEditor) complete(line string) (string, []string) {
+	fields := strings.Fields(line)
+	completing := ""
+	if len(fields) > 0 && !strings.HasSuffix(line, " ") {
+		completing = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) > 1 || (len(fields) == 1 && strings.ToLower(fields[0]) != "help") {
+		return line, []string{}
+	}
+
+	candidates := []string{}
+	for _, command := range e.registry.Commands() {
+		for _, name := range append([]string{command.Name}, command.Aliases...) {
+			if strings.HasPrefix(name, strings.ToLower(completing)) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		return line, candidates
+	}
+
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	completed := strings.Join(append(fields, prefix), " ")
+	if len(candidates) == 1 {
+		completed += " "
+	}
+	return completed, candidates
+}
+
+// mask replaces the characters of arguments named pin with *
+func (e *lineEditor) mask(line string) string {
+	secrets := e.secretArgs(line)
+	if len(secrets) == 0 {
+		return line
+	}
+
+	masked := []rune(line)
+	field := -1
+	inField := false
+	for i, r := range masked {
+		if r == ' ' {
+			inField = false
+			continue
+		}
+		if !inField {
+			inField = true
+			field++
+		}
+		if secrets[field] {
+			masked[i] = '*'
+		}
+	}
+	return string(masked)
+}
+
+// secretArgs returns the positions of the fields of the line that are pin arguments of the command
+func (e *lineEditor) secretArgs(line string) map[int]bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	command, ok := e.registry.Lookup(fields[0])
+	if !ok {
+		return nil
+	}
+
+	secrets := map[int]bool{}
+	for i, arg := range command.Args {
+		if arg.Name == "pin" {
+			secrets[i+1] = true
+		}
+	}
+	return secrets
+}
+
+// loadHistory reads the most recent lines of the history file
+func (e *lineEditor) loadHistory() {
+	if e.historyFile == "" {
+		return
+	}
+	file, err := os.Open(e.historyFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > historyLimit {
+		e.history = e.history[len(e.history)-historyLimit:]
+	}
+}
+
+// addHistory appends the line to the history and the history file.
+// Empty lines, repeats of the previous line and lines containing a pin are skipped
+func (e *lineEditor) addHistory(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || len(e.secretArgs(line)) > 0 {
+		return
+	}
+	if len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if len(e.history) > historyLimit {
+		e.history = e.history[1:]
+	}
+
+	if e.historyFile == "" {
+		return
+	}
+	file, err := os.OpenFile(e.historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.WriteString(line + "\n")
+}
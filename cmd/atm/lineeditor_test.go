@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestLineEditor(t *testing.T, input string) (*lineEditor, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	historyFile := filepath.Join(t.TempDir(), "history")
+	return newLineEditor(strings.NewReader(input), output, atm.DefaultRegistry(), historyFile), output
+}
+
+func TestLineEditorEditing(t *testing.T) {
+	// type "balanxe", fix the typo with the left arrow, backspace and delete, then move home and back to the end
+	editor, _ := newTestLineEditor(t, "balanxe\x1b[D\x7fc\x01\x05\r")
+	line, err := editor.readLine("> ")
+	if err != nil || line != "balance" {
+		t.Errorf("Line is incorrect. %q %v", line, err)
+	}
+
+	editor, _ = newTestLineEditor(t, "withdraw 40\x17deposit 20\x15history\r")
+	line, _ = editor.readLine("> ")
+	if line != "history" {
+		t.Errorf("Line is incorrect. %q", line)
+	}
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	editor, _ := newTestLineEditor(t, "balance\rwithdraw 40\rauthorize 12345678 1234\r\x1b[A\x1b[A\x1b[B\r")
+	for _, expected := range []string{"balance", "withdraw 40", "authorize 12345678 1234", "withdraw 40"} {
+		line, err := editor.readLine("> ")
+		if err != nil || line != expected {
+			t.Errorf("Line is incorrect. %q should be %q", line, expected)
+		}
+	}
+
+	// lines with a pin are not saved, repeated lines are saved once
+	content, err := os.ReadFile(editor.historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "balance\nwithdraw 40\n" {
+		t.Errorf("History file is incorrect. %q", content)
+	}
+
+	reloaded := newLineEditor(strings.NewReader("\x1b[A\r"), io.Discard, atm.DefaultRegistry(), editor.historyFile)
+	line, _ := reloaded.readLine("> ")
+	if line != "withdraw 40" {
+		t.Errorf("History was not loaded. %q", line)
+	}
+}
+
+func TestLineEditorComplete(t *testing.T) {
+	editor, output := newTestLineEditor(t, "wi\t40\r")
+	line, _ := editor.readLine("> ")
+	if line != "withdraw 40" {
+		t.Errorf("Line is incorrect. %q", line)
+	}
+
+	// ambiguous names list the candidates
+	line, candidates := editor.complete("e")
+	if line != "e" || strings.Join(candidates, " ") != "end exit" {
+		t.Errorf("Completion is incorrect. %q %v", line, candidates)
+	}
+	line, _ = editor.complete("help dep")
+	if line != "help deposit " {
+		t.Errorf("Completion is incorrect. %q", line)
+	}
+	line, _ = editor.complete("withdraw 4")
+	if line != "withdraw 4" {
+		t.Errorf("Arguments should not be completed. %q", line)
+	}
+	if output.Len() == 0 {
+		t.Errorf("Line was not written")
+	}
+}
+
+func TestLineEditorMaskPIN(t *testing.T) {
+	editor, output := newTestLineEditor(t, "authorize 12345678 1234\r")
+	line, _ := editor.readLine("> ")
+	if line != "authorize 12345678 1234" {
+		t.Errorf("Line is incorrect. %q", line)
+	}
+	if strings.Contains(output.String(), "12345678 1") || !strings.Contains(output.String(), "authorize 12345678 ****") {
+		t.Errorf("PIN was not masked. %q", output.String())
+	}
+}
+
+func TestLineEditorInterrupt(t *testing.T) {
+	editor, _ := newTestLineEditor(t, "balance\x03\x04")
+	_, err := editor.readLine("> ")
+	if err != errInterrupted {
+		t.Errorf("Expected interrupt. %v", err)
+	}
+	_, err = editor.readLine("> ")
+	if err != io.EOF {
+		t.Errorf("Expected EOF. %v", err)
+	}
+}
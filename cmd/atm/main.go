@@ -1,38 +1,47 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
+)
 
-	"github.com/AndrewCopeland/atm"
+// exit codes of the atm binary, shared by every command
+const (
+	exitOK = 0
+	// exitFailure is returned if the command failed or a check found a problem
+	exitFailure = 1
+	// exitUsage is returned for an unknown command, invalid flags or arguments and a configuration that is not valid
+	exitUsage = 2
 )
 
-func main() {
-	accountDB := atm.AccountDB{
-		DBFile: "./accounts.csv",
-	}
-	transactionDB := atm.TransactionDB{
-		DBFile: "./transactions.csv",
-	}
-	a := &atm.ATM{
-		AccountDB:     accountDB,
-		TransactionDB: transactionDB,
-		ATMBalance:    10000.00,
-		Session:       &atm.Session{},
-	}
+// cli is what a command runs with, the standard streams and the environment of the process
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	lookup func(string) (string, bool)
+	// now is the clock the risk rules of a terminal run on
+	now func() time.Time
+}
 
-	fmt.Print("> ")
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		err := atm.RunCommand(a, scanner.Text())
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Print("> ")
-	}
+// getenv returns the environment variable, empty if it is not set
+func (c *cli) getenv(name string) string {
+	value, _ := c.lookup(name)
+	return value
+}
+
+func main() {
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, lookup: os.LookupEnv, now: time.Now}
+	os.Exit(run(c, os.Args[1:]))
+}
 
-	if scanner.Err() != nil {
-		fmt.Println(scanner.Err().Error())
+// run runs the command of the arguments, the console if the arguments start with a flag or are empty.
+// Returns the exit code of the process
+func run(c *cli, args []string) int {
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && !isHelp(args[0])) {
+		args = append([]string{"console"}, args...)
 	}
+	return runCommands(c, "atm", commands, args)
 }
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"testing"
 
@@ -48,17 +49,17 @@ func TestMainE2E(t *testing.T) {
 
 	accountID := 12345678
 
-	err := atm.RunCommand(a, "authorize 12345678 1234")
+	err := atm.RunCommand(a, io.Discard, "authorize 12345678 1234")
 	if err != nil {
 		t.Errorf("Failed to authorize")
 	}
 
-	err = atm.RunCommand(a, "withdraw 20")
+	err = atm.RunCommand(a, io.Discard, "withdraw 20")
 	if err != nil {
 		t.Errorf("Failed to withdraw 20")
 	}
 
-	err = atm.RunCommand(a, "balance")
+	err = atm.RunCommand(a, io.Discard, "balance")
 	if err != nil {
 		t.Errorf("Failed to get balance")
 	}
@@ -68,7 +69,7 @@ func TestMainE2E(t *testing.T) {
 		t.Errorf("Balance is invalid and should be 80.12")
 	}
 
-	err = atm.RunCommand(a, "deposit 20")
+	err = atm.RunCommand(a, io.Discard, "deposit 20")
 	if err != nil {
 		t.Errorf("Failed to deposit money")
 	}
@@ -78,7 +79,7 @@ func TestMainE2E(t *testing.T) {
 		t.Errorf("Balance is invalid and should be 100.12")
 	}
 
-	err = atm.RunCommand(a, "history")
+	err = atm.RunCommand(a, io.Discard, "history")
 	if err != nil {
 		t.Errorf("Failed to get history")
 	}
@@ -88,12 +89,12 @@ func TestMainE2E(t *testing.T) {
 		t.Errorf("Invalid number of transactions returned")
 	}
 
-	err = atm.RunCommand(a, "logout")
+	err = atm.RunCommand(a, io.Discard, "logout")
 	if err != nil {
 		t.Errorf("Failed to logout")
 	}
 
-	err = atm.RunCommand(a, "balance")
+	err = atm.RunCommand(a, io.Discard, "balance")
 	if err == nil {
 		t.Errorf("Error was expected when executing balanace when logged out")
 	}
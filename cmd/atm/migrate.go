@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+var migrateCommands = []command{
+	{Name: "status", Usage: "[flags]", Help: "Show if the ledger is in the current format, exits 1 if it needs to be migrated.", Run: runMigrateStatus},
+	{Name: "apply", Usage: "[flags]", Help: "Rewrite a ledger written before the hash chain in the current format, chained and checkpointed.", Run: runMigrateApply},
+}
+
+// migration is the outcome of atm migrate as JSON
+type migration struct {
+	Records int `json:"records,omitempty"`
+	// Pending is true if the ledger is not in the current format
+	Pending bool `json:"pending"`
+	// Migrated is the number of records rewritten by atm migrate apply
+	Migrated int    `json:"migrated"`
+	Message  string `json:"message"`
+}
+
+// runMigrateStatus prints if the ledger was written before the hash chain.
+// Returns the exit code of the process, 1 if the ledger needs to be migrated
+func runMigrateStatus(o *options, args []string) int {
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	verification, err := o.transactionDB().Verify()
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+
+	status := migration{Records: verification.Records, Message: fmt.Sprintf("Ledger of %d records is up to date.", verification.Records)}
+	if !verification.Chained && verification.Records > 0 {
+		status.Pending = true
+		status.Message = fmt.Sprintf("Ledger of %d records was written before the hash chain, run atm migrate apply.", verification.Records)
+	}
+	printMigration(o, status)
+	if status.Pending {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runMigrateApply migrates the ledger to the current format.
+// Returns the exit code of the process
+func runMigrateApply(o *options, args []string) int {
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	migrated, err := o.transactionDB().Migrate()
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+
+	status := migration{Migrated: migrated, Message: "Ledger is up to date."}
+	if migrated > 0 {
+		status.Message = fmt.Sprintf("Migrated %d records.", migrated)
+	}
+	printMigration(o, status)
+	return exitOK
+}
+
+// printMigration prints the outcome of a migrate command as text or JSON
+func printMigration(o *options, status migration) {
+	if o.output == atm.OutputJSON {
+		json.NewEncoder(o.stdout).Encode(status)
+		return
+	}
+	fmt.Fprintln(o.stdout, status.Message)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunMigrate(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,60.00\n", "12345678,1,100.00,100.00\n12345678,2,-40.00,60.00\n")
+	migrate := func(args ...string) (int, string, string) {
+		return runTest("", append(append([]string{"migrate"}, args...), stores...)...)
+	}
+
+	code, stdout, _ := migrate("status")
+	if code != exitFailure || stdout != "Ledger of 2 records was written before the hash chain, run atm migrate apply.\n" {
+		t.Errorf("Legacy ledger should need a migration. %d %s", code, stdout)
+	}
+	code, stdout, stderr := migrate("apply", "-ledger-key", "secret")
+	if code != exitOK || stdout != "Migrated 2 records.\n" {
+		t.Errorf("Migration failed. %d %s %s", code, stdout, stderr)
+	}
+	code, stdout, _ = migrate("status", "-output", "json")
+	if code != exitOK || !strings.Contains(stdout, `"records":2,"pending":false`) {
+		t.Errorf("Migrated ledger should be up to date. %d %s", code, stdout)
+	}
+	if code, stdout, _ = migrate("apply"); code != exitOK || stdout != "Ledger is up to date.\n" {
+		t.Errorf("Migrated ledger should not be migrated again. %d %s", code, stdout)
+	}
+	if code, stdout, _ = runTest("", append([]string{"verify", "-ledger-key", "secret"}, stores...)...); code != exitOK {
+		t.Errorf("Migrated ledger should verify. %d %s", code, stdout)
+	}
+}
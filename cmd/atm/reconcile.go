@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// runReconcile checks the host databases and prints every issue as text or as one JSON report.
+// Returns the exit code of the process, 1 if any issue was found even if it was fixed
+func runReconcile(o *options, args []string) int {
+	fix := o.Flags.Bool("fix", false, "write adjustment entries that correct gaps, balance mismatches and orphaned accounts")
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+
+	report, err := o.host().Reconcile(*fix)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+
+	stdout := o.stdout
+	if o.output == atm.OutputJSON {
+		json.NewEncoder(stdout).Encode(report)
+	} else {
+		fmt.Fprintf(stdout, "Checked %d accounts and %d transactions.\n", report.Accounts, report.Transactions)
+		for _, issue := range report.Issues {
+			fmt.Fprintf(stdout, "%s %d: %s\n", issue.Kind, issue.AccountID, issue.Message)
+		}
+		switch {
+		case report.OK():
+			fmt.Fprintln(stdout, "No issues found.")
+		case report.Fixed:
+			fmt.Fprintf(stdout, "%d issues found. Wrote %d adjustment entries.\n", len(report.Issues), len(report.Adjustments))
+		case len(report.Adjustments) > 0:
+			fmt.Fprintf(stdout, "%d issues found. Run with -fix to write %d adjustment entries.\n", len(report.Issues), len(report.Adjustments))
+		default:
+			fmt.Fprintf(stdout, "%d issues found.\n", len(report.Issues))
+		}
+	}
+
+	if !report.OK() {
+		return exitFailure
+	}
+	return exitOK
+}
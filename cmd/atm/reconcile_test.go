@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestRunReconcile(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,100.00\n", "")
+	reconcile := func(args ...string) (int, string, string) {
+		return runTest("", append(append([]string{"report", "reconcile"}, args...), stores...)...)
+	}
+
+	code, stdout, stderr := reconcile()
+	if code != exitFailure {
+		t.Errorf("Reconcile should find an issue. %d %s", code, stderr)
+	}
+	expected := "Checked 1 accounts and 0 transactions.\norphaned_account 12345678: Account 12345678 has a balance of 100.00 and no transactions.\n1 issues found. Run with -fix to write 1 adjustment entries.\n"
+	if stdout != expected {
+		t.Errorf("Output is incorrect.\n%s", stdout)
+	}
+
+	code, stdout, stderr = reconcile("-fix", "-output", "json")
+	if code != exitFailure {
+		t.Errorf("Reconcile should report the fixed issue. %d %s", code, stderr)
+	}
+	report := atm.ReconcileReport{}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil || !report.Fixed || len(report.Adjustments) != 1 {
+		t.Errorf("JSON report is incorrect. %v %s", err, stdout)
+	}
+
+	if code, stdout, _ = reconcile(); code != exitOK || !strings.HasSuffix(stdout, "No issues found.\n") {
+		t.Errorf("Fixed ledger should reconcile. %d %s", code, stdout)
+	}
+
+	if code, _, _ = runTest("", "report", "reconcile", "extra"); code != exitUsage {
+		t.Errorf("Arguments should be refused. %d", code)
+	}
+}
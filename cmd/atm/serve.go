@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// runServe serves the host of the configuration to ISO 8583 terminals and the admin HTTP API until either stops.
+// Returns the exit code of the process
+func runServe(o *options, args []string) int {
+	listen := o.Flags.String("listen", "127.0.0.1:8583", "address ISO 8583 terminals connect to, empty only serves the admin API")
+	terminalKeys := o.Flags.String("terminal-keys", o.getenv("ATM_TERMINAL_KEYS"), "keys terminals sign their messages with as <terminal_id>=<key> separated by commas, defaults to $ATM_TERMINAL_KEYS")
+	adminListen := o.Flags.String("admin-listen", "", "serve the admin HTTP API and Prometheus metrics on this address, requires an admin token")
+	adminToken := o.Flags.String("admin-token", o.getenv("ATM_ADMIN_TOKEN"), "bearer token of the admin HTTP API, defaults to $ATM_ADMIN_TOKEN")
+	auditFile := o.Flags.String("audit-log", "./audit.jsonl", "file reversals through the admin API are recorded to with their operator, empty disables the audit log")
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	if *listen == "" && *adminListen == "" {
+		fmt.Fprintln(o.stderr, "Nothing to serve, set -listen or -admin-listen.")
+		return exitUsage
+	}
+	if *adminListen != "" && *adminToken == "" {
+		fmt.Fprintln(o.stderr, "The admin API requires -admin-token or $ATM_ADMIN_TOKEN.")
+		return exitUsage
+	}
+
+	keys, err := parseTerminalKeys(*terminalKeys)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitUsage
+	}
+
+	host := o.host()
+	stopped := make(chan error, 2)
+	if *adminListen != "" {
+		listener, err := net.Listen("tcp", *adminListen)
+		if err != nil {
+			o.logger.Error("admin API not served", "address", *adminListen, "error", err)
+			return exitFailure
+		}
+		fmt.Fprintf(o.stdout, "Admin API listening on %s\n", listener.Addr())
+		go func() {
+			api := &atm.AdminAPI{Host: host, Token: *adminToken, Metrics: o.metrics, Currency: o.config.Terminal.Currency}
+			if *auditFile != "" {
+				api.AuditLog = &atm.AuditLog{File: *auditFile}
+			}
+			stopped <- http.Serve(listener, api)
+		}()
+	}
+	if *listen != "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			o.logger.Error("host not served", "address", *listen, "error", err)
+			return exitFailure
+		}
+		fmt.Fprintf(o.stdout, "Host listening on %s\n", listener.Addr())
+		go func() {
+			stopped <- (&atm.ISOHost{Host: host, TerminalKeys: keys}).Serve(listener)
+		}()
+	}
+
+	err = <-stopped
+	o.logger.Error("host stopped", "error", err)
+	return exitFailure
+}
+
+// parseTerminalKeys parses the keys of the terminals as <terminal_id>=<key> separated by commas
+func parseTerminalKeys(value string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		terminalID, key, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || terminalID == "" || key == "" {
+			return nil, errors.New("Terminal keys are not <terminal_id>=<key> separated by commas.")
+		}
+		keys[terminalID] = []byte(key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunServe(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "", "")
+	tests := []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"-listen", ""}, "Nothing to serve, set -listen or -admin-listen."},
+		{[]string{"-admin-listen", "127.0.0.1:0"}, "The admin API requires -admin-token or $ATM_ADMIN_TOKEN."},
+		{[]string{"extra"}, "Usage: atm serve [flags]"},
+		{[]string{"-terminal-keys", "ATM00001"}, "Terminal keys are not <terminal_id>=<key> separated by commas."},
+	}
+	for _, test := range tests {
+		code, _, stderr := runTest("", append(append([]string{"serve"}, stores...), test.args...)...)
+		if code != exitUsage || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%v returned %d and should return %d with %q. %s", test.args, code, exitUsage, test.stderr, stderr)
+		}
+	}
+
+	// an address that cannot be listened on stops the host
+	code, _, stderr := runTest("", append(append([]string{"serve"}, stores...), "-listen", "256.0.0.1:0")...)
+	if code != exitFailure || !strings.Contains(stderr, "host not served") {
+		t.Errorf("Invalid address should fail. %d %s", code, stderr)
+	}
+}
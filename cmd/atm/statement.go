@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// runStatement exports the statement of an account from the host databases to a file or stdout.
+// Returns the exit code of the process
+func runStatement(o *options, args []string) int {
+	// the account ID may come before or after the flags
+	account := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		account, args = args[0], args[1:]
+	}
+
+	flags := o.Flags
+	from := flags.String("from", "", "first day of the statement, the first transaction if empty")
+	to := flags.String("to", "", "last day of the statement, today if empty")
+	format := flags.String("format", "csv", "format of the statement, csv, json, ofx or qif")
+	output := flags.String("o", "", "file the statement is written to, stdout if empty")
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if account == "" {
+		account = flags.Arg(0)
+	}
+	accountID, err := strconv.Atoi(account)
+	if err != nil {
+		return o.usageError()
+	}
+
+	formatter, err := atm.LookupStatementFormatter(*format)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitUsage
+	}
+	start, end, err := atm.ParseStatementPeriod(*from, *to)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitUsage
+	}
+	statement, err := o.host().Statement(accountID, start, end)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	statement.Currency = o.config.Terminal.Currency
+
+	w := o.stdout
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(o.stderr, err)
+			return exitFailure
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := formatter.Format(w, statement); err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// writeTestStatementStores writes the stores of an account with a withdrawal of 40 and returns their flags
+func writeTestStatementStores(t *testing.T) []string {
+	dir := t.TempDir()
+	stores := writeTestStores(t, dir, "12345678,1234,100.00\n", "")
+	host := &atm.Host{
+		AccountDB:     atm.AccountDB{DBFile: filepath.Join(dir, "accounts.csv")},
+		TransactionDB: atm.TransactionDB{DBFile: filepath.Join(dir, "transactions.csv")},
+	}
+	if _, err := host.Withdraw(12345678, 40, ""); err != nil {
+		t.Fatal(err)
+	}
+	return stores
+}
+
+func TestRunStatement(t *testing.T) {
+	stores := writeTestStatementStores(t)
+	statement := func(args ...string) (int, string, string) {
+		return runTest("", append(append([]string{"report", "statement"}, args...), stores...)...)
+	}
+
+	code, stdout, stderr := statement("12345678", "-format", "qif")
+	if code != exitOK {
+		t.Fatalf("Statement failed with %d. %s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "!Type:Bank\n") || !strings.Contains(stdout, "T-40.00\n") {
+		t.Errorf("Statement is incorrect.\n%s", stdout)
+	}
+
+	// the account ID after the flags and the statement written to a file
+	output := filepath.Join(t.TempDir(), "statement.ofx")
+	code, stdout, stderr = runTest("", append(append([]string{"statement"}, stores...), "-format", "ofx", "-o", output, "12345678")...)
+	if code != exitOK {
+		t.Fatalf("Statement failed with %d. %s", code, stderr)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil || !strings.Contains(string(content), "<BALAMT>60.00") || stdout != "" {
+		t.Errorf("Statement file is incorrect. %v\n%s", err, content)
+	}
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, exitUsage},
+		{[]string{"12345678", "-format", "pdf"}, exitUsage},
+		{[]string{"12345678", "-from", "yesterday"}, exitUsage},
+		{[]string{"87654321"}, exitFailure},
+	}
+	for _, test := range tests {
+		if code, _, stderr := statement(test.args...); code != test.code || stderr == "" {
+			t.Errorf("%v returned %d and should return %d. %s", test.args, code, test.code, stderr)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "errors"
+
+// terminalState is not used on platforms without raw mode support
+type terminalState struct{}
+
+// isTerminal always returns false so the console falls back to reading plain lines
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("Raw terminal mode is not supported on this platform.")
+}
+
+func restore(fd int, state *terminalState) error {
+	return nil
+}
@@ -0,0 +1,53 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// terminalState is the terminal mode to restore after reading a line in raw mode
+type terminalState struct {
+	termios syscall.Termios
+}
+
+// isTerminal returns true if the file descriptor is a terminal
+func isTerminal(fd int) bool {
+	var termios syscall.Termios
+	return ioctlTermios(fd, ioctlGetTermios, &termios) == nil
+}
+
+// makeRaw disables line buffering, echo and signals so every key press is read as it is typed.
+// Output processing is left enabled so newlines written to the terminal still return the carriage
+func makeRaw(fd int) (*terminalState, error) {
+	var termios syscall.Termios
+	if err := ioctlTermios(fd, ioctlGetTermios, &termios); err != nil {
+		return nil, err
+	}
+	state := &terminalState{termios: termios}
+
+	termios.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	termios.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(fd, ioctlSetTermios, &termios); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// restore returns the terminal to the mode it was in before makeRaw
+func restore(fd int, state *terminalState) error {
+	return ioctlTermios(fd, ioctlSetTermios, &state.termios)
+}
+
+func ioctlTermios(fd int, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// terminalOptions are the flags of the commands that run a terminal, console, tui and run
+type terminalOptions struct {
+	hostAddress   string
+	hostKey       string
+	auditFile     string
+	auditMaxSize  int64
+	auditDaily    bool
+	receiptsDir   string
+	webhookURL    string
+	webhookSecret string
+	webhookOutbox string
+	alertsDB      string
+	alertsFile    string
+	smtpAddress   string
+	smtpFrom      string
+	smtpUsername  string
+	smtpPassword  string
+	riskRules     string
+	metricsListen string
+	metricsToken  string
+
+	// stopAlerts sends the queued alerts and stops sending them, nil if alerts are disabled
+	stopAlerts func()
+}
+
+// registerTerminalFlags adds the flags of a terminal to the options of the command
+func registerTerminalFlags(o *options) *terminalOptions {
+	t := &terminalOptions{}
+	o.Flags.StringVar(&t.hostAddress, "host", "", "address of a remote ISO 8583 host, an in-process host is used if empty")
+	o.Flags.StringVar(&t.hostKey, "host-key", o.getenv("ATM_HOST_KEY"), "key messages to the remote host are signed with, the host declines withdrawals and deposits of an unsigned terminal, defaults to $ATM_HOST_KEY")
+	o.Flags.StringVar(&t.auditFile, "audit-log", "./audit.jsonl", "file every command and event of the terminal is recorded to, empty disables the audit log")
+	o.Flags.Int64Var(&t.auditMaxSize, "audit-max-size", 10<<20, "size in bytes the audit log is rotated at, 0 disables rotating by size")
+	o.Flags.BoolVar(&t.auditDaily, "audit-daily", true, "rotate the audit log every day")
+	o.Flags.StringVar(&t.receiptsDir, "receipts-dir", "./receipts", "directory printed receipts are saved to, empty disables receipts")
+	o.Flags.StringVar(&t.webhookURL, "webhook-url", "", "URL every event of the terminal is posted to, empty disables webhooks")
+	o.Flags.StringVar(&t.webhookSecret, "webhook-secret", o.getenv("ATM_WEBHOOK_SECRET"), "key the webhooks are signed with, defaults to $ATM_WEBHOOK_SECRET")
+	o.Flags.StringVar(&t.webhookOutbox, "webhook-outbox", "./outbox", "directory events wait in until they are delivered to the webhook")
+	o.Flags.StringVar(&t.alertsDB, "alerts-db", "./alerts.csv", "file the alert preferences of the accounts are stored in, empty disables alerts")
+	o.Flags.StringVar(&t.alertsFile, "alerts-file", "./alerts.jsonl", "file alerts are appended to when no SMTP server is set, - prints them to the console")
+	o.Flags.StringVar(&t.smtpAddress, "smtp-address", "", "SMTP server alerts are emailed through e.g. smtp.example.com:587")
+	o.Flags.StringVar(&t.smtpFrom, "smtp-from", "atm@localhost", "sender of the alert emails")
+	o.Flags.StringVar(&t.smtpUsername, "smtp-username", "", "user of the SMTP server, empty sends without authentication")
+	o.Flags.StringVar(&t.smtpPassword, "smtp-password", o.getenv("ATM_SMTP_PASSWORD"), "password of the SMTP server, defaults to $ATM_SMTP_PASSWORD")
+	o.Flags.StringVar(&t.riskRules, "risk-rules", "", "file of the risk rules withdrawals are checked with, the default rules are used if empty")
+	o.Flags.StringVar(&t.metricsListen, "metrics-listen", "", "serve the Prometheus metrics of the terminal from /metrics on this address, requires a metrics token")
+	o.Flags.StringVar(&t.metricsToken, "metrics-token", o.getenv("ATM_METRICS_TOKEN"), "bearer token of the metrics, defaults to $ATM_METRICS_TOKEN")
+	return t
+}
+
+// newATM returns the terminal of the configuration and the flags.
+// An error is returned if the risk rules cannot be loaded, webhooks are set without a secret or metrics without a token
+func (t *terminalOptions) newATM(o *options) (*atm.ATM, error) {
+	if t.metricsListen != "" && t.metricsToken == "" {
+		return nil, errors.New("Metrics require -metrics-token or $ATM_METRICS_TOKEN.")
+	}
+	var hostClient atm.IHostClient = &atm.LocalHostClient{Host: o.host()}
+	if t.hostAddress != "" {
+		hostClient = &atm.NetworkHostClient{
+			Address:    t.hostAddress,
+			TerminalID: o.config.Terminal.ID,
+			Key:        []byte(t.hostKey),
+			Reversals:  &atm.ReversalQueue{DBFile: o.config.Store.Reversals},
+		}
+	}
+
+	events := &atm.EventBus{}
+	a := &atm.ATM{
+		Host:       hostClient,
+		ATMBalance: o.config.Cash.Total(),
+		Session:    &atm.Session{Timeout: o.config.Terminal.SessionTimeout},
+		Flow:       &atm.Flow{Timeouts: flowTimeouts(o.config.Terminal.SessionTimeout)},
+		TerminalID: o.config.Terminal.ID,
+		Currency:   o.config.Terminal.Currency,
+		Logger:     o.logger,
+		Metrics:    o.metrics,
+		Events:     events,
+
+		WithdrawalLimit:  o.config.Limits.Withdrawal,
+		LowCashThreshold: o.config.Limits.LowCash,
+
+		OfflineLimit: o.config.Limits.Offline,
+		StandIn: &atm.StandInQueue{
+			DBFile:     o.config.Store.StandIn,
+			ReviewFile: o.config.Store.StandInReview,
+		},
+	}
+
+	risk, err := loadRiskRules(t.riskRules)
+	if err != nil {
+		return nil, err
+	}
+	risk.Now = o.now
+	a.Risk = risk
+
+	o.metrics.SetCash(a.ATMBalance)
+	if t.webhookURL != "" {
+		if err := startWebhooks(events, t.webhookURL, t.webhookSecret, t.webhookOutbox, o.logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.alertsDB != "" {
+		var notifier atm.INotifier = &atm.FileNotifier{File: t.alertsFile}
+		if t.alertsFile == "-" {
+			notifier = &atm.WriterNotifier{Output: o.stdout}
+		}
+		if t.smtpAddress != "" {
+			notifier = &atm.SMTPNotifier{
+				Address:  t.smtpAddress,
+				From:     t.smtpFrom,
+				Username: t.smtpUsername,
+				Password: t.smtpPassword,
+			}
+		}
+		a.AlertDB = atm.AlertDB{DBFile: t.alertsDB}
+		evaluator := &atm.AlertEvaluator{AlertDB: a.AlertDB, Notifier: notifier, Logger: o.logger}
+		events.Subscribe(evaluator.Publish, atm.EventWithdrawal, atm.EventDeposit)
+		t.stopAlerts = startAlerts(evaluator)
+	}
+
+	if t.receiptsDir != "" {
+		a.Receipts = &atm.ReceiptStore{Dir: t.receiptsDir}
+	}
+	if t.auditFile != "" {
+		a.AuditLog = &atm.AuditLog{
+			File:    t.auditFile,
+			MaxSize: t.auditMaxSize,
+			Daily:   t.auditDaily,
+		}
+	}
+	return a, nil
+}
+
+// close sends the alerts still queued, call it before the command returns
+func (t *terminalOptions) close() {
+	if t.stopAlerts != nil {
+		t.stopAlerts()
+	}
+}
+
+// startAlerts sends the alerts of the evaluator in the background.
+// Returns a function that stops sending and sends the alerts still queued
+func startAlerts(evaluator *atm.AlertEvaluator) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		evaluator.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+		evaluator.Send()
+	}
+}
+
+// parseTerminal parses the flags of a terminal command and returns its terminal.
+// Returns false with the exit code of the process if the command must not run
+func parseTerminal(o *options, t *terminalOptions, args []string) (*atm.ATM, int, bool) {
+	if code, ok := o.parse(args); !ok {
+		return nil, code, false
+	}
+	a, err := t.newATM(o)
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return nil, exitUsage, false
+	}
+	if t.metricsListen != "" {
+		listener, err := net.Listen("tcp", t.metricsListen)
+		if err != nil {
+			o.logger.Error("metrics not served", "address", t.metricsListen, "error", err)
+			return nil, exitFailure, false
+		}
+		o.logger.Info("metrics served", "address", listener.Addr().String())
+		go func() {
+			err := http.Serve(listener, &atm.AdminAPI{Token: t.metricsToken, Metrics: o.metrics})
+			o.logger.Error("metrics stopped", "error", err)
+		}()
+	}
+	return a, exitOK, true
+}
+
+// runConsole reads commands from stdin until the console ends, with line editing if stdin is a terminal.
+// Returns the exit code of the process
+func runConsole(o *options, args []string) int {
+	t := registerTerminalFlags(o)
+	historyFile := o.Flags.String("history-file", defaultHistoryFile(), "file the console history is saved to, empty disables saving the history")
+	a, code, ok := parseTerminal(o, t, args)
+	if !ok {
+		return code
+	}
+	defer t.close()
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+
+	console := &atm.Console{
+		ATM:      a,
+		Output:   o.stdout,
+		Format:   o.output,
+		Registry: atm.DefaultRegistry(),
+	}
+
+	if file, ok := o.stdin.(*os.File); ok && isTerminal(int(file.Fd())) {
+		editor := newLineEditor(file, o.stdout, console.Registry, *historyFile)
+		for {
+			line, err := editor.readTerminalLine(int(file.Fd()), "> ")
+			if err == errInterrupted {
+				continue
+			}
+			if err != nil {
+				if err != io.EOF {
+					fmt.Fprintln(o.stderr, err)
+					return exitFailure
+				}
+				return exitOK
+			}
+			if runConsoleLine(console, line) {
+				return exitOK
+			}
+		}
+	}
+
+	fmt.Fprint(o.stdout, "> ")
+	scanner := bufio.NewScanner(o.stdin)
+	for scanner.Scan() {
+		if runConsoleLine(console, scanner.Text()) {
+			return exitOK
+		}
+		fmt.Fprint(o.stdout, "> ")
+	}
+
+	if scanner.Err() != nil {
+		fmt.Fprintln(o.stderr, scanner.Err().Error())
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runTUICommand shows a full screen ATM with side keys and a keypad.
+// Returns the exit code of the process
+func runTUICommand(o *options, args []string) int {
+	t := registerTerminalFlags(o)
+	a, code, ok := parseTerminal(o, t, args)
+	if !ok {
+		return code
+	}
+	defer t.close()
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	if err := runTUI(a, o.stdin, o.stdout); err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runScript runs a command script or JSONL requests from a file, - reads from stdin, and writes the results as JSONL to stdout.
+// Returns the exit code of the process
+func runScript(o *options, args []string) int {
+	// the file may come before or after the flags
+	path := ""
+	if len(args) > 0 && (args[0] == "-" || !strings.HasPrefix(args[0], "-")) {
+		path, args = args[0], args[1:]
+	}
+	t := registerTerminalFlags(o)
+	a, code, ok := parseTerminal(o, t, args)
+	if !ok {
+		return code
+	}
+	defer t.close()
+	positional := 0
+	if path == "" {
+		path = o.Flags.Arg(0)
+		positional = 1
+	}
+	if path == "" || o.Flags.NArg() != positional {
+		return o.usageError()
+	}
+
+	script := o.stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(o.stderr, err)
+			return exitFailure
+		}
+		defer file.Close()
+		script = file
+	}
+
+	if err := atm.RunScript(a, script, o.stdout); err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// startWebhooks delivers every event published on the bus to the URL in the background, starting with the events left in the outbox
+func startWebhooks(bus *atm.EventBus, url string, secret string, outbox string, logger *slog.Logger) error {
+	if secret == "" {
+		return errors.New("Webhooks require -webhook-secret or $ATM_WEBHOOK_SECRET.")
+	}
+	dispatcher := &atm.WebhookDispatcher{
+		URL:    url,
+		Secret: []byte(secret),
+		Outbox: outbox,
+		Logger: logger,
+	}
+	bus.Subscribe(dispatcher.Publish)
+	go dispatcher.Run(context.Background())
+	return nil
+}
+
+// loadRiskRules reads the risk rules from the file, DefaultRiskRules if no file is given
+func loadRiskRules(path string) (*atm.RiskEngine, error) {
+	text := atm.DefaultRiskRules
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+	rules, err := atm.ParseRiskRules(text)
+	if err != nil {
+		return nil, err
+	}
+	return &atm.RiskEngine{Rules: rules}, nil
+}
+
+// runConsoleLine runs a command line and prints its error. Returns true if the console ended
+func runConsoleLine(console *atm.Console, line string) bool {
+	err := console.Run(line)
+	if err == atm.ErrConsoleEnd {
+		return true
+	}
+	// errors are part of the result in json output
+	if err != nil && console.Format != atm.OutputJSON {
+		fmt.Fprintln(console.Output, err)
+	}
+	return false
+}
+
+// defaultHistoryFile returns the console history file in the home directory
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".atm_history")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// terminalTestFlags returns the flags of a terminal of the stores that writes no audit log, receipts or alerts
+func terminalTestFlags(stores []string) []string {
+	return append([]string{"-audit-log", "", "-receipts-dir", "", "-alerts-db", ""}, stores...)
+}
+
+func TestRunConsole(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,100.00\n", "")
+
+	// the console is run if no command is given
+	input := "authorize 12345678 1234\nwithdraw 40\nbalance\nwithdraw 30\nend\n"
+	code, stdout, stderr := runTest(input, append(terminalTestFlags(stores), "-history-file", "")...)
+	if code != exitOK {
+		t.Fatalf("Console failed with %d. %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Current balance: 60.00") || !strings.Contains(stdout, "amount is not a multiple of 20.") {
+		t.Errorf("Console output is incorrect.\n%s", stdout)
+	}
+
+	code, stdout, _ = runTest("balance\n", append([]string{"console", "-output", "json"}, terminalTestFlags(stores)...)...)
+	if code != exitOK || !strings.Contains(stdout, `"code":"flow_not_allowed"`) {
+		t.Errorf("JSON console output is incorrect. %d\n%s", code, stdout)
+	}
+
+	if code, _, _ := runTest("", append(terminalTestFlags(stores), "script.txt")...); code != exitUsage {
+		t.Errorf("Arguments of the console should be refused. %d", code)
+	}
+
+	// a terminal that cannot start is a usage error
+	code, _, stderr = runTest("", append([]string{"console", "-webhook-url", "http://localhost"}, terminalTestFlags(stores)...)...)
+	if code != exitUsage || !strings.Contains(stderr, "Webhooks require -webhook-secret") {
+		t.Errorf("Webhooks without a secret should be refused. %d %s", code, stderr)
+	}
+}
+
+func TestRunConsoleMetrics(t *testing.T) {
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,100.00\n", "")
+	flags := append(terminalTestFlags(stores), "-history-file", "", "-log-level", "info", "-metrics-listen", "127.0.0.1:0")
+
+	if code, _, stderr := runTest("", flags...); code != exitUsage || !strings.Contains(stderr, "Metrics require -metrics-token") {
+		t.Errorf("Metrics without a token should be refused. %d %s", code, stderr)
+	}
+
+	code, _, stderr := runTest("authorize 12345678 1234\nwithdraw 40\nend\n", append(flags, "-metrics-token", "secret")...)
+	address := regexp.MustCompile(`msg="metrics served" address=(\S+)`).FindStringSubmatch(stderr)
+	if code != exitOK || address == nil {
+		t.Fatalf("Metrics should be served. %d %s", code, stderr)
+	}
+	request, _ := http.NewRequest(http.MethodGet, "http://"+address[1]+"/metrics", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "atm_dispensed_dollars_total 40") {
+		t.Errorf("Metrics of the terminal are incorrect. %d\n%s", response.StatusCode, body)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	dir := t.TempDir()
+	stores := writeTestStores(t, dir, "12345678,1234,100.00\n", "")
+	script := filepath.Join(dir, "script.txt")
+	if err := os.WriteFile(script, []byte("authorize 12345678 1234\ndeposit 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, stderr := runTest("", append([]string{"run", script}, terminalTestFlags(stores)...)...)
+	if code != exitOK || strings.Count(stdout, "\n") != 2 || !strings.Contains(stdout, "Current balance: 120.00") {
+		t.Errorf("Script output is incorrect. %d %s\n%s", code, stderr, stdout)
+	}
+
+	// - reads the script from stdin and the file may come after the flags
+	code, stdout, _ = runTest("authorize 12345678 1234\nbalance\n", append(append([]string{"run"}, terminalTestFlags(stores)...), "-")...)
+	if code != exitOK || !strings.Contains(stdout, `"input":"balance","ok":true,"command":"balance","account_id":12345678,"balance":120,"message":"Current balance: 120.00"`) {
+		t.Errorf("Script from stdin is incorrect. %d\n%s", code, stdout)
+	}
+
+	if code, _, _ := runTest("", append([]string{"run"}, terminalTestFlags(stores)...)...); code != exitUsage {
+		t.Errorf("Missing script should be refused. %d", code)
+	}
+	if code, _, _ := runTest("", append([]string{"run", filepath.Join(dir, "missing.txt")}, terminalTestFlags(stores)...)...); code != exitFailure {
+		t.Errorf("Missing script file should fail. %d", code)
+	}
+}
+
+func TestRunConsoleAlerts(t *testing.T) {
+	dir := t.TempDir()
+	stores := writeTestStores(t, dir, "12345678,1234,100.00\n", "")
+	alertsFile := filepath.Join(dir, "alerts.jsonl")
+	flags := append([]string{"-audit-log", "", "-receipts-dir", "", "-history-file", "", "-alerts-db", filepath.Join(dir, "alerts.csv"), "-alerts-file", alertsFile}, stores...)
+
+	// the alert queued by the last withdrawal is sent before the console exits
+	code, _, stderr := runTest("authorize 12345678 1234\nalerts jane@example.com 50 0\nwithdraw 60\nend\n", flags...)
+	if code != exitOK {
+		t.Fatalf("Console failed with %d. %s", code, stderr)
+	}
+	content, err := os.ReadFile(alertsFile)
+	if err != nil || !strings.Contains(string(content), `"kind":"low_balance"`) {
+		t.Errorf("Low balance alert should have been sent. %v %s", err, content)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// width of the inside of the ATM screen and the number of lines of text it shows
+const (
+	tuiWidth     = 60
+	tuiBodyLines = 13
+	// number of transactions on the mini statement screen
+	tuiStatementLength = 5
+)
+
+// amounts of the fast cash side keys A to D and E
+var tuiFastCash = []int{20, 40, 60, 100, 200}
+
+type tuiScreen int
+
+const (
+	screenWelcome tuiScreen = iota
+	screenPIN
+	screenConfirmPIN
+	screenMenu
+	screenFastCash
+	screenAmount
+	screenBalance
+	screenStatement
+	screenReceiptPrompt
+	screenCardEject
+	screenMessage
+)
+
+// tui is a full screen ATM with side keys next to the screen and a keypad.
+// Side keys are A to D on the left and E to H on the right, the keypad is 0-9, ".", Enter, Backspace and Esc to cancel.
+// The screens follow the customer flow of the ATM, the menu has screens for fast cash, amounts, the balance and statement
+type tui struct {
+	atm    *atm.ATM
+	screen tuiScreen
+	// digits typed on the keypad
+	entry string
+	// depositing is true if the amount screen is for a deposit
+	depositing bool
+	// confirming is the withdrawal waiting for the customer to confirm their PIN
+	confirming int
+	// lines shown on the message, balance and statement screens
+	lines []string
+	// next is the screen shown after the message screen
+	next tuiScreen
+	done bool
+}
+
+func newTUI(a *atm.ATM) *tui {
+	if a.Flow == nil {
+		a.Flow = &atm.Flow{}
+	}
+	return &tui{atm: a, screen: screenWelcome}
+}
+
+// handleKey updates the screen for a key press
+func (t *tui) handleKey(key rune) {
+	if key == keyCtrlC {
+		t.quit()
+		return
+	}
+	if t.atm.Flow.Expire(t.atm) {
+		t.timedOut()
+		return
+	}
+	// key presses count as activity so the session does not time out while the customer is choosing
+	t.atm.Flow.Touch(t.atm)
+	if key >= 'a' && key <= 'h' {
+		key = key - 'a' + 'A'
+	}
+
+	switch t.screen {
+	case screenWelcome:
+		switch {
+		case key == keyEscape:
+			t.quit()
+		case key == keyEnter && t.entry != "":
+			accountID, _ := strconv.Atoi(t.entry)
+			t.entry = ""
+			if err := t.atm.Flow.InsertCard(accountID); err != nil {
+				t.message(screenWelcome, err.Error())
+				return
+			}
+			t.screen = screenPIN
+		default:
+			t.keypad(key, 19, false)
+		}
+
+	case screenPIN:
+		switch {
+		case key == keyEscape:
+			t.ejectCard()
+		case key == keyEnter && t.entry != "":
+			pin := t.entry
+			t.entry = ""
+			err := t.atm.Flow.EnterPIN(t.atm, pin)
+			t.atm.Audit("authorize", t.atm.Flow.AccountID, atm.Result{}, err)
+			switch {
+			case err == atm.ErrFlowPINAttempts:
+				t.screen = screenCardEject
+				t.lines = []string{err.Error()}
+			case err == atm.ErrAuthorizationUnsuccessful || err == atm.ErrAccountNotFound:
+				t.message(screenPIN, fmt.Sprintf("Incorrect PIN. %d attempts left.", atm.MaxPINAttempts-t.atm.Flow.PINAttempts))
+			case err != nil:
+				t.message(screenPIN, err.Error())
+			default:
+				t.screen = screenMenu
+			}
+		default:
+			t.keypad(key, 12, false)
+		}
+
+	case screenConfirmPIN:
+		switch {
+		case key == keyEscape:
+			t.entry = ""
+			t.screen = screenMenu
+		case key == keyEnter && t.entry != "":
+			pin := t.entry
+			t.entry = ""
+			err := t.atm.ConfirmPIN(pin)
+			t.atm.Audit("confirm", t.atm.Flow.AccountID, atm.Result{}, err)
+			switch {
+			case err == atm.ErrAuthorizationUnsuccessful:
+				t.atm.Flow.EjectCard(t.atm)
+				t.screen = screenCardEject
+				t.lines = []string{atm.ErrConsoleAuthorizationFailed.Error()}
+			case err != nil:
+				t.message(screenMenu, err.Error())
+			default:
+				t.withdraw(t.confirming)
+			}
+		default:
+			t.keypad(key, 12, false)
+		}
+
+	case screenMenu:
+		if t.atm.Flow.BeginTransaction(t.atm) != nil {
+			return
+		}
+		switch key {
+		case 'A':
+			t.screen = screenFastCash
+		case 'B', 'C':
+			t.depositing = key == 'C'
+			t.entry = ""
+			t.screen = screenAmount
+		case 'D':
+			t.balance()
+		case 'E':
+			t.statement()
+		case 'H', keyEscape:
+			t.ejectCard()
+		}
+
+	case screenFastCash:
+		switch {
+		case key >= 'A' && key <= 'E':
+			t.withdraw(tuiFastCash[key-'A'])
+		case key == 'F':
+			t.depositing = false
+			t.entry = ""
+			t.screen = screenAmount
+		case key == 'H' || key == keyEscape:
+			t.screen = screenMenu
+		}
+
+	case screenAmount:
+		switch {
+		case key == keyEscape:
+			t.entry = ""
+			t.screen = screenMenu
+		case key == keyEnter && t.entry != "":
+			entry := t.entry
+			t.entry = ""
+			if t.depositing {
+				amount, err := strconv.ParseFloat(entry, 64)
+				if err != nil {
+					t.message(screenMenu, atm.ErrConsoleInvalidAmount.Error())
+					return
+				}
+				t.deposit(amount)
+				return
+			}
+			amount, err := strconv.Atoi(entry)
+			if err != nil {
+				t.message(screenMenu, atm.ErrConsoleInvalidAmount.Error())
+				return
+			}
+			t.withdraw(amount)
+		default:
+			t.keypad(key, 9, t.depositing)
+		}
+
+	case screenBalance, screenStatement:
+		if key == 'H' || key == keyEscape || key == keyEnter {
+			t.screen = screenMenu
+		}
+
+	case screenReceiptPrompt:
+		switch key {
+		case 'E':
+			receipt, err := t.atm.PrintReceipt()
+			t.atm.Audit("receipt", t.atm.Flow.AccountID, atm.Result{}, err)
+			if err != nil {
+				t.message(screenMenu, err.Error())
+				return
+			}
+			t.message(screenMenu, append([]string{"Please take your receipt.", ""}, strings.Split(receipt.Text(), "\n")...)...)
+		case 'H', keyEscape:
+			t.screen = screenMenu
+		}
+
+	case screenCardEject:
+		if key == keyEnter {
+			t.atm.Flow.TakeCard()
+			t.reset()
+		}
+
+	case screenMessage:
+		if key == 'H' || key == keyEscape || key == keyEnter {
+			t.screen = t.next
+		}
+	}
+}
+
+// tick applies the timeouts of the customer flow once a second
+func (t *tui) tick() {
+	if t.atm.Flow.Expire(t.atm) {
+		t.timedOut()
+	}
+}
+
+func (t *tui) keypad(key rune, length int, decimal bool) {
+	switch {
+	case key == keyBackspace || key == keyDelete:
+		if t.entry != "" {
+			t.entry = t.entry[:len(t.entry)-1]
+		}
+	case len(t.entry) >= length:
+	case key >= '0' && key <= '9':
+		t.entry += string(key)
+	case key == '.' && decimal && !strings.Contains(t.entry, "."):
+		t.entry += "."
+	}
+}
+
+func (t *tui) withdraw(amount int) {
+	overdrawn, err := t.atm.Withdraw(t.atm.Flow.AccountID, amount)
+	t.atm.Audit("withdraw", t.atm.Flow.AccountID, atm.Result{Amount: float64(amount)}, err)
+	// the risk rules ask for the PIN again before the withdrawal
+	if err == atm.ErrRiskStepUpRequired {
+		t.confirming = amount
+		t.entry = ""
+		t.screen = screenConfirmPIN
+		return
+	}
+	if err != nil {
+		t.message(screenMenu, err.Error())
+		return
+	}
+
+	t.atm.Flow.CompleteTransaction()
+	lines := []string{fmt.Sprintf("Please take your cash: %s", atm.FormatAmount(t.atm.Currency, float64(amount)))}
+	switch fee := t.atm.LastFee(); {
+	case overdrawn:
+		lines = append(lines, fmt.Sprintf("Your account is overdrawn and you have been charged %s in fees.", atm.FormatAmount(t.atm.Currency, fee)))
+	case fee > 0:
+		lines = append(lines, fmt.Sprintf("You have been charged a fee of %s.", atm.FormatAmount(t.atm.Currency, fee)))
+	}
+	t.offerReceipt(lines)
+}
+
+func (t *tui) deposit(amount float64) {
+	err := t.atm.Deposit(t.atm.Flow.AccountID, amount)
+	t.atm.Audit("deposit", t.atm.Flow.AccountID, atm.Result{Amount: amount}, err)
+	if err != nil {
+		t.message(screenMenu, err.Error())
+		return
+	}
+
+	t.atm.Flow.CompleteTransaction()
+	t.offerReceipt([]string{fmt.Sprintf("Deposited: %s", atm.FormatAmount(t.atm.Currency, amount))})
+}
+
+// offerReceipt asks if the customer wants a receipt, the lines are shown above the question
+func (t *tui) offerReceipt(lines []string) {
+	if !t.atm.ReceiptOffered() {
+		t.message(screenMenu, lines...)
+		return
+	}
+	t.lines = lines
+	t.screen = screenReceiptPrompt
+}
+
+func (t *tui) balance() {
+	balance, err := t.atm.Balance(t.atm.Flow.AccountID)
+	t.atm.Audit("balance", t.atm.Flow.AccountID, atm.Result{}, err)
+	if err != nil {
+		t.message(screenMenu, err.Error())
+		return
+	}
+	t.lines = []string{fmt.Sprintf("Available balance: %s", atm.FormatAmount(t.atm.Currency, balance))}
+	t.screen = screenBalance
+}
+
+// statement shows the last transactions that fit on the screen in receipt form
+func (t *tui) statement() {
+	statement, err := t.atm.MiniStatement(tuiStatementLength)
+	t.atm.Audit("ministatement", t.atm.Flow.AccountID, atm.Result{}, err)
+	if err != nil {
+		t.message(screenMenu, err.Error())
+		return
+	}
+	t.lines = strings.Split(statement.Text(), "\n")
+	t.screen = screenStatement
+}
+
+func (t *tui) message(next tuiScreen, lines ...string) {
+	t.lines = lines
+	t.next = next
+	t.screen = screenMessage
+}
+
+func (t *tui) ejectCard() {
+	t.atm.Audit("logout", t.atm.Flow.AccountID, atm.Result{}, nil)
+	t.atm.Flow.EjectCard(t.atm)
+	t.entry = ""
+	t.lines = []string{"Thank you. Please take your card."}
+	t.screen = screenCardEject
+}
+
+// timedOut shows the screen of the state the flow timed out to
+func (t *tui) timedOut() {
+	t.entry = ""
+	if t.atm.Flow.State == atm.FlowCardEject {
+		t.lines = []string{atm.ErrFlowTimedOut.Error()}
+		t.screen = screenCardEject
+		return
+	}
+	t.reset()
+	t.message(screenWelcome, "Your card was retained. Please contact your bank.")
+}
+
+func (t *tui) quit() {
+	if t.atm.Flow.State != atm.FlowIdle {
+		if t.atm.Flow.State != atm.FlowCardEject {
+			t.atm.Flow.EjectCard(t.atm)
+		}
+		t.atm.Flow.TakeCard()
+	}
+	t.done = true
+}
+
+func (t *tui) reset() {
+	t.entry = ""
+	t.screen = screenWelcome
+}
+
+// view renders the screen and the side key labels
+func (t *tui) view() []string {
+	title := ""
+	body := []string{}
+	left := []string{"", "", "", ""}
+	right := []string{"", "", "", ""}
+	entry := ""
+
+	switch t.screen {
+	case screenWelcome:
+		title = "WELCOME"
+		body = []string{"Please enter your account number", "and press Enter."}
+		entry = t.entry
+	case screenPIN:
+		title = "ENTER PIN"
+		body = []string{"Please enter your PIN and press Enter.", "Press Esc to cancel."}
+		entry = strings.Repeat("*", len(t.entry))
+	case screenConfirmPIN:
+		title = "CONFIRM PIN"
+		body = []string{"For your security please enter your PIN", "again and press Enter.", "Press Esc to cancel."}
+		entry = strings.Repeat("*", len(t.entry))
+	case screenMenu:
+		title = "MAIN MENU"
+		body = []string{"Please select a transaction."}
+		left = []string{"Fast cash", "Withdraw", "Deposit", "Balance"}
+		right = []string{"Statement", "", "", "Exit"}
+	case screenFastCash:
+		title = "FAST CASH"
+		body = []string{"Please select an amount."}
+		left = []string{"$20", "$40", "$60", "$100"}
+		right = []string{"$200", "Other amount", "", "Back"}
+	case screenAmount:
+		title = "WITHDRAWAL"
+		body = []string{"Please enter a multiple of $20", "and press Enter."}
+		if t.depositing {
+			title = "DEPOSIT"
+			body = []string{"Please enter the amount to deposit", "and press Enter."}
+		}
+		entry = "$" + t.entry
+	case screenBalance:
+		title = "BALANCE"
+		body = t.lines
+		right = []string{"", "", "", "Back"}
+	case screenStatement:
+		title = "MINI STATEMENT"
+		body = t.lines
+		right = []string{"", "", "", "Back"}
+	case screenReceiptPrompt:
+		title = "TRANSACTION COMPLETE"
+		body = append(append([]string{}, t.lines...), "", "Would you like a receipt?")
+		right = []string{"Yes", "", "", "No"}
+	case screenCardEject:
+		title = "CARD EJECTED"
+		body = append(append([]string{}, t.lines...), "", "Press Enter once you have taken your card.")
+	case screenMessage:
+		body = t.lines
+		right = []string{"", "", "", "Continue"}
+	}
+
+	border := "+" + strings.Repeat("-", tuiWidth) + "+"
+	lines := []string{border, tuiCenter(title), tuiCenter("")}
+	for i := 0; i < tuiBodyLines; i++ {
+		text := ""
+		if i < len(body) {
+			text = body[i]
+		}
+		lines = append(lines, tuiCenter(text))
+	}
+	lines = append(lines, tuiCenter(entry), tuiCenter(""))
+	for i, key := range "ABCD" {
+		lines = append(lines, tuiSideKeys(key, left[i], key+4, right[i]))
+	}
+
+	footer := ""
+	if remaining := t.atm.Flow.Remaining(); remaining > 0 {
+		seconds := int(remaining / time.Second)
+		footer = fmt.Sprintf("Time remaining %d:%02d", seconds/60, seconds%60)
+	}
+	lines = append(lines, tuiCenter(footer), border)
+	lines = append(lines, " Side keys: A-H   Keypad: 0-9 . Enter Backspace   Cancel: Esc")
+	return lines
+}
+
+func tuiCenter(text string) string {
+	if len(text) > tuiWidth {
+		text = text[:tuiWidth]
+	}
+	padding := tuiWidth - len(text)
+	return "|" + strings.Repeat(" ", padding/2) + text + strings.Repeat(" ", padding-padding/2) + "|"
+}
+
+func tuiSideKeys(leftKey rune, left string, rightKey rune, right string) string {
+	leftLabel, rightLabel := "", ""
+	if left != "" {
+		leftLabel = fmt.Sprintf("[%c] %s", leftKey, left)
+	}
+	if right != "" {
+		rightLabel = fmt.Sprintf("%s [%c]", right, rightKey)
+	}
+	return fmt.Sprintf("| %-*s%*s |", tuiWidth/2-1, leftLabel, tuiWidth/2-1, rightLabel)
+}
+
+// runTUI runs the full screen ATM on the input and output until it is quit, the input must be a terminal
+func runTUI(a *atm.ATM, in io.Reader, out io.Writer) error {
+	file, ok := in.(*os.File)
+	if !ok || !isTerminal(int(file.Fd())) {
+		return errors.New("The ATM screen needs a terminal.")
+	}
+	fd := int(file.Fd())
+	state, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore(fd, state)
+	// hide the cursor while the screen is shown
+	fmt.Fprint(out, "\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[H\x1b[2J")
+
+	keys := make(chan rune)
+	go readTUIKeys(file, keys)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	t := newTUI(a)
+	for !t.done {
+		fmt.Fprint(out, "\x1b[H\x1b[2J"+strings.Join(t.view(), "\r\n"))
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			t.handleKey(key)
+		case <-ticker.C:
+			t.tick()
+		}
+	}
+	return nil
+}
+
+// readTUIKeys sends key presses to the channel until the input is closed.
+// Escape sequences such as arrow keys are dropped, a lone escape is sent as the cancel key
+func readTUIKeys(in io.Reader, keys chan<- rune) {
+	defer close(keys)
+	reader := bufio.NewReader(in)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+		if r == keyEscape && reader.Buffered() > 0 {
+			// drop the rest of the sequence e.g. [A for the up arrow
+			if r, _, err = reader.ReadRune(); err != nil {
+				return
+			}
+			for (r == '[' || r == 'O' || (r >= '0' && r <= '9') || r == ';') && reader.Buffered() > 0 {
+				if r, _, err = reader.ReadRune(); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if r == keyLineFeed {
+			r = keyEnter
+		}
+		keys <- r
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestTUI(t *testing.T) *tui {
+	dir := t.TempDir()
+	accountDB := atm.AccountDB{DBFile: filepath.Join(dir, "accounts.csv")}
+	transactionDB := atm.TransactionDB{DBFile: filepath.Join(dir, "transactions.csv")}
+	if err := os.WriteFile(accountDB.DBFile, []byte("ACCOUNT_ID,PIN,BALANCE\n12345678,1234,100.00\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(transactionDB.DBFile, []byte("ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return newTUI(&atm.ATM{
+		AccountDB:     accountDB,
+		TransactionDB: transactionDB,
+		ATMBalance:    200,
+		Session:       &atm.Session{},
+		TerminalID:    "ATM00001",
+		Receipts:      &atm.ReceiptStore{Dir: filepath.Join(dir, "receipts")},
+	})
+}
+
+func typeKeys(t *tui, keys string) {
+	for _, key := range keys {
+		t.handleKey(key)
+	}
+}
+
+func viewContains(t *tui, text string) bool {
+	return strings.Contains(strings.Join(t.view(), "\n"), text)
+}
+
+func TestTUIAuthorize(t *testing.T) {
+	screen := newTestTUI(t)
+	typeKeys(screen, "12345678\r12")
+	// the pin is masked
+	if !viewContains(screen, "**") || viewContains(screen, "12345678") {
+		t.Errorf("PIN is not masked.\n%s", strings.Join(screen.view(), "\n"))
+	}
+	typeKeys(screen, "99\r")
+	if screen.screen != screenMessage || !viewContains(screen, "Incorrect PIN. 2 attempts left.") {
+		t.Errorf("Wrong PIN was not rejected.\n%s", strings.Join(screen.view(), "\n"))
+	}
+
+	typeKeys(screen, "\r1234\r")
+	if screen.screen != screenMenu || !viewContains(screen, "Time remaining") {
+		t.Errorf("Failed to authorize.\n%s", strings.Join(screen.view(), "\n"))
+	}
+}
+
+func TestTUIPINAttempts(t *testing.T) {
+	screen := newTestTUI(t)
+	typeKeys(screen, "12345678\r1111\r\r2222\r\r3333\r")
+	if screen.screen != screenCardEject || !viewContains(screen, atm.ErrFlowPINAttempts.Error()) {
+		t.Errorf("Card was not ejected.\n%s", strings.Join(screen.view(), "\n"))
+	}
+
+	// the card is taken and the next customer can start
+	typeKeys(screen, "\r")
+	if screen.screen != screenWelcome || screen.atm.Flow.State != atm.FlowIdle {
+		t.Errorf("Did not return to the welcome screen.\n%s", strings.Join(screen.view(), "\n"))
+	}
+}
+
+func TestTUIFastCash(t *testing.T) {
+	screen := newTestTUI(t)
+	typeKeys(screen, "12345678\r1234\r")
+
+	// fast cash $40 then ask for the receipt
+	typeKeys(screen, "ab")
+	if screen.screen != screenReceiptPrompt || screen.atm.ATMBalance != 160 {
+		t.Fatalf("Fast cash was not dispensed.\n%s", strings.Join(screen.view(), "\n"))
+	}
+	typeKeys(screen, "e")
+	if !viewContains(screen, "Please take your receipt.") || !viewContains(screen, "****5678") || !viewContains(screen, "$60.00") {
+		t.Errorf("Receipt is incorrect.\n%s", strings.Join(screen.view(), "\n"))
+	}
+	if _, err := os.Stat(filepath.Join(screen.atm.Receipts.Dir, "ATM00001-000001.txt")); err != nil {
+		t.Errorf("Receipt was not saved. %s", err)
+	}
+
+	typeKeys(screen, "\rd")
+	if screen.screen != screenBalance || !viewContains(screen, "$60.00") {
+		t.Errorf("Balance is incorrect.\n%s", strings.Join(screen.view(), "\n"))
+	}
+}
+
+func TestTUIConfirmPIN(t *testing.T) {
+	screen := newTestTUI(t)
+	screen.atm.Risk = &atm.RiskEngine{Rules: []atm.IRiskRule{atm.HoursRule{From: 0, To: 24, Action: atm.RiskStepUp}}}
+	typeKeys(screen, "12345678\r1234\r")
+
+	// the withdrawal waits for the PIN, cancelling returns to the menu
+	typeKeys(screen, "aa")
+	if screen.screen != screenConfirmPIN || screen.atm.ATMBalance != 200 {
+		t.Fatalf("PIN was not asked for.\n%s", strings.Join(screen.view(), "\n"))
+	}
+	typeKeys(screen, "\x1b")
+	if screen.screen != screenMenu {
+		t.Errorf("Did not return to the menu.\n%s", strings.Join(screen.view(), "\n"))
+	}
+
+	typeKeys(screen, "aa1234\r")
+	if screen.screen != screenReceiptPrompt || screen.atm.ATMBalance != 180 {
+		t.Fatalf("Withdrawal was not dispensed after the PIN.\n%s", strings.Join(screen.view(), "\n"))
+	}
+
+	// an incorrect PIN ejects the card
+	typeKeys(screen, "haa0000\r")
+	if screen.screen != screenCardEject || screen.atm.ATMBalance != 180 {
+		t.Errorf("Card was not ejected.\n%s", strings.Join(screen.view(), "\n"))
+	}
+}
+
+func TestTUIDeposit(t *testing.T) {
+	screen := newTestTUI(t)
+	typeKeys(screen, "12345678\r1234\r")
+
+	typeKeys(screen, "c12.555\x7f\rh")
+	balance, _ := screen.atm.Balance(12345678)
+	if balance != 112.55 || screen.screen != screenMenu {
+		t.Errorf("Deposit is incorrect. %.2f\n%s", balance, strings.Join(screen.view(), "\n"))
+	}
+
+	// exit logs out and returns to the welcome screen
+	typeKeys(screen, "h\r")
+	if screen.screen != screenWelcome || screen.atm.Session.AccountID != 0 {
+		t.Errorf("Failed to log out.\n%s", strings.Join(screen.view(), "\n"))
+	}
+}
+
+func TestTUITimeout(t *testing.T) {
+	screen := newTestTUI(t)
+	typeKeys(screen, "12345678\r1234\r")
+
+	screen.atm.Flow.LastActivity = time.Now().Add(-atm.SessionTimeout - time.Second)
+	screen.tick()
+	if screen.screen != screenCardEject || !viewContains(screen, atm.ErrFlowTimedOut.Error()) || screen.atm.Session.AccountID != 0 {
+		t.Errorf("Session did not time out.\n%s", strings.Join(screen.view(), "\n"))
+	}
+
+	// the card is retained if it is not taken
+	screen.atm.Flow.LastActivity = time.Now().Add(-time.Minute)
+	screen.handleKey('1')
+	if screen.atm.Flow.State != atm.FlowIdle || !viewContains(screen, "retained") {
+		t.Errorf("Card was not retained.\n%s", strings.Join(screen.view(), "\n"))
+	}
+	typeKeys(screen, "\r")
+	if screen.screen != screenWelcome {
+		t.Errorf("Did not return to the welcome screen.")
+	}
+}
+
+func TestReadTUIKeys(t *testing.T) {
+	keys := make(chan rune)
+	go readTUIKeys(strings.NewReader("a\x1b[A1\n"), keys)
+	read := []rune{}
+	for key := range keys {
+		read = append(read, key)
+	}
+	if string(read) != "a1\r" {
+		t.Errorf("Keys are incorrect. %q", string(read))
+	}
+}
+
+func TestRunTUICommand(t *testing.T) {
+	// the screen is drawn on the streams of the command, which are not a terminal in tests
+	stores := writeTestStores(t, t.TempDir(), "12345678,1234,100.00\n", "")
+	code, stdout, stderr := runTest("", append([]string{"tui"}, terminalTestFlags(stores)...)...)
+	if code != exitFailure || stdout != "" || !strings.Contains(stderr, "The ATM screen needs a terminal.") {
+		t.Errorf("TUI without a terminal should fail. %d %q %s", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// runVerify verifies the hash chain of the ledger against its signed checkpoints and prints the outcome as text or JSON.
+// Returns the exit code of the process, 1 if a record was tampered with or deleted
+func runVerify(o *options, args []string) int {
+	if code, ok := o.parse(args); !ok {
+		return code
+	}
+	if o.Flags.NArg() != 0 {
+		return o.usageError()
+	}
+	transactionDB := o.transactionDB()
+	verification, err := transactionDB.Verify()
+	if err != nil {
+		fmt.Fprintln(o.stderr, err)
+		return exitFailure
+	}
+
+	if o.output == atm.OutputJSON {
+		json.NewEncoder(o.stdout).Encode(verification)
+	} else {
+		if len(transactionDB.CheckpointKey) == 0 {
+			fmt.Fprintln(o.stderr, "Checkpoint signatures are not verified without -ledger-key or $ATM_LEDGER_KEY.")
+		}
+		fmt.Fprintln(o.stdout, verification.Message)
+	}
+
+	if !verification.OK() {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestRunVerify(t *testing.T) {
+	dir := t.TempDir()
+	stores := writeTestStores(t, dir, "", "")
+	transactionDB := atm.TransactionDB{
+		DBFile:             filepath.Join(dir, "transactions.csv"),
+		CheckpointFile:     filepath.Join(dir, "checkpoints.csv"),
+		CheckpointKey:      []byte("secret"),
+		CheckpointInterval: 1,
+	}
+	for _, amount := range []float64{100, -40} {
+		if err := transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 1, Amount: amount}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func(args ...string) (int, string, string) {
+		return runTest("", append(append([]string{"verify"}, args...), stores...)...)
+	}
+
+	if code, stdout, stderr := verify("-ledger-key", "secret"); code != exitOK || stdout != "Verified 2 records and 2 checkpoints.\n" {
+		t.Errorf("Ledger should verify. %d %s %s", code, stdout, stderr)
+	}
+
+	content, _ := os.ReadFile(transactionDB.DBFile)
+	os.WriteFile(transactionDB.DBFile, []byte(strings.Replace(string(content), "-40.00", "-4.00", 1)), 0644)
+	if code, stdout, _ := verify("-ledger-key", "secret", "-output", "json"); code != exitFailure || !strings.Contains(stdout, `"first_invalid":2`) {
+		t.Errorf("Tampered ledger should fail. %d %s", code, stdout)
+	}
+
+	// signatures are not verified without a key
+	if _, _, stderr := verify(); !strings.Contains(stderr, "-ledger-key") {
+		t.Errorf("Missing key should be reported. %s", stderr)
+	}
+}
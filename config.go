@@ -0,0 +1,481 @@
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// store backends
+const (
+	StoreBackendCSV = "csv"
+)
+
+// DefaultCurrency is the currency of a terminal without one configured
+const DefaultCurrency = "USD"
+
+// Config is the configuration of the atm binary.
+// It is read from a TOML file, then environment variables and then flags, each overriding the one before
+type Config struct {
+	Store    StoreConfig
+	Terminal TerminalConfig
+	Cash     CashConfig
+	Limits   LimitsConfig
+	Fees     FeeSchedule
+}
+
+// StoreConfig is where the host and terminal keep their data
+type StoreConfig struct {
+	// Backend of the stores, only csv is supported
+	Backend       string
+	Accounts      string
+	Transactions  string
+	Checkpoints   string
+	Idempotency   string
+	StandIn       string
+	StandInReview string
+	// Reversals are the reversals a remote host did not acknowledge
+	Reversals string
+}
+
+// TerminalConfig identifies the terminal and its sessions
+type TerminalConfig struct {
+	// ID is sent to the host in field 41 of ISO 8583 messages, at most 8 characters
+	ID string
+	// Currency is the ISO 4217 code of the cash and accounts
+	Currency       string
+	SessionTimeout time.Duration
+}
+
+// CashConfig is the cash loaded in the terminal
+type CashConfig struct {
+	Cassettes []Cassette
+}
+
+// Cassette holds notes of a single denomination
+type Cassette struct {
+	Denomination int
+	Count        int
+}
+
+// Total returns the value of the notes in every cassette
+func (c CashConfig) Total() float64 {
+	total := 0
+	for _, cassette := range c.Cassettes {
+		total += cassette.Denomination * cassette.Count
+	}
+	return float64(total)
+}
+
+// LimitsConfig limits what the terminal dispenses, a zero limit is disabled
+type LimitsConfig struct {
+	// Withdrawal is the most a single withdrawal may dispense
+	Withdrawal float64
+	// Offline is the most approved in stand-in per account while the host is unavailable
+	Offline float64
+	// LowCash is the cash below which EventLowCash is published
+	LowCash float64
+}
+
+// DefaultConfig returns the configuration of a terminal with its stores in the working directory and $10000 in $20 notes
+func DefaultConfig() Config {
+	return Config{
+		Store: StoreConfig{
+			Backend:       StoreBackendCSV,
+			Accounts:      "./accounts.csv",
+			Transactions:  "./transactions.csv",
+			Checkpoints:   "./transactions_checkpoints.csv",
+			Idempotency:   "./idempotency.csv",
+			StandIn:       "./standin.csv",
+			StandInReview: "./standin_review.csv",
+			Reversals:     "./reversals.csv",
+		},
+		Terminal: TerminalConfig{
+			ID:             "ATM00001",
+			Currency:       DefaultCurrency,
+			SessionTimeout: SessionTimeout,
+		},
+		Cash: CashConfig{
+			Cassettes: []Cassette{{Denomination: NoteDenomination, Count: 500}},
+		},
+		Limits: LimitsConfig{
+			LowCash: 1000,
+		},
+		Fees: DefaultFees,
+	}
+}
+
+// ConfigSetting is a setting of the configuration, its TOML key is also the name of its environment variable and flag
+type ConfigSetting struct {
+	// Key in the TOML file, section.name
+	Key string
+	// Flag of the atm binary without the leading dash
+	Flag  string
+	Usage string
+	set   func(*Config, string) error
+}
+
+// Env returns the environment variable of the setting, ATM_ followed by the key in upper case e.g. ATM_TERMINAL_ID
+func (s ConfigSetting) Env() string {
+	return "ATM_" + strings.ToUpper(strings.ReplaceAll(s.Key, ".", "_"))
+}
+
+// ConfigSettings returns every setting of the configuration
+func ConfigSettings() []ConfigSetting {
+	text := func(field func(*Config) *string) func(*Config, string) error {
+		return func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		}
+	}
+	amount := func(field func(*Config) *float64) func(*Config, string) error {
+		return func(c *Config, value string) error {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", value)
+			}
+			*field(c) = parsed
+			return nil
+		}
+	}
+
+	return []ConfigSetting{
+		{Key: "store.backend", Flag: "store-backend", Usage: "backend of the stores, only csv is supported", set: text(func(c *Config) *string { return &c.Store.Backend })},
+		{Key: "store.accounts", Flag: "accounts-db", Usage: "file of the accounts", set: text(func(c *Config) *string { return &c.Store.Accounts })},
+		{Key: "store.transactions", Flag: "transactions-db", Usage: "file of the transaction ledger", set: text(func(c *Config) *string { return &c.Store.Transactions })},
+		{Key: "store.checkpoints", Flag: "checkpoints-db", Usage: "file of the signed checkpoints of the ledger, empty disables checkpoints", set: text(func(c *Config) *string { return &c.Store.Checkpoints })},
+		{Key: "store.idempotency", Flag: "idempotency-db", Usage: "file of the results of idempotency keys", set: text(func(c *Config) *string { return &c.Store.Idempotency })},
+		{Key: "store.standin", Flag: "standin-db", Usage: "file of the withdrawals approved in stand-in", set: text(func(c *Config) *string { return &c.Store.StandIn })},
+		{Key: "store.standin_review", Flag: "standin-review-db", Usage: "file of the stand-in withdrawals flagged for review", set: text(func(c *Config) *string { return &c.Store.StandInReview })},
+		{Key: "store.reversals", Flag: "reversals-db", Usage: "file of the reversals the remote host did not acknowledge", set: text(func(c *Config) *string { return &c.Store.Reversals })},
+		{Key: "terminal.id", Flag: "terminal-id", Usage: "terminal ID sent to a remote host and printed on receipts", set: text(func(c *Config) *string { return &c.Terminal.ID })},
+		{Key: "terminal.currency", Flag: "currency", Usage: "ISO 4217 code of the currency printed on receipts", set: text(func(c *Config) *string { return &c.Terminal.Currency })},
+		{Key: "terminal.session_timeout", Flag: "session-timeout", Usage: "how long a session stays active without activity e.g. 2m", set: func(c *Config, value string) error {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", value)
+			}
+			c.Terminal.SessionTimeout = timeout
+			return nil
+		}},
+		{Key: "cash.cassettes", Flag: "cassettes", Usage: "notes loaded in each cassette as <count>x<denomination> separated by commas e.g. 500x20,250x20", set: func(c *Config, value string) error {
+			cassettes, err := ParseCassettes(value)
+			if err != nil {
+				return err
+			}
+			c.Cash.Cassettes = cassettes
+			return nil
+		}},
+		{Key: "limits.withdrawal", Flag: "withdrawal-limit", Usage: "most a single withdrawal may dispense, 0 disables the limit", set: amount(func(c *Config) *float64 { return &c.Limits.Withdrawal })},
+		{Key: "limits.offline", Flag: "offline-limit", Usage: "most approved in stand-in per account while the host is unavailable, 0 disables stand-in", set: amount(func(c *Config) *float64 { return &c.Limits.Offline })},
+		{Key: "limits.low_cash", Flag: "low-cash", Usage: "cash below which a low_cash event is published, 0 disables the event", set: amount(func(c *Config) *float64 { return &c.Limits.LowCash })},
+		{Key: "fees.withdrawal", Flag: "withdrawal-fee", Usage: "fee charged for every withdrawal", set: amount(func(c *Config) *float64 { return &c.Fees.Withdrawal })},
+		{Key: "fees.overdraft", Flag: "overdraft-fee", Usage: "fee charged when a withdrawal takes the account below zero", set: amount(func(c *Config) *float64 { return &c.Fees.Overdraft })},
+	}
+}
+
+// Set sets the setting with the key to the value.
+// An error is returned if the key is unknown or the value cannot be parsed
+func (c *Config) Set(key string, value string) error {
+	if err := c.set(key, value); err != nil {
+		return fmt.Errorf("%w %w", ErrConfigInvalid, err)
+	}
+	return nil
+}
+
+func (c *Config) set(key string, value string) error {
+	for _, setting := range ConfigSettings() {
+		if setting.Key == key {
+			if err := setting.set(c, value); err != nil {
+				return fmt.Errorf("%s %w.", key, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a setting.", key)
+}
+
+// LoadFile sets the settings of a TOML file.
+// Tables name the sections and values are strings, numbers, booleans or arrays of them on a single line e.g.
+//
+//	[terminal]
+//	id = "ATM00002"
+//	session_timeout = "90s"
+//
+//	[cash]
+//	cassettes = ["500x20", "250x20"]
+//
+// An error with the line is returned if the file cannot be read, is not valid or has an unknown setting
+func (c *Config) LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseTOML(string(content))
+	if err != nil {
+		return fmt.Errorf("%w %s %w", ErrConfigInvalid, path, err)
+	}
+	for _, value := range values {
+		if err := c.set(value.key, value.value); err != nil {
+			return fmt.Errorf("%w %s line %d: %w", ErrConfigInvalid, path, value.line, err)
+		}
+	}
+	return nil
+}
+
+// LoadEnv sets every setting that has its environment variable set, lookup is usually os.LookupEnv
+func (c *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	for _, setting := range ConfigSettings() {
+		value, ok := lookup(setting.Env())
+		if !ok {
+			continue
+		}
+		if err := c.set(setting.Key, value); err != nil {
+			return fmt.Errorf("%w $%s: %w", ErrConfigInvalid, setting.Env(), err)
+		}
+	}
+	return nil
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// terminalID is a terminal ID that fits in the ISO 8583 card acceptor terminal identification and the name of a receipt file
+var terminalID = regexp.MustCompile(`^[A-Za-z0-9]{1,8}$`)
+
+// Validate returns every problem of the configuration joined, nil if it is valid
+func (c Config) Validate() error {
+	errs := []error{}
+	invalid := func(key string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w %s %s", ErrConfigInvalid, key, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Store.Backend != StoreBackendCSV {
+		invalid("store.backend", "%q is not supported, the only backend is %s.", c.Store.Backend, StoreBackendCSV)
+	}
+	for _, path := range []struct {
+		key   string
+		value string
+	}{
+		{"store.accounts", c.Store.Accounts},
+		{"store.transactions", c.Store.Transactions},
+		{"store.idempotency", c.Store.Idempotency},
+		{"store.standin", c.Store.StandIn},
+		{"store.standin_review", c.Store.StandInReview},
+		{"store.reversals", c.Store.Reversals},
+	} {
+		if path.value == "" {
+			invalid(path.key, "must not be empty.")
+		}
+	}
+	if c.Store.Transactions != "" && c.Store.Transactions == c.Store.Accounts {
+		invalid("store.transactions", "must not be the file of the accounts.")
+	}
+
+	if !terminalID.MatchString(c.Terminal.ID) {
+		invalid("terminal.id", "%q must be 1 to 8 letters or digits.", c.Terminal.ID)
+	}
+	if !currencyCode.MatchString(c.Terminal.Currency) {
+		invalid("terminal.currency", "%q is not a 3 letter ISO 4217 code e.g. USD.", c.Terminal.Currency)
+	}
+	if c.Terminal.SessionTimeout < 10*time.Second || c.Terminal.SessionTimeout > time.Hour {
+		invalid("terminal.session_timeout", "%s must be from 10s to 1h.", c.Terminal.SessionTimeout)
+	}
+
+	if len(c.Cash.Cassettes) == 0 {
+		invalid("cash.cassettes", "must load at least one cassette.")
+	}
+	for i, cassette := range c.Cash.Cassettes {
+		if cassette.Denomination != NoteDenomination {
+			invalid("cash.cassettes", "cassette %d holds %d notes, the terminal only dispenses %d notes.", i+1, cassette.Denomination, NoteDenomination)
+		}
+		if cassette.Count < 0 {
+			invalid("cash.cassettes", "cassette %d must not hold a negative count of notes.", i+1)
+		}
+	}
+
+	for _, amount := range []struct {
+		key   string
+		value float64
+	}{
+		{"limits.withdrawal", c.Limits.Withdrawal},
+		{"limits.offline", c.Limits.Offline},
+		{"limits.low_cash", c.Limits.LowCash},
+		{"fees.withdrawal", c.Fees.Withdrawal},
+		{"fees.overdraft", c.Fees.Overdraft},
+	} {
+		if amount.value < 0 {
+			invalid(amount.key, "%.2f must not be negative.", amount.value)
+		}
+	}
+	if c.Limits.Withdrawal > 0 && c.Limits.Withdrawal < NoteDenomination {
+		invalid("limits.withdrawal", "%.2f must allow at least one %d note.", c.Limits.Withdrawal, NoteDenomination)
+	}
+	return errors.Join(errs...)
+}
+
+// ParseCassettes parses cassettes written as <count>x<denomination> separated by commas e.g. 500x20,250x20
+func ParseCassettes(value string) ([]Cassette, error) {
+	cassettes := []Cassette{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		count, denomination, ok := strings.Cut(strings.ToLower(field), "x")
+		cassette := Cassette{}
+		var countErr, denominationErr error
+		cassette.Count, countErr = strconv.Atoi(count)
+		cassette.Denomination, denominationErr = strconv.Atoi(denomination)
+		if !ok || countErr != nil || denominationErr != nil {
+			return nil, fmt.Errorf("cassette %q is not <count>x<denomination>", field)
+		}
+		cassettes = append(cassettes, cassette)
+	}
+	return cassettes, nil
+}
+
+// tomlValue is a value of a TOML file with its dotted key and line
+type tomlValue struct {
+	key   string
+	value string
+	line  int
+}
+
+var tomlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// parseTOML parses the subset of TOML the configuration uses: comments, tables and keys with single line values.
+// Arrays are returned with their values separated by commas
+func parseTOML(content string) ([]tomlValue, error) {
+	values := []tomlValue{}
+	seen := map[string]bool{}
+	table := ""
+	for i, line := range strings.Split(content, "\n") {
+		number := i + 1
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: table %s is not [name].", number, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if !tomlKey.MatchString(table) {
+				return nil, fmt.Errorf("line %d: table name %q is not valid.", number, table)
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !tomlKey.MatchString(key) {
+			return nil, fmt.Errorf("line %d: %s is not key = value.", number, line)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s is set twice.", number, key)
+		}
+		seen[key] = true
+
+		value, err := parseTOMLValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s %w.", number, key, err)
+		}
+		values = append(values, tomlValue{key: key, value: value, line: number})
+	}
+	return values, nil
+}
+
+// parseTOMLValue returns a string, number or boolean as text and an array as its values separated by commas
+func parseTOMLValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "[") {
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("array is not closed on its line")
+		}
+		items := []string{}
+		for _, item := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			if item == "" {
+				continue
+			}
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	}
+	if strings.HasPrefix(raw, `"`) {
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("string %s is not valid", raw)
+		}
+		return value, nil
+	}
+	if strings.HasPrefix(raw, "'") {
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("string %s is not valid", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+	number := strings.ReplaceAll(raw, "_", "")
+	if _, err := strconv.ParseFloat(number, 64); err != nil || raw == "" {
+		return "", fmt.Errorf("value %s is not a string, number, boolean or array", raw)
+	}
+	return number, nil
+}
+
+// splitTOMLArray splits the items of an array on the commas outside of strings
+func splitTOMLArray(raw string) []string {
+	items := []string{}
+	quote := rune(0)
+	start := 0
+	escaped := false
+	for i, r := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == ',':
+			items = append(items, strings.TrimSpace(raw[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, strings.TrimSpace(raw[start:]))
+}
+
+// stripTOMLComment removes a # comment that is not inside a string
+func stripTOMLComment(line string) string {
+	quote := rune(0)
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,148 @@
+package atm_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "atm.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed writing config: %s", err)
+	}
+	return path
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config := atm.DefaultConfig()
+	assertNoError(t, config.Validate())
+	if config.Cash.Total() != 10000 || config.Store.Accounts != "./accounts.csv" || config.Terminal.SessionTimeout != atm.SessionTimeout || config.Fees.Overdraft != 5 {
+		t.Errorf("Default config is incorrect. %+v", config)
+	}
+}
+
+func TestConfigLoadFile(t *testing.T) {
+	path := writeTestConfig(t, `# terminal in the lobby
+[store]
+accounts = "/var/lib/atm/accounts.csv" # shared with the branch
+transactions = '/var/lib/atm/transactions.csv'
+
+[terminal]
+id = "ATM00002"
+currency = "EUR"
+session_timeout = "90s"
+
+[cash]
+cassettes = ["500x20", "250x20"]
+
+[limits]
+withdrawal = 1_000
+low_cash = 500.50
+
+[fees]
+withdrawal = 1.5
+`)
+	config := atm.DefaultConfig()
+	assertNoError(t, config.LoadFile(path))
+	assertNoError(t, config.Validate())
+
+	if config.Store.Accounts != "/var/lib/atm/accounts.csv" || config.Store.Transactions != "/var/lib/atm/transactions.csv" || config.Store.Idempotency != "./idempotency.csv" {
+		t.Errorf("Store config is incorrect. %+v", config.Store)
+	}
+	if config.Terminal.ID != "ATM00002" || config.Terminal.Currency != "EUR" || config.Terminal.SessionTimeout != 90*time.Second {
+		t.Errorf("Terminal config is incorrect. %+v", config.Terminal)
+	}
+	if len(config.Cash.Cassettes) != 2 || config.Cash.Cassettes[1] != (atm.Cassette{Denomination: 20, Count: 250}) || config.Cash.Total() != 15000 {
+		t.Errorf("Cash config is incorrect. %+v", config.Cash)
+	}
+	if config.Limits.Withdrawal != 1000 || config.Limits.LowCash != 500.50 || config.Fees.Withdrawal != 1.5 || config.Fees.Overdraft != 5 {
+		t.Errorf("Limits and fees are incorrect. %+v %+v", config.Limits, config.Fees)
+	}
+
+	for _, invalid := range []struct {
+		content string
+		err     string
+	}{
+		{"[terminal]\nid = ATM00002\n", "line 2: terminal.id value ATM00002 is not a string"},
+		{"[terminal]\nname = \"lobby\"\n", "line 2: terminal.name is not a setting."},
+		{"[terminal\nid = \"ATM00002\"\n", "line 1: table [terminal is not [name]."},
+		{"[terminal]\nid = \"A\"\nid = \"B\"\n", "line 3: terminal.id is set twice."},
+		{"[cash]\ncassettes = [\"500x20\"\n", "line 2: cash.cassettes array is not closed"},
+		{"[cash]\ncassettes = [\"500 notes\"]\n", "line 2: cash.cassettes cassette \"500 notes\" is not <count>x<denomination>"},
+		{"[terminal]\nsession_timeout = \"2 minutes\"\n", "line 2: terminal.session_timeout \"2 minutes\" is not a duration."},
+		{"[limits]\nwithdrawal = \"lots\"\n", "line 2: limits.withdrawal \"lots\" is not a number."},
+	} {
+		config := atm.DefaultConfig()
+		err := config.LoadFile(writeTestConfig(t, invalid.content))
+		assertErrorContains(t, err, atm.ErrConfigInvalid.Error())
+		assertErrorContains(t, err, invalid.err)
+	}
+
+	assertError(t, config.LoadFile(filepath.Join(t.TempDir(), "missing.toml")))
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	env := map[string]string{
+		"ATM_TERMINAL_ID":     "ATM00003",
+		"ATM_CASH_CASSETTES":  "100x20,100x20,50x20",
+		"ATM_FEES_OVERDRAFT":  "7.5",
+		"ATM_STORE_STANDIN":   "/tmp/standin.csv",
+		"ATM_UNRELATED_VALUE": "ignored",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	config := atm.DefaultConfig()
+	assertNoError(t, config.LoadEnv(lookup))
+	if config.Terminal.ID != "ATM00003" || config.Cash.Total() != 5000 || config.Fees.Overdraft != 7.5 || config.Store.StandIn != "/tmp/standin.csv" {
+		t.Errorf("Config from the environment is incorrect. %+v", config)
+	}
+
+	env["ATM_LIMITS_OFFLINE"] = "some"
+	err := config.LoadEnv(lookup)
+	assertErrorContains(t, err, "$ATM_LIMITS_OFFLINE: limits.offline \"some\" is not a number.")
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := atm.DefaultConfig()
+	config.Store.Backend = "postgres"
+	config.Store.Idempotency = ""
+	config.Terminal.ID = "TERMINAL-LOBBY"
+	config.Terminal.Currency = "usd"
+	config.Terminal.SessionTimeout = time.Second
+	config.Cash.Cassettes = []atm.Cassette{{Denomination: 50, Count: 100}}
+	config.Limits.Withdrawal = 10
+	config.Fees.Overdraft = -5
+
+	err := config.Validate()
+	if !errors.Is(err, atm.ErrConfigInvalid) {
+		t.Errorf("Validation error should be %s", atm.ErrConfigInvalid)
+	}
+	for _, expected := range []string{
+		`store.backend "postgres" is not supported`,
+		"store.idempotency must not be empty.",
+		`terminal.id "TERMINAL-LOBBY" must be 1 to 8 letters or digits.`,
+		`terminal.currency "usd" is not a 3 letter ISO 4217 code`,
+		"terminal.session_timeout 1s must be from 10s to 1h.",
+		"cash.cassettes cassette 1 holds 50 notes, the terminal only dispenses 20 notes.",
+		"limits.withdrawal 10.00 must allow at least one 20 note.",
+		"fees.overdraft -5.00 must not be negative.",
+	} {
+		assertErrorContains(t, err, expected)
+	}
+	// every problem is on its own line
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != 8 {
+		t.Errorf("Validation should report 8 problems. %s", err)
+	}
+
+	config = atm.DefaultConfig()
+	config.Cash.Cassettes = nil
+	assertErrorContains(t, config.Validate(), "cash.cassettes must load at least one cassette.")
+}
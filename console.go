@@ -1,207 +1,515 @@
 package atm
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type CommandRun func(*ATM, []string) error
-
-type ICommand interface {
-	Name() string
-	Run(*ATM, []string) error
-}
-
-type Command struct {
-	name     string
-	usage    string
-	function CommandRun
-}
-
-// Name shows the name of the command
-func (c Command) Name() string {
-	return c.name
-}
-
-// Run executes the command with the provided arguments
-// An error is returned when the command failed to run
-func (c Command) Run(atm *ATM, args []string) error {
-	err := c.function(atm, args)
+// output formats of the console
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
 
-	// Append usage if invalid command was provided
-	if err == ErrConsoleInvalidCommand {
-		return errors.New(ErrConsoleInvalidCommand.Error() + c.usage)
-	}
-	return err
+// Result is the structured outcome of a console command.
+// Message is the human readable text printed in text output
+type Result struct {
+	Command       string        `json:"command"`
+	AccountID     int           `json:"account_id,omitempty"`
+	Amount        float64       `json:"amount,omitempty"`
+	Balance       *float64      `json:"balance,omitempty"`
+	Overdrawn     bool          `json:"overdrawn,omitempty"`
+	TransactionID string        `json:"transaction_id,omitempty"`
+	Transactions  []Transaction `json:"transactions,omitempty"`
+	Receipt       *Receipt      `json:"receipt,omitempty"`
+	Message       string        `json:"message,omitempty"`
 }
 
 // DefaultCommands returns all of the commands valid in the console
 func DefaultCommands() []Command {
 	return []Command{
 		{
-			name:  "authorize",
-			usage: "authorize <account_id> <pin>",
-			function: func(atm *ATM, args []string) error {
-				if len(args) != 3 {
-					return ErrConsoleInvalidCommand
+			Name: "authorize",
+			Help: "Start a session for an account. The session expires after 2 minutes of inactivity.",
+			Args: []ArgSpec{
+				{Name: "account_id", Kind: ArgInt, Invalid: ErrAccountIDNotInteger},
+				{Name: "pin", Sensitive: true},
+			},
+			States: []FlowState{FlowIdle, FlowCardEject},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				accountID := args.Int("account_id")
+				err := authorize(atm, accountID, args.String("pin"))
+				if err == ErrAuthorizationUnsuccessful || err == ErrAccountNotFound {
+					return Result{}, ErrConsoleAuthorizationFailed
 				}
-
-				accountID, err := strconv.Atoi(args[1])
 				if err != nil {
-					return ErrAccountIDNotInteger
-				}
-
-				pin := args[2]
-
-				authorized := atm.Authorize(accountID, pin)
-				if !authorized {
-					return ErrConsoleAuthorizationFailed
+					return Result{}, err
 				}
-				fmt.Printf("%d successfully authorized.\n", accountID)
-				return nil
+				return Result{
+					AccountID: accountID,
+					Message:   fmt.Sprintf("%d successfully authorized.", accountID),
+				}, nil
 			},
 		},
 		{
-			name:  "withdraw",
-			usage: "withdraw <amount>",
-			function: func(atm *ATM, args []string) error {
-				if len(args) != 2 {
-					return ErrConsoleInvalidCommand
+			Name: "confirm",
+			Help: "Confirm the PIN of the authorized account when a withdrawal asks for it. An incorrect PIN ends the session.",
+			Args: []ArgSpec{
+				{Name: "pin", Sensitive: true},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				accountID := atm.Session.AccountID
+				err := atm.ConfirmPIN(args.String("pin"))
+				if err == ErrAuthorizationLocked {
+					endFlow(atm)
+					return Result{}, err
+				}
+				if err == ErrAuthorizationUnsuccessful {
+					endFlow(atm)
+					return Result{}, ErrConsoleAuthorizationFailed
 				}
-
-				amount, err := strconv.Atoi(args[1])
 				if err != nil {
-					return ErrConsoleInvalidAmount
+					return Result{}, err
 				}
-
-				overdrawn, err := atm.Withdraw(atm.Session.AccountID, amount)
+				return Result{
+					AccountID: accountID,
+					Message:   "PIN confirmed. Please repeat your withdrawal.",
+				}, nil
+			},
+		},
+		{
+			Name: "withdraw",
+			Help: "Withdraw a multiple of 20 from the authorized account. A retry with the same idempotency key is not dispensed twice.",
+			Args: []ArgSpec{
+				{Name: "amount", Kind: ArgInt, Invalid: ErrConsoleInvalidAmount},
+				{Name: "idempotency_key", Optional: true},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
+				}
+				amount := args.Int("amount")
+				overdrawn, err := atm.Withdraw(atm.Session.AccountID, amount, args.String("idempotency_key"))
 				if err != nil {
-					return err
+					return Result{}, err
 				}
 
 				newBalance, err := atm.Balance(atm.Session.AccountID)
 				if err != nil {
-					return err
+					return Result{}, err
 				}
 
-				fmt.Printf("Amount dispensed: %d\n", amount)
-				if overdrawn {
-					fmt.Printf("You have been charged an overdraft fee of $5. Current balance:  %.2f\n", newBalance)
-				} else {
-					fmt.Printf("Current balance: %.2f\n", newBalance)
+				completeTransaction(atm)
+				result := Result{
+					AccountID: atm.Session.AccountID,
+					Amount:    float64(amount),
+					Balance:   &newBalance,
+					Overdrawn: overdrawn,
 				}
-				return nil
+				switch fee := atm.LastFee(); {
+				case overdrawn:
+					result.Message = fmt.Sprintf("Amount dispensed: %d\nYour account is overdrawn and you have been charged %s in fees. Current balance:  %.2f", amount, FormatAmount(atm.Currency, fee), newBalance)
+				case fee > 0:
+					result.Message = fmt.Sprintf("Amount dispensed: %d\nYou have been charged a fee of %s. Current balance: %.2f", amount, FormatAmount(atm.Currency, fee), newBalance)
+				default:
+					result.Message = fmt.Sprintf("Amount dispensed: %d\nCurrent balance: %.2f", amount, newBalance)
+				}
+				result.Message += receiptOffer(atm)
+				return result, nil
 			},
 		},
 		{
-			name:  "deposit",
-			usage: "deposit <amount>",
-			function: func(atm *ATM, args []string) error {
-				if len(args) != 2 {
-					return ErrConsoleInvalidCommand
+			Name: "deposit",
+			Help: "Deposit an amount to the authorized account. A retry with the same idempotency key is not credited twice.",
+			Args: []ArgSpec{
+				{Name: "amount", Kind: ArgFloat, Invalid: ErrConsoleInvalidAmount},
+				{Name: "idempotency_key", Optional: true},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
 				}
-
-				amount, err := strconv.ParseFloat(args[1], 64)
+				amount := args.Float("amount")
+				err := atm.Deposit(atm.Session.AccountID, amount, args.String("idempotency_key"))
 				if err != nil {
-					return ErrConsoleInvalidAmount
+					return Result{}, err
 				}
 
-				err = atm.Deposit(atm.Session.AccountID, amount)
+				balance, err := atm.Balance(atm.Session.AccountID)
 				if err != nil {
-					return err
+					return Result{}, err
 				}
 
-				balance, err := atm.Balance(atm.Session.AccountID)
+				completeTransaction(atm)
+				return Result{
+					AccountID: atm.Session.AccountID,
+					Amount:    amount,
+					Balance:   &balance,
+					Message:   fmt.Sprintf("Current balance: %.2f", balance) + receiptOffer(atm),
+				}, nil
+			},
+		},
+		{
+			Name:   "receipt",
+			Help:   "Print and save the receipt of the last withdrawal or deposit.",
+			States: []FlowState{FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				receipt, err := atm.PrintReceipt()
 				if err != nil {
-					return err
+					return Result{}, err
 				}
-
-				fmt.Printf("Current balance: %.2f\n", balance)
-				return nil
+				return Result{
+					AccountID: receipt.AccountID,
+					Receipt:   &receipt,
+					Message:   receipt.Text(),
+				}, nil
 			},
 		},
 		{
-			name:  "balance",
-			usage: "balance",
-			function: func(atm *ATM, args []string) error {
+			Name:   "balance",
+			Help:   "Show the balance of the authorized account.",
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
+				}
 				balance, err := atm.Balance(atm.Session.AccountID)
 				if err != nil {
-					return err
+					return Result{}, err
 				}
 
-				fmt.Printf("Current balance: %.2f\n", balance)
-				return nil
+				return Result{
+					AccountID: atm.Session.AccountID,
+					Balance:   &balance,
+					Message:   fmt.Sprintf("Current balance: %.2f", balance),
+				}, nil
 			},
 		},
 		{
-			name:  "history",
-			usage: "history",
-			function: func(atm *ATM, args []string) error {
-				transactions := atm.History(atm.Session.AccountID)
+			Name: "history",
+			Help: "Show the transactions of the authorized account, most recent first. Filters are key=value pairs: from and to (YYYY-MM-DD), kind, min and max amount, limit, offset and order (asc or desc).",
+			Args: []ArgSpec{
+				{Name: "filters", Optional: true, Variadic: true},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
+				}
+				query, err := ParseHistoryFilters(atm.Session.AccountID, args.String("filters"))
+				if err != nil {
+					return Result{}, err
+				}
+				transactions, err := atm.QueryHistory(query)
+				if err != nil {
+					return Result{}, err
+				}
 				if len(transactions) == 0 {
-					fmt.Println("No history found")
-					return nil
+					return Result{Message: "No history found"}, nil
+				}
+
+				lines := []string{}
+				for _, transaction := range transactions {
+					t := time.Unix(transaction.DateTime, 0)
+					line := fmt.Sprintf("%s %.2f %.2f %s", t.Format("01-02-2006 15:04:05"), transaction.Amount, transaction.Balance, transaction.TransactionID)
+					lines = append(lines, strings.TrimSpace(line))
+				}
+				return Result{
+					AccountID:    atm.Session.AccountID,
+					Transactions: transactions,
+					Message:      strings.Join(lines, "\n"),
+				}, nil
+			},
+		},
+		{
+			Name: "ministatement",
+			Help: "Show the last transactions of the authorized account in receipt form, 10 if no count is given.",
+			Args: []ArgSpec{
+				{Name: "count", Kind: ArgInt, Optional: true},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
+				}
+				count := MiniStatementLength
+				if args.Has("count") {
+					count = args.Int("count")
+				}
+				if count < 1 {
+					return Result{}, fmt.Errorf("%w count", ErrConsoleInvalidArgument)
+				}
+
+				statement, err := atm.MiniStatement(count)
+				if err != nil {
+					return Result{}, err
+				}
+				return Result{
+					AccountID:    statement.AccountID,
+					Balance:      &statement.Balance,
+					Transactions: statement.Transactions,
+					Message:      statement.Text(),
+				}, nil
+			},
+		},
+		{
+			Name: "alerts",
+			Help: "Show the alerts of the authorized account, set them with an email and the low balance and large transaction amounts (0 disables one) or remove them with off.",
+			Args: []ArgSpec{
+				{Name: "email", Optional: true},
+				{Name: "low_balance", Kind: ArgFloat, Optional: true, Invalid: ErrAlertThresholdInvalid},
+				{Name: "large_transaction", Kind: ArgFloat, Optional: true, Invalid: ErrAlertThresholdInvalid},
+			},
+			States: []FlowState{FlowMenu, FlowReceipt},
+			Run: func(atm *ATM, args Args) (Result, error) {
+				if err := beginTransaction(atm); err != nil {
+					return Result{}, err
+				}
+				accountID := atm.Session.AccountID
+				if strings.EqualFold(args.String("email"), "off") {
+					if err := atm.SetAlerts(nil); err != nil {
+						return Result{}, err
+					}
+					return Result{AccountID: accountID, Message: "Alerts removed."}, nil
+				}
+
+				if args.Has("email") {
+					preferences := AlertPreferences{
+						Email:            args.String("email"),
+						LowBalance:       args.Float("low_balance"),
+						LargeTransaction: args.Float("large_transaction"),
+					}
+					if err := atm.SetAlerts(&preferences); err != nil {
+						return Result{}, err
+					}
+					return Result{AccountID: accountID, Message: "Alerts saved. " + preferences.String()}, nil
 				}
 
-				for i := len(transactions) - 1; i >= 0; i-- {
-					t := time.Unix(transactions[i].DateTime, 0)
-					fmt.Printf("%s %.2f %.2f\n", t.Format("01-02-2006 15:04:05"), transactions[i].Amount, transactions[i].Balance)
+				preferences, ok, err := atm.Alerts()
+				if err != nil {
+					return Result{}, err
+				}
+				if !ok {
+					return Result{AccountID: accountID, Message: "No alerts set up."}, nil
 				}
-				return nil
+				return Result{AccountID: accountID, Message: preferences.String()}, nil
 			},
 		},
 		{
-			name:  "logout",
-			usage: "logout",
-			function: func(atm *ATM, args []string) error {
+			Name: "logout",
+			Help: "End the session of the authorized account.",
+			Run: func(atm *ATM, args Args) (Result, error) {
 				accountID := atm.Session.AccountID
 				err := atm.Logout()
+				endFlow(atm)
 				if err != nil {
-					return errors.New("No account is currently authorized.")
+					return Result{}, ErrLogoutNoActiveSession
 				}
-				fmt.Printf("Account %d logged out.\n", accountID)
-				return nil
+				return Result{
+					AccountID: accountID,
+					Message:   fmt.Sprintf("Account %d logged out.", accountID),
+				}, nil
 			},
 		},
 		{
-			name:  "end",
-			usage: "end",
-			function: func(atm *ATM, args []string) error {
-				os.Exit(0)
-				return nil
+			Name:    "end",
+			Aliases: []string{"exit", "quit"},
+			Help:    "End the console.",
+			Run: func(atm *ATM, args Args) (Result, error) {
+				return Result{}, ErrConsoleEnd
 			},
 		},
 	}
 }
 
-// RunCommand will execute the command given the command string
-// If an invalid command is used then the help message is displayed
-func RunCommand(atm *ATM, command string) error {
-	args := strings.Split(command, " ")
-	if len(args) == 0 || args[0] == "" {
+// ParseHistoryFilters parses the filters of the history command into a query for the account, newest first by default.
+// e.g. from=2020-01-01 to=2020-01-31 kind=withdrawal min=20 max=100 limit=10 offset=10 order=asc
+// Dates are local and to includes the whole day. An error is returned if a filter is unknown or not valid
+func ParseHistoryFilters(accountID int, filters string) (HistoryQuery, error) {
+	query := HistoryQuery{AccountID: accountID, Order: SortNewestFirst}
+	for _, filter := range strings.Fields(filters) {
+		separator := strings.Index(filter, "=")
+		if separator < 1 {
+			return HistoryQuery{}, fmt.Errorf("%w filter %s is not key=value.", ErrHistoryQueryInvalid, filter)
+		}
+		key, value := strings.ToLower(filter[:separator]), filter[separator+1:]
+
+		var err error
+		switch key {
+		case "from", "to":
+			var date time.Time
+			date, err = time.ParseInLocation("2006-01-02", value, time.Local)
+			if key == "from" {
+				query.From = date.Unix()
+			} else {
+				query.To = date.AddDate(0, 0, 1).Unix() - 1
+			}
+		case "kind":
+			query.Kind = strings.ToLower(value)
+		case "min":
+			query.MinAmount, err = strconv.ParseFloat(value, 64)
+		case "max":
+			query.MaxAmount, err = strconv.ParseFloat(value, 64)
+		case "limit":
+			query.Limit, err = strconv.Atoi(value)
+		case "offset":
+			query.Offset, err = strconv.Atoi(value)
+		case "order":
+			query.Order = strings.ToLower(value)
+		default:
+			return HistoryQuery{}, fmt.Errorf("%w unknown filter %s.", ErrHistoryQueryInvalid, key)
+		}
+		if err != nil {
+			return HistoryQuery{}, fmt.Errorf("%w %s is not valid.", ErrHistoryQueryInvalid, key)
+		}
+	}
+	return query, query.Validate()
+}
+
+// receiptOffer returns the hint to print a receipt if one is offered
+func receiptOffer(atm *ATM) string {
+	if !atm.ReceiptOffered() {
+		return ""
+	}
+	return "\nType receipt to print a receipt."
+}
+
+// authorize inserts the card and enters the PIN in the customer flow.
+// The console has no card to take so the flow returns to idle if the PIN is not accepted
+func authorize(atm *ATM, accountID int, pin string) error {
+	if atm.Flow == nil {
+		return atm.Authorize(accountID, pin)
+	}
+	if atm.Flow.State == FlowCardEject {
+		atm.Flow.TakeCard()
+	}
+	if err := atm.Flow.InsertCard(accountID); err != nil {
+		return err
+	}
+	err := atm.Flow.EnterPIN(atm, pin)
+	if err != nil {
+		endFlow(atm)
+	}
+	return err
+}
+
+// beginTransaction returns to the menu of the customer flow before a transaction
+func beginTransaction(atm *ATM) error {
+	if atm.Flow == nil {
 		return nil
 	}
+	return atm.Flow.BeginTransaction(atm)
+}
 
-	commands := DefaultCommands()
-	found := false
-	for _, c := range commands {
-		if c.Name() == strings.ToLower(args[0]) {
-			found = true
-			return c.Run(atm, args)
+// completeTransaction offers the receipt after a withdrawal or deposit
+func completeTransaction(atm *ATM) {
+	if atm.Flow != nil {
+		atm.Flow.CompleteTransaction()
+	}
+}
+
+// endFlow ejects the card and takes it, returning the customer flow to idle
+func endFlow(atm *ATM) {
+	if atm.Flow == nil || atm.Flow.State == FlowIdle {
+		return
+	}
+	if atm.Flow.State != FlowCardEject {
+		atm.Flow.EjectCard(atm)
+	}
+	atm.Flow.TakeCard()
+}
+
+// ExecuteCommand executes the command given the command string with the default registry and returns its result without printing it
+func ExecuteCommand(atm *ATM, command string) (Result, error) {
+	return sharedRegistry().Execute(atm, command)
+}
+
+// Console runs commands against an ATM and writes their results to an output writer
+type Console struct {
+	ATM    *ATM
+	Output io.Writer
+	// Format of the results, OutputText if empty or OutputJSON
+	Format string
+	// Registry of the commands, the default commands are used if not set
+	Registry *Registry
+}
+
+// Run will execute the command given the command string and write its result in the output format
+// ErrConsoleEnd is returned if the command ends the console, the caller decides how to stop
+func (c *Console) Run(command string) error {
+	if strings.TrimSpace(command) == "" {
+		return nil
+	}
+
+	registry := c.Registry
+	if registry == nil {
+		registry = sharedRegistry()
+	}
+	result, err := registry.Execute(c.ATM, command)
+	if c.Format == OutputJSON {
+		failure := err
+		// ending the console is not a failure of the command
+		if err == ErrConsoleEnd {
+			failure = nil
 		}
+		if writeErr := WriteJSONResult(c.Output, result, failure); writeErr != nil {
+			c.ATM.logger().Error("result not written", LogKeyCommand, result.Command, logError(writeErr))
+			return writeErr
+		}
+		return err
 	}
 
-	if !found {
-		fmt.Println("Command Usage:")
-		for _, c := range commands {
-			fmt.Println(c.usage)
+	if result.Message != "" {
+		if _, writeErr := fmt.Fprintln(c.Output, result.Message); writeErr != nil {
+			c.ATM.logger().Error("result not written", LogKeyCommand, result.Command, logError(writeErr))
+			return writeErr
 		}
-		return errors.New("Invalid command")
 	}
+	return err
+}
+
+// RunCommand will execute the command given the command string and write its result as text to the writer
+func RunCommand(atm *ATM, w io.Writer, command string) error {
+	console := &Console{ATM: atm, Output: w}
+	return console.Run(command)
+}
+
+// jsonError is an error in machine readable output
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonResult is a result or an error written as one JSON document
+type jsonResult struct {
+	OK bool `json:"ok"`
+	*Result
+	Error *jsonError `json:"error,omitempty"`
+}
+
+// newJSONResult returns the document of a result, only the command is kept if there is an error
+func newJSONResult(result Result, err error) jsonResult {
+	document := jsonResult{OK: err == nil, Result: &result}
+	if err != nil {
+		document.Result = &Result{Command: result.Command}
+		document.Error = &jsonError{
+			Code:    ErrorCode(err),
+			Message: err.Error(),
+		}
+	}
+	return document
+}
 
-	return nil
+// WriteJSONResult writes the result of a command, or its error with a stable error code, as one line of JSON
+func WriteJSONResult(w io.Writer, result Result, err error) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(newJSONResult(result, err))
 }
@@ -1,7 +1,11 @@
 package atm_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,28 +17,57 @@ func TestConsoleAuthorize(t *testing.T) {
 	testATM := &a
 
 	// Invalid authorize command
-	err := atm.RunCommand(testATM, "authorize")
+	err := atm.RunCommand(testATM, io.Discard, "authorize")
 	assertErrorContains(t, err, atm.ErrConsoleInvalidCommand.Error())
 
 	// authorize with invalid account ID
-	err = atm.RunCommand(testATM, "authorize string 6783")
+	err = atm.RunCommand(testATM, io.Discard, "authorize string 6783")
 	assertErrorIsError(t, err, atm.ErrAccountIDNotInteger)
 
 	// authorize successfully
-	err = atm.RunCommand(testATM, fmt.Sprintf("authorize %d %s", defaultAccount.AccountID, defaultAccount.PIN))
+	err = atm.RunCommand(testATM, io.Discard, fmt.Sprintf("authorize %d %s", defaultAccount.AccountID, defaultAccount.PIN))
 	assertNoError(t, err)
 }
 
+func TestConsolePINAttempts(t *testing.T) {
+	bus := &atm.EventBus{}
+	lockouts := 0
+	bus.Subscribe(func(event atm.Event) error {
+		lockouts++
+		return nil
+	}, atm.EventLockout)
+	testATM := newTestFlowATM(t)
+	testATM.Events = bus
+
+	// every authorize inserts the card again but the incorrect PINs are counted by the host
+	for i := 1; i < atm.MaxPINAttempts; i++ {
+		err := atm.RunCommand(testATM, io.Discard, "authorize 12345678 0000")
+		assertErrorIsError(t, err, atm.ErrConsoleAuthorizationFailed)
+	}
+	err := atm.RunCommand(testATM, io.Discard, "authorize 12345678 0000")
+	assertErrorIsError(t, err, atm.ErrFlowPINAttempts)
+	if lockouts != 1 {
+		t.Errorf("Lockout was not published. %d", lockouts)
+	}
+
+	// the account stays locked for the correct PIN
+	err = atm.RunCommand(testATM, io.Discard, "authorize 12345678 1234")
+	assertErrorIsError(t, err, atm.ErrFlowPINAttempts)
+	if testATM.Session.AccountID != 0 {
+		t.Errorf("Locked account should not be authorized")
+	}
+}
+
 func TestConsoleWithdraw(t *testing.T) {
 	a := defaultTestATM()
 	testATM := &a
 
 	// invalid withdraw command
-	err := atm.RunCommand(testATM, "withdraw")
+	err := atm.RunCommand(testATM, io.Discard, "withdraw")
 	assertErrorContains(t, err, atm.ErrConsoleInvalidCommand.Error())
 
 	// withdraw with invalid amount
-	err = atm.RunCommand(testATM, "withdraw abc")
+	err = atm.RunCommand(testATM, io.Discard, "withdraw abc")
 	assertErrorIsError(t, err, atm.ErrConsoleInvalidAmount)
 
 	// with with valid amount
@@ -42,7 +75,7 @@ func TestConsoleWithdraw(t *testing.T) {
 		LastActivity: time.Now().Unix(),
 		AccountID:    defaultAccount.AccountID,
 	}
-	err = atm.RunCommand(testATM, "withdraw 20")
+	err = atm.RunCommand(testATM, io.Discard, "withdraw 20")
 	assertNoError(t, err)
 }
 
@@ -51,11 +84,11 @@ func TestConsoleDeposit(t *testing.T) {
 	testATM := &a
 
 	// invalid deposit command
-	err := atm.RunCommand(testATM, "deposit")
+	err := atm.RunCommand(testATM, io.Discard, "deposit")
 	assertErrorContains(t, err, atm.ErrConsoleInvalidCommand.Error())
 
 	// invalid deposit amount
-	err = atm.RunCommand(testATM, "deposit invalid")
+	err = atm.RunCommand(testATM, io.Discard, "deposit invalid")
 	assertErrorIsError(t, err, atm.ErrConsoleInvalidAmount)
 
 	// successful deposit
@@ -63,7 +96,7 @@ func TestConsoleDeposit(t *testing.T) {
 		LastActivity: time.Now().Unix(),
 		AccountID:    defaultAccount.AccountID,
 	}
-	err = atm.RunCommand(testATM, "deposit 20")
+	err = atm.RunCommand(testATM, io.Discard, "deposit 20")
 	assertNoError(t, err)
 }
 
@@ -75,7 +108,7 @@ func TestConsoleBalance(t *testing.T) {
 		AccountID:    defaultAccount.AccountID,
 	}
 
-	err := atm.RunCommand(testATM, "balance")
+	err := atm.RunCommand(testATM, io.Discard, "balance")
 	assertNoError(t, err)
 }
 
@@ -87,7 +120,7 @@ func TestConsoleHistory(t *testing.T) {
 		AccountID:    defaultAccount.AccountID,
 	}
 
-	err := atm.RunCommand(testATM, "history")
+	err := atm.RunCommand(testATM, io.Discard, "history")
 	assertNoError(t, err)
 }
 
@@ -99,6 +132,156 @@ func TestConsoleLogoff(t *testing.T) {
 		AccountID:    defaultAccount.AccountID,
 	}
 
-	err := atm.RunCommand(testATM, "logout")
+	err := atm.RunCommand(testATM, io.Discard, "logout")
+	assertNoError(t, err)
+}
+
+func TestConsoleReverse(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+	testATM.Authorize(12345678, "1234")
+	_, err := testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	transactionID := testATM.History(12345678)[0].TransactionID
+
+	// reversals are run by a supervisor, never by a customer at the console
+	err = atm.RunCommand(testATM, io.Discard, "reverse "+transactionID+" cash failed to dispense")
+	if !errors.Is(err, atm.ErrConsoleUnknownCommand) {
+		t.Errorf("Reverse should not be a console command. %v", err)
+	}
+	if testATM.ATMBalance != 180 || len(testATM.History(12345678)) != 1 {
+		t.Errorf("Withdrawal should not be reversed. %.2f", testATM.ATMBalance)
+	}
+}
+
+func TestConsoleOutputJSON(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	output := &bytes.Buffer{}
+	console := &atm.Console{
+		ATM:    &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}},
+		Output: output,
+		Format: atm.OutputJSON,
+	}
+
+	assertNoError(t, console.Run("authorize 12345678 1234"))
+	assertNoError(t, console.Run("withdraw 40"))
+	err := console.Run("withdraw 15")
+	assertErrorIsError(t, err, atm.ErrWithdrawAmountNoMultipleOf20)
+	err = console.Run("withdraw")
+	assertErrorContains(t, err, atm.ErrConsoleInvalidCommand.Error())
+	err = console.Run("end")
+	assertErrorIsError(t, err, atm.ErrConsoleEnd)
+
+	expected := []string{
+		`{"ok":true,"command":"authorize","account_id":12345678,"message":"12345678 successfully authorized."}`,
+		`{"ok":true,"command":"withdraw","account_id":12345678,"amount":40,"balance":60,"message":"Amount dispensed: 40\nCurrent balance: 60.00"}`,
+		`{"ok":false,"command":"withdraw","error":{"code":"withdraw_amount_no_multiple_of_20","message":"Unable to process since amount is not a multiple of 20."}}`,
+		`{"ok":false,"command":"withdraw","error":{"code":"console_invalid_command","message":"Invalid command. e.g. withdraw <amount> [idempotency_key]"}}`,
+		`{"ok":true,"command":"end"}`,
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Invalid number of results. %s", output.String())
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Errorf("Result is incorrect. %s should be %s", lines[i], expected[i])
+		}
+	}
+}
+
+func TestConsoleText(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+	output := &bytes.Buffer{}
+
+	assertNoError(t, atm.RunCommand(testATM, output, "authorize 12345678 1234"))
+	assertNoError(t, atm.RunCommand(testATM, output, "withdraw 40"))
+	err := atm.RunCommand(testATM, output, "end")
+	assertErrorIsError(t, err, atm.ErrConsoleEnd)
+
+	expected := "12345678 successfully authorized.\nAmount dispensed: 40\nCurrent balance: 60.00\n"
+	if output.String() != expected {
+		t.Errorf("Output is incorrect. %q", output.String())
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := atm.ErrorCode(atm.ErrAccountNotFound); code != "account_not_found" {
+		t.Errorf("Error code is incorrect. %s", code)
+	}
+	// wrapped sentinel errors keep their code
+	if code := atm.ErrorCode(fmt.Errorf("%w disk is full", atm.ErrHostStoreUnavailable)); code != "host_store_unavailable" {
+		t.Errorf("Error code is incorrect. %s", code)
+	}
+	if code := atm.ErrorCode(errors.New("unexpected")); code != atm.ErrorCodeInternal {
+		t.Errorf("Error code is incorrect. %s", code)
+	}
+}
+
+func TestConsoleHistoryFilters(t *testing.T) {
+	day := time.Date(2020, 10, 19, 12, 0, 0, 0, time.Local).Unix()
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", fmt.Sprintf(""+
+		"12345678,%d,-20.00,80.00,A,withdrawal,0.00,,\n"+
+		"12345678,%d,50.00,130.00,B,deposit,0.00,,\n"+
+		"12345678,%d,-100.00,30.00,C,withdrawal,0.00,,\n", day-86400, day, day+86400))
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+
+	ids := func(command string) string {
+		result, err := atm.ExecuteCommand(testATM, command)
+		assertNoError(t, err)
+		ids := ""
+		for _, transaction := range result.Transactions {
+			ids += transaction.TransactionID
+		}
+		return ids
+	}
+	if result := ids("history"); result != "CBA" {
+		t.Errorf("History should be most recent first. %s", result)
+	}
+	if result := ids("history from=2020-10-19 to=2020-10-19"); result != "B" {
+		t.Errorf("Date range is incorrect. %s", result)
+	}
+	if result := ids("history kind=withdrawal order=asc limit=1"); result != "A" {
+		t.Errorf("Kind, order and limit are incorrect. %s", result)
+	}
+	if result := ids("history min=50 offset=1"); result != "B" {
+		t.Errorf("Amount and offset are incorrect. %s", result)
+	}
+
+	_, err := atm.ExecuteCommand(testATM, "history colour=red")
+	assertErrorContains(t, err, "unknown filter colour")
+	_, err = atm.ExecuteCommand(testATM, "history from=yesterday")
+	if atm.ErrorCode(err) != "history_query_invalid" {
+		t.Errorf("Error code is incorrect. %v", err)
+	}
+}
+
+func TestConsoleMiniStatement(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}, TerminalID: "ATM00001"}
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+	for _, command := range []string{"withdraw 20", "deposit 10", "withdraw 40"} {
+		assertNoError(t, atm.RunCommand(testATM, io.Discard, command))
+	}
+
+	result, err := atm.ExecuteCommand(testATM, "ministatement 2")
+	assertNoError(t, err)
+	if len(result.Transactions) != 2 || result.Transactions[0].Amount != 10 || result.Transactions[1].Amount != -40 {
+		t.Errorf("Mini statement should show the last transactions oldest first. %+v", result.Transactions)
+	}
+	for _, expected := range []string{"MINI STATEMENT", "ATM00001", "****5678", "DEPOSIT", "-40.00", "AVAILABLE BALANCE         $50.00"} {
+		if !strings.Contains(result.Message, expected) {
+			t.Errorf("Mini statement does not contain %s.\n%s", expected, result.Message)
+		}
+	}
+
+	result, err = atm.ExecuteCommand(testATM, "ministatement")
 	assertNoError(t, err)
+	if len(result.Transactions) != 3 {
+		t.Errorf("Mini statement should show every transaction. %d", len(result.Transactions))
+	}
+	_, err = atm.ExecuteCommand(testATM, "ministatement 0")
+	assertError(t, err)
 }
@@ -4,10 +4,14 @@ import (
 	"errors"
 )
 
+// ErrorCodeInternal is the code of errors that are not one of the sentinel errors
+const ErrorCodeInternal = "internal_error"
+
 // authorize errors
 var (
 	ErrAuthorizationUnsuccessful = errors.New("Authorization failed.")
 	ErrAuthorizationRequired     = errors.New("Authorization required.")
+	ErrAuthorizationLocked       = errors.New("Too many incorrect PIN attempts. The card is locked, please try again later.")
 )
 
 // withdraw errors
@@ -16,6 +20,7 @@ var (
 	ErrWithdrawATMNoFunds           = errors.New("Unable to process your withdrawal at this time.")
 	ErrWithdrawAccountOverdrawn     = errors.New("Your account is overdrawn! You may not make withdrawals at this time.")
 	ErrWithdrawAmountNoMultipleOf20 = errors.New("Unable to process since amount is not a multiple of 20.")
+	ErrWithdrawLimitExceeded        = errors.New("Amount is over the withdrawal limit of this ATM.")
 )
 
 // logout errors
@@ -36,6 +41,58 @@ var (
 	ErrTransactionDateTimeNotInteger  = errors.New("Datetime is not an integer")
 	ErrTransactionAmounteNotFloat     = errors.New("Amount is not a float")
 	ErrTransactionBalanceNotFloat     = errors.New("Balance is not a float")
+	ErrTransactionFeeNotFloat         = errors.New("Fee is not a float")
+	ErrTransactionSequenceNotInteger  = errors.New("Sequence is not an integer")
+)
+
+// ledger error
+var (
+	ErrLedgerTampered    = errors.New("Transaction ledger failed verification:")
+	ErrLedgerNotMigrated = errors.New("Transaction ledger was written before the hash chain, run atm migrate apply before adding transactions.")
+)
+
+// history error
+var (
+	ErrHistoryQueryInvalid = errors.New("History query is not valid:")
+)
+
+// alert error
+var (
+	ErrAlertsUnavailable     = errors.New("Alerts are not available at this ATM.")
+	ErrAlertEmailInvalid     = errors.New("Alert email address is not valid.")
+	ErrAlertThresholdInvalid = errors.New("Alert amounts must not be negative.")
+)
+
+// risk error
+var (
+	ErrRiskDeclined       = errors.New("Withdrawal declined for your security. Please contact your bank.")
+	ErrRiskStepUpRequired = errors.New("Please confirm your PIN to continue.")
+	ErrRiskRuleInvalid    = errors.New("Risk rule is not valid:")
+)
+
+// config error
+var (
+	ErrConfigInvalid = errors.New("Configuration is not valid:")
+)
+
+// logging error
+var (
+	ErrLogLevelInvalid  = errors.New("Log level is not debug, info, warn or error")
+	ErrLogFormatInvalid = errors.New("Log format is not text or json")
+)
+
+// statement error
+var (
+	ErrStatementInvalidPeriod = errors.New("Statement period is not valid:")
+	ErrStatementUnknownFormat = errors.New("Statement format is not supported:")
+)
+
+// reversal error
+var (
+	ErrTransactionNotFound        = errors.New("Transaction could not be found in database.")
+	ErrTransactionAlreadyReversed = errors.New("Transaction has already been reversed.")
+	ErrTransactionNotReversible   = errors.New("Transaction cannot be reversed.")
+	ErrReversalInvalidRequest     = errors.New("Reversal requires a reason and the operator reversing it.")
 )
 
 // session error
@@ -50,4 +107,161 @@ var (
 	ErrConsoleInvalidCommand      = errors.New("Invalid command. e.g. ")
 	ErrConsoleAuthorizationFailed = errors.New("Authorization failed.")
 	ErrConsoleInvalidAmount       = errors.New("Amount is not a valid")
+	ErrConsoleUnknownCommand      = errors.New("Invalid command")
+	ErrConsoleInvalidArgument     = errors.New("Argument is not valid:")
+	// ErrConsoleEnd is returned by the end command to signal the caller to stop reading commands
+	ErrConsoleEnd = errors.New("Console ended.")
 )
+
+// registry error
+var (
+	ErrRegistryInvalidCommand = errors.New("Command must have a name without spaces, a run function and valid argument specs.")
+	ErrRegistryCommandExists  = errors.New("Command name or alias is already registered:")
+)
+
+// customer flow error
+var (
+	ErrFlowInvalidTransition = errors.New("Customer flow cannot move")
+	ErrFlowNotAllowed        = errors.New("Not allowed while the ATM is")
+	ErrFlowTimedOut          = errors.New("Timed out. Please take your card.")
+	ErrFlowPINAttempts       = errors.New("Too many incorrect PIN attempts. Please take your card.")
+)
+
+// receipt error
+var (
+	ErrReceiptNotAvailable       = errors.New("No receipt is available. Receipts are offered after a withdrawal or deposit.")
+	ErrReceiptPrinterUnavailable = errors.New("Receipts are not available at this ATM.")
+	ErrReceiptSequenceNotInteger = errors.New("Receipt sequence is not an integer")
+	ErrReceiptTerminalIDInvalid  = errors.New("Receipts are not saved for a terminal ID that is not letters and digits:")
+)
+
+// iso 8583 error
+var (
+	ErrISOInvalidMTI        = errors.New("Message type indicator is not valid.")
+	ErrISOMalformedMessage  = errors.New("ISO 8583 message is malformed.")
+	ErrISOUnknownField      = errors.New("ISO 8583 field is not supported.")
+	ErrISOInvalidFieldValue = errors.New("ISO 8583 field value is not valid.")
+	ErrISOFieldTooLong      = errors.New("ISO 8583 field value is too long.")
+	ErrISOUnsupportedMTI    = errors.New("ISO 8583 message type is not supported by the host.")
+)
+
+// host error
+var (
+	ErrHostUnavailable = errors.New("Host is unavailable. Please try again later.")
+	ErrHostDeclined    = errors.New("Transaction declined by host.")
+	// ErrHostNoResponse is returned if a request was sent but the host did not answer, it may have been posted
+	ErrHostNoResponse = errors.New("Host did not respond. The transaction was not completed.")
+	// ErrHostStoreUnavailable wraps failures to read or write the host databases
+	ErrHostStoreUnavailable = errors.New("Host database is unavailable.")
+)
+
+// stand-in error
+var (
+	ErrStandInLimitExceeded     = errors.New("Host is unavailable. Withdrawal is over the offline limit.")
+	ErrStandInNoBalance         = errors.New("Host is unavailable. No known balance for the account.")
+	ErrStandInInsufficientFunds = errors.New("Host is unavailable. Withdrawal is more than the last known balance.")
+)
+
+// idempotency error
+var (
+	ErrIdempotencyKeyInvalid  = errors.New("Idempotency key is not valid. It must be at most 64 characters without commas or spaces.")
+	ErrIdempotencyKeyMismatch = errors.New("Idempotency key was already used for a different transaction.")
+)
+
+// script error
+var (
+	ErrScriptInvalidRequest = errors.New("Script request is not a valid JSON command.")
+)
+
+// errorCodes are the stable codes of the sentinel errors used in machine readable output.
+// Codes must never change once released, new sentinel errors are added to the end
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrAuthorizationUnsuccessful, "authorization_unsuccessful"},
+	{ErrAuthorizationRequired, "authorization_required"},
+	{ErrAuthorizationLocked, "authorization_locked"},
+	{ErrWithdrawATMInsufficientFunds, "withdraw_atm_insufficient_funds"},
+	{ErrWithdrawATMNoFunds, "withdraw_atm_no_funds"},
+	{ErrWithdrawAccountOverdrawn, "withdraw_account_overdrawn"},
+	{ErrWithdrawAmountNoMultipleOf20, "withdraw_amount_no_multiple_of_20"},
+	{ErrLogoutNoActiveSession, "logout_no_active_session"},
+	{ErrAccountNotFound, "account_not_found"},
+	{ErrAccountIDNotInteger, "account_id_not_integer"},
+	{ErrAccountBalanceNotFloat, "account_balance_not_float"},
+	{ErrTransactionAccountIDNotInteger, "transaction_account_id_not_integer"},
+	{ErrTransactionDateTimeNotInteger, "transaction_date_time_not_integer"},
+	{ErrTransactionAmounteNotFloat, "transaction_amount_not_float"},
+	{ErrTransactionBalanceNotFloat, "transaction_balance_not_float"},
+	{ErrTransactionFeeNotFloat, "transaction_fee_not_float"},
+	{ErrTransactionNotFound, "transaction_not_found"},
+	{ErrTransactionAlreadyReversed, "transaction_already_reversed"},
+	{ErrTransactionNotReversible, "transaction_not_reversible"},
+	{ErrReversalInvalidRequest, "reversal_invalid_request"},
+	{ErrSessionNoActiveSession, "session_no_active_session"},
+	{ErrSessionInvalidAccountID, "session_invalid_account_id"},
+	{ErrSessionTimedOut, "session_timed_out"},
+	{ErrConsoleInvalidCommand, "console_invalid_command"},
+	{ErrConsoleAuthorizationFailed, "console_authorization_failed"},
+	{ErrConsoleInvalidAmount, "console_invalid_amount"},
+	{ErrConsoleUnknownCommand, "console_unknown_command"},
+	{ErrISOInvalidMTI, "iso_invalid_mti"},
+	{ErrISOMalformedMessage, "iso_malformed_message"},
+	{ErrISOUnknownField, "iso_unknown_field"},
+	{ErrISOInvalidFieldValue, "iso_invalid_field_value"},
+	{ErrISOFieldTooLong, "iso_field_too_long"},
+	{ErrISOUnsupportedMTI, "iso_unsupported_mti"},
+	{ErrHostUnavailable, "host_unavailable"},
+	{ErrHostDeclined, "host_declined"},
+	{ErrHostNoResponse, "host_no_response"},
+	{ErrHostStoreUnavailable, "host_store_unavailable"},
+	{ErrStandInLimitExceeded, "stand_in_limit_exceeded"},
+	{ErrStandInNoBalance, "stand_in_no_balance"},
+	{ErrStandInInsufficientFunds, "stand_in_insufficient_funds"},
+	{ErrIdempotencyKeyInvalid, "idempotency_key_invalid"},
+	{ErrIdempotencyKeyMismatch, "idempotency_key_mismatch"},
+	{ErrScriptInvalidRequest, "script_invalid_request"},
+	{ErrConsoleEnd, "console_end"},
+	{ErrConsoleInvalidArgument, "console_invalid_argument"},
+	{ErrRegistryInvalidCommand, "registry_invalid_command"},
+	{ErrRegistryCommandExists, "registry_command_exists"},
+	{ErrFlowInvalidTransition, "flow_invalid_transition"},
+	{ErrFlowNotAllowed, "flow_not_allowed"},
+	{ErrFlowTimedOut, "flow_timed_out"},
+	{ErrFlowPINAttempts, "flow_pin_attempts"},
+	{ErrReceiptNotAvailable, "receipt_not_available"},
+	{ErrReceiptPrinterUnavailable, "receipt_printer_unavailable"},
+	{ErrReceiptSequenceNotInteger, "receipt_sequence_not_integer"},
+	{ErrReceiptTerminalIDInvalid, "receipt_terminal_id_invalid"},
+	{ErrHistoryQueryInvalid, "history_query_invalid"},
+	{ErrStatementInvalidPeriod, "statement_invalid_period"},
+	{ErrStatementUnknownFormat, "statement_unknown_format"},
+	{ErrTransactionSequenceNotInteger, "transaction_sequence_not_integer"},
+	{ErrLedgerTampered, "ledger_tampered"},
+	{ErrLedgerNotMigrated, "ledger_not_migrated"},
+	{ErrLogLevelInvalid, "log_level_invalid"},
+	{ErrLogFormatInvalid, "log_format_invalid"},
+	{ErrAlertsUnavailable, "alerts_unavailable"},
+	{ErrAlertEmailInvalid, "alert_email_invalid"},
+	{ErrAlertThresholdInvalid, "alert_threshold_invalid"},
+	{ErrRiskDeclined, "risk_declined"},
+	{ErrRiskStepUpRequired, "risk_step_up_required"},
+	{ErrRiskRuleInvalid, "risk_rule_invalid"},
+	{ErrConfigInvalid, "config_invalid"},
+	{ErrWithdrawLimitExceeded, "withdraw_limit_exceeded"},
+}
+
+// ErrorCode returns the stable code of the sentinel error wrapped by err.
+// ErrorCodeInternal is returned for any other error and an empty code for nil
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return ErrorCodeInternal
+}
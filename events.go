@@ -0,0 +1,156 @@
+package atm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	EventWithdrawal = "withdrawal"
+	EventDeposit    = "deposit"
+	EventReversal   = "reversal"
+	// EventLockout is published when a card is ejected after MaxPINAttempts incorrect PINs
+	EventLockout = "lockout"
+	// EventLowCash is published when the cash of the terminal falls below LowCashThreshold
+	EventLowCash = "low_cash"
+)
+
+// Event is published after money moved or the terminal needs attention
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	TerminalID string    `json:"terminal_id,omitempty"`
+	AccountID  int       `json:"account_id,omitempty"`
+	Amount     float64   `json:"amount,omitempty"`
+	Fee        float64   `json:"fee,omitempty"`
+	// Balance of the account after the transaction
+	Balance       *float64 `json:"balance,omitempty"`
+	TransactionID string   `json:"transaction_id,omitempty"`
+	// ReversalOf is the transaction ID a reversal compensates
+	ReversalOf string `json:"reversal_of,omitempty"`
+	// StandIn is true if the withdrawal was approved by the terminal while the host was unavailable
+	StandIn bool `json:"stand_in,omitempty"`
+	// Cash left in the terminal
+	Cash float64 `json:"cash,omitempty"`
+}
+
+// IEventPublisher receives the events of a terminal.
+// Return an error if the event could not be accepted, the transaction that published it has already been committed
+type IEventPublisher interface {
+	Publish(Event) error
+}
+
+// publish stamps the event and hands it to the publisher of the terminal.
+// Failures are logged and never fail the transaction that published the event
+func (atm *ATM) publish(event Event) {
+	if atm == nil || atm.Events == nil {
+		return
+	}
+	event.ID = newEventID()
+	event.Time = time.Now()
+	event.TerminalID = atm.TerminalID
+	if err := atm.Events.Publish(event); err != nil {
+		atm.logger().Error("event not published", "event", event.Type, "event_id", event.ID, LogKeyTransactionID, event.TransactionID, logError(err))
+	}
+}
+
+// publishTransaction publishes a withdrawal, deposit or reversal posted by the host
+func (atm *ATM) publishTransaction(eventType string, accountID int, amount float64, result HostResult) {
+	balance := result.Balance
+	atm.publish(Event{
+		Type:          eventType,
+		AccountID:     accountID,
+		Amount:        amount,
+		Fee:           result.Fee,
+		Balance:       &balance,
+		TransactionID: result.TransactionID,
+	})
+}
+
+// dispense takes cash out of the terminal and publishes EventLowCash when the cash falls below LowCashThreshold
+func (atm *ATM) dispense(amount float64) {
+	before := atm.ATMBalance
+	atm.ATMBalance = atm.ATMBalance - amount
+	atm.Metrics.observeDispensed(amount)
+	atm.observeCash()
+	if atm.LowCashThreshold > 0 && before >= atm.LowCashThreshold && atm.ATMBalance < atm.LowCashThreshold {
+		atm.publish(Event{Type: EventLowCash, Cash: atm.ATMBalance})
+	}
+}
+
+// newEventID returns a random 16 character event ID receivers can deduplicate deliveries with
+func newEventID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// EventBus publishes events to the subscribers in the same process in the order they subscribed
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers []eventSubscriber
+	next        int
+}
+
+type eventSubscriber struct {
+	id      int
+	types   []string
+	handler func(Event) error
+}
+
+// Subscribe calls the handler with every event of the types, or with every event if no type is given.
+// The returned function removes the subscriber
+func (b *EventBus) Subscribe(handler func(Event) error, types ...string) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.next++
+	id := b.next
+	b.subscribers = append(b.subscribers, eventSubscriber{id: id, types: types, handler: handler})
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for i, subscriber := range b.subscribers {
+			if subscriber.id == id {
+				b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish calls every subscriber of the event type, a failing subscriber does not stop the others
+// The errors of the subscribers are returned joined
+func (b *EventBus) Publish(event Event) error {
+	b.mutex.Lock()
+	subscribers := append([]eventSubscriber{}, b.subscribers...)
+	b.mutex.Unlock()
+
+	errs := []error{}
+	for _, subscriber := range subscribers {
+		if !subscriber.accepts(event.Type) {
+			continue
+		}
+		if err := subscriber.handler(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s eventSubscriber) accepts(eventType string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
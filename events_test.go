@@ -0,0 +1,115 @@
+package atm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestEventsPublished(t *testing.T) {
+	bus := &atm.EventBus{}
+	events := []atm.Event{}
+	bus.Subscribe(func(event atm.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	testATM := newTestFlowATM(t)
+	testATM.TerminalID = "ATM00001"
+	testATM.Events = bus
+	testATM.LowCashThreshold = 150
+
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+	_, err := testATM.Withdraw(12345678, 40, "withdraw-1")
+	assertNoError(t, err)
+	// a replay moves no money
+	_, err = testATM.Withdraw(12345678, 40, "withdraw-1")
+	assertNoError(t, err)
+	_, err = testATM.Withdraw(12345678, 500)
+	assertError(t, err)
+	assertNoError(t, testATM.Deposit(12345678, 10))
+	// the cash falls below 150 once
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+
+	expected := []string{atm.EventWithdrawal, atm.EventDeposit, atm.EventWithdrawal, atm.EventLowCash, atm.EventWithdrawal}
+	if len(events) != len(expected) {
+		t.Fatalf("Events are incorrect. %+v", events)
+	}
+	for i, eventType := range expected {
+		if events[i].Type != eventType || events[i].ID == "" || events[i].TerminalID != "ATM00001" || events[i].Time.IsZero() {
+			t.Errorf("Event %d should be %s but got %+v", i, eventType, events[i])
+		}
+	}
+	withdrawal := events[0]
+	if withdrawal.AccountID != 12345678 || withdrawal.Amount != 40 || withdrawal.Balance == nil || *withdrawal.Balance != 60 || withdrawal.TransactionID == "" {
+		t.Errorf("Withdrawal event is incorrect. %+v", withdrawal)
+	}
+	if events[3].Cash != 140 {
+		t.Errorf("Low cash event is incorrect. %+v", events[3])
+	}
+
+	reversalID, err := testATM.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertNoError(t, err)
+	reversal := events[len(events)-1]
+	if reversal.Type != atm.EventReversal || reversal.TransactionID != reversalID || reversal.ReversalOf != withdrawal.TransactionID || reversal.AccountID != 12345678 {
+		t.Errorf("Reversal event is incorrect. %+v", reversal)
+	}
+}
+
+func TestEventsLockout(t *testing.T) {
+	bus := &atm.EventBus{}
+	lockouts := 0
+	bus.Subscribe(func(event atm.Event) error {
+		lockouts++
+		if event.AccountID != 12345678 {
+			t.Errorf("Lockout event is incorrect. %+v", event)
+		}
+		return nil
+	}, atm.EventLockout)
+	testATM := newTestFlowATM(t)
+	testATM.Events = bus
+
+	assertNoError(t, testATM.Flow.InsertCard(12345678))
+	for i := 0; i < atm.MaxPINAttempts-1; i++ {
+		assertErrorIsError(t, testATM.Flow.EnterPIN(testATM, "0000"), atm.ErrAuthorizationUnsuccessful)
+	}
+	if lockouts != 0 {
+		t.Errorf("Lockout was published too early.")
+	}
+	assertErrorIsError(t, testATM.Flow.EnterPIN(testATM, "0000"), atm.ErrFlowPINAttempts)
+	if lockouts != 1 {
+		t.Errorf("Lockout was not published.")
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := &atm.EventBus{}
+	received := []string{}
+	unsubscribe := bus.Subscribe(func(event atm.Event) error {
+		received = append(received, "first "+event.Type)
+		return errors.New("first failed")
+	})
+	bus.Subscribe(func(event atm.Event) error {
+		received = append(received, "second "+event.Type)
+		return nil
+	}, atm.EventDeposit)
+
+	// a failing subscriber does not stop the others
+	assertErrorContains(t, bus.Publish(atm.Event{Type: atm.EventDeposit}), "first failed")
+	assertErrorContains(t, bus.Publish(atm.Event{Type: atm.EventWithdrawal}), "first failed")
+	unsubscribe()
+	assertNoError(t, bus.Publish(atm.Event{Type: atm.EventDeposit}))
+
+	expected := []string{"first deposit", "second deposit", "first withdrawal", "second deposit"}
+	if len(received) != len(expected) {
+		t.Fatalf("Received events are incorrect. %v", received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Received events are incorrect. %v", received)
+		}
+	}
+}
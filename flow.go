@@ -0,0 +1,227 @@
+package atm
+
+import (
+	"fmt"
+	"time"
+)
+
+// FlowState is a step of the customer flow of the ATM
+type FlowState int
+
+const (
+	FlowIdle FlowState = iota
+	FlowCardInserted
+	FlowPINEntry
+	FlowMenu
+	FlowReceipt
+	FlowCardEject
+)
+
+var flowStateNames = map[FlowState]string{
+	FlowIdle:         "idle",
+	FlowCardInserted: "card_inserted",
+	FlowPINEntry:     "pin_entry",
+	FlowMenu:         "menu",
+	FlowReceipt:      "receipt",
+	FlowCardEject:    "card_eject",
+}
+
+// what the ATM is doing in each state, used in error messages
+var flowStateDescriptions = map[FlowState]string{
+	FlowIdle:         "idle. Authorization required.",
+	FlowCardInserted: "reading a card.",
+	FlowPINEntry:     "waiting for a PIN.",
+	FlowMenu:         "showing the menu.",
+	FlowReceipt:      "offering a receipt.",
+	FlowCardEject:    "ejecting the card.",
+}
+
+func (s FlowState) String() string {
+	if name, ok := flowStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// flowTransitions are the states each state may move to
+var flowTransitions = map[FlowState][]FlowState{
+	FlowIdle:         {FlowCardInserted},
+	FlowCardInserted: {FlowPINEntry, FlowCardEject},
+	FlowPINEntry:     {FlowMenu, FlowCardEject},
+	FlowMenu:         {FlowReceipt, FlowCardEject},
+	FlowReceipt:      {FlowMenu, FlowCardEject},
+	FlowCardEject:    {FlowIdle},
+}
+
+// DefaultFlowTimeouts is how long the customer may stay in a state without activity.
+// The card is ejected when a customer state times out and retained when the ejected card is not taken.
+// Idle never times out
+var DefaultFlowTimeouts = map[FlowState]time.Duration{
+	FlowCardInserted: 30 * time.Second,
+	FlowPINEntry:     30 * time.Second,
+	FlowMenu:         SessionTimeout,
+	FlowReceipt:      30 * time.Second,
+	FlowCardEject:    30 * time.Second,
+}
+
+// MaxPINAttempts is the number of incorrect PINs after which the card is ejected
+const MaxPINAttempts = 3
+
+// Flow is the customer flow of an ATM: idle, card inserted, PIN entry, transaction menu, receipt and card eject.
+// Every front end drives the same flow so a command is only accepted in the states it is valid in
+type Flow struct {
+	State FlowState
+	// AccountID of the inserted card
+	AccountID int
+	// LastActivity is when the customer last acted, the timeout of the state counts from it
+	LastActivity time.Time
+	// PINAttempts is the number of incorrect PINs entered for the inserted card
+	PINAttempts int
+	// Timeouts of each state, DefaultFlowTimeouts if not set
+	Timeouts map[FlowState]time.Duration
+}
+
+// Allow returns an error if the flow is not in one of the states, otherwise the activity of the customer is recorded
+func (f *Flow) Allow(atm *ATM, states ...FlowState) error {
+	for _, state := range states {
+		if f.State == state {
+			f.Touch(atm)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s", ErrFlowNotAllowed, flowStateDescriptions[f.State])
+}
+
+// Touch records activity of the customer, the session is refreshed while the customer is authorized
+func (f *Flow) Touch(atm *ATM) {
+	f.LastActivity = time.Now()
+	if (f.State == FlowMenu || f.State == FlowReceipt) && atm.Session.AccountID == f.AccountID {
+		atm.Session.Refresh()
+	}
+}
+
+// InsertCard starts the flow for an account
+func (f *Flow) InsertCard(accountID int) error {
+	if err := f.transition(FlowCardInserted); err != nil {
+		return err
+	}
+	f.AccountID = accountID
+	f.PINAttempts = 0
+	return nil
+}
+
+// EnterPIN authorizes the inserted card and moves to the menu.
+// The card is ejected and ErrFlowPINAttempts returned after MaxPINAttempts incorrect PINs for the card
+// or if the host locked the account after incorrect PINs at any terminal
+func (f *Flow) EnterPIN(atm *ATM, pin string) error {
+	if f.State == FlowCardInserted {
+		if err := f.transition(FlowPINEntry); err != nil {
+			return err
+		}
+	}
+	if err := f.Allow(atm, FlowPINEntry); err != nil {
+		return err
+	}
+
+	err := atm.Authorize(f.AccountID, pin)
+	if err == ErrAuthorizationUnsuccessful || err == ErrAccountNotFound {
+		f.PINAttempts++
+	}
+	if err == ErrAuthorizationLocked || f.PINAttempts >= MaxPINAttempts {
+		atm.recordLockout(f.AccountID)
+		atm.publish(Event{Type: EventLockout, AccountID: f.AccountID})
+		f.EjectCard(atm)
+		return ErrFlowPINAttempts
+	}
+	if err != nil {
+		return err
+	}
+	return f.transition(FlowMenu)
+}
+
+// BeginTransaction returns to the menu from the receipt to start another transaction
+func (f *Flow) BeginTransaction(atm *ATM) error {
+	if err := f.Allow(atm, FlowMenu, FlowReceipt); err != nil {
+		return err
+	}
+	if f.State == FlowReceipt {
+		return f.transition(FlowMenu)
+	}
+	return nil
+}
+
+// CompleteTransaction moves to the receipt after a withdrawal or deposit
+func (f *Flow) CompleteTransaction() error {
+	return f.transition(FlowReceipt)
+}
+
+// EjectCard logs out of the session and ejects the card
+func (f *Flow) EjectCard(atm *ATM) error {
+	if err := f.transition(FlowCardEject); err != nil {
+		return err
+	}
+	if atm.Session.AccountID != 0 {
+		atm.Logout()
+	}
+	return nil
+}
+
+// TakeCard returns to idle once the customer has taken the ejected card
+func (f *Flow) TakeCard() error {
+	if err := f.transition(FlowIdle); err != nil {
+		return err
+	}
+	f.AccountID = 0
+	f.PINAttempts = 0
+	return nil
+}
+
+// Expire applies the timeout of the current state and returns true if it timed out.
+// A customer state ejects the card, an ejected card that was not taken is retained and the flow returns to idle
+func (f *Flow) Expire(atm *ATM) bool {
+	timeout := f.timeout()
+	if timeout == 0 || time.Since(f.LastActivity) <= timeout {
+		return false
+	}
+	if f.State == FlowCardEject {
+		atm.Audit(AuditEventCardRetained, f.AccountID, Result{}, ErrFlowTimedOut)
+		f.TakeCard()
+		return true
+	}
+	atm.Audit(AuditEventTimeout, f.AccountID, Result{}, ErrFlowTimedOut)
+	f.EjectCard(atm)
+	return true
+}
+
+// Remaining returns how long until the current state times out, zero if it does not time out
+func (f *Flow) Remaining() time.Duration {
+	timeout := f.timeout()
+	if timeout == 0 {
+		return 0
+	}
+	remaining := time.Until(f.LastActivity.Add(timeout))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (f *Flow) timeout() time.Duration {
+	timeouts := f.Timeouts
+	if timeouts == nil {
+		timeouts = DefaultFlowTimeouts
+	}
+	return timeouts[f.State]
+}
+
+// transition moves to the state if it is allowed from the current state
+func (f *Flow) transition(to FlowState) error {
+	for _, allowed := range flowTransitions[f.State] {
+		if allowed == to {
+			f.State = to
+			f.LastActivity = time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w from %s to %s.", ErrFlowInvalidTransition, f.State, to)
+}
@@ -0,0 +1,143 @@
+package atm_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestFlowATM(t *testing.T) *atm.ATM {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	return &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}, Flow: &atm.Flow{}}
+}
+
+func assertFlowState(t *testing.T, flow *atm.Flow, state atm.FlowState) {
+	if flow.State != state {
+		t.Errorf("Flow state is incorrect. %s should be %s", flow.State, state)
+	}
+}
+
+func TestFlow(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	flow := testATM.Flow
+
+	// a transaction cannot start before a card is inserted
+	assertErrorContains(t, flow.BeginTransaction(testATM), atm.ErrFlowNotAllowed.Error())
+	assertErrorContains(t, flow.TakeCard(), atm.ErrFlowInvalidTransition.Error())
+
+	assertNoError(t, flow.InsertCard(12345678))
+	assertFlowState(t, flow, atm.FlowCardInserted)
+	assertErrorIsError(t, flow.EnterPIN(testATM, "0000"), atm.ErrAuthorizationUnsuccessful)
+	assertFlowState(t, flow, atm.FlowPINEntry)
+	assertNoError(t, flow.EnterPIN(testATM, "1234"))
+	assertFlowState(t, flow, atm.FlowMenu)
+
+	assertNoError(t, flow.BeginTransaction(testATM))
+	assertNoError(t, flow.CompleteTransaction())
+	assertFlowState(t, flow, atm.FlowReceipt)
+	// another transaction returns to the menu
+	assertNoError(t, flow.BeginTransaction(testATM))
+	assertFlowState(t, flow, atm.FlowMenu)
+
+	assertNoError(t, flow.EjectCard(testATM))
+	assertFlowState(t, flow, atm.FlowCardEject)
+	if testATM.Session.AccountID != 0 {
+		t.Errorf("Session was not logged out when the card was ejected")
+	}
+	assertNoError(t, flow.TakeCard())
+	assertFlowState(t, flow, atm.FlowIdle)
+}
+
+func TestFlowPINAttempts(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	flow := testATM.Flow
+
+	assertNoError(t, flow.InsertCard(12345678))
+	for i := 1; i < atm.MaxPINAttempts; i++ {
+		assertErrorIsError(t, flow.EnterPIN(testATM, "0000"), atm.ErrAuthorizationUnsuccessful)
+	}
+	assertErrorIsError(t, flow.EnterPIN(testATM, "0000"), atm.ErrFlowPINAttempts)
+	assertFlowState(t, flow, atm.FlowCardEject)
+
+	// the host keeps the account locked for the next card, even with the correct PIN
+	assertNoError(t, flow.TakeCard())
+	assertNoError(t, flow.InsertCard(12345678))
+	assertErrorIsError(t, flow.EnterPIN(testATM, "1234"), atm.ErrFlowPINAttempts)
+	assertFlowState(t, flow, atm.FlowCardEject)
+
+	// an unknown card is ejected after MaxPINAttempts at this terminal
+	assertNoError(t, flow.TakeCard())
+	assertNoError(t, flow.InsertCard(87654321))
+	for i := 1; i < atm.MaxPINAttempts; i++ {
+		assertErrorIsError(t, flow.EnterPIN(testATM, "0000"), atm.ErrAccountNotFound)
+	}
+	assertErrorIsError(t, flow.EnterPIN(testATM, "0000"), atm.ErrFlowPINAttempts)
+}
+
+func TestFlowExpire(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	flow := testATM.Flow
+	flow.Timeouts = map[atm.FlowState]time.Duration{
+		atm.FlowMenu:      time.Minute,
+		atm.FlowCardEject: time.Minute,
+	}
+
+	if flow.Expire(testATM) || flow.Remaining() != 0 {
+		t.Errorf("Idle should not time out")
+	}
+
+	assertNoError(t, flow.InsertCard(12345678))
+	assertNoError(t, flow.EnterPIN(testATM, "1234"))
+	if flow.Expire(testATM) || flow.Remaining() <= 0 {
+		t.Errorf("Menu timed out too early")
+	}
+
+	// the card is ejected when the menu times out
+	flow.LastActivity = time.Now().Add(-2 * time.Minute)
+	if !flow.Expire(testATM) {
+		t.Errorf("Menu did not time out")
+	}
+	assertFlowState(t, flow, atm.FlowCardEject)
+	if testATM.Session.AccountID != 0 {
+		t.Errorf("Session was not logged out when the menu timed out")
+	}
+
+	// the card is retained when it is not taken
+	flow.LastActivity = time.Now().Add(-2 * time.Minute)
+	if !flow.Expire(testATM) {
+		t.Errorf("Card eject did not time out")
+	}
+	assertFlowState(t, flow, atm.FlowIdle)
+}
+
+func TestConsoleFlow(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	console := &atm.Console{ATM: testATM, Output: io.Discard}
+
+	// commands are rejected before anything is parsed or sent to the host
+	err := console.Run("withdraw 40")
+	assertErrorContains(t, err, atm.ErrFlowNotAllowed.Error())
+	assertErrorContains(t, err, "idle")
+
+	// a failed authorization returns to idle
+	assertErrorIsError(t, console.Run("authorize 12345678 0000"), atm.ErrConsoleAuthorizationFailed)
+	assertFlowState(t, testATM.Flow, atm.FlowIdle)
+
+	assertNoError(t, console.Run("authorize 12345678 1234"))
+	assertErrorContains(t, console.Run("authorize 12345678 1234"), atm.ErrFlowNotAllowed.Error())
+	assertNoError(t, console.Run("withdraw 40"))
+	assertFlowState(t, testATM.Flow, atm.FlowReceipt)
+	assertNoError(t, console.Run("balance"))
+	assertFlowState(t, testATM.Flow, atm.FlowMenu)
+
+	assertNoError(t, console.Run("logout"))
+	assertFlowState(t, testATM.Flow, atm.FlowIdle)
+
+	// a timed out menu ejects the card and a new customer may authorize
+	assertNoError(t, console.Run("authorize 12345678 1234"))
+	testATM.Flow.LastActivity = time.Now().Add(-atm.SessionTimeout - time.Second)
+	assertErrorIsError(t, console.Run("balance"), atm.ErrFlowTimedOut)
+	assertNoError(t, console.Run("authorize 12345678 1234"))
+}
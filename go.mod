@@ -1,3 +1,3 @@
 module github.com/AndrewCopeland/atm
 
-go 1.15
+go 1.21
@@ -0,0 +1,508 @@
+package atm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IHostClient is how a terminal reaches the host that owns the accounts, the ledger and authorization
+type IHostClient interface {
+	// Return error if the account does not exist or the pin is incorrect
+	Authorize(int, string) error
+	// Return the result of debiting the account or an error if the withdrawal was declined.
+	// A non empty idempotency key that was already used returns the original result
+	Withdraw(int, float64, string) (HostResult, error)
+	// Return the result of crediting the account or an error if the deposit failed.
+	// A non empty idempotency key that was already used returns the original result
+	Deposit(int, float64, string) (HostResult, error)
+	// Return the current balance of the account
+	Balance(int) (float64, error)
+	// Return all transactions for the account
+	History(int) ([]Transaction, error)
+	// Return the transactions of the account matching the query
+	QueryHistory(HistoryQuery) ([]Transaction, error)
+	// Return the result of posting a withdrawal the terminal already dispensed while the host was unavailable.
+	// The withdrawal is posted once for its stand-in ID, forwarding it again returns the original result
+	Advice(int, float64, int64, string) (HostResult, error)
+	// Return the result of posting a compensating transaction for a transaction ID with a reason
+	Reverse(string, string) (HostResult, error)
+}
+
+// HostResult is the outcome of a transaction posted by the host
+type HostResult struct {
+	// AccountID is the account the transaction was posted to
+	AccountID     int
+	Balance       float64
+	Fee           float64
+	TransactionID string
+	// Replayed is true if the result is the stored outcome of an idempotency key that was already used
+	Replayed bool
+}
+
+// FeeSchedule is the fees the host charges on top of the amount of a withdrawal
+type FeeSchedule struct {
+	// Withdrawal is charged for every withdrawal
+	Withdrawal float64
+	// Overdraft is charged when a withdrawal and its fee take the account below zero
+	Overdraft float64
+}
+
+// DefaultFees are the fees of a host without a fee schedule, an overdraft fee of $5
+var DefaultFees = FeeSchedule{Overdraft: 5}
+
+// Host authorizes transactions and posts them to the account and transaction databases.
+// A single host can be shared by many terminals
+type Host struct {
+	AccountDB     IAccountDB
+	TransactionDB ITransactionDB
+	// IdempotencyDB stores the outcome of withdrawals and deposits made with an idempotency key.
+	// If not set the keys are kept in memory
+	IdempotencyDB IIdempotencyDB
+	// Logger records store failures of the host, nothing is logged if not set
+	Logger *slog.Logger
+	// Fees charged on withdrawals, DefaultFees if not set
+	Fees *FeeSchedule
+	// PINLockout is how long an account is locked after MaxPINAttempts incorrect PINs, DefaultPINLockout if not set
+	PINLockout time.Duration
+
+	mutex sync.Mutex
+	// incorrect PINs entered in a row for each account at any terminal
+	pinFailures map[int]int
+	// when each locked account is unlocked
+	lockedUntil map[int]time.Time
+}
+
+// DefaultPINLockout is how long an account is locked after MaxPINAttempts incorrect PINs
+const DefaultPINLockout = 30 * time.Minute
+
+// Authorize verifies the pin of the account.
+// Incorrect PINs are counted for the account across every terminal and session, the account is locked after MaxPINAttempts of them.
+// An error is returned if the account cannot be found, the pin is incorrect or the account is locked
+func (h *Host) Authorize(accountID int, pin string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	account, err := h.account(accountID)
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(h.lockedUntil[accountID]) {
+		return ErrAuthorizationLocked
+	}
+	delete(h.lockedUntil, accountID)
+
+	if account.PIN != pin {
+		return h.failPIN(accountID)
+	}
+	delete(h.pinFailures, accountID)
+	return nil
+}
+
+// failPIN counts an incorrect PIN and locks the account once MaxPINAttempts are counted.
+// Callers must hold the mutex
+func (h *Host) failPIN(accountID int) error {
+	if h.pinFailures == nil {
+		h.pinFailures = map[int]int{}
+		h.lockedUntil = map[int]time.Time{}
+	}
+	h.pinFailures[accountID]++
+	if h.pinFailures[accountID] < MaxPINAttempts {
+		return ErrAuthorizationUnsuccessful
+	}
+
+	lockout := h.PINLockout
+	if lockout <= 0 {
+		lockout = DefaultPINLockout
+	}
+	delete(h.pinFailures, accountID)
+	h.lockedUntil[accountID] = time.Now().Add(lockout)
+	h.logger().Warn("account locked after incorrect PINs", logAccount(accountID), "until", h.lockedUntil[accountID])
+	return ErrAuthorizationLocked
+}
+
+// Withdraw debits the account and records the transaction in the ledger
+// Withdrawl will fail if account current balance is negative,
+// If withdrawl amount is more than account's balance then the overdraft fee of the fee schedule is charged
+// If the idempotency key was already used the original result is returned without debiting the account again
+func (h *Host) Withdraw(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.idempotent(idempotencyKey, TransactionKindWithdrawal, accountID, amount, func() (HostResult, error) {
+		account, err := h.account(accountID)
+		if err != nil {
+			return HostResult{}, err
+		}
+
+		if account.Balance < 0 {
+			return HostResult{}, ErrWithdrawAccountOverdrawn
+		}
+
+		return h.debit(account, amount, time.Now().Unix())
+	})
+}
+
+// Advice posts a withdrawal that a terminal approved in stand-in while the host was unavailable.
+// The cash has already been dispensed so the withdrawal is posted even if the account is overdrawn.
+// The stand-in ID is the idempotency key of the advice so a withdrawal forwarded twice is only posted once
+func (h *Host) Advice(accountID int, amount float64, dateTime int64, standInID string) (HostResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.idempotent(standInID, idempotencyOperationAdvice, accountID, amount, func() (HostResult, error) {
+		account, err := h.account(accountID)
+		if err != nil {
+			return HostResult{}, err
+		}
+
+		return h.debit(account, amount, dateTime)
+	})
+}
+
+// debit posts a withdrawal and charges the withdrawal fee and the overdraft fee if the account goes negative.
+// Callers must hold the mutex
+func (h *Host) debit(account Account, amount float64, dateTime int64) (HostResult, error) {
+	fees := DefaultFees
+	if h.Fees != nil {
+		fees = *h.Fees
+	}
+	transaction := Transaction{
+		DateTime: dateTime,
+		Kind:     TransactionKindWithdrawal,
+		Amount:   amount * -1,
+		Fee:      fees.Withdrawal,
+	}
+	if account.Balance-amount-fees.Withdrawal < 0 {
+		transaction.Fee = roundCents(transaction.Fee + fees.Overdraft)
+	}
+
+	return h.post(account, transaction)
+}
+
+// Deposit credits the account and records the transaction in the ledger
+// An error is returned on failure to interface with DBs
+// If the idempotency key was already used the original result is returned without crediting the account again
+func (h *Host) Deposit(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.idempotent(idempotencyKey, TransactionKindDeposit, accountID, amount, func() (HostResult, error) {
+		account, err := h.account(accountID)
+		if err != nil {
+			return HostResult{}, err
+		}
+
+		return h.post(account, Transaction{
+			Kind:   TransactionKindDeposit,
+			Amount: amount,
+		})
+	})
+}
+
+// idempotencyOperationAdvice is the operation of a stand-in ID, an advice never replays a withdrawal or deposit key
+const idempotencyOperationAdvice = "advice"
+
+// idempotent runs a money moving operation at most once per idempotency key and stores its outcome.
+// A replay of the key returns the stored outcome, ErrIdempotencyKeyMismatch is returned if the key was
+// used for a different operation, account or amount. Outages are not stored so the operation can be retried.
+// Callers must hold the mutex
+func (h *Host) idempotent(key string, operation string, accountID int, amount float64, run func() (HostResult, error)) (HostResult, error) {
+	if key == "" {
+		return run()
+	}
+	if err := validIdempotencyKey(key); err != nil {
+		return HostResult{}, err
+	}
+
+	if h.IdempotencyDB == nil {
+		h.IdempotencyDB = &memoryIdempotencyDB{}
+	}
+	record, ok, err := h.IdempotencyDB.Get(key)
+	if err != nil {
+		return HostResult{}, storeUnavailable(err)
+	}
+	if ok {
+		if record.Operation != operation || record.AccountID != accountID || record.Amount != roundCents(amount) {
+			return HostResult{}, ErrIdempotencyKeyMismatch
+		}
+		result := record.Result
+		result.AccountID = record.AccountID
+		result.Replayed = true
+		return result, isoResponseError(record.ResponseCode)
+	}
+
+	result, err := run()
+	code := isoResponseCode(err)
+	// nothing was posted if the ledger was not written, a retry may post the transaction.
+	// Once the ledger is written the outcome is stored even if the account was not updated,
+	// so a retry never posts the transaction a second time
+	if code == ResponseSystemMalfunction && result.TransactionID == "" {
+		return result, err
+	}
+
+	// The outcome is final at this point, failing to store the key must not fail the transaction
+	setErr := h.IdempotencyDB.Set(IdempotencyRecord{
+		Key:          key,
+		DateTime:     time.Now().Unix(),
+		Operation:    operation,
+		AccountID:    accountID,
+		Amount:       roundCents(amount),
+		ResponseCode: code,
+		Result:       result,
+	})
+	if setErr != nil {
+		h.logger().Error("idempotency key not stored, a retry will post the transaction again",
+			logAccount(accountID), LogKeyTransactionID, result.TransactionID, logError(setErr))
+	}
+	return result, err
+}
+
+// Reverse posts a compensating transaction linked to the original transaction.
+// The amount and any fee of the original transaction are returned to the account
+// An error is returned if the transaction cannot be found, is a reversal or has already been reversed
+func (h *Host) Reverse(transactionID string, reason string) (HostResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if transactionID == "" {
+		return HostResult{}, ErrTransactionNotFound
+	}
+	transactions, err := h.TransactionDB.All()
+	if err != nil {
+		return HostResult{}, storeUnavailable(err)
+	}
+
+	var original *Transaction
+	for i, transaction := range transactions {
+		if transaction.ReversalOf == transactionID {
+			return HostResult{}, ErrTransactionAlreadyReversed
+		}
+		if transaction.TransactionID == transactionID {
+			original = &transactions[i]
+		}
+	}
+	if original == nil {
+		return HostResult{}, ErrTransactionNotFound
+	}
+	// adjustments correct the ledger and never moved money
+	if original.Kind == TransactionKindReversal || original.Kind == TransactionKindAdjustment {
+		return HostResult{}, ErrTransactionNotReversible
+	}
+
+	account, err := h.account(original.AccountID)
+	if err != nil {
+		return HostResult{}, err
+	}
+
+	return h.post(account, Transaction{
+		Kind:       TransactionKindReversal,
+		Amount:     original.Amount * -1,
+		Fee:        original.Fee * -1,
+		ReversalOf: original.TransactionID,
+		Reason:     reason,
+	})
+}
+
+// Balance returns the current balance of the account
+// An error is returned if the account could not be found
+func (h *Host) Balance(accountID int) (float64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	account, err := h.account(accountID)
+	return account.Balance, err
+}
+
+// History returns all transactions of the account
+// An error is returned on failure to read the transaction DB
+func (h *Host) History(accountID int) ([]Transaction, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	transactions, err := h.TransactionDB.Get(accountID)
+	if err != nil {
+		return transactions, storeUnavailable(err)
+	}
+	return transactions, nil
+}
+
+// QueryHistory returns the transactions of the account matching the query, filtered by the transaction DB
+// An error is returned if the query is invalid or on failure to read the transaction DB
+func (h *Host) QueryHistory(query HistoryQuery) ([]Transaction, error) {
+	if err := query.Validate(); err != nil {
+		return []Transaction{}, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	transactions, err := h.TransactionDB.Query(query)
+	if err != nil {
+		return transactions, storeUnavailable(err)
+	}
+	return transactions, nil
+}
+
+// account reads the account from the account DB.
+// Callers must hold the mutex
+func (h *Host) account(accountID int) (Account, error) {
+	account, err := h.AccountDB.Get(accountID)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		h.logger().Error("account not read", logAccount(accountID), logError(err))
+		return account, storeUnavailable(err)
+	}
+	return account, err
+}
+
+// post assigns an ID to the transaction, writes it to the ledger and updates the account balance.
+// The fee is charged on top of the amount and the date time defaults to now.
+// Nothing has been posted if ErrHostStoreUnavailable is returned without a transaction ID,
+// with an ID the transaction is in the ledger but the account balance was not updated until reconciled.
+// Callers must hold the mutex
+func (h *Host) post(account Account, transaction Transaction) (HostResult, error) {
+	transaction.AccountID = account.AccountID
+	transaction.TransactionID = newTransactionID()
+	transaction.Balance = roundCents(account.Balance + transaction.Amount - transaction.Fee)
+	if transaction.DateTime == 0 {
+		transaction.DateTime = time.Now().Unix()
+	}
+
+	result := HostResult{
+		AccountID:     account.AccountID,
+		Balance:       transaction.Balance,
+		Fee:           transaction.Fee,
+		TransactionID: transaction.TransactionID,
+	}
+
+	err := h.TransactionDB.Set(transaction)
+	if err != nil {
+		h.logger().Error("transaction not posted", logAccount(account.AccountID), LogKeyTransactionID, transaction.TransactionID, logError(err))
+		return HostResult{}, storeUnavailable(err)
+	}
+
+	account.Balance = transaction.Balance
+	err = h.AccountDB.Set(account)
+	if err != nil {
+		// the ledger and the account disagree until reconciled
+		h.logger().Error("transaction posted but the account balance was not updated", logAccount(account.AccountID), LogKeyTransactionID, transaction.TransactionID, logError(err))
+		return result, storeUnavailable(err)
+	}
+	h.logger().Info("transaction posted", logAccount(account.AccountID), LogKeyTransactionID, transaction.TransactionID, "kind", transaction.Kind, LogKeyAmount, transaction.Amount)
+	return result, nil
+}
+
+func (h *Host) logger() *slog.Logger {
+	return orDiscard(h.Logger)
+}
+
+// newTransactionID returns a random 12 character ID that fits in the ISO 8583 retrieval reference number
+func newTransactionID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+func storeUnavailable(err error) error {
+	return fmt.Errorf("%w %w", ErrHostStoreUnavailable, err)
+}
+
+// LocalHostClient reaches a host running in the same process.
+// The host can be taken offline to simulate an outage
+type LocalHostClient struct {
+	Host *Host
+
+	mutex   sync.Mutex
+	offline bool
+}
+
+// SetOffline simulates a host outage, every request fails with ErrHostUnavailable while offline
+func (c *LocalHostClient) SetOffline(offline bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.offline = offline
+}
+
+func (c *LocalHostClient) available() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.offline || c.Host == nil {
+		return ErrHostUnavailable
+	}
+	return nil
+}
+
+// Authorize verifies the pin of the account on the host
+func (c *LocalHostClient) Authorize(accountID int, pin string) error {
+	if err := c.available(); err != nil {
+		return err
+	}
+	return c.Host.Authorize(accountID, pin)
+}
+
+// Withdraw debits the account on the host
+func (c *LocalHostClient) Withdraw(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	if err := c.available(); err != nil {
+		return HostResult{}, err
+	}
+	return c.Host.Withdraw(accountID, amount, idempotencyKey)
+}
+
+// Deposit credits the account on the host
+func (c *LocalHostClient) Deposit(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	if err := c.available(); err != nil {
+		return HostResult{}, err
+	}
+	return c.Host.Deposit(accountID, amount, idempotencyKey)
+}
+
+// Balance returns the balance of the account from the host
+func (c *LocalHostClient) Balance(accountID int) (float64, error) {
+	if err := c.available(); err != nil {
+		return 0, err
+	}
+	return c.Host.Balance(accountID)
+}
+
+// History returns the transactions of the account from the host
+func (c *LocalHostClient) History(accountID int) ([]Transaction, error) {
+	if err := c.available(); err != nil {
+		return []Transaction{}, err
+	}
+	return c.Host.History(accountID)
+}
+
+// QueryHistory returns the transactions of the account matching the query from the host
+func (c *LocalHostClient) QueryHistory(query HistoryQuery) ([]Transaction, error) {
+	if err := c.available(); err != nil {
+		return []Transaction{}, err
+	}
+	return c.Host.QueryHistory(query)
+}
+
+// Advice posts a stand-in withdrawal on the host
+func (c *LocalHostClient) Advice(accountID int, amount float64, dateTime int64, standInID string) (HostResult, error) {
+	if err := c.available(); err != nil {
+		return HostResult{}, err
+	}
+	return c.Host.Advice(accountID, amount, dateTime, standInID)
+}
+
+// Reverse posts a compensating transaction on the host
+func (c *LocalHostClient) Reverse(transactionID string, reason string) (HostResult, error) {
+	if err := c.available(); err != nil {
+		return HostResult{}, err
+	}
+	return c.Host.Reverse(transactionID, reason)
+}
+
+// roundCents rounds an amount in dollars to whole cents
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
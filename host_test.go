@@ -0,0 +1,248 @@
+package atm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestHostAuthorize(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	err := host.Authorize(12345678, "0000")
+	assertErrorIsError(t, err, atm.ErrAuthorizationUnsuccessful)
+
+	err = host.Authorize(87654321, "1234")
+	assertErrorIsError(t, err, atm.ErrAccountNotFound)
+
+	err = host.Authorize(12345678, "1234")
+	assertNoError(t, err)
+}
+
+func TestHostPINLockout(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB, PINLockout: 20 * time.Millisecond}
+
+	// a correct PIN starts the count over
+	assertErrorIsError(t, host.Authorize(12345678, "0000"), atm.ErrAuthorizationUnsuccessful)
+	assertNoError(t, host.Authorize(12345678, "1234"))
+	for i := 1; i < atm.MaxPINAttempts; i++ {
+		assertErrorIsError(t, host.Authorize(12345678, "0000"), atm.ErrAuthorizationUnsuccessful)
+	}
+	assertErrorIsError(t, host.Authorize(12345678, "0000"), atm.ErrAuthorizationLocked)
+	assertErrorIsError(t, host.Authorize(12345678, "1234"), atm.ErrAuthorizationLocked)
+
+	// the ISO host answers a locked account with PIN tries exceeded
+	isoHost := &atm.ISOHost{Host: host}
+	response, err := isoHost.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "1", 0, "1234"))
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponsePINTriesExceeded)
+
+	time.Sleep(30 * time.Millisecond)
+	assertNoError(t, host.Authorize(12345678, "1234"))
+}
+
+func TestHostWithdrawDeposit(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	result, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	if result.Balance != 60.12 || result.Fee != 0 {
+		t.Errorf("Withdraw result is incorrect. %+v", result)
+	}
+
+	// overdraft fee is charged
+	result, err = host.Withdraw(12345678, 80, "")
+	assertNoError(t, err)
+	if result.Balance != -24.88 || result.Fee != 5 {
+		t.Errorf("Withdraw result is incorrect. %+v", result)
+	}
+
+	// overdrawn account is declined
+	_, err = host.Withdraw(12345678, 20, "")
+	assertErrorIsError(t, err, atm.ErrWithdrawAccountOverdrawn)
+
+	result, err = host.Deposit(12345678, 24.88, "")
+	assertNoError(t, err)
+	if result.Balance != 0 {
+		t.Errorf("Deposit result is incorrect. %+v", result)
+	}
+
+	transactions, err := host.History(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 3 {
+		t.Errorf("Invalid number of transactions. %d", len(transactions))
+	}
+}
+
+func TestHostFees(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB, Fees: &atm.FeeSchedule{Withdrawal: 2.5, Overdraft: 10}}
+
+	result, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	if result.Balance != 57.5 || result.Fee != 2.5 {
+		t.Errorf("Withdraw result is incorrect. %+v", result)
+	}
+
+	// the withdrawal fee counts towards going below zero
+	result, err = host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	if result.Balance != 15 || result.Fee != 2.5 {
+		t.Errorf("Withdraw result is incorrect. %+v", result)
+	}
+	result, err = host.Withdraw(12345678, 20, "")
+	assertNoError(t, err)
+	if result.Balance != -17.5 || result.Fee != 12.5 {
+		t.Errorf("Withdraw result is incorrect. %+v", result)
+	}
+}
+
+func TestLocalHostClientOffline(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	client := &atm.LocalHostClient{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}}
+	terminal := &atm.ATM{Host: client, ATMBalance: 200, Session: &atm.Session{}}
+
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	client.SetOffline(true)
+	_, err := terminal.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrHostUnavailable)
+	if terminal.ATMBalance != 200 {
+		t.Errorf("Cash should not be dispensed while the host is unavailable")
+	}
+
+	client.SetOffline(false)
+	_, err = terminal.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	if terminal.ATMBalance != 180 {
+		t.Errorf("ATM balance is incorrect. %.2f", terminal.ATMBalance)
+	}
+}
+
+func TestHostSharedByTerminals(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			terminal := &atm.ATM{
+				Host:       &atm.LocalHostClient{Host: host},
+				ATMBalance: 100,
+				Session:    &atm.Session{AccountID: 12345678, LastActivity: time.Now().Unix()},
+			}
+			_, err := terminal.Withdraw(12345678, 20)
+			done <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		assertNoError(t, <-done)
+	}
+
+	balance, err := host.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 20 {
+		t.Errorf("Balance is incorrect after concurrent withdrawals. %.2f", balance)
+	}
+}
+
+func TestHostReverse(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,20.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	withdrawal, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+	if withdrawal.TransactionID == "" || withdrawal.Fee != 5 {
+		t.Fatalf("Withdraw result is incorrect. %+v", withdrawal)
+	}
+
+	// reversal restores the amount and the fee
+	reversal, err := host.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertNoError(t, err)
+	if reversal.Balance != 20 || reversal.Fee != -5 {
+		t.Errorf("Reverse result is incorrect. %+v", reversal)
+	}
+
+	transactions, err := host.History(12345678)
+	assertNoError(t, err)
+	last := transactions[len(transactions)-1]
+	if last.Kind != atm.TransactionKindReversal || last.ReversalOf != withdrawal.TransactionID || last.Amount != 40 {
+		t.Errorf("Compensating transaction is incorrect. %+v", last)
+	}
+
+	// the same transaction cannot be reversed twice
+	_, err = host.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertErrorIsError(t, err, atm.ErrTransactionAlreadyReversed)
+
+	// a reversal cannot be reversed
+	_, err = host.Reverse(reversal.TransactionID, "Undo")
+	assertErrorIsError(t, err, atm.ErrTransactionNotReversible)
+
+	_, err = host.Reverse("UNKNOWN", "Undo")
+	assertErrorIsError(t, err, atm.ErrTransactionNotFound)
+}
+
+func TestHostIdempotencyKey(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,20.00\n", "")
+	host := &atm.Host{
+		AccountDB:     accountDB,
+		TransactionDB: transactionDB,
+		IdempotencyDB: atm.IdempotencyDB{DBFile: t.TempDir() + "/idempotency.csv"},
+	}
+
+	withdrawal, err := host.Withdraw(12345678, 40, "key-1")
+	assertNoError(t, err)
+	replay, err := host.Withdraw(12345678, 40, "key-1")
+	assertNoError(t, err)
+	if !replay.Replayed || replay.TransactionID != withdrawal.TransactionID || replay.Balance != withdrawal.Balance || replay.Fee != 5 {
+		t.Errorf("Replay result is incorrect. %+v", replay)
+	}
+
+	// a declined withdrawal is replayed as declined even after the account is no longer overdrawn
+	_, err = host.Withdraw(12345678, 20, "key-2")
+	assertErrorIsError(t, err, atm.ErrWithdrawAccountOverdrawn)
+	_, err = host.Deposit(12345678, 100, "")
+	assertNoError(t, err)
+	_, err = host.Withdraw(12345678, 20, "key-2")
+	assertErrorIsError(t, err, atm.ErrWithdrawAccountOverdrawn)
+
+	_, err = host.Deposit(12345678, 40, "key-1")
+	assertErrorIsError(t, err, atm.ErrIdempotencyKeyMismatch)
+	_, err = host.Deposit(12345678, 40, "not,valid")
+	assertErrorIsError(t, err, atm.ErrIdempotencyKeyInvalid)
+
+	transactions, err := host.History(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 2 {
+		t.Errorf("Invalid number of transactions. %d", len(transactions))
+	}
+}
+
+func TestHostIdempotencyKeyAccountNotUpdated(t *testing.T) {
+	_, transactionDB := newTestDBs(t, "", "")
+	accountDB := AccountDBTest{getAccount: defaultAccount, setAccountError: errors.New("disk is full")}
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	// the transaction is in the ledger but the balance was not updated
+	withdrawal, err := host.Withdraw(defaultAccount.AccountID, 20, "key-1")
+	if !errors.Is(err, atm.ErrHostStoreUnavailable) || withdrawal.TransactionID == "" {
+		t.Fatalf("Withdrawal should fail with its transaction ID. %+v %v", withdrawal, err)
+	}
+
+	// a retry replays the outcome and never posts the withdrawal again
+	replay, err := host.Withdraw(defaultAccount.AccountID, 20, "key-1")
+	if !errors.Is(err, atm.ErrHostStoreUnavailable) || !replay.Replayed || replay.TransactionID != withdrawal.TransactionID {
+		t.Errorf("Retry should replay the outcome. %+v %v", replay, err)
+	}
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	if len(transactions) != 1 {
+		t.Errorf("Withdrawal was posted twice. %+v", transactions)
+	}
+}
@@ -0,0 +1,188 @@
+package atm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyRetention is how long idempotency keys are kept if no retention is configured
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// IdempotencyRecord is the stored outcome of a money moving operation
+type IdempotencyRecord struct {
+	Key       string
+	DateTime  int64
+	Operation string
+	AccountID int
+	Amount    float64
+	// ResponseCode is the ISO 8583 response code of the outcome, 00 if approved
+	ResponseCode string
+	Result       HostResult
+}
+
+type IIdempotencyDB interface {
+	// Return the record of a key and false if the key is unknown or expired
+	Get(string) (IdempotencyRecord, bool, error)
+	// Store the record of a key
+	Set(IdempotencyRecord) error
+}
+
+// IdempotencyDB stores idempotency records in a CSV file.
+// Records older than the retention are ignored and removed on the next write
+type IdempotencyDB struct {
+	DBFile    string
+	Retention time.Duration
+}
+
+func (d IdempotencyDB) retention() time.Duration {
+	if d.Retention == 0 {
+		return DefaultIdempotencyRetention
+	}
+	return d.Retention
+}
+
+func (d IdempotencyDB) read() ([]IdempotencyRecord, error) {
+	rows, err := readCSVRows(d.DBFile, 9)
+	if err != nil {
+		return []IdempotencyRecord{}, err
+	}
+
+	records := []IdempotencyRecord{}
+	for _, columns := range rows {
+		dateTime, err := strconv.ParseInt(columns[1], 10, 64)
+		if err != nil {
+			return []IdempotencyRecord{}, ErrTransactionDateTimeNotInteger
+		}
+		accountID, err := strconv.Atoi(columns[3])
+		if err != nil {
+			return []IdempotencyRecord{}, ErrTransactionAccountIDNotInteger
+		}
+		amount, err := strconv.ParseFloat(columns[4], 64)
+		if err != nil {
+			return []IdempotencyRecord{}, ErrTransactionAmounteNotFloat
+		}
+		balance, err := strconv.ParseFloat(columns[6], 64)
+		if err != nil {
+			return []IdempotencyRecord{}, ErrTransactionBalanceNotFloat
+		}
+		fee, err := strconv.ParseFloat(columns[7], 64)
+		if err != nil {
+			return []IdempotencyRecord{}, ErrTransactionFeeNotFloat
+		}
+
+		records = append(records, IdempotencyRecord{
+			Key:          columns[0],
+			DateTime:     dateTime,
+			Operation:    columns[2],
+			AccountID:    accountID,
+			Amount:       amount,
+			ResponseCode: columns[5],
+			Result: HostResult{
+				Balance:       balance,
+				Fee:           fee,
+				TransactionID: columns[8],
+			},
+		})
+	}
+	return records, nil
+}
+
+func (d IdempotencyDB) write(records []IdempotencyRecord) error {
+	tmpFile := d.DBFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	datawriter := bufio.NewWriter(file)
+	datawriter.WriteString("KEY,DATE_TIME,OPERATION,ACCOUNT_ID,AMOUNT,RESPONSE_CODE,BALANCE,FEE,TRANSACTION_ID\n")
+	for _, r := range records {
+		datawriter.WriteString(fmt.Sprintf("%s,%d,%s,%d,%.2f,%s,%.2f,%.2f,%s\n",
+			r.Key, r.DateTime, r.Operation, r.AccountID, r.Amount, r.ResponseCode, r.Result.Balance, r.Result.Fee, r.Result.TransactionID))
+	}
+	if err = datawriter.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, d.DBFile)
+}
+
+// Get returns the record of a key from the CSV file
+// false is returned if the key is unknown or older than the retention
+func (d IdempotencyDB) Get(key string) (IdempotencyRecord, bool, error) {
+	records, err := d.read()
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	expired := time.Now().Add(-d.retention()).Unix()
+	for _, record := range records {
+		if record.Key == key && record.DateTime >= expired {
+			return record, true, nil
+		}
+	}
+	return IdempotencyRecord{}, false, nil
+}
+
+// Set stores the record of a key in the CSV file and removes expired records
+func (d IdempotencyDB) Set(record IdempotencyRecord) error {
+	records, err := d.read()
+	if err != nil {
+		return err
+	}
+
+	expired := time.Now().Add(-d.retention()).Unix()
+	kept := []IdempotencyRecord{}
+	for _, r := range records {
+		if r.Key != record.Key && r.DateTime >= expired {
+			kept = append(kept, r)
+		}
+	}
+	return d.write(append(kept, record))
+}
+
+// memoryIdempotencyDB keeps idempotency records in memory for hosts without an idempotency DB
+type memoryIdempotencyDB struct {
+	mutex   sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+func (d *memoryIdempotencyDB) Get(key string) (IdempotencyRecord, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	record, ok := d.records[key]
+	if ok && record.DateTime < time.Now().Add(-DefaultIdempotencyRetention).Unix() {
+		delete(d.records, key)
+		return IdempotencyRecord{}, false, nil
+	}
+	return record, ok, nil
+}
+
+func (d *memoryIdempotencyDB) Set(record IdempotencyRecord) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.records == nil {
+		d.records = map[string]IdempotencyRecord{}
+	}
+	d.records[record.Key] = record
+	return nil
+}
+
+// validIdempotencyKey returns an error if the key cannot be stored
+func validIdempotencyKey(key string) error {
+	if len(key) > 64 || strings.ContainsAny(key, ", \t\r\n") {
+		return ErrIdempotencyKeyInvalid
+	}
+	return nil
+}
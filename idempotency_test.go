@@ -0,0 +1,56 @@
+package atm_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestIdempotencyDB(t *testing.T) {
+	db := atm.IdempotencyDB{DBFile: t.TempDir() + "/idempotency.csv"}
+
+	_, ok, err := db.Get("key-1")
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("Unknown key should not be found")
+	}
+
+	record := atm.IdempotencyRecord{
+		Key:          "key-1",
+		DateTime:     time.Now().Unix(),
+		Operation:    atm.TransactionKindWithdrawal,
+		AccountID:    12345678,
+		Amount:       40,
+		ResponseCode: atm.ResponseApproved,
+		Result:       atm.HostResult{Balance: 60.12, Fee: 5, TransactionID: "0123456789AB"},
+	}
+	assertNoError(t, db.Set(record))
+
+	stored, ok, err := db.Get("key-1")
+	assertNoError(t, err)
+	if !ok || stored != record {
+		t.Errorf("Stored record is incorrect. %+v", stored)
+	}
+}
+
+func TestIdempotencyDBRetention(t *testing.T) {
+	db := atm.IdempotencyDB{DBFile: t.TempDir() + "/idempotency.csv", Retention: time.Hour}
+
+	assertNoError(t, db.Set(atm.IdempotencyRecord{Key: "expired", DateTime: time.Now().Add(-2 * time.Hour).Unix()}))
+	_, ok, err := db.Get("expired")
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("Expired key should not be found")
+	}
+
+	// expired keys are removed on the next write
+	assertNoError(t, db.Set(atm.IdempotencyRecord{Key: "current", DateTime: time.Now().Unix()}))
+	content, err := os.ReadFile(db.DBFile)
+	assertNoError(t, err)
+	if lines := strings.Count(string(content), "\n"); lines != 2 {
+		t.Errorf("Expired key was not removed. %s", content)
+	}
+}
@@ -0,0 +1,630 @@
+package atm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ISO 8583 message type indicators supported between the terminal and the host
+const (
+	MTIAuthorizationRequest    = "0100"
+	MTIAuthorizationResponse   = "0110"
+	MTIFinancialRequest        = "0200"
+	MTIFinancialResponse       = "0210"
+	MTIFinancialAdvice         = "0220"
+	MTIFinancialAdviceResponse = "0230"
+	MTIReversalAdvice          = "0420"
+	MTIReversalResponse        = "0430"
+)
+
+// ISO 8583 processing codes (field 3)
+const (
+	ProcessingCodeWithdrawal     = "010000"
+	ProcessingCodeDeposit        = "210000"
+	ProcessingCodeBalanceInquiry = "310000"
+	ProcessingCodeMiniStatement  = "380000"
+)
+
+// ISO 8583 response codes (field 39)
+const (
+	ResponseApproved               = "00"
+	ResponseInvalidTransaction     = "12"
+	ResponseInvalidAmount          = "13"
+	ResponseInvalidCardNumber      = "14"
+	ResponseUnableToLocateOriginal = "25"
+	ResponseFormatError            = "30"
+	ResponseInsufficientFunds      = "51"
+	ResponseIncorrectPIN           = "55"
+	ResponseSecurityViolation      = "63"
+	ResponsePINTriesExceeded       = "75"
+	ResponseDuplicateTransmission  = "94"
+	ResponseSystemMalfunction      = "96"
+)
+
+// ISO 8583 data elements used by the terminal and the host
+const (
+	FieldPAN                  = 2
+	FieldProcessingCode       = 3
+	FieldAmount               = 4
+	FieldTransmissionDateTime = 7
+	FieldSTAN                 = 11
+	FieldLocalTime            = 12
+	FieldLocalDate            = 13
+	FieldTransactionFee       = 28
+	FieldRetrievalReference   = 37
+	FieldAuthorizationID      = 38
+	FieldResponseCode         = 39
+	FieldTerminalID           = 41
+	FieldAdditionalResponse   = 44
+	FieldAdditionalData       = 48
+	FieldCurrencyCode         = 49
+	FieldPINData              = 52
+	FieldAdditionalAmounts    = 54
+	FieldTransportData        = 59
+	FieldMAC                  = 64
+	FieldOriginalDataElements = 90
+)
+
+const (
+	isoCurrencyUSD               = "840"
+	isoAdditionalAmountAvailable = "02"
+	isoStatementEntryLength      = 38
+	// additional response data of a response replayed for an idempotency key that was already used
+	isoAdditionalResponseReplayed = "REPLAYED"
+)
+
+type isoFieldFormat int
+
+const (
+	isoNumeric isoFieldFormat = iota
+	isoAlpha
+	isoBinary
+)
+
+// isoField describes how a data element is encoded.
+// prefix is 0 for fixed length fields, 2 for LLVAR and 3 for LLLVAR fields
+type isoField struct {
+	length int
+	prefix int
+	format isoFieldFormat
+}
+
+var isoFields = map[int]isoField{
+	FieldPAN:                  {length: 19, prefix: 2, format: isoNumeric},
+	FieldProcessingCode:       {length: 6, format: isoNumeric},
+	FieldAmount:               {length: 12, format: isoNumeric},
+	FieldTransmissionDateTime: {length: 10, format: isoNumeric},
+	FieldSTAN:                 {length: 6, format: isoNumeric},
+	FieldLocalTime:            {length: 6, format: isoNumeric},
+	FieldLocalDate:            {length: 4, format: isoNumeric},
+	FieldTransactionFee:       {length: 9, format: isoAlpha},
+	FieldRetrievalReference:   {length: 12, format: isoAlpha},
+	FieldAuthorizationID:      {length: 6, format: isoAlpha},
+	FieldResponseCode:         {length: 2, format: isoAlpha},
+	FieldTerminalID:           {length: 8, format: isoAlpha},
+	FieldAdditionalResponse:   {length: 25, prefix: 2, format: isoAlpha},
+	FieldAdditionalData:       {length: 999, prefix: 3, format: isoAlpha},
+	FieldCurrencyCode:         {length: 3, format: isoNumeric},
+	FieldPINData:              {length: 8, format: isoBinary},
+	FieldAdditionalAmounts:    {length: 120, prefix: 3, format: isoAlpha},
+	FieldTransportData:        {length: 999, prefix: 3, format: isoAlpha},
+	FieldMAC:                  {length: 8, format: isoBinary},
+	FieldOriginalDataElements: {length: 42, format: isoNumeric},
+}
+
+// ISOMessage is an ISO 8583 message encoded as ASCII with a hexadecimal bitmap.
+// Binary fields are stored and transmitted as hexadecimal strings
+type ISOMessage struct {
+	MTI    string
+	Fields map[int]string
+}
+
+// NewISOMessage returns an empty message of the given message type
+func NewISOMessage(mti string) *ISOMessage {
+	return &ISOMessage{
+		MTI:    mti,
+		Fields: map[int]string{},
+	}
+}
+
+// Set sets the value of a data element
+func (m *ISOMessage) Set(field int, value string) {
+	if m.Fields == nil {
+		m.Fields = map[int]string{}
+	}
+	m.Fields[field] = value
+}
+
+// Get returns the value of a data element and whether it is present
+func (m *ISOMessage) Get(field int) (string, bool) {
+	value, ok := m.Fields[field]
+	return value, ok
+}
+
+// Has returns true if the data element is present
+func (m *ISOMessage) Has(field int) bool {
+	_, ok := m.Fields[field]
+	return ok
+}
+
+// Response returns a response message for a request, echoing the data elements the
+// requester uses to match the response to the request
+func (m *ISOMessage) Response(responseCode string) *ISOMessage {
+	response := NewISOMessage(isoResponseMTI(m.MTI))
+	echo := []int{
+		FieldPAN, FieldProcessingCode, FieldAmount, FieldTransmissionDateTime, FieldSTAN,
+		FieldLocalTime, FieldLocalDate, FieldRetrievalReference, FieldTerminalID,
+		FieldCurrencyCode, FieldOriginalDataElements,
+	}
+	for _, field := range echo {
+		if value, ok := m.Get(field); ok {
+			response.Set(field, value)
+		}
+	}
+	response.Set(FieldResponseCode, responseCode)
+	return response
+}
+
+// Pack encodes the message to its wire format
+// An error is returned if a field is unknown or a value does not fit its field
+func (m *ISOMessage) Pack() ([]byte, error) {
+	if len(m.MTI) != 4 || !isDigits(m.MTI) {
+		return nil, ErrISOInvalidMTI
+	}
+
+	fields := []int{}
+	secondary := false
+	for field := range m.Fields {
+		if _, ok := isoFields[field]; !ok {
+			return nil, fmt.Errorf("%w %d", ErrISOUnknownField, field)
+		}
+		if field > 64 {
+			secondary = true
+		}
+		fields = append(fields, field)
+	}
+	sort.Ints(fields)
+
+	bitmap := make([]byte, 8)
+	if secondary {
+		bitmap = make([]byte, 16)
+		bitmap[0] |= 0x80
+	}
+	for _, field := range fields {
+		bitmap[(field-1)/8] |= 0x80 >> uint((field-1)%8)
+	}
+
+	var builder strings.Builder
+	builder.WriteString(m.MTI)
+	builder.WriteString(strings.ToUpper(hex.EncodeToString(bitmap)))
+	for _, field := range fields {
+		encoded, err := isoFields[field].encode(m.Fields[field])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to pack field %d. %w", field, err)
+		}
+		builder.WriteString(encoded)
+	}
+
+	return []byte(builder.String()), nil
+}
+
+// UnpackISOMessage decodes a message from its wire format
+// An error is returned if the message is truncated or contains unknown fields
+func UnpackISOMessage(data []byte) (*ISOMessage, error) {
+	raw := string(data)
+	if len(raw) < 20 {
+		return nil, ErrISOMalformedMessage
+	}
+
+	message := NewISOMessage(raw[:4])
+	if !isDigits(message.MTI) {
+		return nil, ErrISOInvalidMTI
+	}
+
+	bitmap, err := hex.DecodeString(raw[4:20])
+	if err != nil {
+		return nil, ErrISOMalformedMessage
+	}
+	position := 20
+	if bitmap[0]&0x80 != 0 {
+		if len(raw) < 36 {
+			return nil, ErrISOMalformedMessage
+		}
+		secondary, err := hex.DecodeString(raw[20:36])
+		if err != nil {
+			return nil, ErrISOMalformedMessage
+		}
+		bitmap = append(bitmap, secondary...)
+		position = 36
+	}
+
+	for field := 2; field <= len(bitmap)*8; field++ {
+		if bitmap[(field-1)/8]&(0x80>>uint((field-1)%8)) == 0 {
+			continue
+		}
+		definition, ok := isoFields[field]
+		if !ok {
+			return nil, fmt.Errorf("%w %d", ErrISOUnknownField, field)
+		}
+		value, read, err := definition.decode(raw[position:])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unpack field %d. %w", field, err)
+		}
+		message.Set(field, value)
+		position += read
+	}
+
+	if position != len(raw) {
+		return nil, ErrISOMalformedMessage
+	}
+
+	return message, nil
+}
+
+func (f isoField) encode(value string) (string, error) {
+	if f.format == isoBinary {
+		if _, err := hex.DecodeString(value); err != nil || len(value) != f.length*2 {
+			return "", ErrISOInvalidFieldValue
+		}
+		return strings.ToUpper(value), nil
+	}
+	if f.format == isoNumeric && !isDigits(value) {
+		return "", ErrISOInvalidFieldValue
+	}
+	if len(value) > f.length {
+		return "", ErrISOFieldTooLong
+	}
+
+	switch {
+	case f.prefix > 0:
+		return fmt.Sprintf("%0*d%s", f.prefix, len(value), value), nil
+	case f.format == isoNumeric:
+		return isoPadNumeric(value, f.length), nil
+	default:
+		return value + strings.Repeat(" ", f.length-len(value)), nil
+	}
+}
+
+func (f isoField) decode(raw string) (string, int, error) {
+	length := f.length
+	if f.format == isoBinary {
+		length = f.length * 2
+	}
+
+	read := 0
+	if f.prefix > 0 {
+		if len(raw) < f.prefix {
+			return "", 0, ErrISOMalformedMessage
+		}
+		// the length must be digits only, Atoi also accepts a sign
+		if !isDigits(raw[:f.prefix]) {
+			return "", 0, ErrISOMalformedMessage
+		}
+		l, err := strconv.Atoi(raw[:f.prefix])
+		if err != nil || l > f.length {
+			return "", 0, ErrISOMalformedMessage
+		}
+		length = l
+		read = f.prefix
+	}
+
+	if len(raw) < read+length {
+		return "", 0, ErrISOMalformedMessage
+	}
+	value := raw[read : read+length]
+	if f.format == isoAlpha && f.prefix == 0 {
+		value = strings.TrimRight(value, " ")
+	}
+	if f.format == isoNumeric && !isDigits(value) {
+		return "", 0, ErrISOInvalidFieldValue
+	}
+	if _, err := hex.DecodeString(value); f.format == isoBinary && err != nil {
+		return "", 0, ErrISOInvalidFieldValue
+	}
+
+	return value, read + length, nil
+}
+
+// ReadISOFrame reads a single message prefixed with its length as a 2 byte big endian integer
+func ReadISOFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteISOFrame writes a single message prefixed with its length as a 2 byte big endian integer
+func WriteISOFrame(w io.Writer, data []byte) error {
+	if len(data) > math.MaxUint16 {
+		return ErrISOFieldTooLong
+	}
+	frame := make([]byte, 2, len(data)+2)
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// ISOPINBlock returns an ISO 9564 format 0 PIN block for the pin and account number as hexadecimal.
+// The block is not encrypted since the terminal and the host do not share a PIN key
+func ISOPINBlock(pin string, pan string) (string, error) {
+	if len(pin) < 4 || len(pin) > 12 || !isDigits(pin) || !isDigits(pan) {
+		return "", ErrISOInvalidFieldValue
+	}
+	pinField, _ := hex.DecodeString(fmt.Sprintf("0%X%s", len(pin), pin) + strings.Repeat("F", 14-len(pin)))
+	panField, _ := hex.DecodeString("0000" + isoPANDigits(pan))
+
+	block := make([]byte, 8)
+	for i := range block {
+		block[i] = pinField[i] ^ panField[i]
+	}
+	return strings.ToUpper(hex.EncodeToString(block)), nil
+}
+
+// ISOPINFromBlock recovers the pin from an ISO 9564 format 0 PIN block for the account number
+func ISOPINFromBlock(block string, pan string) (string, error) {
+	blockBytes, err := hex.DecodeString(block)
+	if err != nil || len(blockBytes) != 8 || !isDigits(pan) {
+		return "", ErrISOInvalidFieldValue
+	}
+	panField, _ := hex.DecodeString("0000" + isoPANDigits(pan))
+
+	pinField := make([]byte, 8)
+	for i := range pinField {
+		pinField[i] = blockBytes[i] ^ panField[i]
+	}
+	digits := strings.ToUpper(hex.EncodeToString(pinField))
+	length, err := strconv.ParseInt(digits[1:2], 16, 64)
+	if err != nil || digits[0] != '0' || length < 4 || length > 12 {
+		return "", ErrISOInvalidFieldValue
+	}
+	pin := digits[2 : 2+length]
+	if !isDigits(pin) {
+		return "", ErrISOInvalidFieldValue
+	}
+	return pin, nil
+}
+
+// SignISOMessage sets the message authentication code of the message with the key of the terminal.
+// The code is the first 8 bytes of the HMAC-SHA256 of the message packed without it
+func SignISOMessage(m *ISOMessage, key []byte) error {
+	mac, err := isoMAC(m, key)
+	if err != nil {
+		return err
+	}
+	m.Set(FieldMAC, mac)
+	return nil
+}
+
+// VerifyISOMessage is true if the message carries a message authentication code signed with the key
+func VerifyISOMessage(m *ISOMessage, key []byte) bool {
+	signature, ok := m.Get(FieldMAC)
+	if !ok || len(key) == 0 {
+		return false
+	}
+	mac, err := isoMAC(m, key)
+	return err == nil && hmac.Equal([]byte(mac), []byte(strings.ToUpper(signature)))
+}
+
+func isoMAC(m *ISOMessage, key []byte) (string, error) {
+	unsigned := NewISOMessage(m.MTI)
+	for field, value := range m.Fields {
+		if field != FieldMAC {
+			unsigned.Set(field, value)
+		}
+	}
+	data, err := unsigned.Pack()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)[:isoFields[FieldMAC].length])), nil
+}
+
+// isoPANDigits returns the 12 right most digits of the account number excluding the check digit
+func isoPANDigits(pan string) string {
+	digits := strings.Repeat("0", 13) + pan
+	digits = digits[:len(digits)-1]
+	return digits[len(digits)-12:]
+}
+
+// FormatISOAmount formats an amount in dollars as a 12 digit amount in cents
+func FormatISOAmount(amount float64) string {
+	return fmt.Sprintf("%012d", int64(math.Round(math.Abs(amount)*100)))
+}
+
+// ParseISOAmount parses a 12 digit amount in cents to dollars
+func ParseISOAmount(amount string) (float64, error) {
+	cents, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0, ErrISOInvalidFieldValue
+	}
+	return float64(cents) / 100, nil
+}
+
+// FormatISOBalance formats the available balance as an additional amount (field 54)
+func FormatISOBalance(balance float64) string {
+	sign := "C"
+	if balance < 0 {
+		sign = "D"
+	}
+	return "00" + isoAdditionalAmountAvailable + isoCurrencyUSD + sign + FormatISOAmount(balance)
+}
+
+// ParseISOBalance parses the available balance from an additional amount (field 54)
+func ParseISOBalance(additionalAmounts string) (float64, error) {
+	for i := 0; i+20 <= len(additionalAmounts); i += 20 {
+		amount := additionalAmounts[i : i+20]
+		if amount[2:4] != isoAdditionalAmountAvailable {
+			continue
+		}
+		balance, err := ParseISOAmount(amount[8:])
+		if err != nil {
+			return 0, err
+		}
+		if amount[7] == 'D' {
+			balance = -balance
+		}
+		return balance, nil
+	}
+	return 0, ErrISOInvalidFieldValue
+}
+
+// FormatISOFee formats a fee charged to the account as a transaction fee amount (field 28).
+// A negative fee is a refunded fee and is credited to the account
+func FormatISOFee(fee float64) string {
+	if fee < 0 {
+		return "C" + FormatISOAmount(fee)[4:]
+	}
+	return "D" + FormatISOAmount(fee)[4:]
+}
+
+// ParseISOFee parses a transaction fee amount (field 28)
+func ParseISOFee(fee string) (float64, error) {
+	if len(fee) != 9 || (fee[0] != 'C' && fee[0] != 'D') {
+		return 0, ErrISOInvalidFieldValue
+	}
+	amount, err := ParseISOAmount(fee[1:])
+	if fee[0] == 'C' {
+		amount = -amount
+	}
+	return amount, err
+}
+
+// FormatISOStatement formats the most recent transactions that fit in the additional data (field 48).
+// Each entry is the date time followed by the signed amount and the signed balance
+func FormatISOStatement(transactions []Transaction) string {
+	max := isoFields[FieldAdditionalData].length / isoStatementEntryLength
+	if len(transactions) > max {
+		transactions = transactions[len(transactions)-max:]
+	}
+
+	var builder strings.Builder
+	for _, transaction := range transactions {
+		builder.WriteString(fmt.Sprintf("%012d", transaction.DateTime))
+		builder.WriteString(isoSignedAmount(transaction.Amount))
+		builder.WriteString(isoSignedAmount(transaction.Balance))
+	}
+	return builder.String()
+}
+
+// ParseISOStatement parses the transactions of an account from the additional data (field 48)
+func ParseISOStatement(accountID int, statement string) ([]Transaction, error) {
+	if len(statement)%isoStatementEntryLength != 0 {
+		return []Transaction{}, ErrISOInvalidFieldValue
+	}
+
+	transactions := []Transaction{}
+	for i := 0; i < len(statement); i += isoStatementEntryLength {
+		entry := statement[i : i+isoStatementEntryLength]
+		dateTime, err := strconv.ParseInt(entry[:12], 10, 64)
+		if err != nil {
+			return []Transaction{}, ErrISOInvalidFieldValue
+		}
+		amount, err := parseISOSignedAmount(entry[12:25])
+		if err != nil {
+			return []Transaction{}, err
+		}
+		balance, err := parseISOSignedAmount(entry[25:])
+		if err != nil {
+			return []Transaction{}, err
+		}
+		transaction := Transaction{
+			AccountID: accountID,
+			DateTime:  dateTime,
+			Amount:    amount,
+			Balance:   balance,
+			Kind:      TransactionKindDeposit,
+		}
+		if amount < 0 {
+			transaction.Kind = TransactionKindWithdrawal
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, nil
+}
+
+func isoSignedAmount(amount float64) string {
+	if amount < 0 {
+		return "D" + FormatISOAmount(amount)
+	}
+	return "C" + FormatISOAmount(amount)
+}
+
+func parseISOSignedAmount(value string) (float64, error) {
+	amount, err := ParseISOAmount(value[1:])
+	if err != nil {
+		return 0, err
+	}
+	if value[0] == 'D' {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// FormatISOTransmissionDateTime formats a time as MMDDhhmmss in UTC (field 7)
+func FormatISOTransmissionDateTime(t time.Time) string {
+	return t.UTC().Format("0102150405")
+}
+
+// parseISOTransmissionDateTime parses a transmission date time (field 7) in UTC.
+// The field has no year, the year that puts the date time closest to now is used
+func parseISOTransmissionDateTime(value string, now time.Time) (time.Time, error) {
+	parsed, err := time.Parse("0102150405", value)
+	if err != nil {
+		return time.Time{}, ErrISOInvalidFieldValue
+	}
+	now = now.UTC()
+	closest := time.Time{}
+	for year := now.Year() - 1; year <= now.Year()+1; year++ {
+		candidate := time.Date(year, parsed.Month(), parsed.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), 0, time.UTC)
+		if closest.IsZero() || candidate.Sub(now).Abs() < closest.Sub(now).Abs() {
+			closest = candidate
+		}
+	}
+	return closest, nil
+}
+
+// FormatISOOriginalData formats the original data elements (field 90) of the message being reversed
+func FormatISOOriginalData(original *ISOMessage) string {
+	stan, _ := original.Get(FieldSTAN)
+	dateTime, _ := original.Get(FieldTransmissionDateTime)
+	return original.MTI + isoPadNumeric(stan, 6) + isoPadNumeric(dateTime, 10) + strings.Repeat("0", 22)
+}
+
+func isoPadNumeric(value string, length int) string {
+	if len(value) >= length {
+		return value
+	}
+	return strings.Repeat("0", length-len(value)) + value
+}
+
+func isoResponseMTI(mti string) string {
+	if len(mti) != 4 {
+		return mti
+	}
+	return mti[:2] + string(mti[2]+1) + mti[3:]
+}
+
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package atm_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestISOMessagePackUnpack(t *testing.T) {
+	message := atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldPAN, "12345678")
+	message.Set(atm.FieldProcessingCode, atm.ProcessingCodeWithdrawal)
+	message.Set(atm.FieldAmount, atm.FormatISOAmount(40))
+	message.Set(atm.FieldSTAN, "42")
+	message.Set(atm.FieldTerminalID, "TERM01")
+
+	data, err := message.Pack()
+	assertNoError(t, err)
+
+	// MTI, primary bitmap, LLVAR PAN, processing code, amount, STAN and padded terminal ID
+	expected := "0200" + "7020000000800000" + "0812345678" + "010000" + "000000004000" + "000042" + "TERM01  "
+	if string(data) != expected {
+		t.Errorf("Packed message is incorrect. '%s' should be '%s'", string(data), expected)
+	}
+
+	unpacked, err := atm.UnpackISOMessage(data)
+	assertNoError(t, err)
+	if unpacked.MTI != atm.MTIFinancialRequest {
+		t.Errorf("MTI is incorrect")
+	}
+	if pan, _ := unpacked.Get(atm.FieldPAN); pan != "12345678" {
+		t.Errorf("PAN is incorrect")
+	}
+	if stan, _ := unpacked.Get(atm.FieldSTAN); stan != "000042" {
+		t.Errorf("STAN is incorrect")
+	}
+	if terminalID, _ := unpacked.Get(atm.FieldTerminalID); terminalID != "TERM01" {
+		t.Errorf("Terminal ID is incorrect")
+	}
+	amount, err := atm.ParseISOAmount(unpacked.Fields[atm.FieldAmount])
+	assertNoError(t, err)
+	if amount != 40 {
+		t.Errorf("Amount is incorrect")
+	}
+}
+
+func TestISOMessageSecondaryBitmap(t *testing.T) {
+	original := atm.NewISOMessage(atm.MTIFinancialRequest)
+	original.Set(atm.FieldSTAN, "000042")
+	original.Set(atm.FieldTransmissionDateTime, "1019120000")
+
+	message := atm.NewISOMessage(atm.MTIReversalAdvice)
+	message.Set(atm.FieldSTAN, "000043")
+	message.Set(atm.FieldOriginalDataElements, atm.FormatISOOriginalData(original))
+
+	data, err := message.Pack()
+	assertNoError(t, err)
+
+	unpacked, err := atm.UnpackISOMessage(data)
+	assertNoError(t, err)
+	originalData, _ := unpacked.Get(atm.FieldOriginalDataElements)
+	if originalData[:20] != "02000000421019120000" {
+		t.Errorf("Original data elements are incorrect. %s", originalData)
+	}
+}
+
+func TestISOMessageInvalid(t *testing.T) {
+	// unknown field
+	message := atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(100, "1")
+	_, err := message.Pack()
+	assertError(t, err)
+
+	// numeric field with letters
+	message = atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldAmount, "abc")
+	_, err = message.Pack()
+	assertError(t, err)
+
+	// field too long
+	message = atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldResponseCode, "000")
+	_, err = message.Pack()
+	assertError(t, err)
+
+	// invalid MTI
+	message = atm.NewISOMessage("02")
+	_, err = message.Pack()
+	assertErrorIsError(t, err, atm.ErrISOInvalidMTI)
+
+	// truncated message
+	_, err = atm.UnpackISOMessage([]byte("0200702000000080000008123"))
+	assertError(t, err)
+
+	// length prefixes that are not digits
+	for _, prefix := range []string{"-1", "+1", " 1", "1-"} {
+		_, err = atm.UnpackISOMessage([]byte(atm.MTIAuthorizationRequest + "4000000000000000" + prefix + "1234"))
+		assertErrorContains(t, err, atm.ErrISOMalformedMessage.Error())
+	}
+
+	// binary fields that are not hex
+	message = atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldPINData, "ABCDEF0123456789")
+	data, err := message.Pack()
+	assertNoError(t, err)
+	_, err = atm.UnpackISOMessage(bytes.Replace(data, []byte("ABCDEF0123456789"), []byte("ZZZZZZZZZZZZZZZZ"), 1))
+	assertErrorContains(t, err, atm.ErrISOInvalidFieldValue.Error())
+}
+
+func FuzzUnpackISOMessage(f *testing.F) {
+	f.Add([]byte("0100" + "4000000000000000" + "-1"))
+	f.Add([]byte("0200702000000080000008123"))
+	message := atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldPAN, "12345678")
+	message.Set(atm.FieldAmount, "000000002000")
+	message.Set(atm.FieldOriginalDataElements, "020000004210191200000000000000000000000000")
+	if data, err := message.Pack(); err == nil {
+		f.Add(data)
+	}
+	// a PIN block that is not hex
+	message = atm.NewISOMessage(atm.MTIFinancialRequest)
+	message.Set(atm.FieldPINData, "ABCDEF0123456789")
+	if data, err := message.Pack(); err == nil {
+		f.Add(bytes.Replace(data, []byte("ABCDEF0123456789"), []byte("ZZZZZZZZZZZZZZZZ"), 1))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := atm.UnpackISOMessage(data)
+		if err != nil {
+			return
+		}
+		// a message that unpacks packs again
+		if _, err := message.Pack(); err != nil {
+			t.Errorf("Unpacked message does not pack. %s", err)
+		}
+	})
+}
+
+func TestISOResponse(t *testing.T) {
+	request := atm.NewISOMessage(atm.MTIReversalAdvice)
+	request.Set(atm.FieldSTAN, "000001")
+	request.Set(atm.FieldPINData, "0000000000000000")
+
+	response := request.Response(atm.ResponseApproved)
+	if response.MTI != atm.MTIReversalResponse {
+		t.Errorf("Response MTI is incorrect. %s", response.MTI)
+	}
+	if !response.Has(atm.FieldSTAN) {
+		t.Errorf("Response should echo the STAN")
+	}
+	if response.Has(atm.FieldPINData) {
+		t.Errorf("Response should not echo the PIN block")
+	}
+}
+
+func TestISOPINBlock(t *testing.T) {
+	block, err := atm.ISOPINBlock("1234", "43219876543210987")
+	assertNoError(t, err)
+	if block != "0412AC89ABCDEF67" {
+		t.Errorf("PIN block is incorrect. %s", block)
+	}
+
+	pin, err := atm.ISOPINFromBlock(block, "43219876543210987")
+	assertNoError(t, err)
+	if pin != "1234" {
+		t.Errorf("PIN recovered from block is incorrect. %s", pin)
+	}
+
+	_, err = atm.ISOPINBlock("12", "12345678")
+	assertError(t, err)
+}
+
+func TestISOBalance(t *testing.T) {
+	balance, err := atm.ParseISOBalance(atm.FormatISOBalance(-14.76))
+	assertNoError(t, err)
+	if balance != -14.76 {
+		t.Errorf("Balance is incorrect. %.2f", balance)
+	}
+}
+
+func TestISOFrame(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	err := atm.WriteISOFrame(buffer, []byte("0800"))
+	assertNoError(t, err)
+	if !bytes.Equal(buffer.Bytes(), []byte{0, 4, '0', '8', '0', '0'}) {
+		t.Errorf("Frame is incorrect")
+	}
+
+	data, err := atm.ReadISOFrame(buffer)
+	assertNoError(t, err)
+	if string(data) != "0800" {
+		t.Errorf("Frame data is incorrect")
+	}
+}
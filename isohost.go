@@ -0,0 +1,538 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultISOApprovalsRetained is the number of approved requests the host remembers to locate the original of a reversal
+const DefaultISOApprovalsRetained = 10000
+
+// DefaultISOMaxClockSkew is how far the transmission date time of a request that moves money may be from the clock of the host
+const DefaultISOMaxClockSkew = 5 * time.Minute
+
+// ISOHost serves ISO 8583 messages from terminals using the host
+type ISOHost struct {
+	Host *Host
+	// TerminalKeys are the keys the messages of each terminal ID are signed with.
+	// Messages that move money or return account data without a PIN block are only answered for a terminal signing with its key
+	TerminalKeys map[string][]byte
+	// ApprovalsRetained is the number of approved requests remembered to locate the original of a reversal, defaults to DefaultISOApprovalsRetained
+	ApprovalsRetained int
+	// MaxClockSkew is how far the transmission date time of a request that moves money may be from the clock of the host,
+	// defaults to DefaultISOMaxClockSkew
+	MaxClockSkew time.Duration
+	// Now returns the time requests are checked for freshness at, time.Now if not set
+	Now func() time.Time
+
+	mutex sync.Mutex
+	// requests that move money seen within MaxClockSkew keyed by terminal ID, STAN and transmission date time
+	seen map[string]time.Time
+	// approved financial requests keyed by terminal ID, STAN and transmission date time
+	approved map[string]isoApproval
+	// keys of approved keyed by transaction ID
+	references map[string]string
+	// keys of approved in the order they were approved, the oldest is forgotten first
+	approvals []string
+	sequence  int
+}
+
+// isoApproval is a transaction posted for a request and the terminal and account it was posted for
+type isoApproval struct {
+	TransactionID string
+	TerminalID    string
+	AccountID     int
+}
+
+// Handle processes a request message and returns the response message
+// An error is returned if the message type is not a request supported by the host
+func (h *ISOHost) Handle(request *ISOMessage) (*ISOMessage, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// a signed message is refused if the signature is not valid, even if it also carries a PIN block
+	if request.Has(FieldMAC) && !h.authenticated(request) && isISORequestMTI(request.MTI) {
+		return request.Response(ResponseSecurityViolation), nil
+	}
+	if code := h.fresh(request); code != ResponseApproved {
+		return request.Response(code), nil
+	}
+
+	switch request.MTI {
+	case MTIAuthorizationRequest:
+		return h.authorization(request), nil
+	case MTIFinancialRequest:
+		return h.financial(request), nil
+	case MTIFinancialAdvice:
+		return h.advice(request), nil
+	case MTIReversalAdvice:
+		return h.reversal(request), nil
+	}
+	return nil, ErrISOUnsupportedMTI
+}
+
+// Serve accepts connections on the listener and answers length prefixed ISO 8583 messages until the listener is closed
+func (h *ISOHost) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go h.serveConn(conn)
+	}
+}
+
+func (h *ISOHost) serveConn(conn net.Conn) {
+	defer conn.Close()
+	logger := h.logger().With("remote", conn.RemoteAddr().String())
+	// a message that panics closes its own connection, never the host
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("connection closed on a panic", "panic", fmt.Sprint(r))
+		}
+	}()
+	for {
+		data, err := ReadISOFrame(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logger.Warn("connection closed", logError(err))
+			return
+		}
+		var response *ISOMessage
+		terminalID := ""
+		request, err := UnpackISOMessage(data)
+		if err != nil {
+			// a malformed request is answered with a format error, anything else closes the connection
+			if len(data) < 4 || !isISORequestMTI(string(data[:4])) {
+				logger.Warn("connection closed on a malformed message", logError(err))
+				return
+			}
+			logger.Warn("malformed message", "mti", string(data[:4]), logError(err))
+			request = NewISOMessage(string(data[:4]))
+			response = request.Response(ResponseFormatError)
+		} else {
+			terminalID, _ = request.Get(FieldTerminalID)
+			response, err = h.Handle(request)
+			if err != nil {
+				logger.Warn("connection closed on an unsupported message", LogKeyTerminal, terminalID, "mti", request.MTI, logError(err))
+				return
+			}
+		}
+		code, _ := response.Get(FieldResponseCode)
+		level := slog.LevelDebug
+		if code == ResponseSystemMalfunction {
+			level = slog.LevelError
+		}
+		transactionID, _ := response.Get(FieldRetrievalReference)
+		logger.Log(context.Background(), level, "request answered", LogKeyTerminal, terminalID, "mti", request.MTI, "response_code", code, LogKeyTransactionID, transactionID)
+		data, err = response.Pack()
+		if err != nil {
+			logger.Error("response not packed", LogKeyTerminal, terminalID, logError(err))
+			return
+		}
+		if err = WriteISOFrame(conn, data); err != nil {
+			logger.Warn("connection closed", LogKeyTerminal, terminalID, logError(err))
+			return
+		}
+	}
+}
+
+// isISORequestMTI is true for the message types the host answers
+func isISORequestMTI(mti string) bool {
+	switch mti {
+	case MTIAuthorizationRequest, MTIFinancialRequest, MTIFinancialAdvice, MTIReversalAdvice:
+		return true
+	}
+	return false
+}
+
+// logger is the logger of the host
+func (h *ISOHost) logger() *slog.Logger {
+	if h.Host == nil {
+		return discardLogger
+	}
+	return h.Host.logger()
+}
+
+// authorization answers balance inquiries and withdrawal authorizations without moving money.
+// The PIN block is required
+func (h *ISOHost) authorization(request *ISOMessage) *ISOMessage {
+	if !request.Has(FieldPINData) {
+		return request.Response(ResponseFormatError)
+	}
+	accountID, code := h.account(request)
+	if code != ResponseApproved {
+		return request.Response(code)
+	}
+
+	balance, err := h.Host.Balance(accountID)
+	if err != nil {
+		return request.Response(isoResponseCode(err))
+	}
+
+	processingCode, _ := request.Get(FieldProcessingCode)
+	switch processingCode {
+	case ProcessingCodeBalanceInquiry:
+	case ProcessingCodeWithdrawal:
+		if _, code := isoRequestAmount(request); code != ResponseApproved {
+			return request.Response(code)
+		}
+		if balance < 0 {
+			return request.Response(ResponseInsufficientFunds)
+		}
+	default:
+		return request.Response(ResponseInvalidTransaction)
+	}
+
+	return h.approve(request, balance)
+}
+
+// financial answers balance inquiries and mini statements and posts withdrawals and deposits to the ledger
+func (h *ISOHost) financial(request *ISOMessage) *ISOMessage {
+	accountID, code := h.account(request)
+	if code != ResponseApproved {
+		return request.Response(code)
+	}
+
+	processingCode, _ := request.Get(FieldProcessingCode)
+	switch processingCode {
+	case ProcessingCodeBalanceInquiry:
+		balance, err := h.Host.Balance(accountID)
+		if err != nil {
+			return request.Response(isoResponseCode(err))
+		}
+		return h.approve(request, balance)
+
+	case ProcessingCodeMiniStatement:
+		balance, err := h.Host.Balance(accountID)
+		if err != nil {
+			return request.Response(isoResponseCode(err))
+		}
+		transactions, err := h.Host.History(accountID)
+		if err != nil {
+			return request.Response(isoResponseCode(err))
+		}
+		response := h.approve(request, balance)
+		response.Set(FieldAdditionalData, FormatISOStatement(transactions))
+		return response
+
+	case ProcessingCodeDeposit:
+		amount, code := isoRequestAmount(request)
+		if code != ResponseApproved {
+			return request.Response(code)
+		}
+		idempotencyKey, _ := request.Get(FieldTransportData)
+		result, err := h.Host.Deposit(accountID, amount, idempotencyKey)
+		if err != nil {
+			return h.failed(request, result, err)
+		}
+		return h.posted(request, result)
+
+	case ProcessingCodeWithdrawal:
+		amount, code := isoRequestAmount(request)
+		if code != ResponseApproved {
+			return request.Response(code)
+		}
+		idempotencyKey, _ := request.Get(FieldTransportData)
+		result, err := h.Host.Withdraw(accountID, amount, idempotencyKey)
+		if err != nil {
+			return h.failed(request, result, err)
+		}
+		return h.posted(request, result)
+	}
+
+	return request.Response(ResponseInvalidTransaction)
+}
+
+// advice posts a withdrawal that the terminal approved in stand-in.
+// The additional data carries the time the cash was dispensed and the transport data its stand-in ID
+func (h *ISOHost) advice(request *ISOMessage) *ISOMessage {
+	accountID, code := h.account(request)
+	if code != ResponseApproved {
+		return request.Response(code)
+	}
+	if processingCode, _ := request.Get(FieldProcessingCode); processingCode != ProcessingCodeWithdrawal {
+		return request.Response(ResponseInvalidTransaction)
+	}
+	amount, code := isoRequestAmount(request)
+	if code != ResponseApproved {
+		return request.Response(code)
+	}
+	dateTime, err := strconv.ParseInt(request.Fields[FieldAdditionalData], 10, 64)
+	if err != nil {
+		return request.Response(ResponseFormatError)
+	}
+
+	standInID, _ := request.Get(FieldTransportData)
+	result, err := h.Host.Advice(accountID, amount, dateTime, standInID)
+	if err != nil {
+		return h.failed(request, result, err)
+	}
+	return h.posted(request, result)
+}
+
+// reversal posts a compensating transaction for the original transaction.
+// The original is identified by its retrieval reference number or by its original data elements,
+// the additional data carries the reason for the reversal. Only an authenticated terminal may reverse
+// and only a transaction approved for that terminal and, if the reversal names one, for that account
+func (h *ISOHost) reversal(request *ISOMessage) *ISOMessage {
+	if !h.authenticated(request) {
+		return request.Response(ResponseSecurityViolation)
+	}
+	terminalID, _ := request.Get(FieldTerminalID)
+	transactionID, _ := request.Get(FieldRetrievalReference)
+	key := h.references[transactionID]
+	if original, ok := request.Get(FieldOriginalDataElements); ok && transactionID == "" {
+		if len(original) != 42 {
+			return request.Response(ResponseFormatError)
+		}
+		key = terminalID + ":" + original[4:10] + ":" + original[10:20]
+	}
+	approval, ok := h.approved[key]
+	if !ok || approval.TerminalID != terminalID {
+		return request.Response(ResponseUnableToLocateOriginal)
+	}
+	if pan, ok := request.Get(FieldPAN); ok && pan != strconv.Itoa(approval.AccountID) {
+		return request.Response(ResponseUnableToLocateOriginal)
+	}
+
+	reason, _ := request.Get(FieldAdditionalData)
+	result, err := h.Host.Reverse(approval.TransactionID, reason)
+	if err != nil {
+		return request.Response(isoResponseCode(err))
+	}
+	return h.posted(request, result)
+}
+
+// account returns the account referenced by the primary account number.
+// The PIN block is verified if present, otherwise the request must come from an authenticated terminal
+func (h *ISOHost) account(request *ISOMessage) (int, string) {
+	pan, ok := request.Get(FieldPAN)
+	if !ok {
+		return 0, ResponseFormatError
+	}
+	accountID, err := strconv.Atoi(pan)
+	if err != nil {
+		return 0, ResponseInvalidCardNumber
+	}
+
+	block, ok := request.Get(FieldPINData)
+	if !ok {
+		if !h.authenticated(request) {
+			return 0, ResponseSecurityViolation
+		}
+		return accountID, ResponseApproved
+	}
+	pin, err := ISOPINFromBlock(block, pan)
+	if err != nil {
+		return 0, ResponseIncorrectPIN
+	}
+	if err := h.Host.Authorize(accountID, pin); err != nil {
+		return 0, isoResponseCode(err)
+	}
+
+	return accountID, ResponseApproved
+}
+
+// fresh checks a request that moves money was sent within MaxClockSkew and was not seen before,
+// so a captured request cannot be sent again to move money twice.
+// Only requests that are signed or carry a PIN block are remembered, the host refuses the others
+func (h *ISOHost) fresh(request *ISOMessage) string {
+	switch request.MTI {
+	case MTIFinancialRequest, MTIFinancialAdvice, MTIReversalAdvice:
+	default:
+		return ResponseApproved
+	}
+	now := time.Now()
+	if h.Now != nil {
+		now = h.Now()
+	}
+	skew := h.MaxClockSkew
+	if skew <= 0 {
+		skew = DefaultISOMaxClockSkew
+	}
+
+	value, ok := request.Get(FieldTransmissionDateTime)
+	if !ok {
+		return ResponseFormatError
+	}
+	sent, err := parseISOTransmissionDateTime(value, now)
+	if err != nil {
+		return ResponseFormatError
+	}
+	if sent.Before(now.Add(-skew)) || sent.After(now.Add(skew)) {
+		return ResponseSecurityViolation
+	}
+
+	if !request.Has(FieldMAC) && !request.Has(FieldPINData) {
+		return ResponseApproved
+	}
+	if h.seen == nil {
+		h.seen = map[string]time.Time{}
+	}
+	// a request older than the skew is refused as stale, it no longer has to be remembered
+	for key, at := range h.seen {
+		if at.Before(now.Add(-skew)) {
+			delete(h.seen, key)
+		}
+	}
+	key := isoApprovalKey(request)
+	if _, ok := h.seen[key]; ok {
+		return ResponseDuplicateTransmission
+	}
+	h.seen[key] = sent
+	return ResponseApproved
+}
+
+// authenticated is true if the request is signed with the key of its terminal
+func (h *ISOHost) authenticated(request *ISOMessage) bool {
+	terminalID, _ := request.Get(FieldTerminalID)
+	key, ok := h.TerminalKeys[terminalID]
+	return ok && VerifyISOMessage(request, key)
+}
+
+// approve returns an approved response carrying the available balance and an authorization ID
+func (h *ISOHost) approve(request *ISOMessage, balance float64) *ISOMessage {
+	h.sequence = (h.sequence + 1) % 1000000
+	response := request.Response(ResponseApproved)
+	response.Set(FieldAuthorizationID, fmt.Sprintf("%06d", h.sequence))
+	response.Set(FieldAdditionalAmounts, FormatISOBalance(balance))
+	return response
+}
+
+// posted returns an approved response for a transaction posted to the ledger.
+// The transaction ID is returned as the retrieval reference number and a replayed result is marked in the additional response data
+func (h *ISOHost) posted(request *ISOMessage, result HostResult) *ISOMessage {
+	terminalID, _ := request.Get(FieldTerminalID)
+	h.remember(isoApprovalKey(request), isoApproval{TransactionID: result.TransactionID, TerminalID: terminalID, AccountID: result.AccountID})
+
+	response := h.approve(request, result.Balance)
+	response.Set(FieldRetrievalReference, result.TransactionID)
+	response.Set(FieldTransactionFee, FormatISOFee(result.Fee))
+	// a reversal names its original by reference only, the response tells the terminal its account
+	if _, ok := response.Get(FieldPAN); !ok && result.AccountID != 0 {
+		response.Set(FieldPAN, strconv.Itoa(result.AccountID))
+	}
+	if result.Replayed {
+		response.Set(FieldAdditionalResponse, isoAdditionalResponseReplayed)
+	}
+	return response
+}
+
+// failed returns the response of a request the host failed to post.
+// A transaction that reached the ledger before the failure is named by its retrieval reference number
+func (h *ISOHost) failed(request *ISOMessage, result HostResult, err error) *ISOMessage {
+	response := request.Response(isoResponseCode(err))
+	if result.TransactionID != "" {
+		response.Set(FieldRetrievalReference, result.TransactionID)
+	}
+	return response
+}
+
+// remember keeps the transaction of an approved request, forgetting the oldest once ApprovalsRetained are kept
+func (h *ISOHost) remember(key string, approval isoApproval) {
+	if h.approved == nil {
+		h.approved = map[string]isoApproval{}
+		h.references = map[string]string{}
+	}
+	if _, ok := h.approved[key]; !ok {
+		h.approvals = append(h.approvals, key)
+	}
+	h.approved[key] = approval
+	// a transaction replayed for another request stays with the request it was posted for
+	if _, ok := h.references[approval.TransactionID]; !ok {
+		h.references[approval.TransactionID] = key
+	}
+
+	retained := h.ApprovalsRetained
+	if retained <= 0 {
+		retained = DefaultISOApprovalsRetained
+	}
+	for len(h.approvals) > retained {
+		if forgotten := h.approved[h.approvals[0]]; h.references[forgotten.TransactionID] == h.approvals[0] {
+			delete(h.references, forgotten.TransactionID)
+		}
+		delete(h.approved, h.approvals[0])
+		h.approvals = h.approvals[1:]
+	}
+}
+
+// isoResponseCode converts an error returned by the host to a response code, the error may wrap the error of the host
+func isoResponseCode(err error) string {
+	switch {
+	case err == nil:
+		return ResponseApproved
+	case errors.Is(err, ErrHostStoreUnavailable):
+		return ResponseSystemMalfunction
+	case errors.Is(err, ErrAccountNotFound):
+		return ResponseInvalidCardNumber
+	case errors.Is(err, ErrAuthorizationUnsuccessful):
+		return ResponseIncorrectPIN
+	case errors.Is(err, ErrAuthorizationLocked):
+		return ResponsePINTriesExceeded
+	case errors.Is(err, ErrWithdrawAccountOverdrawn):
+		return ResponseInsufficientFunds
+	case errors.Is(err, ErrTransactionNotFound):
+		return ResponseUnableToLocateOriginal
+	case errors.Is(err, ErrTransactionAlreadyReversed):
+		return ResponseDuplicateTransmission
+	case errors.Is(err, ErrTransactionNotReversible):
+		return ResponseInvalidTransaction
+	case errors.Is(err, ErrIdempotencyKeyInvalid):
+		return ResponseFormatError
+	case errors.Is(err, ErrIdempotencyKeyMismatch):
+		return ResponseDuplicateTransmission
+	}
+	return ResponseSystemMalfunction
+}
+
+// isoResponseError converts a response code to the error returned by the host
+func isoResponseError(code string) error {
+	switch code {
+	case ResponseApproved:
+		return nil
+	case ResponseInvalidCardNumber:
+		return ErrAccountNotFound
+	case ResponseIncorrectPIN:
+		return ErrAuthorizationUnsuccessful
+	case ResponsePINTriesExceeded:
+		return ErrAuthorizationLocked
+	case ResponseInsufficientFunds:
+		return ErrWithdrawAccountOverdrawn
+	case ResponseSystemMalfunction:
+		return ErrHostStoreUnavailable
+	case ResponseUnableToLocateOriginal:
+		return ErrTransactionNotFound
+	case ResponseDuplicateTransmission:
+		return ErrTransactionAlreadyReversed
+	}
+	return fmt.Errorf("%w Response code %s", ErrHostDeclined, code)
+}
+
+func isoRequestAmount(request *ISOMessage) (float64, string) {
+	value, ok := request.Get(FieldAmount)
+	if !ok {
+		return 0, ResponseFormatError
+	}
+	amount, err := ParseISOAmount(value)
+	if err != nil || amount <= 0 {
+		return 0, ResponseInvalidAmount
+	}
+	return amount, ResponseApproved
+}
+
+func isoApprovalKey(request *ISOMessage) string {
+	terminalID, _ := request.Get(FieldTerminalID)
+	stan, _ := request.Get(FieldSTAN)
+	dateTime, _ := request.Get(FieldTransmissionDateTime)
+	return terminalID + ":" + isoPadNumeric(stan, 6) + ":" + isoPadNumeric(dateTime, 10)
+}
@@ -0,0 +1,369 @@
+package atm_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newISORequest(t *testing.T, mti string, processingCode string, stan string, amount float64, pin string) *atm.ISOMessage {
+	request := atm.NewISOMessage(mti)
+	request.Set(atm.FieldPAN, "12345678")
+	request.Set(atm.FieldProcessingCode, processingCode)
+	request.Set(atm.FieldSTAN, stan)
+	request.Set(atm.FieldTransmissionDateTime, atm.FormatISOTransmissionDateTime(time.Now()))
+	request.Set(atm.FieldTerminalID, "TERM0001")
+	if amount > 0 {
+		request.Set(atm.FieldAmount, atm.FormatISOAmount(amount))
+	}
+	if pin != "" {
+		block, err := atm.ISOPINBlock(pin, "12345678")
+		assertNoError(t, err)
+		request.Set(atm.FieldPINData, block)
+	}
+	return request
+}
+
+func assertISOResponse(t *testing.T, response *atm.ISOMessage, err error, mti string, code string) {
+	assertNoError(t, err)
+	if response.MTI != mti {
+		t.Errorf("Response MTI is incorrect. '%s' should be '%s'", response.MTI, mti)
+	}
+	if responseCode, _ := response.Get(atm.FieldResponseCode); responseCode != code {
+		t.Errorf("Response code is incorrect. '%s' should be '%s'", responseCode, code)
+	}
+}
+
+func assertISOBalance(t *testing.T, response *atm.ISOMessage, expected float64) {
+	balance, err := atm.ParseISOBalance(response.Fields[atm.FieldAdditionalAmounts])
+	assertNoError(t, err)
+	if balance != expected {
+		t.Errorf("Balance is incorrect. %.2f should be %.2f", balance, expected)
+	}
+}
+
+func TestISOHostBalanceInquiry(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}}
+
+	// incorrect PIN
+	response, err := host.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "1", 0, "0000"))
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseIncorrectPIN)
+
+	// missing PIN
+	response, err = host.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "2", 0, ""))
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseFormatError)
+
+	// unknown account
+	request := newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "3", 0, "1234")
+	request.Set(atm.FieldPAN, "87654321")
+	response, err = host.Handle(request)
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseInvalidCardNumber)
+
+	// valid balance inquiry
+	response, err = host.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "4", 0, "1234"))
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 100.12)
+}
+
+func TestISOHostWrappedError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"account closed", fmt.Errorf("%w Account was closed.", atm.ErrAccountNotFound), atm.ResponseInvalidCardNumber},
+		{"store failed", errors.New("disk is full"), atm.ResponseSystemMalfunction},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			accountDB := AccountDBTest{getAccount: defaultAccount, getAccountError: test.err}
+			host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: TransactionDBTest{}}}
+			response, err := host.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "1", 0, "1234"))
+			assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, test.code)
+		})
+	}
+}
+
+func TestISOHostWithdrawal(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}}
+
+	// authorization does not move money
+	response, err := host.Handle(newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeWithdrawal, "1", 40, "1234"))
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 100.12)
+
+	// missing amount
+	response, err = host.Handle(newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "2", 0, "1234"))
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseFormatError)
+
+	// valid withdrawal
+	response, err = host.Handle(newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "3", 40, "1234"))
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 60.12)
+
+	// overdraft is charged a fee
+	response, err = host.Handle(newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "4", 80, "1234"))
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, -24.88)
+
+	// overdrawn account is declined
+	response, err = host.Handle(newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "5", 20, "1234"))
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseInsufficientFunds)
+
+	transactions, err := transactionDB.Get(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 2 {
+		t.Errorf("Invalid number of transactions posted. %d", len(transactions))
+	}
+
+	// unsupported message type
+	_, err = host.Handle(atm.NewISOMessage("0800"))
+	assertErrorIsError(t, err, atm.ErrISOUnsupportedMTI)
+}
+
+func TestISOHostAuthentication(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	key := []byte("secret")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key}}
+
+	// money is not moved and account data is not returned without a PIN block or a signature
+	for i, processingCode := range []string{atm.ProcessingCodeWithdrawal, atm.ProcessingCodeDeposit, atm.ProcessingCodeBalanceInquiry, atm.ProcessingCodeMiniStatement} {
+		response, err := host.Handle(newISORequest(t, atm.MTIFinancialRequest, processingCode, strconv.Itoa(i+1), 20, ""))
+		assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseSecurityViolation)
+	}
+	advice := newISORequest(t, atm.MTIFinancialAdvice, atm.ProcessingCodeWithdrawal, "5", 20, "")
+	advice.Set(atm.FieldAdditionalData, "1700000000")
+	response, err := host.Handle(advice)
+	assertISOResponse(t, response, err, atm.MTIFinancialAdviceResponse, atm.ResponseSecurityViolation)
+
+	// a signature of another key or of another message is refused, even with a PIN block
+	request := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "6", 20, "1234")
+	assertNoError(t, atm.SignISOMessage(request, []byte("guess")))
+	response, err = host.Handle(request)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseSecurityViolation)
+
+	request = newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "7", 20, "")
+	assertNoError(t, atm.SignISOMessage(request, key))
+	request.Set(atm.FieldAmount, atm.FormatISOAmount(100))
+	response, err = host.Handle(request)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseSecurityViolation)
+
+	// a terminal without a key cannot sign
+	request = newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "8", 20, "")
+	request.Set(atm.FieldTerminalID, "TERM0002")
+	assertNoError(t, atm.SignISOMessage(request, key))
+	response, err = host.Handle(request)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseSecurityViolation)
+
+	transactions, err := transactionDB.Get(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 0 {
+		t.Fatalf("Unauthenticated requests should not post. %+v", transactions)
+	}
+
+	// a signed request is answered without a PIN block
+	request = newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "9", 20, "")
+	assertNoError(t, atm.SignISOMessage(request, key))
+	response, err = host.Handle(request)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 80)
+}
+
+func TestISOHostApprovalsRetained(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	key := []byte("secret")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key}, ApprovalsRetained: 1}
+
+	first := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "1", 20, "1234")
+	response, err := host.Handle(first)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	second := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "2", 20, "1234")
+	response, err = host.Handle(second)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+
+	// only the most recent approval is remembered
+	for _, test := range []struct {
+		original *atm.ISOMessage
+		code     string
+		stan     string
+	}{{first, atm.ResponseUnableToLocateOriginal, "3"}, {second, atm.ResponseApproved, "4"}} {
+		reversal := newISORequest(t, atm.MTIReversalAdvice, atm.ProcessingCodeWithdrawal, test.stan, 20, "")
+		reversal.Set(atm.FieldOriginalDataElements, atm.FormatISOOriginalData(test.original))
+		assertNoError(t, atm.SignISOMessage(reversal, key))
+		response, err = host.Handle(reversal)
+		assertISOResponse(t, response, err, atm.MTIReversalResponse, test.code)
+	}
+}
+
+func TestISOHostReversal(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,20.00\n", "")
+	key := []byte("secret")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key, "TERM0002": key}}
+
+	original := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "7", 40, "1234")
+	response, err := host.Handle(original)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, -25)
+
+	reversal := newISORequest(t, atm.MTIReversalAdvice, atm.ProcessingCodeWithdrawal, "8", 40, "")
+	reversal.Set(atm.FieldOriginalDataElements, atm.FormatISOOriginalData(original))
+
+	// an unsigned reversal is refused
+	response, err = host.Handle(reversal)
+	assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseSecurityViolation)
+	assertNoError(t, atm.SignISOMessage(reversal, key))
+
+	// reversal restores the amount and the overdraft fee
+	response, err = host.Handle(reversal)
+	assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 20)
+
+	// repeated reversal advice is refused without crediting again
+	reversal.Set(atm.FieldSTAN, "000012")
+	assertNoError(t, atm.SignISOMessage(reversal, key))
+	response, err = host.Handle(reversal)
+	assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseDuplicateTransmission)
+
+	// reversal by retrieval reference number with a reason
+	deposit := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeDeposit, "10", 15, "")
+	assertNoError(t, atm.SignISOMessage(deposit, key))
+	response, err = host.Handle(deposit)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 35)
+	depositID, _ := response.Get(atm.FieldRetrievalReference)
+
+	// only the terminal and account the deposit was posted for may reverse it
+	for _, test := range []struct {
+		stan       string
+		terminalID string
+		pan        string
+	}{{"14", "TERM0002", "12345678"}, {"15", "TERM0001", "87654321"}} {
+		other := newISORequest(t, atm.MTIReversalAdvice, atm.ProcessingCodeDeposit, test.stan, 0, "")
+		other.Set(atm.FieldTerminalID, test.terminalID)
+		other.Set(atm.FieldPAN, test.pan)
+		other.Set(atm.FieldRetrievalReference, depositID)
+		assertNoError(t, atm.SignISOMessage(other, key))
+		response, err = host.Handle(other)
+		assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseUnableToLocateOriginal)
+	}
+
+	reversal = newISORequest(t, atm.MTIReversalAdvice, atm.ProcessingCodeDeposit, "11", 0, "")
+	reversal.Set(atm.FieldRetrievalReference, depositID)
+	reversal.Set(atm.FieldAdditionalData, "Deposit entered wrongly")
+	assertNoError(t, atm.SignISOMessage(reversal, key))
+	response, err = host.Handle(reversal)
+	assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 20)
+
+	transactions, err := transactionDB.Get(12345678)
+	assertNoError(t, err)
+	last := transactions[len(transactions)-1]
+	if last.Kind != atm.TransactionKindReversal || last.ReversalOf != depositID || last.Reason != "Deposit entered wrongly" {
+		t.Errorf("Reversal is not linked to the original transaction. %+v", last)
+	}
+
+	// unknown original
+	delete(reversal.Fields, atm.FieldRetrievalReference)
+	unknown := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "9", 40, "1234")
+	reversal.Set(atm.FieldOriginalDataElements, atm.FormatISOOriginalData(unknown))
+	reversal.Set(atm.FieldSTAN, "000013")
+	assertNoError(t, atm.SignISOMessage(reversal, key))
+	response, err = host.Handle(reversal)
+	assertISOResponse(t, response, err, atm.MTIReversalResponse, atm.ResponseUnableToLocateOriginal)
+}
+
+func TestISOHostReplay(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	key := []byte("secret")
+	now := time.Date(2026, time.January, 1, 0, 1, 0, 0, time.UTC)
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key}, Now: func() time.Time { return now }}
+
+	// a request sent just before the new year is fresh
+	withdrawal := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "1", 20, "")
+	withdrawal.Set(atm.FieldTransmissionDateTime, atm.FormatISOTransmissionDateTime(now.Add(-2*time.Minute)))
+	assertNoError(t, atm.SignISOMessage(withdrawal, key))
+	response, err := host.Handle(withdrawal)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 80)
+
+	// the captured request sent again is refused without posting twice
+	response, err = host.Handle(withdrawal)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseDuplicateTransmission)
+	balance, err := host.Host.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 80 {
+		t.Errorf("Replayed withdrawal should not be posted. %.2f", balance)
+	}
+
+	for _, test := range []struct {
+		name     string
+		dateTime string
+		code     string
+	}{
+		{"stale", atm.FormatISOTransmissionDateTime(now.Add(-10 * time.Minute)), atm.ResponseSecurityViolation},
+		{"future", atm.FormatISOTransmissionDateTime(now.Add(10 * time.Minute)), atm.ResponseSecurityViolation},
+		{"invalid", "1399250000", atm.ResponseFormatError},
+		{"missing", "", atm.ResponseFormatError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := newISORequest(t, atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, "2", 20, "")
+			delete(request.Fields, atm.FieldTransmissionDateTime)
+			if test.dateTime != "" {
+				request.Set(atm.FieldTransmissionDateTime, test.dateTime)
+			}
+			assertNoError(t, atm.SignISOMessage(request, key))
+			response, err := host.Handle(request)
+			assertISOResponse(t, response, err, atm.MTIFinancialResponse, test.code)
+		})
+	}
+
+	// once it is too old to be fresh the request is forgotten and still refused
+	now = now.Add(10 * time.Minute)
+	response, err = host.Handle(withdrawal)
+	assertISOResponse(t, response, err, atm.MTIFinancialResponse, atm.ResponseSecurityViolation)
+}
+
+func TestISOHostServe(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.12\n", "")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer listener.Close()
+	go host.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assertNoError(t, err)
+	defer conn.Close()
+
+	data, err := newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "1", 0, "1234").Pack()
+	assertNoError(t, err)
+	assertNoError(t, atm.WriteISOFrame(conn, data))
+
+	data, err = atm.ReadISOFrame(conn)
+	assertNoError(t, err)
+	response, err := atm.UnpackISOMessage(data)
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseApproved)
+	assertISOBalance(t, response, 100.12)
+
+	// a malformed request is answered with a format error and the host keeps serving
+	assertNoError(t, atm.WriteISOFrame(conn, []byte(atm.MTIAuthorizationRequest+"4000000000000000"+"-1")))
+	data, err = atm.ReadISOFrame(conn)
+	assertNoError(t, err)
+	response, err = atm.UnpackISOMessage(data)
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseFormatError)
+
+	data, err = newISORequest(t, atm.MTIAuthorizationRequest, atm.ProcessingCodeBalanceInquiry, "2", 0, "1234").Pack()
+	assertNoError(t, err)
+	assertNoError(t, atm.WriteISOFrame(conn, data))
+	data, err = atm.ReadISOFrame(conn)
+	assertNoError(t, err)
+	response, err = atm.UnpackISOMessage(data)
+	assertISOResponse(t, response, err, atm.MTIAuthorizationResponse, atm.ResponseApproved)
+}
@@ -0,0 +1,319 @@
+package atm
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCheckpointInterval is the number of transactions between signed checkpoints of the ledger
+const DefaultCheckpointInterval = 100
+
+// LedgerCheckpoint signs the hash of the ledger at a sequence so the chain cannot be rewritten without the key
+type LedgerCheckpoint struct {
+	Sequence  int64  `json:"sequence"`
+	Hash      string `json:"hash"`
+	DateTime  int64  `json:"date_time"`
+	Signature string `json:"signature"`
+}
+
+// sign returns the HMAC-SHA256 of the checkpoint
+func (c LedgerCheckpoint) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d,%s,%d", c.Sequence, c.Hash, c.DateTime)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ledgerRecord returns the columns of a transaction as written to the CSV file, without the hash
+func ledgerRecord(t Transaction) string {
+	reason := strings.NewReplacer(",", " ", "\n", " ").Replace(t.Reason)
+	return fmt.Sprintf("%d,%d,%.2f,%.2f,%s,%s,%.2f,%s,%s,%d",
+		t.AccountID, t.DateTime, t.Amount, t.Balance,
+		t.TransactionID, t.Kind, t.Fee, t.ReversalOf, reason, t.Sequence)
+}
+
+// ledgerHash chains the record of a transaction to the hash of the transaction before it
+func ledgerHash(previous string, t Transaction) string {
+	sum := sha256.Sum256([]byte(previous + "\n" + ledgerRecord(t)))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainLedger numbers and hashes every transaction from the start of the ledger
+func chainLedger(transactions []Transaction) {
+	previous := ""
+	for i := range transactions {
+		transactions[i].Sequence = int64(i + 1)
+		transactions[i].Hash = ledgerHash(previous, transactions[i])
+		previous = transactions[i].Hash
+	}
+}
+
+// ledgerChained is true if any transaction carries a hash
+func ledgerChained(transactions []Transaction) bool {
+	for _, t := range transactions {
+		if t.Hash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// LedgerVerification is the outcome of verifying the hash chain and checkpoints of the ledger
+type LedgerVerification struct {
+	Records     int `json:"records"`
+	Checkpoints int `json:"checkpoints"`
+	// Chained is false if the ledger was written before the hash chain and no transaction was added since
+	Chained bool `json:"chained"`
+	// FirstInvalid is the position of the first tampered or deleted record, 0 if the ledger is intact
+	FirstInvalid int `json:"first_invalid,omitempty"`
+	// Unsigned is the number of records after the last checkpoint, their deletion or a chain computed again over them is not found
+	Unsigned int    `json:"unsigned,omitempty"`
+	Message  string `json:"message"`
+}
+
+// OK is true if no record was tampered with or deleted
+func (v LedgerVerification) OK() bool {
+	return v.FirstInvalid == 0
+}
+
+// VerifyLedger walks the hash chain and compares it with the checkpoints.
+// The chain finds records edited or deleted without recomputing the hashes, the checkpoints find a recomputed chain.
+// Signatures are only verified if a key is given. With a key every record of a chained ledger must be signed,
+// so a chain computed again after deleting the checkpoints is found
+func VerifyLedger(transactions []Transaction, checkpoints []LedgerCheckpoint, key []byte) LedgerVerification {
+	verification := LedgerVerification{
+		Records:     len(transactions),
+		Checkpoints: len(checkpoints),
+		Chained:     ledgerChained(transactions),
+	}
+	invalid := func(position int, format string, args ...interface{}) {
+		if verification.FirstInvalid == 0 || position < verification.FirstInvalid {
+			verification.FirstInvalid = position
+			verification.Message = fmt.Sprintf(format, args...)
+		}
+	}
+
+	previous := ""
+	for i, t := range transactions {
+		if !verification.Chained {
+			break
+		}
+		position := i + 1
+		if t.Hash == "" {
+			invalid(position, "Record %d has no hash.", position)
+			break
+		}
+		if t.Sequence == int64(position)+1 {
+			invalid(position, "Record %d was deleted.", position)
+			break
+		}
+		if t.Sequence > int64(position) {
+			invalid(position, "Records %d to %d were deleted.", position, t.Sequence-1)
+			break
+		}
+		if t.Sequence < int64(position) {
+			invalid(position, "Record %d is out of sequence, it has sequence %d.", position, t.Sequence)
+			break
+		}
+		if ledgerHash(previous, t) != t.Hash {
+			invalid(position, "Record %d was modified.", position)
+			break
+		}
+		previous = t.Hash
+	}
+
+	signed := 0
+	for _, checkpoint := range checkpoints {
+		position := int(checkpoint.Sequence)
+		if position > signed {
+			signed = position
+		}
+		switch {
+		case position < 1 || (len(key) > 0 && !hmac.Equal([]byte(checkpoint.sign(key)), []byte(checkpoint.Signature))):
+			invalid(position, "Checkpoint of record %d is not signed with the key.", position)
+		case position > len(transactions):
+			invalid(len(transactions)+1, "Record %d and the records after it were deleted.", len(transactions)+1)
+		case transactions[position-1].Hash != checkpoint.Hash:
+			invalid(position, "Record %d does not match its checkpoint.", position)
+		}
+	}
+
+	if signed < len(transactions) {
+		verification.Unsigned = len(transactions) - signed
+		if len(key) > 0 && verification.Chained {
+			invalid(signed+1, "Record %d and the records after it are not signed with the key.", signed+1)
+		}
+	}
+
+	if verification.OK() {
+		verification.Message = fmt.Sprintf("Verified %d records and %d checkpoints.", len(transactions), len(checkpoints))
+		if verification.Unsigned > 0 {
+			verification.Message = fmt.Sprintf("Verified %d records and %d checkpoints, the last %d records are not signed.", len(transactions), len(checkpoints), verification.Unsigned)
+		}
+		if !verification.Chained && len(transactions) > 0 {
+			verification.Message = fmt.Sprintf("Ledger of %d records was written before the hash chain and has to be migrated.", len(transactions))
+		}
+	}
+	return verification
+}
+
+// Verify verifies the hash chain of the CSV file against the signed checkpoints
+// An error is returned on failure to read the CSV files
+func (t TransactionDB) Verify() (LedgerVerification, error) {
+	transactions, err := t.read(nil)
+	if err != nil {
+		return LedgerVerification{}, err
+	}
+	checkpoints, err := t.readCheckpoints()
+	if err != nil {
+		return LedgerVerification{}, err
+	}
+	return VerifyLedger(transactions, checkpoints, t.verificationKey()), nil
+}
+
+// verificationKey returns the key the checkpoints are verified with, nil if checkpoints are not written
+func (t TransactionDB) verificationKey() []byte {
+	if !t.checkpointsEnabled() {
+		return nil
+	}
+	return t.CheckpointKey
+}
+
+// checkpointsEnabled is true if checkpoints are written
+func (t TransactionDB) checkpointsEnabled() bool {
+	return t.CheckpointFile != "" && len(t.CheckpointKey) > 0
+}
+
+// signCheckpoints returns the checkpoints with the head of the chain signed.
+// A checkpoint is kept every interval records and the checkpoint of the previous head is replaced,
+// so deleting or editing the last records is found without waiting for the next interval
+func (t TransactionDB) signCheckpoints(transactions []Transaction, checkpoints []LedgerCheckpoint) []LedgerCheckpoint {
+	interval := int64(t.CheckpointInterval)
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	if last := len(checkpoints) - 1; last >= 0 && checkpoints[last].Sequence%interval != 0 {
+		checkpoints = checkpoints[:last]
+	}
+	after := int64(0)
+	if len(checkpoints) > 0 {
+		after = checkpoints[len(checkpoints)-1].Sequence
+	}
+
+	sign := func(sequence int64) {
+		checkpoint := LedgerCheckpoint{
+			Sequence: sequence,
+			Hash:     transactions[sequence-1].Hash,
+			DateTime: time.Now().Unix(),
+		}
+		checkpoint.Signature = checkpoint.sign(t.CheckpointKey)
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	for sequence := after - after%interval + interval; sequence <= int64(len(transactions)); sequence += interval {
+		sign(sequence)
+	}
+	if head := int64(len(transactions)); head > after && head%interval != 0 {
+		sign(head)
+	}
+	return checkpoints
+}
+
+// checkpoint signs the head of the ledger after transactions were added
+func (t TransactionDB) checkpoint(transactions []Transaction, checkpoints []LedgerCheckpoint) error {
+	if !t.checkpointsEnabled() || len(transactions) == 0 {
+		return nil
+	}
+	if err := t.writeCheckpoints(t.signCheckpoints(transactions, checkpoints)); err != nil {
+		return err
+	}
+	orDiscard(t.Logger).Debug("ledger head signed", "sequence", len(transactions))
+	return nil
+}
+
+// verifyHead returns ErrLedgerTampered if a chained ledger has no checkpoint, or the last checkpoint is not signed with the key
+// or no longer matches the ledger, so records deleted or edited since the head was signed are never signed over
+func (t TransactionDB) verifyHead(transactions []Transaction, checkpoints []LedgerCheckpoint) error {
+	if len(checkpoints) == 0 {
+		if ledgerChained(transactions) {
+			return fmt.Errorf("%w Ledger of %d records has no checkpoint signed with the key.", ErrLedgerTampered, len(transactions))
+		}
+		return nil
+	}
+	head := checkpoints[len(checkpoints)-1]
+	switch {
+	case !hmac.Equal([]byte(head.sign(t.CheckpointKey)), []byte(head.Signature)):
+		return fmt.Errorf("%w Checkpoint of record %d is not signed with the key.", ErrLedgerTampered, head.Sequence)
+	case head.Sequence < 1 || head.Sequence > int64(len(transactions)):
+		return fmt.Errorf("%w Record %d and the records after it were deleted.", ErrLedgerTampered, len(transactions)+1)
+	case transactions[head.Sequence-1].Hash != head.Hash:
+		return fmt.Errorf("%w Record %d does not match its checkpoint.", ErrLedgerTampered, head.Sequence)
+	}
+	return nil
+}
+
+// readCheckpoints reads the checkpoint CSV file, there are no checkpoints if it does not exist
+func (t TransactionDB) readCheckpoints() ([]LedgerCheckpoint, error) {
+	checkpoints := []LedgerCheckpoint{}
+	if t.CheckpointFile == "" {
+		return checkpoints, nil
+	}
+	file, err := os.Open(t.CheckpointFile)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return checkpoints, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	firstLine := true
+	for scanner.Scan() {
+		// Skip first line since it is a CSV
+		if firstLine {
+			firstLine = false
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		columns := strings.Split(line, ",")
+		if len(columns) != 4 {
+			return []LedgerCheckpoint{}, fmt.Errorf("Invalid number of columns in the provided checkpoints CSV. %s", line)
+		}
+		sequence, err := strconv.ParseInt(columns[0], 10, 64)
+		if err != nil {
+			return []LedgerCheckpoint{}, ErrTransactionSequenceNotInteger
+		}
+		dateTime, err := strconv.ParseInt(columns[2], 10, 64)
+		if err != nil {
+			return []LedgerCheckpoint{}, ErrTransactionDateTimeNotInteger
+		}
+		checkpoints = append(checkpoints, LedgerCheckpoint{
+			Sequence:  sequence,
+			Hash:      columns[1],
+			DateTime:  dateTime,
+			Signature: columns[3],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return []LedgerCheckpoint{}, err
+	}
+	return checkpoints, nil
+}
+
+func (t TransactionDB) writeCheckpoints(checkpoints []LedgerCheckpoint) error {
+	content := &strings.Builder{}
+	content.WriteString("SEQUENCE,HASH,DATE_TIME,SIGNATURE\n")
+	for _, checkpoint := range checkpoints {
+		fmt.Fprintf(content, "%d,%s,%d,%s\n", checkpoint.Sequence, checkpoint.Hash, checkpoint.DateTime, checkpoint.Signature)
+	}
+	return writeFileAtomic(t.CheckpointFile, []byte(content.String()))
+}
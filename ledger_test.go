@@ -0,0 +1,241 @@
+package atm_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// newTestLedger returns a chained transaction DB of 5 withdrawals with a checkpoint every 2 transactions
+func newTestLedger(t *testing.T) atm.TransactionDB {
+	_, transactionDB := newTestDBs(t, "", "")
+	transactionDB.CheckpointFile = filepath.Join(filepath.Dir(transactionDB.DBFile), "checkpoints.csv")
+	transactionDB.CheckpointKey = []byte("secret")
+	transactionDB.CheckpointInterval = 2
+	for i := 1; i <= 5; i++ {
+		err := transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: int64(i), Amount: -20, Balance: float64(100 - 20*i), TransactionID: string(rune('A' + i)), Kind: atm.TransactionKindWithdrawal})
+		assertNoError(t, err)
+	}
+	return transactionDB
+}
+
+// editLedger rewrites the lines of the ledger CSV file, line 0 is the header
+func editLedger(t *testing.T, path string, edit func(lines []string) []string) {
+	content, err := os.ReadFile(path)
+	assertNoError(t, err)
+	lines := edit(strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"))
+	assertNoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+}
+
+// newLegacyTestDB returns a transaction DB of a ledger written before the hash chain
+func newLegacyTestDB(t *testing.T, transactions string) atm.TransactionDB {
+	_, transactionDB := newTestDBs(t, "", "")
+	assertNoError(t, os.WriteFile(transactionDB.DBFile, []byte("ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE\n"+transactions), 0644))
+	return transactionDB
+}
+
+func assertLedgerInvalid(t *testing.T, transactionDB atm.TransactionDB, position int, message string) {
+	verification, err := transactionDB.Verify()
+	assertNoError(t, err)
+	if verification.OK() || verification.FirstInvalid != position || verification.Message != message {
+		t.Errorf("Expected record %d to be invalid with %q but got %+v", position, message, verification)
+	}
+}
+
+func TestLedgerChain(t *testing.T) {
+	transactionDB := newTestLedger(t)
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	if transactions[4].Sequence != 5 || len(transactions[4].Hash) != 64 || transactions[4].Hash == transactions[3].Hash {
+		t.Errorf("Transactions are not chained. %+v", transactions[4])
+	}
+
+	verification, err := transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || !verification.Chained || verification.Records != 5 || verification.Checkpoints != 3 || verification.Unsigned != 0 {
+		t.Errorf("Ledger should verify. %+v", verification)
+	}
+
+	// the head is signed on every write and a checkpoint is kept every interval
+	checkpoints, err := os.ReadFile(transactionDB.CheckpointFile)
+	assertNoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(checkpoints), "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "2,") || !strings.HasPrefix(lines[2], "4,") || !strings.HasPrefix(lines[3], "5,") {
+		t.Errorf("Checkpoints are incorrect.\n%s", checkpoints)
+	}
+
+	// records of a ledger without checkpoints are reported as not signed
+	transactionDB.CheckpointFile = ""
+	verification, err = transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || verification.Unsigned != 5 || verification.Message != "Verified 5 records and 0 checkpoints, the last 5 records are not signed." {
+		t.Errorf("Unsigned records should be reported. %+v", verification)
+	}
+}
+
+func TestLedgerChainLegacy(t *testing.T) {
+	// transactions are not added to a ledger written before the hash chain until it is migrated
+	transactionDB := newLegacyTestDB(t, "12345678,1,-20.00,80.00\n12345678,2,-20.00,60.00\n")
+	verification, err := transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || verification.Chained {
+		t.Errorf("Legacy ledger should not be chained. %+v", verification)
+	}
+
+	before, err := os.ReadFile(transactionDB.DBFile)
+	assertNoError(t, err)
+	err = transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 3, Amount: -20, Balance: 40})
+	assertErrorIsError(t, err, atm.ErrLedgerNotMigrated)
+	after, err := os.ReadFile(transactionDB.DBFile)
+	assertNoError(t, err)
+	if string(after) != string(before) {
+		t.Errorf("Legacy ledger should not change.\n%s", after)
+	}
+
+	_, err = transactionDB.Migrate()
+	assertNoError(t, err)
+	assertNoError(t, transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 3, Amount: -20, Balance: 40}))
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	if transactions[0].Sequence != 1 || transactions[0].Hash == "" || transactions[2].Sequence != 3 {
+		t.Errorf("Legacy ledger was not chained. %+v", transactions)
+	}
+	verification, err = transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || !verification.Chained {
+		t.Errorf("Chained ledger should verify. %+v", verification)
+	}
+}
+
+func TestLedgerMigrate(t *testing.T) {
+	transactionDB := newLegacyTestDB(t, "12345678,1,-20.00,80.00\n12345678,2,-20.00,60.00,0123456789AB,withdrawal,0.00,,\n")
+	transactionDB.CheckpointFile = filepath.Join(filepath.Dir(transactionDB.DBFile), "checkpoints.csv")
+	transactionDB.CheckpointKey = []byte("secret")
+	transactionDB.CheckpointInterval = 2
+
+	migrated, err := transactionDB.Migrate()
+	assertNoError(t, err)
+	if migrated != 2 {
+		t.Errorf("Legacy records should be migrated. %d", migrated)
+	}
+	verification, err := transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || !verification.Chained || verification.Checkpoints != 1 {
+		t.Errorf("Migrated ledger should verify. %+v", verification)
+	}
+	content, err := os.ReadFile(transactionDB.DBFile)
+	assertNoError(t, err)
+	if !strings.HasPrefix(strings.Split(string(content), "\n")[1], "12345678,1,-20.00,80.00,,withdrawal,0.00,,,1,") {
+		t.Errorf("Ledger was not written in the current format.\n%s", content)
+	}
+
+	// a chained ledger is left as it is
+	migrated, err = transactionDB.Migrate()
+	assertNoError(t, err)
+	if migrated != 0 {
+		t.Errorf("Chained ledger should not be migrated again. %d", migrated)
+	}
+}
+
+func TestLedgerTampered(t *testing.T) {
+	transactionDB := newTestLedger(t)
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		lines[3] = strings.Replace(lines[3], "-20.00", "-200.00", 1)
+		return lines
+	})
+	assertLedgerInvalid(t, transactionDB, 3, "Record 3 was modified.")
+
+	transactionDB = newTestLedger(t)
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		return append(lines[:2], lines[3:]...)
+	})
+	assertLedgerInvalid(t, transactionDB, 2, "Record 2 was deleted.")
+
+	transactionDB = newTestLedger(t)
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		return append(lines[:2], lines[4:]...)
+	})
+	assertLedgerInvalid(t, transactionDB, 2, "Records 2 to 3 were deleted.")
+
+	// removing the last records is only found by the checkpoints
+	transactionDB = newTestLedger(t)
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		return lines[:4]
+	})
+	assertLedgerInvalid(t, transactionDB, 4, "Record 4 and the records after it were deleted.")
+
+	// the last record is signed by the head checkpoint
+	transactionDB = newTestLedger(t)
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		return lines[:5]
+	})
+	assertLedgerInvalid(t, transactionDB, 5, "Record 5 and the records after it were deleted.")
+	// and the head is never signed again over the deleted record
+	err := transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 6, Amount: -20, Balance: 0})
+	if !errors.Is(err, atm.ErrLedgerTampered) {
+		t.Errorf("Set should refuse a ledger that does not match its head. %v", err)
+	}
+	assertLedgerInvalid(t, transactionDB, 5, "Record 5 and the records after it were deleted.")
+
+	// a chain computed again after an edit is only found by the checkpoints
+	transactionDB = newTestLedger(t)
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	transactions[2].Amount = -200
+	transactions[2].Hash = ""
+	rechained, _ := newTestDBs(t, "", "")
+	for _, transaction := range transactions {
+		assertNoError(t, atm.TransactionDB{DBFile: rechained.DBFile}.Set(transaction))
+	}
+	transactionDB.DBFile = rechained.DBFile
+	assertLedgerInvalid(t, transactionDB, 4, "Record 4 does not match its checkpoint.")
+
+	// and deleting the checkpoints leaves every record of the chain unsigned
+	assertNoError(t, os.Remove(transactionDB.CheckpointFile))
+	assertLedgerInvalid(t, transactionDB, 1, "Record 1 and the records after it are not signed with the key.")
+	err = transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 6, Amount: -20, Balance: 0})
+	if !errors.Is(err, atm.ErrLedgerTampered) {
+		t.Errorf("Set should refuse a chained ledger without checkpoints. %v", err)
+	}
+	if _, err := os.Stat(transactionDB.CheckpointFile); !os.IsNotExist(err) {
+		t.Errorf("A ledger without checkpoints should not be signed again. %v", err)
+	}
+
+	// checkpoints signed with another key
+	transactionDB = newTestLedger(t)
+	transactionDB.CheckpointKey = []byte("another secret")
+	assertLedgerInvalid(t, transactionDB, 2, "Checkpoint of record 2 is not signed with the key.")
+}
+
+func TestLedgerAppend(t *testing.T) {
+	transactionDB := newTestLedger(t)
+	adjustments := []atm.Transaction{
+		{AccountID: 12345678, DateTime: 6, Amount: 100, Balance: 0, Kind: atm.TransactionKindAdjustment},
+		{AccountID: 12345678, DateTime: 6, Amount: 20, Balance: 20, Kind: atm.TransactionKindAdjustment},
+	}
+	assertNoError(t, transactionDB.Append(adjustments))
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	if len(transactions) != 7 || transactions[5].Amount != 100 || transactions[6].Sequence != 7 {
+		t.Errorf("Transactions should be appended. %+v", transactions)
+	}
+	verification, err := transactionDB.Verify()
+	assertNoError(t, err)
+	if !verification.OK() || verification.Records != 7 || verification.Checkpoints != 4 {
+		t.Errorf("Appended ledger should verify. %+v", verification)
+	}
+
+	// a tampered ledger is never chained again
+	editLedger(t, transactionDB.DBFile, func(lines []string) []string {
+		lines[1] = strings.Replace(lines[1], "-20.00", "-2.00", 1)
+		return lines
+	})
+	err = transactionDB.Append(adjustments)
+	if !errors.Is(err, atm.ErrLedgerTampered) {
+		t.Errorf("Append should refuse a tampered ledger. %v", err)
+	}
+}
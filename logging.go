@@ -0,0 +1,117 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// keys of the fields shared by every log record
+const (
+	LogKeyTerminal      = "terminal"
+	LogKeyAccount       = "account"
+	LogKeySession       = "session"
+	LogKeyTransactionID = "transaction_id"
+	LogKeyCommand       = "command"
+	LogKeyAmount        = "amount"
+	LogKeyError         = "error"
+	LogKeyErrorCode     = "error_code"
+)
+
+// log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// discardLogger is used when no logger was injected
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// NewLogger returns a logger writing records at or above the level, debug, info, warn or error, as text or JSON
+// An error is returned if the level or format is not valid
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, ErrLogLevelInvalid
+	}
+	options := &slog.HandlerOptions{Level: l}
+
+	switch strings.ToLower(format) {
+	case LogFormatText, "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, ErrLogFormatInvalid
+}
+
+// orDiscard returns the logger or a logger that discards every record if it is nil
+func orDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// logAccount is the account field, masked to the last 4 digits like receipts and the audit log
+func logAccount(accountID int) slog.Attr {
+	return slog.String(LogKeyAccount, maskAccount(accountID))
+}
+
+// logError is the error field with its stable error code.
+// An unknown command echoes what was typed, which may be a PIN, so only the sentinel is logged
+func logError(err error) slog.Attr {
+	message := err.Error()
+	if errors.Is(err, ErrConsoleUnknownCommand) {
+		message = ErrConsoleUnknownCommand.Error()
+	}
+	return slog.Group("", slog.String(LogKeyError, message), slog.String(LogKeyErrorCode, ErrorCode(err)))
+}
+
+// errorLevel is the level a failed command is logged at.
+// Store failures and internal errors need an operator, an unavailable host may need one and declines are expected
+func errorLevel(err error) slog.Level {
+	switch {
+	case errors.Is(err, ErrHostStoreUnavailable), errors.Is(err, ErrLedgerTampered), ErrorCode(err) == ErrorCodeInternal:
+		return slog.LevelError
+	case errors.Is(err, ErrHostUnavailable), errors.Is(err, ErrHostNoResponse):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// logger returns the logger of the terminal with the terminal and the active session
+func (atm *ATM) logger() *slog.Logger {
+	if atm == nil {
+		return discardLogger
+	}
+	logger := orDiscard(atm.Logger)
+	if atm.TerminalID != "" {
+		logger = logger.With(LogKeyTerminal, atm.TerminalID)
+	}
+	if atm.Session != nil && atm.Session.ID != "" {
+		logger = logger.With(LogKeySession, atm.Session.ID)
+	}
+	return logger
+}
+
+// logCommand logs a command at debug level, or at the level of its error if it failed
+func (atm *ATM) logCommand(command string, accountID int, result Result, err error) {
+	attrs := []any{LogKeyCommand, command}
+	if accountID != 0 {
+		attrs = append(attrs, logAccount(accountID))
+	}
+	if result.TransactionID != "" {
+		attrs = append(attrs, LogKeyTransactionID, result.TransactionID)
+	}
+	if result.Amount != 0 {
+		attrs = append(attrs, LogKeyAmount, result.Amount)
+	}
+	if err == nil {
+		atm.logger().Debug("command succeeded", attrs...)
+		return
+	}
+	atm.logger().Log(context.Background(), errorLevel(err), "command failed", append(attrs, logError(err))...)
+}
@@ -0,0 +1,125 @@
+package atm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// logRecords parses the JSON log lines in the buffer
+func logRecords(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Log line is not JSON. %s", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// findLogRecord returns the first record with the message
+func findLogRecord(t *testing.T, records []map[string]interface{}, message string) map[string]interface{} {
+	for _, record := range records {
+		if record["msg"] == message {
+			return record
+		}
+	}
+	t.Fatalf("No log record %q in %v", message, records)
+	return nil
+}
+
+func TestNewLogger(t *testing.T) {
+	_, err := atm.NewLogger(io.Discard, "verbose", atm.LogFormatText)
+	assertErrorIsError(t, err, atm.ErrLogLevelInvalid)
+	_, err = atm.NewLogger(io.Discard, "info", "xml")
+	assertErrorIsError(t, err, atm.ErrLogFormatInvalid)
+
+	buffer := &bytes.Buffer{}
+	logger, err := atm.NewLogger(buffer, "WARN", atm.LogFormatJSON)
+	assertNoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", atm.LogKeyAccount, "****5678")
+	records := logRecords(t, buffer)
+	if len(records) != 1 || records[0]["msg"] != "shown" || records[0]["level"] != "WARN" || records[0][atm.LogKeyAccount] != "****5678" {
+		t.Errorf("Records are incorrect. %v", records)
+	}
+
+	buffer.Reset()
+	logger, err = atm.NewLogger(buffer, "debug", atm.LogFormatText)
+	assertNoError(t, err)
+	logger.Debug("shown")
+	if !strings.Contains(buffer.String(), "level=DEBUG msg=shown") {
+		t.Errorf("Text record is incorrect. %s", buffer)
+	}
+}
+
+func TestLoggingSession(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := atm.NewLogger(buffer, "debug", atm.LogFormatJSON)
+	assertNoError(t, err)
+	testATM := newTestFlowATM(t)
+	testATM.TerminalID = "ATM00001"
+	testATM.Logger = logger
+	console := &atm.Console{ATM: testATM, Output: io.Discard}
+	for _, line := range []string{"authorize 12345678 1234", "withdraw 500", "withdraw 40", "9876", "logout"} {
+		console.Run(line)
+	}
+
+	records := logRecords(t, buffer)
+	started := findLogRecord(t, records, "session started")
+	session, _ := started[atm.LogKeySession].(string)
+	if session == "" || started[atm.LogKeyAccount] != "****5678" || started[atm.LogKeyTerminal] != "ATM00001" {
+		t.Errorf("Session record is incorrect. %v", started)
+	}
+
+	withdrawal := findLogRecord(t, records, "withdrawal approved")
+	if withdrawal[atm.LogKeySession] != session || withdrawal[atm.LogKeyAccount] != "****5678" || withdrawal[atm.LogKeyTransactionID] == "" {
+		t.Errorf("Withdrawal record is incorrect. %v", withdrawal)
+	}
+
+	failed := findLogRecord(t, records, "command failed")
+	if failed["level"] != "INFO" || failed[atm.LogKeyCommand] != "withdraw" || failed[atm.LogKeyErrorCode] != "withdraw_atm_insufficient_funds" || failed[atm.LogKeySession] != session {
+		t.Errorf("Declined withdrawal record is incorrect. %v", failed)
+	}
+
+	ended := findLogRecord(t, records, "session ended")
+	if ended[atm.LogKeySession] != session {
+		t.Errorf("Session end record is incorrect. %v", ended)
+	}
+
+	// PINs and account numbers never reach the log
+	// the digits of the time and the random IDs may match by chance
+	content := regexp.MustCompile(`"(time|session|transaction_id)":"[^"]*"`).ReplaceAllString(buffer.String(), "")
+	for _, secret := range []string{"9876", "1234", "12345678"} {
+		if strings.Contains(content, secret) {
+			t.Errorf("Log contains %s.\n%s", secret, content)
+		}
+	}
+}
+
+func TestLoggingHostStoreFailure(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := atm.NewLogger(buffer, "error", atm.LogFormatJSON)
+	assertNoError(t, err)
+	accountDB := defaultAccountDB
+	accountDB.setAccountError = errors.New("disk full")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: defaultTranscationDB, Logger: logger}
+
+	result, err := host.Withdraw(defaultAccount.AccountID, 20, "")
+	assertErrorContains(t, err, "disk full")
+	record := findLogRecord(t, logRecords(t, buffer), "transaction posted but the account balance was not updated")
+	if record[atm.LogKeyTransactionID] != result.TransactionID || record[atm.LogKeyAccount] != "****5678" || record[atm.LogKeyError] != "disk full" || record[atm.LogKeyErrorCode] != atm.ErrorCodeInternal {
+		t.Errorf("Record is incorrect. %v", record)
+	}
+}
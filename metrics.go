@@ -0,0 +1,274 @@
+package atm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric names
+const (
+	MetricTransactions     = "atm_transactions_total"
+	MetricDispensed        = "atm_dispensed_dollars_total"
+	MetricWithdrawalAmount = "atm_withdrawal_amount_dollars"
+	MetricCashNotes        = "atm_cash_notes"
+	MetricCashDollars      = "atm_cash_dollars"
+	MetricActiveSessions   = "atm_active_sessions"
+	MetricAuthFailures     = "atm_authorization_failures_total"
+	MetricStoreDuration    = "atm_store_duration_seconds"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric kinds
+const (
+	metricKindCounter   = "counter"
+	metricKindGauge     = "gauge"
+	metricKindHistogram = "histogram"
+)
+
+// label values
+const (
+	metricOutcomeApproved   = "approved"
+	metricOutcomeDeclined   = "declined"
+	metricStoreAccounts     = "accounts"
+	metricStoreTransactions = "transactions"
+	metricOperationRead     = "read"
+	metricOperationWrite    = "write"
+)
+
+// NoteDenomination is the only note the terminal holds and dispenses, withdrawals are multiples of it
+const NoteDenomination = 20
+
+// metric buckets
+var (
+	withdrawalAmountBuckets = []float64{20, 40, 60, 100, 200, 500, 1000}
+	storeDurationBuckets    = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+)
+
+// Metrics counts the transactions, cash, sessions and store latency of terminals and hosts in the Prometheus text format.
+// A nil Metrics records nothing so it is optional everywhere it is used
+type Metrics struct {
+	mutex    sync.Mutex
+	families []*metricFamily
+}
+
+// metricFamily is a metric and its series, one for each combination of label values
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricSeries is the value of a counter or a gauge, or the buckets of a histogram
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// NewMetrics returns the metrics of the terminals and the host with no samples
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.register(MetricTransactions, "Withdrawals and deposits by outcome and error code.", metricKindCounter, nil, "kind", "outcome", "error_code")
+	m.register(MetricDispensed, "Dollars dispensed by the terminal.", metricKindCounter, nil)
+	m.register(MetricWithdrawalAmount, "Dollars dispensed by each withdrawal.", metricKindHistogram, withdrawalAmountBuckets)
+	m.register(MetricCashNotes, "Notes in the terminal by denomination.", metricKindGauge, nil, "denomination")
+	m.register(MetricCashDollars, "Dollars in the terminal.", metricKindGauge, nil)
+	m.register(MetricActiveSessions, "Sessions authorized and not timed out or logged out.", metricKindGauge, nil)
+	m.register(MetricAuthFailures, "Failed authorizations by error code.", metricKindCounter, nil, "error_code")
+	m.register(MetricStoreDuration, "Duration of reads and writes of the CSV stores.", metricKindHistogram, storeDurationBuckets, "store", "operation")
+	return m
+}
+
+func (m *Metrics) register(name string, help string, kind string, buckets []float64, labels ...string) {
+	family := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	// a metric without labels is exposed before its first sample
+	if len(labels) == 0 {
+		family.series[""] = &metricSeries{counts: make([]uint64, len(buckets))}
+	}
+	m.families = append(m.families, family)
+}
+
+// update runs the change on the series of the metric with the label values, creating the series if it is new
+func (m *Metrics) update(name string, change func(*metricFamily, *metricSeries), labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, family := range m.families {
+		if family.name != name {
+			continue
+		}
+		key := strings.Join(labelValues, "\xff")
+		series, ok := family.series[key]
+		if !ok {
+			series = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(family.buckets))}
+			family.series[key] = series
+		}
+		change(family, series)
+		return
+	}
+}
+
+func (m *Metrics) add(name string, value float64, labelValues ...string) {
+	m.update(name, func(_ *metricFamily, s *metricSeries) { s.value += value }, labelValues...)
+}
+
+func (m *Metrics) set(name string, value float64, labelValues ...string) {
+	m.update(name, func(_ *metricFamily, s *metricSeries) { s.value = value }, labelValues...)
+}
+
+func (m *Metrics) observe(name string, value float64, labelValues ...string) {
+	m.update(name, func(f *metricFamily, s *metricSeries) {
+		for i, bound := range f.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.sum += value
+		s.count++
+	}, labelValues...)
+}
+
+// observeTransaction counts a withdrawal or deposit with the error code it failed with
+func (m *Metrics) observeTransaction(kind string, err error) {
+	outcome := metricOutcomeApproved
+	if err != nil {
+		outcome = metricOutcomeDeclined
+	}
+	m.add(MetricTransactions, 1, kind, outcome, ErrorCode(err))
+}
+
+// observeDispensed counts the cash of a withdrawal
+func (m *Metrics) observeDispensed(amount float64) {
+	m.add(MetricDispensed, amount)
+	m.observe(MetricWithdrawalAmount, amount)
+}
+
+// observeAuthFailure counts a failed authorization
+func (m *Metrics) observeAuthFailure(err error) {
+	m.add(MetricAuthFailures, 1, ErrorCode(err))
+}
+
+// observeStore records how long a read or write of a store took since start
+func (m *Metrics) observeStore(store string, operation string, start time.Time) {
+	m.observe(MetricStoreDuration, time.Since(start).Seconds(), store, operation)
+}
+
+// SetCash sets the cash of the terminal and the notes it is held in
+func (m *Metrics) SetCash(balance float64) {
+	m.set(MetricCashDollars, balance)
+	m.set(MetricCashNotes, math.Floor(balance/NoteDenomination), strconv.Itoa(NoteDenomination))
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format, series sorted by their labels
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+	for _, family := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			labels := metricLabels(family.labels, series.labelValues)
+			if family.kind != metricKindHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", family.name, formatLabels(labels), formatMetricValue(series.value))
+				continue
+			}
+			for i, bound := range family.buckets {
+				bucket := append(labels, [2]string{"le", formatMetricValue(bound)})
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", family.name, formatLabels(bucket), series.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", family.name, formatLabels(append(labels, [2]string{"le", "+Inf"})), series.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", family.name, formatLabels(labels), formatMetricValue(series.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", family.name, formatLabels(labels), series.count)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP writes the metrics for a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	m.WritePrometheus(w)
+}
+
+// metricLabels pairs the label names with the values of a series
+func metricLabels(names []string, values []string) [][2]string {
+	labels := make([][2]string, 0, len(names)+1)
+	for i, name := range names {
+		labels = append(labels, [2]string{name, values[i]})
+	}
+	return labels
+}
+
+func formatLabels(labels [][2]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label[1])
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label[0], value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// observeCash sets the cash gauges to the balance of the terminal
+func (atm *ATM) observeCash() {
+	atm.Metrics.SetCash(atm.ATMBalance)
+}
+
+// observeSession moves the active sessions gauge when the session of the terminal starts or ends.
+// A session that timed out stops counting on the next command of the terminal
+func (atm *ATM) observeSession() {
+	if atm == nil || atm.Metrics == nil {
+		return
+	}
+	active := atm.Session != nil && atm.Session.AccountID != 0 && atm.Session.LastActivity != 0 && !atm.Session.TimedOut()
+	if active == atm.sessionCounted {
+		return
+	}
+	atm.sessionCounted = active
+	if active {
+		atm.Metrics.add(MetricActiveSessions, 1)
+		return
+	}
+	atm.Metrics.add(MetricActiveSessions, -1)
+}
@@ -0,0 +1,85 @@
+package atm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// assertMetrics checks the Prometheus text of the metrics contains every line
+func assertMetrics(t *testing.T, metrics *atm.Metrics, lines ...string) {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	assertNoError(t, metrics.WritePrometheus(buffer))
+	for _, line := range lines {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("Metrics do not contain %s.\n%s", line, buffer)
+		}
+	}
+}
+
+func TestMetricsTerminal(t *testing.T) {
+	metrics := atm.NewMetrics()
+	testATM := newTestFlowATM(t)
+	testATM.Metrics = metrics
+	metrics.SetCash(testATM.ATMBalance)
+	assertMetrics(t, metrics,
+		"# TYPE atm_transactions_total counter",
+		"atm_cash_dollars 200",
+		`atm_cash_notes{denomination="20"} 10`,
+		"atm_active_sessions 0",
+	)
+
+	assertErrorIsError(t, testATM.Authorize(12345678, "0000"), atm.ErrAuthorizationUnsuccessful)
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+	assertMetrics(t, metrics, "atm_active_sessions 1", `atm_authorization_failures_total{error_code="authorization_unsuccessful"} 1`)
+
+	_, err := testATM.Withdraw(12345678, 500)
+	assertErrorIsError(t, err, atm.ErrWithdrawATMInsufficientFunds)
+	_, err = testATM.Withdraw(12345678, 40)
+	assertNoError(t, err)
+	assertNoError(t, testATM.Deposit(12345678, 10))
+	assertMetrics(t, metrics,
+		`atm_transactions_total{kind="withdrawal",outcome="declined",error_code="withdraw_atm_insufficient_funds"} 1`,
+		`atm_transactions_total{kind="withdrawal",outcome="approved",error_code=""} 1`,
+		`atm_transactions_total{kind="deposit",outcome="approved",error_code=""} 1`,
+		"atm_dispensed_dollars_total 40",
+		`atm_withdrawal_amount_dollars_bucket{le="20"} 0`,
+		`atm_withdrawal_amount_dollars_bucket{le="40"} 1`,
+		`atm_withdrawal_amount_dollars_bucket{le="+Inf"} 1`,
+		"atm_withdrawal_amount_dollars_sum 40",
+		"atm_cash_dollars 160",
+		`atm_cash_notes{denomination="20"} 8`,
+	)
+
+	assertNoError(t, testATM.Logout())
+	assertMetrics(t, metrics, "atm_active_sessions 0")
+}
+
+func TestMetricsStores(t *testing.T) {
+	metrics := atm.NewMetrics()
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	accountDB.Metrics = metrics
+	transactionDB.Metrics = metrics
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+	_, err := host.Deposit(12345678, 20, "")
+	assertNoError(t, err)
+
+	// the deposit reads the account, reads and writes the ledger and reads and writes the account
+	assertMetrics(t, metrics,
+		`atm_store_duration_seconds_count{store="accounts",operation="read"} 2`,
+		`atm_store_duration_seconds_count{store="accounts",operation="write"} 1`,
+		`atm_store_duration_seconds_count{store="transactions",operation="read"} 1`,
+		`atm_store_duration_seconds_count{store="transactions",operation="write"} 1`,
+		`atm_store_duration_seconds_bucket{store="transactions",operation="write",le="+Inf"} 1`,
+	)
+}
+
+func TestMetricsNil(t *testing.T) {
+	var metrics *atm.Metrics
+	// nil metrics record nothing
+	metrics.SetCash(100)
+	assertNoError(t, metrics.WritePrometheus(&bytes.Buffer{}))
+}
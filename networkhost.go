@@ -0,0 +1,359 @@
+package atm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NetworkHostClient reaches a remote host over TCP using ISO 8583 messages
+type NetworkHostClient struct {
+	// Address of the ISO 8583 host e.g. localhost:8583
+	Address string
+	// TerminalID identifies this terminal to the host
+	TerminalID string
+	// Key signs every request so the host accepts withdrawals, deposits and reversals that carry no PIN block
+	Key []byte
+	// Timeout for connecting to and exchanging a message with the host, defaults to 10 seconds
+	Timeout time.Duration
+	// Reversals stores the reversals the host did not acknowledge, they are sent again before the next financial request.
+	// They are only kept in memory if not set
+	Reversals *ReversalQueue
+
+	mutex sync.Mutex
+	conn  net.Conn
+	stan  int
+	// reversing stops two requests from sending the same pending reversal
+	reversing sync.Mutex
+	// unsent are the pending reversals without a queue
+	unsent []PendingReversal
+}
+
+// Authorize verifies the pin of the account with an authorization request
+func (c *NetworkHostClient) Authorize(accountID int, pin string) error {
+	pan := strconv.Itoa(accountID)
+	block, err := ISOPINBlock(pin, pan)
+	if err != nil {
+		return ErrAuthorizationUnsuccessful
+	}
+
+	request := NewISOMessage(MTIAuthorizationRequest)
+	request.Set(FieldPAN, pan)
+	request.Set(FieldProcessingCode, ProcessingCodeBalanceInquiry)
+	request.Set(FieldPINData, block)
+
+	_, err = c.exchange(request)
+	return err
+}
+
+// Withdraw debits the account with a financial request
+func (c *NetworkHostClient) Withdraw(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	return c.post(accountID, ProcessingCodeWithdrawal, amount, idempotencyKey)
+}
+
+// Deposit credits the account with a financial request
+func (c *NetworkHostClient) Deposit(accountID int, amount float64, idempotencyKey string) (HostResult, error) {
+	return c.post(accountID, ProcessingCodeDeposit, amount, idempotencyKey)
+}
+
+// post sends a financial request that moves money.
+// The idempotency key is sent in the transport data so a retried request is not posted twice.
+// If the host does not respond the request is reversed, ErrHostNoResponse is returned either way
+func (c *NetworkHostClient) post(accountID int, processingCode string, amount float64, idempotencyKey string) (HostResult, error) {
+	request := newISOFinancialRequest(accountID, processingCode, amount)
+	if idempotencyKey != "" {
+		if err := validIdempotencyKey(idempotencyKey); err != nil {
+			return HostResult{}, err
+		}
+		request.Set(FieldTransportData, idempotencyKey)
+	}
+
+	if err := c.forwardReversals(); err != nil {
+		return HostResult{}, err
+	}
+	response, err := c.exchange(request)
+	if err == ErrHostNoResponse {
+		return HostResult{}, c.reverseUnanswered(request)
+	}
+	// A financial request is never a reversal so a duplicate transmission is a reused idempotency key
+	if err == ErrTransactionAlreadyReversed {
+		return HostResult{}, ErrIdempotencyKeyMismatch
+	}
+	if err != nil {
+		return HostResult{}, err
+	}
+	return isoPostedResult(response)
+}
+
+// Balance returns the balance of the account with a balance inquiry
+func (c *NetworkHostClient) Balance(accountID int) (float64, error) {
+	response, err := c.exchange(newISOFinancialRequest(accountID, ProcessingCodeBalanceInquiry, 0))
+	if err != nil {
+		return 0, err
+	}
+	result, err := isoHostResult(response)
+	return result.Balance, err
+}
+
+// Advice posts a stand-in withdrawal with a financial advice.
+// The stand-in ID is sent in the transport data like an idempotency key
+func (c *NetworkHostClient) Advice(accountID int, amount float64, dateTime int64, standInID string) (HostResult, error) {
+	request := newISOFinancialRequest(accountID, ProcessingCodeWithdrawal, amount)
+	request.MTI = MTIFinancialAdvice
+	request.Set(FieldAdditionalData, strconv.FormatInt(dateTime, 10))
+	if standInID != "" {
+		if err := validIdempotencyKey(standInID); err != nil {
+			return HostResult{}, err
+		}
+		request.Set(FieldTransportData, standInID)
+	}
+	if err := c.forwardReversals(); err != nil {
+		return HostResult{}, err
+	}
+	response, err := c.exchange(request)
+	if err != nil {
+		// the host names a withdrawal it wrote to the ledger but failed to apply to the account
+		result := HostResult{}
+		if response != nil {
+			result.TransactionID, _ = response.Get(FieldRetrievalReference)
+		}
+		return result, err
+	}
+	return isoPostedResult(response)
+}
+
+// Reverse posts a compensating transaction with a reversal advice.
+// The transaction is identified by its retrieval reference number
+func (c *NetworkHostClient) Reverse(transactionID string, reason string) (HostResult, error) {
+	if len(reason) > isoFields[FieldAdditionalData].length {
+		reason = reason[:isoFields[FieldAdditionalData].length]
+	}
+	request := NewISOMessage(MTIReversalAdvice)
+	request.Set(FieldRetrievalReference, transactionID)
+	request.Set(FieldAdditionalData, reason)
+	response, err := c.exchange(request)
+	if err != nil {
+		return HostResult{}, err
+	}
+	return isoPostedResult(response)
+}
+
+// reverseUnanswered sends a reversal advice for a request the host did not respond to, identified by its original data elements.
+// A reversal that is not acknowledged is queued and sent again before the next financial request.
+// ErrHostNoResponse is returned, wrapping the error of the reversal if it was not acknowledged
+func (c *NetworkHostClient) reverseUnanswered(original *ISOMessage) error {
+	accountID, _ := strconv.Atoi(original.Fields[FieldPAN])
+	pending := PendingReversal{
+		OriginalData:   FormatISOOriginalData(original),
+		ProcessingCode: original.Fields[FieldProcessingCode],
+		AccountID:      accountID,
+		Reason:         "Host did not respond",
+	}
+	err := c.sendReversal(pending)
+	if err == nil {
+		return ErrHostNoResponse
+	}
+	if queueErr := c.queueReversal(pending); queueErr != nil {
+		return fmt.Errorf("%w Reversal was not acknowledged and could not be queued. %w %w", ErrHostNoResponse, err, queueErr)
+	}
+	return fmt.Errorf("%w Reversal was not acknowledged and is queued. %w", ErrHostNoResponse, err)
+}
+
+// sendReversal sends a reversal advice for an unanswered request.
+// The reversal is done if the host acknowledges it or cannot locate the original, which then was never posted
+func (c *NetworkHostClient) sendReversal(pending PendingReversal) error {
+	reversal := NewISOMessage(MTIReversalAdvice)
+	reversal.Set(FieldPAN, strconv.Itoa(pending.AccountID))
+	reversal.Set(FieldProcessingCode, pending.ProcessingCode)
+	reversal.Set(FieldOriginalDataElements, pending.OriginalData)
+	reversal.Set(FieldAdditionalData, pending.Reason)
+	_, err := c.exchange(reversal)
+	if err == ErrTransactionNotFound || err == ErrTransactionAlreadyReversed {
+		return nil
+	}
+	return err
+}
+
+// forwardReversals sends the reversals the host did not acknowledge in the order they were queued.
+// The error of the first reversal that is still not acknowledged is returned, it stays queued
+func (c *NetworkHostClient) forwardReversals() error {
+	c.reversing.Lock()
+	defer c.reversing.Unlock()
+
+	pending := c.unsent
+	if c.Reversals != nil {
+		var err error
+		if pending, err = c.Reversals.Pending(); err != nil {
+			return err
+		}
+	}
+	for len(pending) > 0 {
+		if err := c.sendReversal(pending[0]); err != nil {
+			return err
+		}
+		if c.Reversals != nil {
+			if err := c.Reversals.Remove(pending[0].OriginalData); err != nil {
+				return err
+			}
+		} else {
+			c.unsent = pending[1:]
+		}
+		pending = pending[1:]
+	}
+	return nil
+}
+
+// queueReversal keeps a reversal the host did not acknowledge until it is forwarded
+func (c *NetworkHostClient) queueReversal(pending PendingReversal) error {
+	c.reversing.Lock()
+	defer c.reversing.Unlock()
+	if c.Reversals != nil {
+		return c.Reversals.Add(pending)
+	}
+	c.unsent = append(c.unsent, pending)
+	return nil
+}
+
+// History returns the transactions of the account with a mini statement request.
+// Only the most recent transactions that fit in a single message are returned
+func (c *NetworkHostClient) History(accountID int) ([]Transaction, error) {
+	response, err := c.exchange(newISOFinancialRequest(accountID, ProcessingCodeMiniStatement, 0))
+	if err != nil {
+		return []Transaction{}, err
+	}
+	statement, _ := response.Get(FieldAdditionalData)
+	return ParseISOStatement(accountID, statement)
+}
+
+// QueryHistory applies the query to the mini statement of the account.
+// Only the most recent transactions that fit in a single message are searched
+func (c *NetworkHostClient) QueryHistory(query HistoryQuery) ([]Transaction, error) {
+	if err := query.Validate(); err != nil {
+		return []Transaction{}, err
+	}
+	transactions, err := c.History(query.AccountID)
+	if err != nil {
+		return []Transaction{}, err
+	}
+	return query.Apply(transactions)
+}
+
+// exchange sends a request to the host and waits for the matching response.
+// ErrHostUnavailable is returned if the request could not be sent and ErrHostNoResponse if it was sent without a response
+func (c *NetworkHostClient) exchange(request *ISOMessage) (*ISOMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stan == 0 {
+		// a terminal started again does not repeat the STANs it sent before, the host refuses them as replays
+		seed := make([]byte, 4)
+		rand.Read(seed)
+		c.stan = int(binary.BigEndian.Uint32(seed) % 999999)
+	}
+	c.stan = c.stan%999999 + 1
+	stan := fmt.Sprintf("%06d", c.stan)
+	now := time.Now()
+	request.Set(FieldSTAN, stan)
+	request.Set(FieldTransmissionDateTime, FormatISOTransmissionDateTime(now))
+	request.Set(FieldLocalTime, now.Format("150405"))
+	request.Set(FieldLocalDate, now.Format("0102"))
+	request.Set(FieldTerminalID, c.TerminalID)
+	if len(c.Key) > 0 {
+		if err := SignISOMessage(request, c.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	if c.conn == nil {
+		c.conn, err = net.DialTimeout("tcp", c.Address, timeout)
+		if err != nil {
+			c.conn = nil
+			return nil, ErrHostUnavailable
+		}
+	}
+
+	c.conn.SetDeadline(now.Add(timeout))
+	if err = WriteISOFrame(c.conn, data); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, ErrHostUnavailable
+	}
+	if data, err = ReadISOFrame(c.conn); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, ErrHostNoResponse
+	}
+
+	response, err := UnpackISOMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if response.MTI != isoResponseMTI(request.MTI) || response.Fields[FieldSTAN] != stan {
+		return nil, ErrISOMalformedMessage
+	}
+
+	return response, isoResponseError(response.Fields[FieldResponseCode])
+}
+
+// Close closes the connection to the host
+func (c *NetworkHostClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func newISOFinancialRequest(accountID int, processingCode string, amount float64) *ISOMessage {
+	request := NewISOMessage(MTIFinancialRequest)
+	request.Set(FieldPAN, strconv.Itoa(accountID))
+	request.Set(FieldProcessingCode, processingCode)
+	if amount > 0 {
+		request.Set(FieldAmount, FormatISOAmount(amount))
+		request.Set(FieldCurrencyCode, isoCurrencyUSD)
+	}
+	return request
+}
+
+func isoHostResult(response *ISOMessage) (HostResult, error) {
+	additionalAmounts, ok := response.Get(FieldAdditionalAmounts)
+	if !ok {
+		return HostResult{}, ErrISOMalformedMessage
+	}
+	balance, err := ParseISOBalance(additionalAmounts)
+	return HostResult{Balance: balance}, err
+}
+
+func isoPostedResult(response *ISOMessage) (HostResult, error) {
+	result, err := isoHostResult(response)
+	if err != nil {
+		return HostResult{}, err
+	}
+	result.TransactionID, _ = response.Get(FieldRetrievalReference)
+	if pan, ok := response.Get(FieldPAN); ok {
+		if result.AccountID, err = strconv.Atoi(pan); err != nil {
+			return HostResult{}, ErrISOMalformedMessage
+		}
+	}
+	result.Replayed = response.Fields[FieldAdditionalResponse] == isoAdditionalResponseReplayed
+	if fee, ok := response.Get(FieldTransactionFee); ok {
+		result.Fee, err = ParseISOFee(fee)
+	}
+	return result, err
+}
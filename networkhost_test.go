@@ -0,0 +1,275 @@
+package atm_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestNetworkHost(t *testing.T, accounts string) (net.Listener, *atm.NetworkHostClient) {
+	accountDB, transactionDB := newTestDBs(t, accounts, "")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": []byte("secret")}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go host.Serve(listener)
+
+	client := &atm.NetworkHostClient{
+		Address:    listener.Addr().String(),
+		TerminalID: "TERM0001",
+		Key:        []byte("secret"),
+		Timeout:    time.Second,
+	}
+	return listener, client
+}
+
+func TestNetworkHostClient(t *testing.T) {
+	listener, client := newTestNetworkHost(t, "12345678,1234,100.12\n")
+	defer listener.Close()
+	defer client.Close()
+
+	err := client.Authorize(12345678, "0000")
+	assertErrorIsError(t, err, atm.ErrAuthorizationUnsuccessful)
+	err = client.Authorize(87654321, "1234")
+	assertErrorIsError(t, err, atm.ErrAccountNotFound)
+
+	terminal := &atm.ATM{Host: client, ATMBalance: 200, Session: &atm.Session{}}
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	overdrawn, err := terminal.Withdraw(12345678, 120)
+	assertNoError(t, err)
+	if !overdrawn {
+		t.Errorf("Expected overdrawn")
+	}
+
+	err = terminal.Deposit(12345678, 24.88)
+	assertNoError(t, err)
+
+	balance, err := terminal.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 0 {
+		t.Errorf("Balance is incorrect. %.2f", balance)
+	}
+
+	transactions := terminal.History(12345678)
+	if len(transactions) != 2 || transactions[0].Amount != -120 || transactions[1].Balance != 0 {
+		t.Errorf("History is incorrect. %+v", transactions)
+	}
+}
+
+func TestNetworkHostClientReverse(t *testing.T) {
+	listener, client := newTestNetworkHost(t, "12345678,1234,100.00\n")
+	defer listener.Close()
+	defer client.Close()
+
+	withdrawal, err := client.Withdraw(12345678, 120, "")
+	assertNoError(t, err)
+	if withdrawal.TransactionID == "" || withdrawal.Fee != 5 {
+		t.Fatalf("Withdraw result is incorrect. %+v", withdrawal)
+	}
+
+	reversal, err := client.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertNoError(t, err)
+	if reversal.Balance != 100 || reversal.Fee != -5 || reversal.TransactionID == withdrawal.TransactionID || reversal.AccountID != 12345678 {
+		t.Errorf("Reverse result is incorrect. %+v", reversal)
+	}
+
+	_, err = client.Reverse(withdrawal.TransactionID, "Cash failed to dispense")
+	assertErrorIsError(t, err, atm.ErrTransactionAlreadyReversed)
+}
+
+func TestNetworkHostClientIdempotencyKey(t *testing.T) {
+	listener, client := newTestNetworkHost(t, "12345678,1234,100.00\n")
+	defer listener.Close()
+	defer client.Close()
+
+	withdrawal, err := client.Withdraw(12345678, 40, "key-1")
+	assertNoError(t, err)
+	if withdrawal.Replayed {
+		t.Errorf("First withdrawal should not be replayed")
+	}
+	replay, err := client.Withdraw(12345678, 40, "key-1")
+	assertNoError(t, err)
+	if !replay.Replayed || replay.TransactionID != withdrawal.TransactionID || replay.Balance != 60 {
+		t.Errorf("Replay result is incorrect. %+v", replay)
+	}
+
+	_, err = client.Deposit(12345678, 40, "key-1")
+	assertErrorIsError(t, err, atm.ErrIdempotencyKeyMismatch)
+
+	// an advice is posted once for its stand-in ID
+	advice, err := client.Advice(12345678, 20, 1, "standin-1")
+	assertNoError(t, err)
+	replay, err = client.Advice(12345678, 20, 1, "standin-1")
+	assertNoError(t, err)
+	if !replay.Replayed || replay.TransactionID != advice.TransactionID || replay.Balance != 40 {
+		t.Errorf("Advice replay result is incorrect. %+v", replay)
+	}
+}
+
+func TestNetworkHostClientUnsigned(t *testing.T) {
+	listener, client := newTestNetworkHost(t, "12345678,1234,100.00\n")
+	defer listener.Close()
+	defer client.Close()
+	client.Key = nil
+
+	// the PIN is still verified but nothing else is answered for a terminal that does not sign
+	assertNoError(t, client.Authorize(12345678, "1234"))
+	_, err := client.Withdraw(12345678, 40, "")
+	assertErrorContains(t, err, "Response code 63")
+	_, err = client.Balance(12345678)
+	assertErrorContains(t, err, "Response code 63")
+}
+
+func TestNetworkHostClientUnavailable(t *testing.T) {
+	listener, client := newTestNetworkHost(t, "12345678,1234,100.12\n")
+	defer client.Close()
+
+	_, err := client.Balance(12345678)
+	assertNoError(t, err)
+
+	// simulate a host outage
+	listener.Close()
+	client.Close()
+	_, err = client.Balance(12345678)
+	assertErrorIsError(t, err, atm.ErrHostUnavailable)
+}
+
+// serveWithoutResponse serves the host but closes the connection instead of responding to the requests unanswered returns true for.
+// Those requests are posted, the requests lost returns true for are not even handled
+func serveWithoutResponse(t *testing.T, host *atm.ISOHost, unanswered func(*atm.ISOMessage) bool, lost func(*atm.ISOMessage) bool) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			for {
+				data, err := atm.ReadISOFrame(conn)
+				if err != nil {
+					break
+				}
+				request, err := atm.UnpackISOMessage(data)
+				if err != nil {
+					break
+				}
+				if lost != nil && lost(request) {
+					break
+				}
+				response, err := host.Handle(request)
+				if err != nil {
+					break
+				}
+				if unanswered != nil && unanswered(request) {
+					break
+				}
+				data, _ = response.Pack()
+				atm.WriteISOFrame(conn, data)
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+// firstRequests returns true for the first n requests of the MTI and processing code
+func firstRequests(mti string, processingCode string, n int) func(*atm.ISOMessage) bool {
+	seen := 0
+	return func(request *atm.ISOMessage) bool {
+		if request.MTI != mti || request.Fields[atm.FieldProcessingCode] != processingCode || seen >= n {
+			return false
+		}
+		seen++
+		return true
+	}
+}
+
+func TestNetworkHostClientNoResponse(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	key := []byte("secret")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key}}
+	listener := serveWithoutResponse(t, host, firstRequests(atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, 1), nil)
+	defer listener.Close()
+	client := &atm.NetworkHostClient{Address: listener.Addr().String(), TerminalID: "TERM0001", Key: key, Timeout: time.Second}
+	defer client.Close()
+
+	terminal := &atm.ATM{
+		Host:         client,
+		ATMBalance:   1000,
+		Session:      &atm.Session{},
+		OfflineLimit: 60,
+		StandIn:      &atm.StandInQueue{DBFile: filepath.Join(t.TempDir(), "standin.csv")},
+	}
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	// the host posted the withdrawal but did not respond, it is reversed and nothing is dispensed
+	_, err := terminal.Withdraw(12345678, 40)
+	assertErrorIsError(t, err, atm.ErrHostNoResponse)
+	pending, err := terminal.StandIn.Pending()
+	assertNoError(t, err)
+	if len(pending) != 0 || terminal.ATMBalance != 1000 {
+		t.Errorf("Nothing should be dispensed. %+v %.2f", pending, terminal.ATMBalance)
+	}
+	balance, err := host.Host.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 100 {
+		t.Errorf("Unanswered withdrawal should be reversed. %.2f", balance)
+	}
+	transactions, err := transactionDB.Get(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 2 || transactions[1].Kind != atm.TransactionKindReversal {
+		t.Errorf("Ledger is incorrect. %+v", transactions)
+	}
+}
+
+func TestNetworkHostClientReversalQueued(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	key := []byte("secret")
+	host := &atm.ISOHost{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, TerminalKeys: map[string][]byte{"TERM0001": key}}
+	// the withdrawal is posted without a response and its reversal never reaches the host
+	listener := serveWithoutResponse(t, host,
+		firstRequests(atm.MTIFinancialRequest, atm.ProcessingCodeWithdrawal, 1),
+		firstRequests(atm.MTIReversalAdvice, atm.ProcessingCodeWithdrawal, 1))
+	defer listener.Close()
+	queue := &atm.ReversalQueue{DBFile: filepath.Join(t.TempDir(), "reversals.csv")}
+	client := &atm.NetworkHostClient{Address: listener.Addr().String(), TerminalID: "TERM0001", Key: key, Timeout: time.Second, Reversals: queue}
+	defer client.Close()
+
+	_, err := client.Withdraw(12345678, 40, "")
+	assertErrorContains(t, err, "Reversal was not acknowledged and is queued.")
+	pending, err := queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 1 || pending[0].ProcessingCode != atm.ProcessingCodeWithdrawal {
+		t.Fatalf("Reversal should be queued. %+v", pending)
+	}
+
+	// a terminal started again forwards the reversal before its next financial request
+	restarted := &atm.NetworkHostClient{Address: listener.Addr().String(), TerminalID: "TERM0001", Key: key, Timeout: time.Second, Reversals: queue}
+	defer restarted.Close()
+	deposit, err := restarted.Deposit(12345678, 20, "")
+	assertNoError(t, err)
+	if deposit.Balance != 120 {
+		t.Errorf("Withdrawal should be reversed before the deposit. %+v", deposit)
+	}
+	pending, err = queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 0 {
+		t.Errorf("Acknowledged reversal should be removed. %+v", pending)
+	}
+	transactions, err := transactionDB.Get(12345678)
+	assertNoError(t, err)
+	if len(transactions) != 3 || transactions[1].Kind != atm.TransactionKindReversal {
+		t.Errorf("Ledger is incorrect. %+v", transactions)
+	}
+}
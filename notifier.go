@@ -0,0 +1,133 @@
+package atm
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPNotifier emails alerts through an SMTP server.
+// The server is reached with STARTTLS when it offers it, credentials are only sent over TLS or to localhost
+type SMTPNotifier struct {
+	// Address of the server e.g. smtp.example.com:587
+	Address  string
+	From     string
+	Username string
+	Password string
+	// Timeout of the whole conversation with the server, 10 seconds if zero
+	Timeout time.Duration
+}
+
+// Notify sends the alert to the email address of the preferences
+// An error is returned if the server could not be reached or refused the email
+func (n *SMTPNotifier) Notify(alert Alert) error {
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", n.Address, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(n.Address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(alert.Email); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(alertEmail(n.From, alert)); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// alertEmail formats the alert as an email with CRLF line endings
+func alertEmail(from string, alert Alert) []byte {
+	lines := []string{
+		"From: " + from,
+		"To: " + alert.Email,
+		"Subject: " + alert.Subject,
+		"Date: " + alert.Time.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		alert.Message,
+	}
+	if alert.TransactionID != "" {
+		lines = append(lines, "", "Transaction: "+alert.TransactionID)
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// FileNotifier appends alerts to a file as JSON lines
+type FileNotifier struct {
+	File string
+
+	mutex sync.Mutex
+}
+
+// Notify appends the alert to the file
+// An error is returned on failure to write the file
+func (n *FileNotifier) Notify(alert Alert) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(n.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriterNotifier prints alerts to a writer such as the console
+type WriterNotifier struct {
+	Output io.Writer
+}
+
+// Notify prints the recipient and the message of the alert
+func (n *WriterNotifier) Notify(alert Alert) error {
+	_, err := fmt.Fprintf(n.Output, "Alert to %s: %s\n", alert.Email, alert.Message)
+	return err
+}
@@ -0,0 +1,164 @@
+package atm_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// testSMTPServer accepts one email and sends what it received on the channel
+func testSMTPServer(t *testing.T, rejectRecipient bool) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		lines := []string{}
+		defer func() { received <- lines }()
+
+		reply("220 localhost ESMTP test")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			command := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch command {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 Authentication succeeded")
+			case "RCPT":
+				if rejectRecipient {
+					reply("550 No such user")
+					continue
+				}
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					if line == "." {
+						break
+					}
+					lines = append(lines, line)
+				}
+				reply("250 OK queued")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func testAlert() atm.Alert {
+	return atm.Alert{
+		Kind:          atm.AlertLowBalance,
+		Time:          time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		AccountID:     "****5678",
+		Email:         "jane@example.com",
+		Subject:       "ATM alert: low balance",
+		Message:       "The balance of account ****5678 is 40.00 after a withdrawal of 20.00, below your alert of 50.00.",
+		TransactionID: "TX1",
+		Amount:        20,
+		Balance:       40,
+		Threshold:     50,
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	address, received := testSMTPServer(t, false)
+	notifier := &atm.SMTPNotifier{Address: address, From: "atm@example.com", Username: "atm", Password: "secret", Timeout: 5 * time.Second}
+	assertNoError(t, notifier.Notify(testAlert()))
+
+	conversation := strings.Join(<-received, "\n")
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00atm\x00secret"))
+	for _, expected := range []string{
+		"AUTH PLAIN " + credentials,
+		"MAIL FROM:<atm@example.com>",
+		"RCPT TO:<jane@example.com>",
+		"To: jane@example.com",
+		"Subject: ATM alert: low balance",
+		"below your alert of 50.00.",
+		"Transaction: TX1",
+		"QUIT",
+	} {
+		if !strings.Contains(conversation, expected) {
+			t.Errorf("Email is missing %q. %s", expected, conversation)
+		}
+	}
+}
+
+func TestSMTPNotifierFailure(t *testing.T) {
+	address, received := testSMTPServer(t, true)
+	notifier := &atm.SMTPNotifier{Address: address, From: "atm@example.com", Timeout: 5 * time.Second}
+	assertErrorContains(t, notifier.Notify(testAlert()), "No such user")
+	<-received
+
+	// an unreachable server fails the alert
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	notifier.Address = closed
+	assertError(t, notifier.Notify(testAlert()))
+}
+
+func TestFileNotifier(t *testing.T) {
+	notifier := &atm.FileNotifier{File: filepath.Join(t.TempDir(), "alerts.jsonl")}
+	assertNoError(t, notifier.Notify(testAlert()))
+	assertNoError(t, notifier.Notify(testAlert()))
+
+	content, err := os.ReadFile(notifier.File)
+	assertNoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Alerts file should have 2 lines. %s", content)
+	}
+	alert := atm.Alert{}
+	assertNoError(t, json.Unmarshal([]byte(lines[0]), &alert))
+	if alert != testAlert() {
+		t.Errorf("Alert is incorrect. %+v", alert)
+	}
+
+	notifier.File = filepath.Join(t.TempDir(), "missing", "alerts.jsonl")
+	assertError(t, notifier.Notify(testAlert()))
+}
+
+func TestWriterNotifier(t *testing.T) {
+	output := &bytes.Buffer{}
+	assertNoError(t, (&atm.WriterNotifier{Output: output}).Notify(testAlert()))
+	if output.String() != "Alert to jane@example.com: "+testAlert().Message+"\n" {
+		t.Errorf("Alert output is incorrect. %s", output.String())
+	}
+}
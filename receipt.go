@@ -0,0 +1,203 @@
+package atm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receiptWidth is the number of characters on a line of receipt paper
+const receiptWidth = 32
+
+// Receipt of a withdrawal or deposit
+type Receipt struct {
+	TerminalID string `json:"terminal_id"`
+	// Currency the amounts are printed in, DefaultCurrency if empty
+	Currency string `json:"currency,omitempty"`
+	// Sequence is assigned when the receipt is saved, numbered per terminal
+	Sequence      int     `json:"sequence"`
+	DateTime      int64   `json:"date_time"`
+	AccountID     int     `json:"-"`
+	Kind          string  `json:"kind"`
+	Amount        float64 `json:"amount"`
+	Fee           float64 `json:"fee,omitempty"`
+	Balance       float64 `json:"balance"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+}
+
+// MaskedAccount returns the account number with every digit but the last 4 replaced by *
+func (r Receipt) MaskedAccount() string {
+	return maskAccount(r.AccountID)
+}
+
+// Text renders the receipt as plain text lines of receipt paper
+func (r Receipt) Text() string {
+	t := time.Unix(r.DateTime, 0)
+	lines := []string{
+		receiptTitle("ATM RECEIPT"),
+		receiptLine("TERMINAL", r.TerminalID),
+		receiptLine("SEQUENCE", fmt.Sprintf("%06d", r.Sequence)),
+		receiptLine("DATE", t.Format("01-02-2006")),
+		receiptLine("TIME", t.Format("15:04:05")),
+		receiptLine("ACCOUNT", r.MaskedAccount()),
+		receiptLine(strings.ToUpper(r.Kind), FormatAmount(r.Currency, r.Amount)),
+	}
+	if r.Fee != 0 {
+		lines = append(lines, receiptLine("FEE", FormatAmount(r.Currency, r.Fee)))
+	}
+	lines = append(lines, receiptLine("AVAILABLE BALANCE", FormatAmount(r.Currency, r.Balance)))
+	if r.TransactionID != "" {
+		lines = append(lines, receiptLine("TRANSACTION", r.TransactionID))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MiniStatement is the last transactions of an account in receipt form
+type MiniStatement struct {
+	TerminalID string `json:"terminal_id"`
+	// Currency the balance is printed in, DefaultCurrency if empty
+	Currency  string `json:"currency,omitempty"`
+	DateTime  int64  `json:"date_time"`
+	AccountID int    `json:"-"`
+	// Transactions oldest first
+	Transactions []Transaction `json:"transactions"`
+	Balance      float64       `json:"balance"`
+}
+
+// Text renders the mini statement as plain text lines of receipt paper, one line per transaction
+func (s MiniStatement) Text() string {
+	t := time.Unix(s.DateTime, 0)
+	lines := []string{
+		receiptTitle("MINI STATEMENT"),
+		receiptLine("TERMINAL", s.TerminalID),
+		receiptLine("DATE", t.Format("01-02-2006")),
+		receiptLine("TIME", t.Format("15:04:05")),
+		receiptLine("ACCOUNT", maskAccount(s.AccountID)),
+		"",
+	}
+	for _, transaction := range s.Transactions {
+		label := time.Unix(transaction.DateTime, 0).Format("01-02") + " " + strings.ToUpper(transaction.Kind)
+		lines = append(lines, receiptLine(label, fmt.Sprintf("%.2f", transaction.Amount)))
+	}
+	if len(s.Transactions) == 0 {
+		lines = append(lines, "No history found")
+	}
+	lines = append(lines, "", receiptLine("AVAILABLE BALANCE", FormatAmount(s.Currency, s.Balance)))
+	return strings.Join(lines, "\n")
+}
+
+// FormatAmount formats an amount in the currency, dollars with a $ sign and any other currency followed by its code
+func FormatAmount(currency string, amount float64) string {
+	if currency == "" || currency == DefaultCurrency {
+		return fmt.Sprintf("$%.2f", amount)
+	}
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+// maskAccount replaces every digit of the account number but the last 4 with *
+func maskAccount(accountID int) string {
+	account := strconv.Itoa(accountID)
+	if len(account) <= 4 {
+		return account
+	}
+	return strings.Repeat("*", len(account)-4) + account[len(account)-4:]
+}
+
+// receiptTitle centers the title on receipt paper
+func receiptTitle(title string) string {
+	return strings.Repeat(" ", (receiptWidth-len(title))/2) + title
+}
+
+// receiptLine aligns the label to the left and the value to the right
+func receiptLine(label string, value string) string {
+	padding := receiptWidth - len(label) - len(value)
+	if padding < 1 {
+		padding = 1
+	}
+	return label + strings.Repeat(" ", padding) + value
+}
+
+// receiptTerminalID is a terminal ID that is safe in the name of a receipt file
+var receiptTerminalID = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// ReceiptStore numbers receipts and saves them as text files to a directory.
+// The last sequence number of each terminal is kept in its <terminal id>-SEQUENCE file so terminals can share the directory
+type ReceiptStore struct {
+	Dir string
+
+	// mutex serializes reading and writing the sequence files
+	mutex sync.Mutex
+}
+
+// Save assigns the next sequence number of the terminal to the receipt and writes it to <terminal id>-<sequence>.txt
+// ErrReceiptTerminalIDInvalid is returned if the terminal ID is not letters and digits
+// An error is returned if the directory or the sequence file cannot be written
+func (s *ReceiptStore) Save(receipt *Receipt) error {
+	if !receiptTerminalID.MatchString(receipt.TerminalID) {
+		return fmt.Errorf("%w %q", ErrReceiptTerminalIDInvalid, receipt.TerminalID)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	sequence, err := s.sequence(receipt.TerminalID)
+	if err != nil {
+		return err
+	}
+	sequence++
+	if err := writeFileAtomic(filepath.Join(s.Dir, receipt.TerminalID+"-SEQUENCE"), []byte(strconv.Itoa(sequence)+"\n")); err != nil {
+		return err
+	}
+
+	receipt.Sequence = sequence
+	name := fmt.Sprintf("%s-%06d.txt", receipt.TerminalID, sequence)
+	return writeFileAtomic(filepath.Join(s.Dir, name), []byte(receipt.Text()+"\n"))
+}
+
+// sequence returns the sequence number of the last receipt saved by the terminal, 0 if it saved none.
+// A terminal without a sequence file continues from the SEQUENCE file the directory was numbered with before
+func (s *ReceiptStore) sequence(terminalID string) (int, error) {
+	content, err := os.ReadFile(filepath.Join(s.Dir, terminalID+"-SEQUENCE"))
+	if os.IsNotExist(err) {
+		content, err = os.ReadFile(filepath.Join(s.Dir, "SEQUENCE"))
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	sequence, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, ErrReceiptSequenceNotInteger
+	}
+	return sequence, nil
+}
+
+// writeFileAtomic writes the file through a temporary file so a crash never leaves it half written
+func writeFileAtomic(path string, content []byte) error {
+	tmpFile := path + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
@@ -0,0 +1,167 @@
+package atm_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestReceiptText(t *testing.T) {
+	dateTime := time.Date(2020, 10, 19, 14, 3, 12, 0, time.Local).Unix()
+	receipt := atm.Receipt{
+		TerminalID:    "ATM00001",
+		Sequence:      42,
+		DateTime:      dateTime,
+		AccountID:     12345678,
+		Kind:          atm.TransactionKindWithdrawal,
+		Amount:        120,
+		Fee:           5,
+		Balance:       -25,
+		TransactionID: "0123456789AB",
+	}
+
+	expected := strings.Join([]string{
+		"          ATM RECEIPT",
+		"TERMINAL                ATM00001",
+		"SEQUENCE                  000042",
+		"DATE                  10-19-2020",
+		"TIME                    14:03:12",
+		"ACCOUNT                 ****5678",
+		"WITHDRAWAL               $120.00",
+		"FEE                        $5.00",
+		"AVAILABLE BALANCE        $-25.00",
+		"TRANSACTION         0123456789AB",
+	}, "\n")
+	if receipt.Text() != expected {
+		t.Errorf("Receipt is incorrect.\n%s\nshould be\n%s", receipt.Text(), expected)
+	}
+
+	receipt.AccountID = 1234
+	if receipt.MaskedAccount() != "1234" {
+		t.Errorf("Short account number should not be masked. %s", receipt.MaskedAccount())
+	}
+
+	// amounts in other currencies are followed by the code
+	receipt.Currency = "EUR"
+	if !strings.Contains(receipt.Text(), "WITHDRAWAL            120.00 EUR") || !strings.Contains(receipt.Text(), "FEE                     5.00 EUR") {
+		t.Errorf("Receipt in euros is incorrect.\n%s", receipt.Text())
+	}
+}
+
+func TestReceiptStore(t *testing.T) {
+	store := &atm.ReceiptStore{Dir: filepath.Join(t.TempDir(), "receipts")}
+
+	first := atm.Receipt{TerminalID: "ATM00001", AccountID: 12345678, Kind: atm.TransactionKindDeposit, Amount: 10}
+	assertNoError(t, store.Save(&first))
+	second := first
+	assertNoError(t, store.Save(&second))
+	if first.Sequence != 1 || second.Sequence != 2 {
+		t.Errorf("Sequence numbers are incorrect. %d %d", first.Sequence, second.Sequence)
+	}
+
+	content, err := os.ReadFile(filepath.Join(store.Dir, "ATM00001-000002.txt"))
+	assertNoError(t, err)
+	if string(content) != second.Text()+"\n" {
+		t.Errorf("Saved receipt is incorrect. %q", content)
+	}
+
+	// the sequence continues after a restart
+	third := first
+	assertNoError(t, (&atm.ReceiptStore{Dir: store.Dir}).Save(&third))
+	if third.Sequence != 3 {
+		t.Errorf("Sequence did not continue. %d", third.Sequence)
+	}
+
+	// terminals sharing the directory are numbered on their own
+	other := atm.Receipt{TerminalID: "ATM00002", AccountID: 12345678, Kind: atm.TransactionKindDeposit, Amount: 10}
+	assertNoError(t, store.Save(&other))
+	if other.Sequence != 1 {
+		t.Errorf("Sequence of another terminal is incorrect. %d", other.Sequence)
+	}
+
+	// a terminal ID that is not letters and digits never names a file
+	invalid := atm.Receipt{TerminalID: "../ATM1"}
+	err = store.Save(&invalid)
+	if !errors.Is(err, atm.ErrReceiptTerminalIDInvalid) {
+		t.Errorf("Terminal ID should be refused. %v", err)
+	}
+}
+
+func TestReceiptStoreSharedSequence(t *testing.T) {
+	// a directory numbered before the sequence was kept per terminal continues from its SEQUENCE file
+	store := &atm.ReceiptStore{Dir: t.TempDir()}
+	assertNoError(t, os.WriteFile(filepath.Join(store.Dir, "SEQUENCE"), []byte("41\n"), 0644))
+	receipt := atm.Receipt{TerminalID: "ATM00001", AccountID: 12345678, Kind: atm.TransactionKindDeposit, Amount: 10}
+	assertNoError(t, store.Save(&receipt))
+	if receipt.Sequence != 42 {
+		t.Errorf("Sequence did not continue from the shared sequence. %d", receipt.Sequence)
+	}
+}
+
+func TestPrintReceipt(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{
+		AccountDB:     accountDB,
+		TransactionDB: transactionDB,
+		ATMBalance:    200,
+		Session:       &atm.Session{},
+		TerminalID:    "ATM00001",
+	}
+	assertNoError(t, testATM.Authorize(12345678, "1234"))
+	_, err := testATM.Withdraw(12345678, 120)
+	assertNoError(t, err)
+
+	// receipts are not offered without a receipt store
+	if testATM.ReceiptOffered() {
+		t.Errorf("Receipt should not be offered")
+	}
+	_, err = testATM.PrintReceipt()
+	assertErrorIsError(t, err, atm.ErrReceiptPrinterUnavailable)
+
+	testATM.Receipts = &atm.ReceiptStore{Dir: t.TempDir()}
+	receipt, err := testATM.PrintReceipt()
+	assertNoError(t, err)
+	if receipt.Sequence != 1 || receipt.Amount != 120 || receipt.Fee != 5 || receipt.Balance != -25 || receipt.TransactionID == "" {
+		t.Errorf("Receipt is incorrect. %+v", receipt)
+	}
+
+	// a receipt is printed once
+	_, err = testATM.PrintReceipt()
+	assertErrorIsError(t, err, atm.ErrReceiptNotAvailable)
+
+	assertNoError(t, testATM.Deposit(12345678, 10))
+	assertNoError(t, testATM.Logout())
+	_, err = testATM.PrintReceipt()
+	assertErrorIsError(t, err, atm.ErrReceiptNotAvailable)
+}
+
+func TestConsoleReceipt(t *testing.T) {
+	testATM := newTestFlowATM(t)
+	testATM.TerminalID = "ATM00001"
+	testATM.Receipts = &atm.ReceiptStore{Dir: t.TempDir()}
+	output := &bytes.Buffer{}
+	console := &atm.Console{ATM: testATM, Output: output}
+
+	assertNoError(t, console.Run("authorize 12345678 1234"))
+	// the receipt is only offered after a withdrawal or deposit
+	assertErrorContains(t, console.Run("receipt"), atm.ErrFlowNotAllowed.Error())
+	assertNoError(t, console.Run("withdraw 40"))
+	if !strings.Contains(output.String(), "Type receipt to print a receipt.") {
+		t.Errorf("Receipt was not offered. %s", output.String())
+	}
+	assertNoError(t, console.Run("receipt"))
+	if !strings.Contains(output.String(), "SEQUENCE                  000001") {
+		t.Errorf("Receipt was not printed. %s", output.String())
+	}
+
+	// declining the receipt by starting another transaction
+	assertNoError(t, console.Run("deposit 10"))
+	assertNoError(t, console.Run("balance"))
+	assertErrorContains(t, console.Run("receipt"), atm.ErrFlowNotAllowed.Error())
+}
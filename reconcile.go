@@ -0,0 +1,259 @@
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// reconciliation issue kinds
+const (
+	// the balance of the account does not agree with the running balance of its last transaction
+	ReconcileBalanceMismatch = "balance_mismatch"
+	// the running balance of a transaction does not follow from the transaction before it
+	ReconcileGap = "gap"
+	// a transaction ID is used twice, or a transaction written before transaction IDs is repeated column for column
+	ReconcileDuplicate = "duplicate"
+	// a transaction is older than the transaction of the account before it
+	ReconcileOutOfOrder = "out_of_order"
+	// the account has a balance but no transactions
+	ReconcileOrphanedAccount = "orphaned_account"
+	// transactions of an account that is not in the account DB
+	ReconcileUnknownAccount = "unknown_account"
+)
+
+// ReconcileIssue is an inconsistency between the account and transaction DBs
+type ReconcileIssue struct {
+	Kind      string `json:"kind"`
+	AccountID int    `json:"account_id"`
+	// Entry is the 1-based position of the transaction in the ledger, 0 for issues of an account
+	Entry         int    `json:"entry,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	// Expected and Actual are the balances of balance mismatches, gaps and orphaned accounts
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+	Message  string  `json:"message"`
+}
+
+// ReconcileReport is the outcome of replaying every transaction of the ledger against the accounts
+type ReconcileReport struct {
+	Accounts     int              `json:"accounts"`
+	Transactions int              `json:"transactions"`
+	Issues       []ReconcileIssue `json:"issues"`
+	// Adjustments are the entries that correct the gaps, balance mismatches and orphaned accounts
+	Adjustments []Transaction `json:"adjustments"`
+	// Fixed is true if the adjustments were written to the ledger
+	Fixed bool `json:"fixed"`
+}
+
+// OK is true if no issue was found
+func (r ReconcileReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// reconcileEntryReason is the reason of an adjustment correcting the gap of an entry, the entry is its 1-based position in the ledger
+const reconcileEntryReason = "Reconciliation of entry %d"
+
+// Reconcile replays the transactions of every account in ledger order starting from a zero balance.
+// Every transaction must move the running balance of the one before it by its amount less its fee,
+// and the last running balance must agree with the account balance
+func Reconcile(accounts []Account, transactions []Transaction) ReconcileReport {
+	return reconcile(accounts, transactions, time.Now().Unix())
+}
+
+// reconcile returns the report with the adjustments to append to the ledger.
+// The account balances are taken as correct: an adjustment is appended for every gap, it is replayed as if it came
+// right before the entry it corrects and does not move the running balance where it is, and for every account whose
+// balance does not agree with its last transaction
+func reconcile(accounts []Account, transactions []Transaction, now int64) ReconcileReport {
+	report := ReconcileReport{
+		Accounts:     len(accounts),
+		Transactions: len(transactions),
+		Issues:       []ReconcileIssue{},
+		Adjustments:  []Transaction{},
+	}
+	known := map[int]bool{}
+	for _, account := range accounts {
+		known[account.AccountID] = true
+	}
+
+	// running balance and date time of the last transaction of each account
+	type ledgerState struct {
+		balance  float64
+		dateTime int64
+	}
+	states := map[int]*ledgerState{}
+	unknown := map[int]bool{}
+	seen := map[string]int{}
+	adjust := func(adjustment Transaction) {
+		adjustment.TransactionID = newTransactionID()
+		adjustment.Kind = TransactionKindAdjustment
+		report.Adjustments = append(report.Adjustments, adjustment)
+	}
+
+	// amounts of the adjustments written for gaps, by the entry they correct
+	corrections := map[int]float64{}
+	corrects := func(t Transaction) (int, bool) {
+		entry := 0
+		if t.Kind != TransactionKindAdjustment {
+			return 0, false
+		}
+		n, err := fmt.Sscanf(t.Reason, reconcileEntryReason, &entry)
+		return entry, err == nil && n == 1
+	}
+	for _, t := range transactions {
+		if entry, ok := corrects(t); ok {
+			corrections[entry] = roundCents(corrections[entry] + t.Amount)
+		}
+	}
+
+	for i, t := range transactions {
+		entry := i + 1
+		if !known[t.AccountID] {
+			if !unknown[t.AccountID] {
+				unknown[t.AccountID] = true
+				report.Issues = append(report.Issues, ReconcileIssue{
+					Kind:          ReconcileUnknownAccount,
+					AccountID:     t.AccountID,
+					Entry:         entry,
+					TransactionID: t.TransactionID,
+					Message:       fmt.Sprintf("Entry %d belongs to account %d which does not exist.", entry, t.AccountID),
+				})
+			}
+			continue
+		}
+
+		// transactions written before transaction IDs are duplicates if every column matches
+		key := t.TransactionID
+		if key == "" {
+			key = fmt.Sprintf("%d,%d,%.2f,%.2f", t.AccountID, t.DateTime, t.Amount, t.Balance)
+		}
+		if first, ok := seen[key]; ok {
+			report.Issues = append(report.Issues, ReconcileIssue{
+				Kind:          ReconcileDuplicate,
+				AccountID:     t.AccountID,
+				Entry:         entry,
+				TransactionID: t.TransactionID,
+				Message:       fmt.Sprintf("Entry %d duplicates entry %d.", entry, first),
+			})
+		} else {
+			seen[key] = entry
+		}
+
+		state, ok := states[t.AccountID]
+		if !ok {
+			state = &ledgerState{}
+			states[t.AccountID] = state
+		} else if t.DateTime < state.dateTime {
+			report.Issues = append(report.Issues, ReconcileIssue{
+				Kind:          ReconcileOutOfOrder,
+				AccountID:     t.AccountID,
+				Entry:         entry,
+				TransactionID: t.TransactionID,
+				Message:       fmt.Sprintf("Entry %d at %s is older than the transaction before it at %s.", entry, time.Unix(t.DateTime, 0).Format(time.RFC3339), time.Unix(state.dateTime, 0).Format(time.RFC3339)),
+			})
+		}
+
+		// the correction was replayed with the entry it corrects
+		if _, ok := corrects(t); ok {
+			state.dateTime = t.DateTime
+			continue
+		}
+
+		expected := roundCents(state.balance + corrections[entry] + t.Amount - t.Fee)
+		if expected != roundCents(t.Balance) {
+			report.Issues = append(report.Issues, ReconcileIssue{
+				Kind:          ReconcileGap,
+				AccountID:     t.AccountID,
+				Entry:         entry,
+				TransactionID: t.TransactionID,
+				Expected:      expected,
+				Actual:        t.Balance,
+				Message:       fmt.Sprintf("Entry %d has a balance of %.2f, the transactions before it add up to %.2f.", entry, t.Balance, expected),
+			})
+			adjust(Transaction{
+				AccountID: t.AccountID,
+				DateTime:  now,
+				Amount:    roundCents(t.Balance - expected),
+				Reason:    fmt.Sprintf(reconcileEntryReason, entry),
+			})
+		}
+		state.balance = roundCents(t.Balance)
+		state.dateTime = t.DateTime
+	}
+	// the gap adjustments leave the running balance of the account as it is at the end of the ledger
+	for i, adjustment := range report.Adjustments {
+		report.Adjustments[i].Balance = states[adjustment.AccountID].balance
+	}
+
+	for _, account := range accounts {
+		balance := roundCents(account.Balance)
+		state, ok := states[account.AccountID]
+		if !ok {
+			if balance != 0 {
+				report.Issues = append(report.Issues, ReconcileIssue{
+					Kind:      ReconcileOrphanedAccount,
+					AccountID: account.AccountID,
+					Actual:    balance,
+					Message:   fmt.Sprintf("Account %d has a balance of %.2f and no transactions.", account.AccountID, balance),
+				})
+				adjust(Transaction{
+					AccountID: account.AccountID,
+					DateTime:  now,
+					Amount:    balance,
+					Balance:   balance,
+					Reason:    "Opening balance",
+				})
+			}
+			continue
+		}
+		if balance != state.balance {
+			report.Issues = append(report.Issues, ReconcileIssue{
+				Kind:      ReconcileBalanceMismatch,
+				AccountID: account.AccountID,
+				Expected:  state.balance,
+				Actual:    balance,
+				Message:   fmt.Sprintf("Account %d has a balance of %.2f, its transactions add up to %.2f.", account.AccountID, balance, state.balance),
+			})
+			adjust(Transaction{
+				AccountID: account.AccountID,
+				DateTime:  now,
+				Amount:    roundCents(balance - state.balance),
+				Balance:   balance,
+				Reason:    "Reconciliation of the account balance",
+			})
+		}
+	}
+	return report
+}
+
+// Reconcile checks the account DB against the transaction DB.
+// If fix is true the adjustments are appended to the ledger, the account balances are never changed
+// An error is returned on failure to read or write the DBs
+func (h *Host) Reconcile(fix bool) (ReconcileReport, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	accounts, err := h.AccountDB.All()
+	if err != nil {
+		return ReconcileReport{}, storeUnavailable(err)
+	}
+	transactions, err := h.TransactionDB.All()
+	if err != nil {
+		return ReconcileReport{}, storeUnavailable(err)
+	}
+
+	report := reconcile(accounts, transactions, time.Now().Unix())
+	if !fix || len(report.Adjustments) == 0 {
+		return report, nil
+	}
+	err = h.TransactionDB.Append(report.Adjustments)
+	if errors.Is(err, ErrLedgerTampered) || errors.Is(err, ErrLedgerNotMigrated) {
+		return report, err
+	}
+	if err != nil {
+		return report, storeUnavailable(err)
+	}
+	report.Fixed = true
+	return report, nil
+}
@@ -0,0 +1,111 @@
+package atm_test
+
+import (
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func assertIssueKinds(t *testing.T, report atm.ReconcileReport, kinds ...string) {
+	if len(report.Issues) != len(kinds) {
+		t.Fatalf("Expected issues %v but got %+v", kinds, report.Issues)
+	}
+	for i, kind := range kinds {
+		if report.Issues[i].Kind != kind {
+			t.Errorf("Expected issues %v but got %+v", kinds, report.Issues)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	accounts := []atm.Account{
+		{AccountID: 12345678, Balance: 55},
+		{AccountID: 87654321, Balance: 0},
+	}
+	transactions := []atm.Transaction{
+		{AccountID: 12345678, DateTime: 100, Amount: 100, Balance: 100, TransactionID: "A", Kind: atm.TransactionKindDeposit},
+		{AccountID: 12345678, DateTime: 200, Amount: -40, Fee: 5, Balance: 55, TransactionID: "B", Kind: atm.TransactionKindWithdrawal},
+		{AccountID: 87654321, DateTime: 150, Amount: 20, Balance: 20},
+		{AccountID: 87654321, DateTime: 160, Amount: -20, Balance: 0},
+	}
+	report := atm.Reconcile(accounts, transactions)
+	if !report.OK() || report.Accounts != 2 || report.Transactions != 4 || len(report.Adjustments) != 0 {
+		t.Errorf("Ledger should reconcile. %+v", report)
+	}
+
+	// accounts opened with a balance and transactions that do not add up
+	accounts = []atm.Account{
+		{AccountID: 12345678, Balance: 60},
+		{AccountID: 87654321, Balance: 25.50},
+		{AccountID: 11111111, Balance: 0},
+	}
+	transactions = []atm.Transaction{
+		{AccountID: 12345678, DateTime: 200, Amount: -40, Balance: 60, TransactionID: "A", Kind: atm.TransactionKindWithdrawal},
+		{AccountID: 12345678, DateTime: 100, Amount: 20, Balance: 80, TransactionID: "B", Kind: atm.TransactionKindDeposit},
+		{AccountID: 12345678, DateTime: 100, Amount: 20, Balance: 80, TransactionID: "B", Kind: atm.TransactionKindDeposit},
+		{AccountID: 99999999, DateTime: 300, Amount: 20, Balance: 20},
+	}
+	report = atm.Reconcile(accounts, transactions)
+	assertIssueKinds(t, report,
+		atm.ReconcileGap, atm.ReconcileOutOfOrder, atm.ReconcileDuplicate, atm.ReconcileGap,
+		atm.ReconcileUnknownAccount, atm.ReconcileBalanceMismatch, atm.ReconcileOrphanedAccount)
+	if issue := report.Issues[0]; issue.Entry != 1 || issue.Expected != -40 || issue.Actual != 60 {
+		t.Errorf("Gap is incorrect. %+v", issue)
+	}
+	if issue := report.Issues[5]; issue.AccountID != 12345678 || issue.Expected != 80 || issue.Actual != 60 {
+		t.Errorf("Balance mismatch is incorrect. %+v", issue)
+	}
+
+	adjustments := []float64{100, -20, -20, 25.50}
+	if len(report.Adjustments) != len(adjustments) {
+		t.Fatalf("Adjustments are incorrect. %+v", report.Adjustments)
+	}
+	for i, amount := range adjustments {
+		if report.Adjustments[i].Amount != amount || report.Adjustments[i].Kind != atm.TransactionKindAdjustment {
+			t.Errorf("Adjustment %d should be %.2f. %+v", i, amount, report.Adjustments[i])
+		}
+	}
+}
+
+func TestHostReconcile(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t,
+		"12345678,1234,100.00\n87654321,4321,10.00\n",
+		"12345678,1,-40.00,60.00\n12345678,2,20.00,80.00\n")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+
+	report, err := host.Reconcile(false)
+	assertNoError(t, err)
+	assertIssueKinds(t, report, atm.ReconcileGap, atm.ReconcileBalanceMismatch, atm.ReconcileOrphanedAccount)
+	if report.Fixed {
+		t.Errorf("Ledger should not be fixed")
+	}
+	transactions, err := transactionDB.All()
+	assertNoError(t, err)
+	if len(transactions) != 2 {
+		t.Errorf("Ledger should not change. %+v", transactions)
+	}
+
+	report, err = host.Reconcile(true)
+	assertNoError(t, err)
+	if !report.Fixed || len(report.Adjustments) != 3 {
+		t.Errorf("Ledger should be fixed. %+v", report)
+	}
+	transactions, err = transactionDB.All()
+	assertNoError(t, err)
+	// the adjustments are appended, the gap of the first entry is corrected without moving the running balance
+	if len(transactions) != 5 || transactions[0].Kind != atm.TransactionKindWithdrawal || transactions[2].Kind != atm.TransactionKindAdjustment || transactions[2].Amount != 100 || transactions[2].Balance != 80 {
+		t.Errorf("Adjustments were not appended. %+v", transactions)
+	}
+
+	// the fixed ledger reconciles and the account balances are unchanged
+	report, err = host.Reconcile(false)
+	assertNoError(t, err)
+	if !report.OK() {
+		t.Errorf("Fixed ledger should reconcile. %+v", report.Issues)
+	}
+	balance, err := host.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 100 {
+		t.Errorf("Account balance should not change. %.2f", balance)
+	}
+}
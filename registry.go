@@ -0,0 +1,411 @@
+package atm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ArgKind is the type an argument is parsed to before the command runs
+type ArgKind int
+
+const (
+	ArgString ArgKind = iota
+	ArgInt
+	ArgFloat
+)
+
+// ArgSpec describes a positional argument of a command
+type ArgSpec struct {
+	Name string
+	Kind ArgKind
+	// Optional arguments may be left out, they must come after the required arguments
+	Optional bool
+	// Variadic joins the remaining arguments with spaces, only valid for the last argument
+	Variadic bool
+	// Sensitive arguments such as PINs are masked wherever the command is echoed
+	Sensitive bool
+	// Invalid is returned if the value cannot be parsed, defaults to ErrConsoleInvalidArgument
+	Invalid error
+}
+
+func (s ArgSpec) usage() string {
+	if s.Optional {
+		return "[" + s.Name + "]"
+	}
+	return "<" + s.Name + ">"
+}
+
+func (s ArgSpec) parse(value string) (interface{}, error) {
+	invalid := s.Invalid
+	if invalid == nil {
+		invalid = fmt.Errorf("%w %s", ErrConsoleInvalidArgument, s.Name)
+	}
+
+	switch s.Kind {
+	case ArgInt:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, invalid
+		}
+		return parsed, nil
+	case ArgFloat:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		return parsed, nil
+	}
+	return value, nil
+}
+
+// Args are the arguments of a command by name, parsed according to the argument specs
+type Args map[string]interface{}
+
+// Has returns true if the argument was given
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// String returns a string argument or an empty string if it was not given
+func (a Args) String(name string) string {
+	value, _ := a[name].(string)
+	return value
+}
+
+// Int returns an integer argument or 0 if it was not given
+func (a Args) Int(name string) int {
+	value, _ := a[name].(int)
+	return value
+}
+
+// Float returns a float argument or 0 if it was not given
+func (a Args) Float(name string) float64 {
+	value, _ := a[name].(float64)
+	return value
+}
+
+type CommandRun func(*ATM, Args) (Result, error)
+
+// Command is a console command. The arguments are validated against Args before Run is called
+type Command struct {
+	Name    string
+	Aliases []string
+	// Help describes what the command does
+	Help string
+	Args []ArgSpec
+	// States of the customer flow the command may run in, any state if empty or the ATM has no flow
+	States []FlowState
+	Run    CommandRun
+}
+
+// Usage shows how to call the command e.g. withdraw <amount> [idempotency_key]
+func (c Command) Usage() string {
+	usage := []string{c.Name}
+	for _, arg := range c.Args {
+		usage = append(usage, arg.usage())
+	}
+	return strings.Join(usage, " ")
+}
+
+// Execute validates the provided arguments, not including the command name, runs the command and records it in the audit log
+// An error is returned when the arguments are invalid or the command failed to run
+func (c Command) Execute(atm *ATM, args []string) (Result, error) {
+	// the account is read before the command runs since logout ends the session
+	parsed, _ := c.parse(args)
+	account := atm.auditAccount(parsed)
+	result, err := c.execute(atm, args)
+	// declined amounts are recorded too
+	audited := result
+	if audited.Amount == 0 {
+		audited.Amount = parsed.Float("amount") + float64(parsed.Int("amount"))
+	}
+	atm.Audit(c.Name, account, audited, err)
+	return result, err
+}
+
+func (c Command) execute(atm *ATM, args []string) (Result, error) {
+	if atm != nil && atm.Flow != nil && len(c.States) > 0 {
+		timedOut := atm.Flow.Expire(atm)
+		if err := atm.Flow.Allow(atm, c.States...); err != nil {
+			if timedOut {
+				err = ErrFlowTimedOut
+			}
+			return Result{Command: c.Name}, err
+		}
+	}
+
+	parsed, err := c.parse(args)
+	if err == ErrConsoleInvalidCommand {
+		// Append usage if invalid command was provided
+		return Result{Command: c.Name}, fmt.Errorf("%w%s", ErrConsoleInvalidCommand, c.Usage())
+	}
+	if err != nil {
+		return Result{Command: c.Name}, err
+	}
+
+	result, err := c.Run(atm, parsed)
+	result.Command = c.Name
+	return result, err
+}
+
+// parse returns ErrConsoleInvalidCommand if the number of arguments does not match the argument specs
+func (c Command) parse(args []string) (Args, error) {
+	required := 0
+	variadic := false
+	for _, spec := range c.Args {
+		if !spec.Optional {
+			required++
+		}
+		variadic = variadic || spec.Variadic
+	}
+	if len(args) < required || (len(args) > len(c.Args) && !variadic) {
+		return nil, ErrConsoleInvalidCommand
+	}
+
+	parsed := Args{}
+	for i, spec := range c.Args {
+		if i >= len(args) {
+			break
+		}
+		value := args[i]
+		if spec.Variadic {
+			value = strings.Join(args[i:], " ")
+		}
+		v, err := spec.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		parsed[spec.Name] = v
+	}
+	return parsed, nil
+}
+
+// Registry holds the commands of a console by name and alias.
+// Commands are listed in the order they were registered
+type Registry struct {
+	mutex    sync.RWMutex
+	commands []Command
+	// index of the command for every name and alias
+	names map[string]int
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]int{},
+	}
+}
+
+// DefaultRegistry returns a registry with the default commands and the help builtin
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	for _, command := range DefaultCommands() {
+		r.Register(command)
+	}
+	r.Register(Command{
+		Name: "help",
+		Help: "List every command or show the usage of a command.",
+		Args: []ArgSpec{
+			{Name: "command", Optional: true},
+		},
+		Run: func(atm *ATM, args Args) (Result, error) {
+			message, err := r.Help(args.String("command"))
+			return Result{Message: message}, err
+		},
+	})
+	return r
+}
+
+var (
+	defaultRegistry     *Registry
+	defaultRegistryOnce sync.Once
+)
+
+// sharedRegistry returns the default registry used when no registry is given
+func sharedRegistry() *Registry {
+	defaultRegistryOnce.Do(func() {
+		defaultRegistry = DefaultRegistry()
+	})
+	return defaultRegistry
+}
+
+// Register adds a command to the registry
+// An error is returned if the command has no name or run function, or the name or an alias is already used
+func (r *Registry) Register(command Command) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := validCommand(command); err != nil {
+		return err
+	}
+	for _, name := range commandNames(command) {
+		if _, ok := r.names[name]; ok {
+			return fmt.Errorf("%w %s", ErrRegistryCommandExists, name)
+		}
+	}
+
+	r.commands = append(r.commands, command)
+	r.index()
+	return nil
+}
+
+// Override replaces the command with the same name or adds it if there is none.
+// The aliases of the replaced command are removed
+// An error is returned if an alias is used by a different command
+func (r *Registry) Override(command Command) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := validCommand(command); err != nil {
+		return err
+	}
+	name := strings.ToLower(command.Name)
+	for _, alias := range commandNames(command) {
+		if i, ok := r.names[alias]; ok && strings.ToLower(r.commands[i].Name) != name {
+			return fmt.Errorf("%w %s", ErrRegistryCommandExists, alias)
+		}
+	}
+
+	if i, ok := r.names[name]; ok && strings.ToLower(r.commands[i].Name) == name {
+		r.commands[i] = command
+	} else {
+		r.commands = append(r.commands, command)
+	}
+	r.index()
+	return nil
+}
+
+// Lookup returns the command by name or alias
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	i, ok := r.names[strings.ToLower(name)]
+	if !ok {
+		return Command{}, false
+	}
+	return r.commands[i], true
+}
+
+// Commands returns the registered commands in the order they were registered
+func (r *Registry) Commands() []Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return append([]Command{}, r.commands...)
+}
+
+// Execute runs the command given the command string and returns its result without printing it
+// An error is returned if the command is unknown, the arguments are invalid or the command failed
+func (r *Registry) Execute(atm *ATM, command string) (Result, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return Result{}, fmt.Errorf("%w. Type help to list the commands.", ErrConsoleUnknownCommand)
+	}
+
+	c, ok := r.Lookup(args[0])
+	if !ok {
+		name := strings.ToLower(args[0])
+		err := fmt.Errorf("%w %s. Type help to list the commands.", ErrConsoleUnknownCommand, name)
+		// the name is not recorded since a PIN typed at the prompt would leak into the log
+		atm.Audit(AuditCommandUnknown, atm.auditAccount(nil), Result{}, err)
+		return Result{Command: name}, err
+	}
+	return c.Execute(atm, args[1:])
+}
+
+// maskedArgument replaces a sensitive argument in a masked command
+const maskedArgument = "****"
+
+// Mask returns the command string with its sensitive arguments replaced by ****, so it can be echoed or recorded.
+// Arguments the command does not take are masked as well and the arguments of an unknown command are left out
+func (r *Registry) Mask(command string) string {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return ""
+	}
+	c, ok := r.Lookup(args[0])
+	if !ok {
+		return args[0]
+	}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case i <= len(c.Args):
+			if c.Args[i-1].Sensitive {
+				args[i] = maskedArgument
+			}
+		case len(c.Args) == 0 || !c.Args[len(c.Args)-1].Variadic || c.Args[len(c.Args)-1].Sensitive:
+			args[i] = maskedArgument
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// Help returns the usage and help of every command, or of a single command if a name is given
+// An error is returned if the command is unknown
+func (r *Registry) Help(name string) (string, error) {
+	if name != "" {
+		c, ok := r.Lookup(name)
+		if !ok {
+			return "", fmt.Errorf("%w %s. Type help to list the commands.", ErrConsoleUnknownCommand, strings.ToLower(name))
+		}
+		lines := []string{c.Usage()}
+		if len(c.Aliases) > 0 {
+			lines = append(lines, "Aliases: "+strings.Join(c.Aliases, ", "))
+		}
+		if c.Help != "" {
+			lines = append(lines, c.Help)
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	commands := r.Commands()
+	width := 0
+	for _, c := range commands {
+		if len(c.Usage()) > width {
+			width = len(c.Usage())
+		}
+	}
+	lines := []string{"Commands:"}
+	for _, c := range commands {
+		lines = append(lines, strings.TrimRight(fmt.Sprintf("  %-*s  %s", width, c.Usage(), c.Help), " "))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// index rebuilds the names of the commands. Callers must hold the mutex
+func (r *Registry) index() {
+	r.names = map[string]int{}
+	for i, command := range r.commands {
+		for _, name := range commandNames(command) {
+			r.names[name] = i
+		}
+	}
+}
+
+func validCommand(command Command) error {
+	if strings.TrimSpace(command.Name) == "" || strings.ContainsAny(command.Name, " \t") || command.Run == nil {
+		return ErrRegistryInvalidCommand
+	}
+	for i, arg := range command.Args {
+		if arg.Variadic && i != len(command.Args)-1 {
+			return ErrRegistryInvalidCommand
+		}
+		if i > 0 && command.Args[i-1].Optional && !arg.Optional {
+			return ErrRegistryInvalidCommand
+		}
+	}
+	return nil
+}
+
+// commandNames returns the lower case name and aliases of a command
+func commandNames(command Command) []string {
+	names := []string{strings.ToLower(command.Name)}
+	for _, alias := range command.Aliases {
+		names = append(names, strings.ToLower(alias))
+	}
+	return names
+}
@@ -0,0 +1,130 @@
+package atm_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newTestCommand(name string, message string) atm.Command {
+	return atm.Command{
+		Name:    name,
+		Aliases: []string{name[:1]},
+		Help:    "Test command.",
+		Args: []atm.ArgSpec{
+			{Name: "count", Kind: atm.ArgInt},
+			{Name: "note", Optional: true, Variadic: true},
+		},
+		Run: func(a *atm.ATM, args atm.Args) (atm.Result, error) {
+			return atm.Result{Message: strings.TrimSpace(message + " " + strings.Repeat("x", args.Int("count")) + " " + args.String("note"))}, nil
+		},
+	}
+}
+
+func TestRegistryRegister(t *testing.T) {
+	registry := atm.NewRegistry()
+	assertNoError(t, registry.Register(newTestCommand("ping", "pong")))
+
+	err := registry.Register(newTestCommand("ping", "pong"))
+	if !errors.Is(err, atm.ErrRegistryCommandExists) {
+		t.Errorf("Duplicate command should not be registered. %v", err)
+	}
+	err = registry.Register(atm.Command{Name: "pong"})
+	assertErrorIsError(t, err, atm.ErrRegistryInvalidCommand)
+
+	// commands are found by name or alias ignoring case
+	result, err := registry.Execute(nil, "PING 2 hello  world")
+	assertNoError(t, err)
+	if result.Command != "ping" || result.Message != "pong xx hello world" {
+		t.Errorf("Result is incorrect. %+v", result)
+	}
+	result, err = registry.Execute(nil, "p 1")
+	assertNoError(t, err)
+	if result.Message != "pong x" {
+		t.Errorf("Result is incorrect. %+v", result)
+	}
+}
+
+func TestRegistryOverride(t *testing.T) {
+	registry := atm.DefaultRegistry()
+	assertNoError(t, registry.Override(newTestCommand("balance", "overridden")))
+
+	result, err := registry.Execute(nil, "balance 1")
+	assertNoError(t, err)
+	if result.Message != "overridden x" {
+		t.Errorf("Command was not overridden. %+v", result)
+	}
+	if len(registry.Commands()) != len(atm.DefaultCommands())+1 {
+		t.Errorf("Override should replace the command. %d", len(registry.Commands()))
+	}
+
+	// alias of another command cannot be taken
+	err = registry.Override(newTestCommand("exit", "overridden"))
+	if !errors.Is(err, atm.ErrRegistryCommandExists) {
+		t.Errorf("Alias of another command should not be overridden. %v", err)
+	}
+}
+
+func TestRegistryArgs(t *testing.T) {
+	registry := atm.NewRegistry()
+	assertNoError(t, registry.Register(newTestCommand("ping", "pong")))
+
+	_, err := registry.Execute(nil, "ping")
+	assertErrorContains(t, err, atm.ErrConsoleInvalidCommand.Error()+"ping <count> [note]")
+	_, err = registry.Execute(nil, "ping many")
+	if !errors.Is(err, atm.ErrConsoleInvalidArgument) {
+		t.Errorf("Invalid argument should be rejected. %v", err)
+	}
+	_, err = registry.Execute(nil, "pong")
+	if !errors.Is(err, atm.ErrConsoleUnknownCommand) {
+		t.Errorf("Unknown command should be rejected. %v", err)
+	}
+}
+
+func TestRegistryHelp(t *testing.T) {
+	registry := atm.DefaultRegistry()
+
+	result, err := registry.Execute(nil, "help withdraw")
+	assertNoError(t, err)
+	if !strings.HasPrefix(result.Message, "withdraw <amount> [idempotency_key]\n") {
+		t.Errorf("Help is incorrect. %s", result.Message)
+	}
+
+	result, err = registry.Execute(nil, "help end")
+	assertNoError(t, err)
+	if !strings.Contains(result.Message, "Aliases: exit, quit") {
+		t.Errorf("Help is incorrect. %s", result.Message)
+	}
+
+	result, err = registry.Execute(nil, "help")
+	assertNoError(t, err)
+	for _, command := range registry.Commands() {
+		if !strings.Contains(result.Message, command.Usage()) {
+			t.Errorf("Help is missing %s. %s", command.Name, result.Message)
+		}
+	}
+
+	_, err = registry.Execute(nil, "help unknown")
+	if !errors.Is(err, atm.ErrConsoleUnknownCommand) {
+		t.Errorf("Unknown command should be rejected. %v", err)
+	}
+}
+
+func TestRegistryMask(t *testing.T) {
+	registry := atm.DefaultRegistry()
+	tests := map[string]string{
+		"authorize 12345678 1234":    "authorize 12345678 ****",
+		"CONFIRM 1234 5678":          "CONFIRM **** ****",
+		"history kind=withdrawal 10": "history kind=withdrawal 10",
+		"balance 1234":               "balance ****",
+		"1234":                       "1234",
+		"":                           "",
+	}
+	for command, masked := range tests {
+		if got := registry.Mask(command); got != masked {
+			t.Errorf("%q should be masked as %q but is %q", command, masked, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package atm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PendingReversal is a reversal advice the host did not acknowledge for a request it did not respond to
+type PendingReversal struct {
+	// OriginalData identifies the unanswered request by its MTI, STAN and transmission date time (field 90)
+	OriginalData   string
+	ProcessingCode string
+	// AccountID of the unanswered request, the host only reverses a transaction of this account
+	AccountID int
+	Reason    string
+}
+
+// ReversalQueue stores the reversals the host did not acknowledge on local disk until they are forwarded
+type ReversalQueue struct {
+	DBFile string
+}
+
+// Add appends a reversal to the queue and syncs it to disk.
+// A reversal of a request that is already queued is not added again
+// An error is returned if the reversal could not be stored
+func (q ReversalQueue) Add(reversal PendingReversal) error {
+	pending, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	for _, queued := range pending {
+		if queued.OriginalData == reversal.OriginalData {
+			return nil
+		}
+	}
+
+	file, err := openCSVAppend(q.DBFile, reversalHeader)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(reversalRecord(reversal)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Pending returns the reversals that have not been acknowledged by the host in the order they were queued
+// An empty list is returned if nothing has been queued
+func (q ReversalQueue) Pending() ([]PendingReversal, error) {
+	rows, err := readCSVRows(q.DBFile, 4)
+	if err != nil {
+		return []PendingReversal{}, err
+	}
+
+	reversals := []PendingReversal{}
+	for _, columns := range rows {
+		if len(columns[0]) != 42 || !isDigits(columns[0]) {
+			return []PendingReversal{}, fmt.Errorf("Original data elements of a queued reversal are not valid. %s", columns[0])
+		}
+		accountID, err := strconv.Atoi(columns[2])
+		if err != nil {
+			return []PendingReversal{}, fmt.Errorf("Account ID of a queued reversal is not valid. %s", columns[2])
+		}
+		reversals = append(reversals, PendingReversal{
+			OriginalData:   columns[0],
+			ProcessingCode: columns[1],
+			AccountID:      accountID,
+			Reason:         columns[3],
+		})
+	}
+	return reversals, nil
+}
+
+// Remove removes the reversal of the request from the queue once the host acknowledged it
+func (q ReversalQueue) Remove(originalData string) error {
+	pending, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	var content strings.Builder
+	content.WriteString(reversalHeader)
+	for _, reversal := range pending {
+		if reversal.OriginalData != originalData {
+			content.WriteString(reversalRecord(reversal))
+		}
+	}
+	return writeFileAtomic(q.DBFile, []byte(content.String()))
+}
+
+// reversalHeader is the header of the reversal queue
+const reversalHeader = "ORIGINAL_DATA,PROCESSING_CODE,ACCOUNT_ID,REASON\n"
+
+func reversalRecord(reversal PendingReversal) string {
+	reason := strings.NewReplacer(",", " ", "\n", " ").Replace(reversal.Reason)
+	return fmt.Sprintf("%s,%s,%d,%s\n", reversal.OriginalData, reversal.ProcessingCode, reversal.AccountID, reason)
+}
@@ -0,0 +1,36 @@
+package atm_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestReversalQueue(t *testing.T) {
+	queue := atm.ReversalQueue{DBFile: filepath.Join(t.TempDir(), "reversals.csv")}
+	pending, err := queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 0 {
+		t.Errorf("Queue should be empty. %+v", pending)
+	}
+
+	first := atm.PendingReversal{OriginalData: "020000000110191200000000000000000000000000", ProcessingCode: atm.ProcessingCodeWithdrawal, AccountID: 12345678, Reason: "Host did not respond, twice"}
+	second := atm.PendingReversal{OriginalData: "020000000210191200000000000000000000000000", ProcessingCode: atm.ProcessingCodeDeposit, AccountID: 87654321}
+	assertNoError(t, queue.Add(first))
+	assertNoError(t, queue.Add(second))
+	// a reversal of the same request is queued once
+	assertNoError(t, queue.Add(first))
+	pending, err = queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 2 || pending[0].OriginalData != first.OriginalData || pending[0].Reason != "Host did not respond  twice" || pending[0].AccountID != 12345678 || pending[1].ProcessingCode != atm.ProcessingCodeDeposit {
+		t.Errorf("Queued reversals are incorrect. %+v", pending)
+	}
+
+	assertNoError(t, queue.Remove(first.OriginalData))
+	pending, err = queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 1 || pending[0].OriginalData != second.OriginalData {
+		t.Errorf("Acknowledged reversal should be removed. %+v", pending)
+	}
+}
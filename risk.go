@@ -0,0 +1,341 @@
+package atm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RiskAction is what a risk rule decides for a withdrawal
+type RiskAction string
+
+// risk actions
+const (
+	RiskAllow RiskAction = "allow"
+	// RiskStepUp asks the customer to confirm their PIN before the withdrawal is sent to the host
+	RiskStepUp  RiskAction = "step_up"
+	RiskDecline RiskAction = "decline"
+)
+
+// DefaultRiskRules are the rules of a terminal started without a rules file
+const DefaultRiskRules = `# more than 5 withdrawals in 10 minutes
+velocity count=5 window=10m action=decline
+# a withdrawal within 30 minutes of the card being ejected after incorrect PINs
+lockout window=30m action=step_up
+# more than 5 times the average of at least 5 earlier withdrawals
+average multiple=5 min_history=5 action=step_up
+# between 1am and 5am
+hours from=1 to=5 action=step_up
+`
+
+// RiskRequest is a withdrawal and what the terminal knows about the account before it is sent to the host
+type RiskRequest struct {
+	AccountID int
+	Amount    float64
+	Time      time.Time
+	// History of the account, empty if the host could not return it
+	History []Transaction
+	// LastLockout is when a card of the account was last ejected after MaxPINAttempts incorrect PINs at this terminal, zero if never
+	LastLockout time.Time
+}
+
+// IRiskRule decides a withdrawal.
+// Evaluate returns false if the rule does not apply to the request, otherwise its action and the reason it fired
+type IRiskRule interface {
+	Name() string
+	Evaluate(RiskRequest) (RiskAction, string, bool)
+}
+
+// RiskDecision is the outcome of the risk engine for a withdrawal
+type RiskDecision struct {
+	Action RiskAction
+	// Rule that fired, empty if no rule applied
+	Rule   string
+	Reason string
+}
+
+// RiskEngine evaluates the rules in order before a withdrawal, the first rule that fires decides.
+// A withdrawal no rule fires for is allowed
+type RiskEngine struct {
+	Rules []IRiskRule
+	// Now returns the time withdrawals and lockouts are evaluated at, time.Now if not set
+	Now func() time.Time
+}
+
+// now returns the time of the engine, the wall clock if the engine or its clock is not set
+func (e *RiskEngine) now() time.Time {
+	if e == nil || e.Now == nil {
+		return time.Now()
+	}
+	return e.Now()
+}
+
+// Evaluate returns the decision of the first rule that fires for the request
+func (e *RiskEngine) Evaluate(request RiskRequest) RiskDecision {
+	for _, rule := range e.Rules {
+		if action, reason, ok := rule.Evaluate(request); ok {
+			return RiskDecision{Action: action, Rule: rule.Name(), Reason: reason}
+		}
+	}
+	return RiskDecision{Action: RiskAllow}
+}
+
+// VelocityRule fires when the account already made Count withdrawals within Window of the request
+type VelocityRule struct {
+	Count  int
+	Window time.Duration
+	Action RiskAction
+}
+
+func (r VelocityRule) Name() string {
+	return "velocity"
+}
+
+func (r VelocityRule) Evaluate(request RiskRequest) (RiskAction, string, bool) {
+	since := request.Time.Add(-r.Window).Unix()
+	count := 0
+	for _, transaction := range request.History {
+		if transaction.Kind == TransactionKindWithdrawal && transaction.DateTime >= since {
+			count++
+		}
+	}
+	if count < r.Count {
+		return RiskAllow, "", false
+	}
+	return r.Action, fmt.Sprintf("%d withdrawals in the last %s", count, r.Window), true
+}
+
+// LockoutRule fires when a card of the account was ejected after incorrect PINs within Window of the request
+type LockoutRule struct {
+	Window time.Duration
+	Action RiskAction
+}
+
+func (r LockoutRule) Name() string {
+	return "lockout"
+}
+
+func (r LockoutRule) Evaluate(request RiskRequest) (RiskAction, string, bool) {
+	if request.LastLockout.IsZero() || request.Time.Sub(request.LastLockout) > r.Window {
+		return RiskAllow, "", false
+	}
+	return r.Action, fmt.Sprintf("PIN lockout %s ago", request.Time.Sub(request.LastLockout).Round(time.Second)), true
+}
+
+// AverageRule fires when the amount is more than Multiple times the average of the earlier withdrawals of the account.
+// Accounts with fewer than MinHistory withdrawals have no average to compare with
+type AverageRule struct {
+	Multiple   float64
+	MinHistory int
+	Action     RiskAction
+}
+
+func (r AverageRule) Name() string {
+	return "average"
+}
+
+func (r AverageRule) Evaluate(request RiskRequest) (RiskAction, string, bool) {
+	count := 0
+	total := 0.0
+	for _, transaction := range request.History {
+		if transaction.Kind == TransactionKindWithdrawal {
+			count++
+			total += math.Abs(transaction.Amount)
+		}
+	}
+	if count == 0 || count < r.MinHistory {
+		return RiskAllow, "", false
+	}
+	average := total / float64(count)
+	if request.Amount <= average*r.Multiple {
+		return RiskAllow, "", false
+	}
+	return r.Action, fmt.Sprintf("%.2f is more than %g times the average withdrawal of %.2f", request.Amount, r.Multiple, average), true
+}
+
+// HoursRule fires for withdrawals from hour From up to hour To local time, wrapping past midnight if From is after To
+type HoursRule struct {
+	From   int
+	To     int
+	Action RiskAction
+}
+
+func (r HoursRule) Name() string {
+	return "hours"
+}
+
+func (r HoursRule) Evaluate(request RiskRequest) (RiskAction, string, bool) {
+	hour := request.Time.Hour()
+	inside := hour >= r.From && hour < r.To
+	if r.From > r.To {
+		inside = hour >= r.From || hour < r.To
+	}
+	if !inside {
+		return RiskAllow, "", false
+	}
+	return r.Action, fmt.Sprintf("withdrawal at %s is between %02d:00 and %02d:00", request.Time.Format("15:04"), r.From, r.To), true
+}
+
+// ParseRiskRules parses rules, one per line, in the order they are evaluated.
+// A rule is its name followed by key=value settings and its action, blank lines and lines starting with # are ignored e.g.
+//
+//	velocity count=5 window=10m action=decline
+//	lockout window=30m action=step_up
+//	average multiple=5 min_history=5 action=step_up
+//	hours from=1 to=5 action=step_up
+//
+// An error is returned if a rule or setting is unknown or not valid
+func ParseRiskRules(text string) ([]IRiskRule, error) {
+	rules := []IRiskRule{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRiskRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%w line %d %w", ErrRiskRuleInvalid, i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRiskRule(fields []string) (IRiskRule, error) {
+	settings := map[string]string{}
+	for _, field := range fields[1:] {
+		separator := strings.Index(field, "=")
+		if separator < 1 {
+			return nil, fmt.Errorf("setting %s is not key=value.", field)
+		}
+		settings[strings.ToLower(field[:separator])] = field[separator+1:]
+	}
+
+	action := RiskAction(settings["action"])
+	if action != RiskAllow && action != RiskStepUp && action != RiskDecline {
+		return nil, fmt.Errorf("action %q is not allow, step_up or decline.", settings["action"])
+	}
+	delete(settings, "action")
+	// every setting of the rule is read from settings and removed, anything left is unknown
+	var err error
+	duration := func(key string) time.Duration {
+		value, parseErr := time.ParseDuration(settings[key])
+		if parseErr != nil || value <= 0 {
+			err = fmt.Errorf("%s must be a positive duration.", key)
+		}
+		delete(settings, key)
+		return value
+	}
+	integer := func(key string, min int, max int) int {
+		value, parseErr := strconv.Atoi(settings[key])
+		if parseErr != nil || value < min || value > max {
+			err = fmt.Errorf("%s must be a whole number from %d to %d.", key, min, max)
+		}
+		delete(settings, key)
+		return value
+	}
+
+	var rule IRiskRule
+	switch strings.ToLower(fields[0]) {
+	case "velocity":
+		rule = VelocityRule{Count: integer("count", 1, math.MaxInt32), Window: duration("window"), Action: action}
+	case "lockout":
+		rule = LockoutRule{Window: duration("window"), Action: action}
+	case "average":
+		multiple, parseErr := strconv.ParseFloat(settings["multiple"], 64)
+		if parseErr != nil || multiple <= 0 {
+			err = fmt.Errorf("multiple must be a positive number.")
+		}
+		delete(settings, "multiple")
+		minHistory := 1
+		if _, ok := settings["min_history"]; ok {
+			minHistory = integer("min_history", 1, math.MaxInt32)
+		}
+		rule = AverageRule{Multiple: multiple, MinHistory: minHistory, Action: action}
+	case "hours":
+		rule = HoursRule{From: integer("from", 0, 23), To: integer("to", 0, 24), Action: action}
+	default:
+		return nil, fmt.Errorf("rule %s is not velocity, lockout, average or hours.", fields[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key := range settings {
+		return nil, fmt.Errorf("setting %s is not known.", key)
+	}
+	return rule, nil
+}
+
+// assessRisk runs the risk engine of the terminal for a withdrawal and logs the decision with the rule that fired.
+// ErrRiskDeclined is returned if the withdrawal is declined and ErrRiskStepUpRequired until the customer confirmed their PIN
+func (atm *ATM) assessRisk(accountID int, amount float64) error {
+	if atm.Risk == nil {
+		return nil
+	}
+	request := RiskRequest{
+		AccountID:   accountID,
+		Amount:      amount,
+		Time:        atm.Risk.now(),
+		LastLockout: atm.lockouts[accountID],
+	}
+	history, err := atm.host().History(accountID)
+	if err != nil {
+		atm.logger().Warn("history not available to the risk rules", logAccount(accountID), logError(err))
+	}
+	request.History = history
+
+	decision := atm.Risk.Evaluate(request)
+	logger := atm.logger().With(logAccount(accountID), LogKeyAmount, amount, "action", string(decision.Action))
+	if decision.Rule == "" {
+		logger.Debug("risk decision")
+		return nil
+	}
+	logger = logger.With("rule", decision.Rule, "reason", decision.Reason)
+
+	switch decision.Action {
+	case RiskDecline:
+		logger.Warn("risk decision")
+		return ErrRiskDeclined
+	case RiskStepUp:
+		if atm.Session.steppedUp {
+			// a confirmation of the PIN is good for one withdrawal
+			atm.Session.steppedUp = false
+			logger.Info("risk decision", "confirmed", true)
+			return nil
+		}
+		logger.Warn("risk decision", "confirmed", false)
+		return ErrRiskStepUpRequired
+	}
+	logger.Info("risk decision")
+	return nil
+}
+
+// ConfirmPIN checks the PIN of the authorized account again so a withdrawal the risk rules stepped up can continue.
+// An incorrect PIN logs out the session and returns ErrAuthorizationUnsuccessful, or ErrAuthorizationLocked if the host locked the account
+func (atm *ATM) ConfirmPIN(pin string) error {
+	accountID := atm.Session.AccountID
+	if err := atm.Session.Valid(accountID); err != nil {
+		return err
+	}
+	err := atm.host().Authorize(accountID, pin)
+	if err == ErrAuthorizationUnsuccessful || err == ErrAuthorizationLocked {
+		atm.logger().Warn("PIN confirmation failed, session ended", logAccount(accountID))
+		atm.Logout()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	atm.Session.steppedUp = true
+	return nil
+}
+
+// recordLockout remembers when the card of an account was ejected after incorrect PINs for the lockout rule
+func (atm *ATM) recordLockout(accountID int) {
+	if atm.lockouts == nil {
+		atm.lockouts = map[int]time.Time{}
+	}
+	atm.lockouts[accountID] = atm.Risk.now()
+}
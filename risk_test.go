@@ -0,0 +1,185 @@
+package atm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func riskWithdrawals(now time.Time, amounts map[time.Duration]float64) []atm.Transaction {
+	transactions := []atm.Transaction{{Kind: atm.TransactionKindDeposit, DateTime: now.Unix(), Amount: 1000}}
+	for ago, amount := range amounts {
+		transactions = append(transactions, atm.Transaction{Kind: atm.TransactionKindWithdrawal, DateTime: now.Add(-ago).Unix(), Amount: -amount})
+	}
+	return transactions
+}
+
+func assertRiskDecision(t *testing.T, decision atm.RiskDecision, action atm.RiskAction, rule string) {
+	t.Helper()
+	if decision.Action != action || decision.Rule != rule {
+		t.Errorf("Risk decision should be %s by %q but got %+v", action, rule, decision)
+	}
+}
+
+func TestRiskRules(t *testing.T) {
+	rules, err := atm.ParseRiskRules(atm.DefaultRiskRules)
+	assertNoError(t, err)
+	engine := &atm.RiskEngine{Rules: rules}
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.Local)
+
+	// no history at midday
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{AccountID: 1, Amount: 500, Time: now}), atm.RiskAllow, "")
+
+	// velocity counts withdrawals in the window only
+	history := riskWithdrawals(now, map[time.Duration]float64{
+		time.Minute: 20, 2 * time.Minute: 20, 3 * time.Minute: 20, 4 * time.Minute: 20, 11 * time.Minute: 20,
+	})
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 20, Time: now, History: history}), atm.RiskAllow, "")
+	history = append(history, atm.Transaction{Kind: atm.TransactionKindWithdrawal, DateTime: now.Add(-5 * time.Minute).Unix(), Amount: -20})
+	decision := engine.Evaluate(atm.RiskRequest{Amount: 20, Time: now, History: history})
+	assertRiskDecision(t, decision, atm.RiskDecline, "velocity")
+	if decision.Reason != "5 withdrawals in the last 10m0s" {
+		t.Errorf("Reason is incorrect. %s", decision.Reason)
+	}
+
+	// lockout within 30 minutes
+	request := atm.RiskRequest{Amount: 20, Time: now, LastLockout: now.Add(-10 * time.Minute)}
+	assertRiskDecision(t, engine.Evaluate(request), atm.RiskStepUp, "lockout")
+	request.LastLockout = now.Add(-31 * time.Minute)
+	assertRiskDecision(t, engine.Evaluate(request), atm.RiskAllow, "")
+
+	// average of 5 earlier withdrawals of 20 to 60
+	history = riskWithdrawals(now, map[time.Duration]float64{
+		24 * time.Hour: 20, 48 * time.Hour: 40, 72 * time.Hour: 40, 96 * time.Hour: 40, 120 * time.Hour: 60,
+	})
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 200, Time: now, History: history}), atm.RiskAllow, "")
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 220, Time: now, History: history}), atm.RiskStepUp, "average")
+	// fewer than 5 withdrawals have no average
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 1000, Time: now, History: history[:5]}), atm.RiskAllow, "")
+
+	// unusual hours
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 20, Time: now.Add(-10 * time.Hour)}), atm.RiskStepUp, "hours")
+	assertRiskDecision(t, engine.Evaluate(atm.RiskRequest{Amount: 20, Time: now.Add(-7 * time.Hour)}), atm.RiskAllow, "")
+
+	// the first rule that fires decides
+	request = atm.RiskRequest{Amount: 20, Time: now.Add(-10 * time.Hour), LastLockout: now.Add(-10 * time.Hour)}
+	assertRiskDecision(t, engine.Evaluate(request), atm.RiskStepUp, "lockout")
+}
+
+func TestHoursRuleWrapsMidnight(t *testing.T) {
+	rule := atm.HoursRule{From: 22, To: 6, Action: atm.RiskDecline}
+	for hour, fires := range map[int]bool{21: false, 22: true, 23: true, 0: true, 5: true, 6: false, 12: false} {
+		_, _, ok := rule.Evaluate(atm.RiskRequest{Time: time.Date(2020, 1, 2, hour, 30, 0, 0, time.Local)})
+		if ok != fires {
+			t.Errorf("Hours rule at %d:30 should fire %t", hour, fires)
+		}
+	}
+}
+
+func TestParseRiskRules(t *testing.T) {
+	rules, err := atm.ParseRiskRules("\n# allow everything at night\nhours from=22 to=6 action=allow\n  velocity count=2 window=1h action=step_up\naverage multiple=3 action=decline\n")
+	assertNoError(t, err)
+	if len(rules) != 3 {
+		t.Fatalf("Rules are incorrect. %+v", rules)
+	}
+	if rules[0] != (atm.HoursRule{From: 22, To: 6, Action: atm.RiskAllow}) ||
+		rules[1] != (atm.VelocityRule{Count: 2, Window: time.Hour, Action: atm.RiskStepUp}) ||
+		rules[2] != (atm.AverageRule{Multiple: 3, MinHistory: 1, Action: atm.RiskDecline}) {
+		t.Errorf("Rules are incorrect. %+v", rules)
+	}
+
+	for _, invalid := range []string{
+		"velocity count=2 window=1h",
+		"velocity count=2 window=1h action=block",
+		"velocity count=0 window=1h action=decline",
+		"velocity count=2 window=soon action=decline",
+		"lockout window=30m action=decline limit=3",
+		"average multiple=-1 action=decline",
+		"hours from=1 to=25 action=decline",
+		"hours from=1 action=decline",
+		"geo country=US action=decline",
+		"lockout 30m action=decline",
+	} {
+		_, err := atm.ParseRiskRules("# rules\n" + invalid)
+		assertErrorContains(t, err, atm.ErrRiskRuleInvalid.Error()+" line 2")
+	}
+}
+
+func TestRiskWithdrawDefaultRules(t *testing.T) {
+	rules, err := atm.ParseRiskRules(atm.DefaultRiskRules)
+	assertNoError(t, err)
+	now := time.Date(2020, 1, 2, 3, 0, 0, 0, time.Local)
+	testATM := newTestFlowATM(t)
+	testATM.Risk = &atm.RiskEngine{Rules: rules, Now: func() time.Time { return now }}
+	assertNoError(t, atm.RunCommand(testATM, &bytes.Buffer{}, "authorize 12345678 1234"))
+
+	// the withdrawal is stepped up at 3am by the clock of the engine, not the wall clock
+	_, err = testATM.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrRiskStepUpRequired)
+
+	now = time.Date(2020, 1, 2, 12, 0, 0, 0, time.Local)
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+}
+
+func TestRiskWithdraw(t *testing.T) {
+	logs := &bytes.Buffer{}
+	logger, err := atm.NewLogger(logs, "debug", atm.LogFormatText)
+	assertNoError(t, err)
+	testATM := newTestFlowATM(t)
+	testATM.Logger = logger
+	testATM.Risk = &atm.RiskEngine{Rules: []atm.IRiskRule{
+		atm.VelocityRule{Count: 2, Window: time.Hour, Action: atm.RiskDecline},
+		atm.LockoutRule{Window: time.Hour, Action: atm.RiskStepUp},
+	}}
+	testATM.Host = &atm.LocalHostClient{Host: &atm.Host{AccountDB: testATM.AccountDB, TransactionDB: testATM.TransactionDB, PINLockout: time.Millisecond}}
+
+	// a lockout steps up the next withdrawals once the host unlocks the account
+	assertNoError(t, testATM.Flow.InsertCard(12345678))
+	for i := 0; i < atm.MaxPINAttempts; i++ {
+		assertError(t, testATM.Flow.EnterPIN(testATM, "0000"))
+	}
+	assertNoError(t, testATM.Flow.TakeCard())
+	time.Sleep(5 * time.Millisecond)
+	assertNoError(t, atm.RunCommand(testATM, &bytes.Buffer{}, "authorize 12345678 1234"))
+	_, err = testATM.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrRiskStepUpRequired)
+	if testATM.ATMBalance != 200 {
+		t.Errorf("Cash was dispensed before the PIN was confirmed")
+	}
+	if !strings.Contains(logs.String(), `msg="risk decision"`) || !strings.Contains(logs.String(), "action=step_up rule=lockout") {
+		t.Errorf("Risk decision was not logged with its rule. %s", logs.String())
+	}
+
+	// the confirmation is good for one withdrawal
+	assertNoError(t, atm.RunCommand(testATM, &bytes.Buffer{}, "confirm 1234"))
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	_, err = testATM.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrRiskStepUpRequired)
+
+	// an incorrect PIN ends the session
+	assertErrorIsError(t, atm.RunCommand(testATM, &bytes.Buffer{}, "confirm 0000"), atm.ErrConsoleAuthorizationFailed)
+	_, err = testATM.Withdraw(12345678, 20)
+	assertError(t, err)
+	if testATM.Flow.State != atm.FlowIdle {
+		t.Errorf("Card was not ejected. %s", testATM.Flow.State)
+	}
+
+	// velocity declines a confirmed withdrawal
+	assertNoError(t, atm.RunCommand(testATM, &bytes.Buffer{}, "authorize 12345678 1234"))
+	assertNoError(t, testATM.ConfirmPIN("1234"))
+	_, err = testATM.Withdraw(12345678, 20)
+	assertNoError(t, err)
+	_, err = testATM.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrRiskDeclined)
+	if testATM.ATMBalance != 160 {
+		t.Errorf("ATM balance is incorrect. %.2f", testATM.ATMBalance)
+	}
+	if !strings.Contains(logs.String(), "action=decline rule=velocity") {
+		t.Errorf("Decline was not logged with its rule. %s", logs.String())
+	}
+}
@@ -0,0 +1,116 @@
+package atm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ScriptResult is the outcome of a single script line written as one JSON document,
+// the result of the command as written by WriteJSONResult with the line it came from
+type ScriptResult struct {
+	Line int `json:"line"`
+	// Input is the command of the line with its PIN and other sensitive arguments masked
+	Input string `json:"input"`
+	jsonResult
+}
+
+// scriptCommand returns the console command of a JSON request e.g. {"cmd":"withdraw","amount":40}.
+// Every field but cmd is an argument of the command by the name of its argument spec
+// ErrScriptInvalidRequest is returned if the request is not a JSON object, the command is unknown
+// or a field is not an argument of the command
+func scriptCommand(registry *Registry, text string) (string, error) {
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return "", fmt.Errorf("%w The line is not a JSON object.", ErrScriptInvalidRequest)
+	}
+	name, _ := fields["cmd"].(string)
+	command, ok := registry.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("%w The cmd field does not name a command.", ErrScriptInvalidRequest)
+	}
+	delete(fields, "cmd")
+
+	args := []string{command.Name}
+	for _, spec := range command.Args {
+		value, ok := fields[spec.Name]
+		if !ok {
+			break
+		}
+		delete(fields, spec.Name)
+		var arg string
+		switch value := value.(type) {
+		case string:
+			arg = value
+		case json.Number:
+			arg = value.String()
+		default:
+			return "", fmt.Errorf("%w The %s field is not a string or number.", ErrScriptInvalidRequest, spec.Name)
+		}
+		if arg == "" || (!spec.Variadic && strings.ContainsAny(arg, " \t")) {
+			return "", fmt.Errorf("%w The %s field is not a single argument.", ErrScriptInvalidRequest, spec.Name)
+		}
+		args = append(args, arg)
+	}
+	// fields left are unknown or come after an argument that was left out
+	if len(fields) > 0 {
+		unknown := make([]string, 0, len(fields))
+		for field := range fields {
+			unknown = append(unknown, field)
+		}
+		sort.Strings(unknown)
+		return "", fmt.Errorf("%w %s is not an argument of %s or an argument before it is missing.", ErrScriptInvalidRequest, strings.Join(unknown, ", "), command.Name)
+	}
+	return strings.Join(args, " "), nil
+}
+
+// RunScript executes every line of a script against the ATM and writes a JSONL stream of results.
+// A line is either a plain console command or a JSON request. Blank lines and lines starting with # are skipped.
+// The script stops at the end command. A failing line does not stop the script, its error is written as a result
+// An error is returned if the script cannot be read or the results cannot be written
+func RunScript(atm *ATM, script io.Reader, results io.Writer) error {
+	registry := sharedRegistry()
+	encoder := json.NewEncoder(results)
+	encoder.SetEscapeHTML(false)
+	scanner := bufio.NewScanner(script)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		command := text
+		if strings.HasPrefix(text, "{") {
+			var err error
+			command, err = scriptCommand(registry, text)
+			if err != nil {
+				// the request is not echoed since it may carry a PIN
+				if err := encoder.Encode(ScriptResult{Line: line, jsonResult: newJSONResult(Result{}, err)}); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		result, err := registry.Execute(atm, command)
+		ended := err == ErrConsoleEnd
+		if ended {
+			err = nil
+		}
+		if err := encoder.Encode(ScriptResult{Line: line, Input: registry.Mask(command), jsonResult: newJSONResult(result, err)}); err != nil {
+			return err
+		}
+		if ended {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,50 @@
+package atm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestRunScript(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	testATM := &atm.ATM{AccountDB: accountDB, TransactionDB: transactionDB, ATMBalance: 200, Session: &atm.Session{}}
+
+	script := strings.Join([]string{
+		"# regression scenario",
+		"authorize 12345678 1234",
+		"",
+		`{"cmd":"withdraw","amount":40}`,
+		`{"cmd":"deposit","amount":10.5,"idempotency_key":"key-1"}`,
+		"withdraw 15",
+		`{"amount":40}`,
+		`{"cmd":"authorize","account_id":12345678,"pin":"1234","reason":"none"}`,
+		`{"cmd":"alerts","low_balance":10}`,
+		"end",
+		"balance",
+	}, "\n")
+	results := &bytes.Buffer{}
+	assertNoError(t, atm.RunScript(testATM, strings.NewReader(script), results))
+
+	expected := []string{
+		`{"line":2,"input":"authorize 12345678 ****","ok":true,"command":"authorize","account_id":12345678,"message":"12345678 successfully authorized."}`,
+		`{"line":4,"input":"withdraw 40","ok":true,"command":"withdraw","account_id":12345678,"amount":40,"balance":60,"message":"Amount dispensed: 40\nCurrent balance: 60.00"}`,
+		`{"line":5,"input":"deposit 10.5 key-1","ok":true,"command":"deposit","account_id":12345678,"amount":10.5,"balance":70.5,"message":"Current balance: 70.50"}`,
+		`{"line":6,"input":"withdraw 15","ok":false,"command":"withdraw","error":{"code":"withdraw_amount_no_multiple_of_20","message":"` + atm.ErrWithdrawAmountNoMultipleOf20.Error() + `"}}`,
+		`{"line":7,"input":"","ok":false,"command":"","error":{"code":"script_invalid_request","message":"` + atm.ErrScriptInvalidRequest.Error() + ` The cmd field does not name a command."}}`,
+		`{"line":8,"input":"","ok":false,"command":"","error":{"code":"script_invalid_request","message":"` + atm.ErrScriptInvalidRequest.Error() + ` reason is not an argument of authorize or an argument before it is missing."}}`,
+		`{"line":9,"input":"","ok":false,"command":"","error":{"code":"script_invalid_request","message":"` + atm.ErrScriptInvalidRequest.Error() + ` low_balance is not an argument of alerts or an argument before it is missing."}}`,
+		`{"line":10,"input":"end","ok":true,"command":"end"}`,
+	}
+	lines := strings.Split(strings.TrimSpace(results.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Invalid number of results. %s", results.String())
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("Result is incorrect.\n%s\nshould be\n%s", line, expected[i])
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package atm
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 )
 
+// SessionTimeout is how long a session stays active without activity
+const SessionTimeout = 2 * time.Minute
+
 type ISession interface {
 	Authorize(int)
 	TimedOut() bool
@@ -17,29 +22,60 @@ type Session struct {
 	LastActivity int64
 
 	AccountID int
+	// ID is a random identifier of the session in the logs, empty if no session is active
+	ID string
+	// Timeout is how long the session stays active without activity, SessionTimeout if zero
+	Timeout time.Duration
+
+	// steppedUp is true once the customer confirmed their PIN for a withdrawal the risk rules stepped up
+	steppedUp bool
 }
 
-// Authorize will set the LastActivity time to now and the AccountID of the session
+// Authorize will set the LastActivity time to now, the AccountID of the session and a new session ID
 func (s *Session) Authorize(accountID int) {
 	s.AccountID = accountID
+	s.ID = newSessionID()
+	s.steppedUp = false
 	s.Refresh()
 }
 
+// newSessionID returns a random 16 character session ID
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 // Refresh updates the LastActivity to now
 func (s *Session) Refresh() {
 	s.LastActivity = time.Now().Unix()
 }
 
-// TimedOut checks if the session has timed out after 2 mins
+// TimedOut checks if the session has timed out, after 2 mins unless the session has its own timeout
 func (s *Session) TimedOut() bool {
 	difference := time.Now().Unix() - s.LastActivity
-	// if activity has not happened in 2 mins or more
-	if difference > 120 {
+	// if activity has not happened in the timeout or more
+	if difference > int64(s.timeout()/time.Second) {
 		return true
 	}
 	return false
 }
 
+// Remaining returns how long until the session times out, zero if there is no active session
+func (s *Session) Remaining() time.Duration {
+	if s.AccountID == 0 || s.LastActivity == 0 || s.TimedOut() {
+		return 0
+	}
+	return time.Until(time.Unix(s.LastActivity, 0).Add(s.timeout() + time.Second))
+}
+
+func (s *Session) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return SessionTimeout
+	}
+	return s.Timeout
+}
+
 // LogOut will logout of the session
 func (s *Session) LogOut() error {
 	err := s.Valid(s.AccountID)
@@ -49,6 +85,8 @@ func (s *Session) LogOut() error {
 
 	s.AccountID = 0
 	s.LastActivity = 0
+	s.ID = ""
+	s.steppedUp = false
 	return nil
 }
 
@@ -31,3 +31,34 @@ func TestSession(t *testing.T) {
 	err = session.LogOut()
 	assertErrorIsError(t, err, atm.ErrSessionTimedOut)
 }
+
+func TestSessionRemaining(t *testing.T) {
+	session := &atm.Session{}
+	if session.Remaining() != 0 {
+		t.Errorf("Inactive session should have no time remaining")
+	}
+
+	session.Authorize(defaultAccount.AccountID)
+	session.LastActivity = time.Now().Unix() - 60
+	if remaining := session.Remaining(); remaining <= 59*time.Second || remaining > 61*time.Second {
+		t.Errorf("Remaining time is incorrect. %s", remaining)
+	}
+
+	session.LastActivity = time.Now().Unix() - 121
+	if session.Remaining() != 0 {
+		t.Errorf("Timed out session should have no time remaining")
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	session := &atm.Session{Timeout: 30 * time.Second}
+	session.Authorize(defaultAccount.AccountID)
+	session.LastActivity = time.Now().Unix() - 20
+	if remaining := session.Remaining(); remaining <= 9*time.Second || remaining > 11*time.Second {
+		t.Errorf("Remaining time is incorrect. %s", remaining)
+	}
+	assertNoError(t, session.Valid(defaultAccount.AccountID))
+
+	session.LastActivity = time.Now().Unix() - 31
+	assertErrorIsError(t, session.Valid(defaultAccount.AccountID), atm.ErrSessionTimedOut)
+}
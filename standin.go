@@ -0,0 +1,311 @@
+package atm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StandInTransaction is a withdrawal the terminal approved while the host was unavailable
+type StandInTransaction struct {
+	// ID identifies the withdrawal to the host so it is posted once however often it is forwarded
+	ID        string
+	AccountID int
+	DateTime  int64
+	Amount    float64
+}
+
+// StandInConflict is a forwarded stand-in withdrawal that needs to be reviewed
+type StandInConflict struct {
+	StandInTransaction
+	// Balance of the account after the withdrawal was posted
+	Balance float64
+	Reason  string
+}
+
+// ForwardResult is the outcome of forwarding queued stand-in withdrawals to the host
+type ForwardResult struct {
+	Forwarded int
+	Remaining int
+	Conflicts []StandInConflict
+}
+
+// StandInQueue stores stand-in withdrawals on local disk until they are forwarded to the host
+type StandInQueue struct {
+	DBFile string
+	// ReviewFile records forwarded withdrawals that were flagged for review
+	ReviewFile string
+}
+
+// isHostOutage returns true if the request never reached the host.
+// Only then is a withdrawal approved in stand-in, a host that did not respond or failed to post may have debited the account
+func isHostOutage(err error) bool {
+	return errors.Is(err, ErrHostUnavailable)
+}
+
+// isAdviceRetryable returns true if an advice may not have been posted and is kept queued to be forwarded again
+func isAdviceRetryable(err error) bool {
+	return isHostOutage(err) || errors.Is(err, ErrHostNoResponse) || errors.Is(err, ErrHostStoreUnavailable)
+}
+
+// Add appends a stand-in withdrawal to the queue and syncs it to disk, a withdrawal without an ID is given one.
+// An error is returned if the withdrawal could not be stored
+func (q StandInQueue) Add(transaction StandInTransaction) error {
+	if transaction.ID == "" {
+		transaction.ID = newTransactionID()
+	}
+	file, err := openCSVAppend(q.DBFile, standInHeader)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(standInRecord(transaction))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Pending returns the stand-in withdrawals that have not been forwarded to the host
+// An empty list is returned if nothing has been queued
+func (q StandInQueue) Pending() ([]StandInTransaction, error) {
+	rows, err := readCSVRows(q.DBFile, 4)
+	if err != nil {
+		return []StandInTransaction{}, err
+	}
+
+	transactions := []StandInTransaction{}
+	for _, columns := range rows {
+		transaction, err := parseStandInTransaction(columns)
+		if err != nil {
+			return []StandInTransaction{}, err
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, nil
+}
+
+// PendingAmount returns the total amount queued for an account
+func (q StandInQueue) PendingAmount(accountID int) (float64, error) {
+	transactions, err := q.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0.0
+	for _, transaction := range transactions {
+		if transaction.AccountID == accountID {
+			total += transaction.Amount
+		}
+	}
+	return total, nil
+}
+
+// Forward posts the queued withdrawals to the host in the order they were approved.
+// Withdrawals that leave the account with a negative balance or that the host rejects are flagged for review.
+// Forwarding stops at the first withdrawal the host is unavailable for, it stays queued for the next attempt
+func (q StandInQueue) Forward(host IHostClient) (ForwardResult, error) {
+	result := ForwardResult{
+		Conflicts: []StandInConflict{},
+	}
+	pending, err := q.Pending()
+	if err != nil {
+		return result, err
+	}
+
+	for i, transaction := range pending {
+		posted, err := host.Advice(transaction.AccountID, transaction.Amount, transaction.DateTime, transaction.ID)
+		// a withdrawal the host wrote to its ledger is not retried even if the account was not updated, it is flagged for review
+		if isAdviceRetryable(err) && posted.TransactionID == "" {
+			result.Remaining = len(pending) - i
+			return result, nil
+		}
+
+		conflict := StandInConflict{
+			StandInTransaction: transaction,
+			Balance:            posted.Balance,
+		}
+		switch {
+		case err != nil:
+			conflict.Reason = err.Error()
+		case posted.Balance < 0:
+			conflict.Reason = "Account balance is negative after forwarding."
+		}
+		if conflict.Reason != "" {
+			if err := q.flag(conflict); err != nil {
+				return result, err
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+		}
+
+		// Remove the withdrawal from the queue as soon as it is posted.
+		// If the terminal stops before the queue is written it is forwarded again and the host replays it from its ID
+		if err := q.write(pending[i+1:]); err != nil {
+			return result, err
+		}
+		result.Forwarded++
+	}
+
+	return result, nil
+}
+
+// Conflicts returns the forwarded withdrawals that were flagged for review
+func (q StandInQueue) Conflicts() ([]StandInConflict, error) {
+	rows, err := readCSVRows(q.ReviewFile, 6)
+	if err != nil {
+		return []StandInConflict{}, err
+	}
+
+	conflicts := []StandInConflict{}
+	for _, columns := range rows {
+		transaction, err := parseStandInTransaction(columns)
+		if err != nil {
+			return []StandInConflict{}, err
+		}
+		balance, err := strconv.ParseFloat(columns[4], 64)
+		if err != nil {
+			return []StandInConflict{}, ErrTransactionBalanceNotFloat
+		}
+		conflicts = append(conflicts, StandInConflict{
+			StandInTransaction: transaction,
+			Balance:            balance,
+			Reason:             columns[5],
+		})
+	}
+	return conflicts, nil
+}
+
+func (q StandInQueue) flag(conflict StandInConflict) error {
+	if q.ReviewFile == "" {
+		return nil
+	}
+	file, err := openCSVAppend(q.ReviewFile, "ID,ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE,REASON\n")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reason := strings.NewReplacer(",", " ", "\n", " ").Replace(conflict.Reason)
+	_, err = file.WriteString(fmt.Sprintf("%s,%d,%d,%.2f,%.2f,%s\n", conflict.ID, conflict.AccountID, conflict.DateTime, conflict.Amount, conflict.Balance, reason))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// write replaces the queue with the given withdrawals.
+// The queue is written to a temporary file first so a crash never leaves a partial queue
+func (q StandInQueue) write(transactions []StandInTransaction) error {
+	tmpFile := q.DBFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	datawriter := bufio.NewWriter(file)
+	datawriter.WriteString(standInHeader)
+	for _, transaction := range transactions {
+		datawriter.WriteString(standInRecord(transaction))
+	}
+	if err = datawriter.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, q.DBFile)
+}
+
+// standInHeader is the header of the stand-in queue
+const standInHeader = "ID,ACCOUNT_ID,DATE_TIME,AMOUNT\n"
+
+func standInRecord(transaction StandInTransaction) string {
+	return fmt.Sprintf("%s,%d,%d,%.2f\n", transaction.ID, transaction.AccountID, transaction.DateTime, transaction.Amount)
+}
+
+func parseStandInTransaction(columns []string) (StandInTransaction, error) {
+	accountID, err := strconv.Atoi(columns[1])
+	if err != nil {
+		return StandInTransaction{}, ErrTransactionAccountIDNotInteger
+	}
+	dateTime, err := strconv.ParseInt(columns[2], 10, 64)
+	if err != nil {
+		return StandInTransaction{}, ErrTransactionDateTimeNotInteger
+	}
+	amount, err := strconv.ParseFloat(columns[3], 64)
+	if err != nil {
+		return StandInTransaction{}, ErrTransactionAmounteNotFloat
+	}
+	return StandInTransaction{
+		ID:        columns[0],
+		AccountID: accountID,
+		DateTime:  dateTime,
+		Amount:    amount,
+	}, nil
+}
+
+// openCSVAppend opens a CSV file for appending and writes the header if the file is new
+func openCSVAppend(path string, header string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if _, err = file.WriteString(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// readCSVRows reads the rows of a CSV file skipping the header.
+// An empty list is returned if the file does not exist
+func readCSVRows(path string, columns int) ([][]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return [][]string{}, nil
+	}
+	if err != nil {
+		return [][]string{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	firstLine := true
+	rows := [][]string{}
+	for scanner.Scan() {
+		// Skip first line since it is a CSV
+		if firstLine {
+			firstLine = false
+			continue
+		}
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		row := strings.Split(line, ",")
+		if len(row) != columns {
+			return [][]string{}, fmt.Errorf("Invalid number of columns in the provided CSV. %s", line)
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return [][]string{}, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,246 @@
+package atm_test
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func newStandInTestATM(t *testing.T, accounts string) (*atm.ATM, *atm.LocalHostClient, *atm.Host) {
+	accountDB, transactionDB := newTestDBs(t, accounts, "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+	client := &atm.LocalHostClient{Host: host}
+	dir := t.TempDir()
+
+	terminal := &atm.ATM{
+		Host:         client,
+		ATMBalance:   1000,
+		Session:      &atm.Session{},
+		OfflineLimit: 60,
+		StandIn: &atm.StandInQueue{
+			DBFile:     filepath.Join(dir, "standin.csv"),
+			ReviewFile: filepath.Join(dir, "standin_review.csv"),
+		},
+	}
+	return terminal, client, host
+}
+
+func TestStandInWithdraw(t *testing.T) {
+	terminal, client, host := newStandInTestATM(t, "12345678,1234,100.00\n")
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	client.SetOffline(true)
+
+	// small withdrawals are approved from the last known balance
+	_, err := terminal.Withdraw(12345678, 40)
+	assertNoError(t, err)
+	balance, err := terminal.Balance(12345678)
+	assertNoError(t, err)
+	if balance != 60 {
+		t.Errorf("Last known balance is incorrect. %.2f", balance)
+	}
+	if terminal.ATMBalance != 960 {
+		t.Errorf("ATM balance is incorrect. %.2f", terminal.ATMBalance)
+	}
+
+	// offline limit is shared by all stand-in withdrawals of the account
+	_, err = terminal.Withdraw(12345678, 40)
+	assertErrorIsError(t, err, atm.ErrStandInLimitExceeded)
+
+	// withdrawal is queued durably
+	queue := atm.StandInQueue{DBFile: terminal.StandIn.DBFile}
+	pending, err := queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 1 || pending[0].Amount != 40 || pending[0].AccountID != 12345678 {
+		t.Errorf("Stand-in queue is incorrect. %+v", pending)
+	}
+
+	// forwarded when the host is available again
+	client.SetOffline(false)
+	_, err = terminal.Balance(12345678)
+	assertNoError(t, err)
+	pending, err = queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 0 {
+		t.Errorf("Stand-in queue should be empty after forwarding")
+	}
+	hostBalance, err := host.Balance(12345678)
+	assertNoError(t, err)
+	if hostBalance != 60 {
+		t.Errorf("Host balance is incorrect after forwarding. %.2f", hostBalance)
+	}
+}
+
+func TestStandInDeclined(t *testing.T) {
+	terminal, client, _ := newStandInTestATM(t, "12345678,1234,20.00\n87654321,4321,100.00\n")
+	client.SetOffline(true)
+
+	// no known balance
+	terminal.Session = &atm.Session{AccountID: 87654321, LastActivity: time.Now().Unix()}
+	_, err := terminal.Withdraw(87654321, 20)
+	assertErrorIsError(t, err, atm.ErrStandInNoBalance)
+
+	// withdrawal is more than the last known balance
+	client.SetOffline(false)
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+	client.SetOffline(true)
+	_, err = terminal.Withdraw(12345678, 40)
+	assertErrorIsError(t, err, atm.ErrStandInInsufficientFunds)
+
+	// stand-in disabled
+	terminal.OfflineLimit = 0
+	_, err = terminal.Withdraw(12345678, 20)
+	assertErrorIsError(t, err, atm.ErrHostUnavailable)
+}
+
+func TestStandInForwardConflict(t *testing.T) {
+	terminal, client, host := newStandInTestATM(t, "12345678,1234,40.00\n")
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	client.SetOffline(true)
+	_, err := terminal.Withdraw(12345678, 40)
+	assertNoError(t, err)
+
+	// the account is emptied at another terminal while this terminal is offline
+	_, err = host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+
+	client.SetOffline(false)
+	result, err := terminal.ForwardStandIn()
+	assertNoError(t, err)
+	if result.Forwarded != 1 || result.Remaining != 0 || len(result.Conflicts) != 1 {
+		t.Errorf("Forward result is incorrect. %+v", result)
+	}
+
+	conflicts, err := terminal.StandIn.Conflicts()
+	assertNoError(t, err)
+	if len(conflicts) != 1 || conflicts[0].Balance != -45 {
+		t.Errorf("Conflict was not flagged for review. %+v", conflicts)
+	}
+}
+
+func TestStandInForwardHostUnavailable(t *testing.T) {
+	_, client, _ := newStandInTestATM(t, "12345678,1234,100.00\n")
+	queue := atm.StandInQueue{DBFile: filepath.Join(t.TempDir(), "standin.csv")}
+	assertNoError(t, queue.Add(atm.StandInTransaction{AccountID: 12345678, DateTime: 1, Amount: 20}))
+	assertNoError(t, queue.Add(atm.StandInTransaction{AccountID: 12345678, DateTime: 2, Amount: 20}))
+
+	client.SetOffline(true)
+	result, err := queue.Forward(client)
+	assertNoError(t, err)
+	if result.Forwarded != 0 || result.Remaining != 2 {
+		t.Errorf("Forward result is incorrect. %+v", result)
+	}
+
+	client.SetOffline(false)
+	result, err = queue.Forward(client)
+	assertNoError(t, err)
+	if result.Forwarded != 2 || result.Remaining != 0 {
+		t.Errorf("Forward result is incorrect. %+v", result)
+	}
+}
+
+func TestStandInHostStoreUnavailable(t *testing.T) {
+	accountDB := defaultAccountDB
+	transactionDB := TransactionDBTest{setTransactionError: errors.New("disk is full")}
+	dir := t.TempDir()
+	terminal := &atm.ATM{
+		Host:         &atm.LocalHostClient{Host: &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}},
+		ATMBalance:   1000,
+		Session:      &atm.Session{},
+		OfflineLimit: 60,
+		StandIn:      &atm.StandInQueue{DBFile: filepath.Join(dir, "standin.csv")},
+	}
+	if err := terminal.Authorize(12345678, "1234"); err != nil {
+		t.Fatal("Failed to authorize")
+	}
+
+	// the host answered so the withdrawal is declined, not approved in stand-in
+	_, err := terminal.Withdraw(12345678, 20)
+	if !errors.Is(err, atm.ErrHostStoreUnavailable) {
+		t.Errorf("Withdrawal should be declined. %v", err)
+	}
+	pending, err := terminal.StandIn.Pending()
+	assertNoError(t, err)
+	if len(pending) != 0 || terminal.ATMBalance != 1000 {
+		t.Errorf("Nothing should be dispensed in stand-in. %+v %.2f", pending, terminal.ATMBalance)
+	}
+}
+
+func TestStandInForwardTwice(t *testing.T) {
+	_, client, host := newStandInTestATM(t, "12345678,1234,100.00\n")
+	queue := atm.StandInQueue{DBFile: filepath.Join(t.TempDir(), "standin.csv")}
+	assertNoError(t, queue.Add(atm.StandInTransaction{AccountID: 12345678, DateTime: 1, Amount: 20}))
+	pending, err := queue.Pending()
+	assertNoError(t, err)
+	if len(pending) != 1 || pending[0].ID == "" {
+		t.Fatalf("Queued withdrawal should have an ID. %+v", pending)
+	}
+
+	// the terminal stopped after the advice was posted but before it was removed from the queue
+	posted, err := client.Advice(12345678, 20, 1, pending[0].ID)
+	assertNoError(t, err)
+
+	result, err := queue.Forward(client)
+	assertNoError(t, err)
+	if result.Forwarded != 1 || result.Remaining != 0 {
+		t.Errorf("Forward result is incorrect. %+v", result)
+	}
+	balance, err := host.Balance(12345678)
+	assertNoError(t, err)
+	if balance != posted.Balance || balance != 80 {
+		t.Errorf("Withdrawal should only be posted once. %.2f", balance)
+	}
+}
+
+func TestStandInForwardAccountNotUpdated(t *testing.T) {
+	newHost := func() (*atm.Host, atm.TransactionDB) {
+		_, transactionDB := newTestDBs(t, "", "")
+		accountDB := AccountDBTest{getAccount: defaultAccount, setAccountError: errors.New("disk is full")}
+		return &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}, transactionDB
+	}
+	local, localDB := newHost()
+	remote, remoteDB := newHost()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer listener.Close()
+	go (&atm.ISOHost{Host: remote, TerminalKeys: map[string][]byte{"TERM0001": []byte("secret")}}).Serve(listener)
+	network := &atm.NetworkHostClient{Address: listener.Addr().String(), TerminalID: "TERM0001", Key: []byte("secret"), Timeout: time.Second}
+	defer network.Close()
+
+	clients := map[string]struct {
+		client        atm.IHostClient
+		transactionDB atm.TransactionDB
+	}{
+		"local":   {&atm.LocalHostClient{Host: local}, localDB},
+		"network": {network, remoteDB},
+	}
+	for name, test := range clients {
+		queue := atm.StandInQueue{DBFile: filepath.Join(t.TempDir(), "standin.csv"), ReviewFile: filepath.Join(t.TempDir(), "review.csv")}
+		assertNoError(t, queue.Add(atm.StandInTransaction{AccountID: defaultAccount.AccountID, DateTime: 1, Amount: 20}))
+
+		// a withdrawal in the ledger of the host is flagged for review instead of forwarded again
+		result, err := queue.Forward(test.client)
+		assertNoError(t, err)
+		if result.Forwarded != 1 || result.Remaining != 0 || len(result.Conflicts) != 1 {
+			t.Errorf("%s forward result is incorrect. %+v", name, result)
+		}
+		_, err = queue.Forward(test.client)
+		assertNoError(t, err)
+		transactions, err := test.transactionDB.All()
+		assertNoError(t, err)
+		if len(transactions) != 1 {
+			t.Errorf("%s withdrawal was posted twice. %+v", name, transactions)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package atm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statement of an account for a period with its opening and closing balances and totals
+type Statement struct {
+	AccountID int `json:"account_id"`
+	// Currency is the ISO 4217 code of the amounts, DefaultCurrency if empty
+	Currency string `json:"currency,omitempty"`
+	// From and To are the period in epoch seconds, both inclusive. From is 0 if the statement starts with the first transaction
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// GeneratedAt is when the statement was generated in epoch seconds
+	GeneratedAt    int64   `json:"generated_at"`
+	OpeningBalance float64 `json:"opening_balance"`
+	ClosingBalance float64 `json:"closing_balance"`
+	// TotalCredits is the sum of the positive amounts and TotalDebits the sum of the negative amounts, both without fees
+	TotalCredits float64 `json:"total_credits"`
+	TotalDebits  float64 `json:"total_debits"`
+	// TotalFees is the sum of the fees charged less the fees refunded
+	TotalFees float64 `json:"total_fees"`
+	// Transactions of the period oldest first
+	Transactions []Transaction `json:"transactions"`
+}
+
+// NewStatement builds the statement of an account for a period from its current balance and every transaction of the account.
+// The balances are worked back from the current balance so they are correct for accounts opened with a balance
+func NewStatement(account Account, transactions []Transaction, from int64, to int64) Statement {
+	sorted := append([]Transaction{}, transactions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].DateTime < sorted[j].DateTime
+	})
+
+	statement := Statement{
+		AccountID:      account.AccountID,
+		From:           from,
+		To:             to,
+		GeneratedAt:    time.Now().Unix(),
+		OpeningBalance: account.Balance,
+		ClosingBalance: account.Balance,
+		Transactions:   []Transaction{},
+	}
+	for _, transaction := range sorted {
+		if transaction.AccountID != account.AccountID {
+			continue
+		}
+		// the fee is charged on top of the amount
+		change := transaction.Amount - transaction.Fee
+		if transaction.DateTime > to {
+			statement.OpeningBalance -= change
+			statement.ClosingBalance -= change
+			continue
+		}
+		if transaction.DateTime < from {
+			continue
+		}
+
+		statement.OpeningBalance -= change
+		statement.Transactions = append(statement.Transactions, transaction)
+		if transaction.Amount > 0 {
+			statement.TotalCredits += transaction.Amount
+		} else {
+			statement.TotalDebits += transaction.Amount
+		}
+		statement.TotalFees += transaction.Fee
+	}
+	return statement
+}
+
+// ParseStatementPeriod parses the period of a statement from dates formatted as YYYY-MM-DD in local time.
+// An empty from starts with the first transaction and an empty to ends now, to includes the whole day
+// An error is returned if a date is not valid or from is after to
+func ParseStatementPeriod(from string, to string) (int64, int64, error) {
+	period := []int64{0, time.Now().Unix()}
+	for i, value := range []string{from, to} {
+		if value == "" {
+			continue
+		}
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w %s is not a date formatted as YYYY-MM-DD.", ErrStatementInvalidPeriod, value)
+		}
+		period[i] = date.Unix()
+		if i == 1 {
+			period[i] = date.AddDate(0, 0, 1).Unix() - 1
+		}
+	}
+	if period[0] > period[1] {
+		return 0, 0, fmt.Errorf("%w from is after to.", ErrStatementInvalidPeriod)
+	}
+	return period[0], period[1], nil
+}
+
+// Statement generates the statement of an account for a period from the account and transaction DBs
+// An error is returned if the account cannot be found or on failure to read the DBs
+func (h *Host) Statement(accountID int, from int64, to int64) (Statement, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	account, err := h.account(accountID)
+	if err != nil {
+		return Statement{}, err
+	}
+	transactions, err := h.TransactionDB.Get(accountID)
+	if err != nil {
+		return Statement{}, storeUnavailable(err)
+	}
+	return NewStatement(account, transactions, from, to), nil
+}
+
+// StatementFormatter exports a statement to a file format
+type StatementFormatter interface {
+	// ContentType is the media type of the exported statement e.g. text/csv
+	ContentType() string
+	// Extension is the file extension of the exported statement without a dot
+	Extension() string
+	// Format writes the statement
+	Format(io.Writer, Statement) error
+}
+
+var (
+	statementFormattersMutex sync.RWMutex
+	statementFormatters      = map[string]StatementFormatter{
+		"csv":  CSVStatementFormatter{},
+		"json": JSONStatementFormatter{},
+		"ofx":  OFXStatementFormatter{},
+		"qif":  QIFStatementFormatter{},
+	}
+)
+
+// RegisterStatementFormatter adds or replaces the formatter of a format name e.g. csv
+func RegisterStatementFormatter(name string, formatter StatementFormatter) {
+	statementFormattersMutex.Lock()
+	defer statementFormattersMutex.Unlock()
+	statementFormatters[strings.ToLower(name)] = formatter
+}
+
+// LookupStatementFormatter returns the formatter of a format name
+// ErrStatementUnknownFormat is returned if no formatter is registered for the name
+func LookupStatementFormatter(name string) (StatementFormatter, error) {
+	statementFormattersMutex.RLock()
+	defer statementFormattersMutex.RUnlock()
+
+	formatter, ok := statementFormatters[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w %s. Use one of %s.", ErrStatementUnknownFormat, name, strings.Join(statementFormatNames(), ", "))
+	}
+	return formatter, nil
+}
+
+// statementFormatNames returns the registered format names sorted. Callers must hold the mutex
+func statementFormatNames() []string {
+	names := []string{}
+	for name := range statementFormatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
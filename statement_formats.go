@@ -0,0 +1,182 @@
+package atm
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVStatementFormatter exports one row per transaction
+type CSVStatementFormatter struct{}
+
+func (CSVStatementFormatter) ContentType() string { return "text/csv" }
+func (CSVStatementFormatter) Extension() string   { return "csv" }
+
+// Format writes a header and a row per transaction with the date in ISO 8601
+func (CSVStatementFormatter) Format(w io.Writer, statement Statement) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"DATE", "TRANSACTION_ID", "KIND", "AMOUNT", "FEE", "BALANCE", "REVERSAL_OF", "REASON"})
+	for _, t := range statement.Transactions {
+		writer.Write([]string{
+			time.Unix(t.DateTime, 0).Format(time.RFC3339),
+			t.TransactionID,
+			t.Kind,
+			strconv.FormatFloat(t.Amount, 'f', 2, 64),
+			strconv.FormatFloat(t.Fee, 'f', 2, 64),
+			strconv.FormatFloat(t.Balance, 'f', 2, 64),
+			t.ReversalOf,
+			t.Reason,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// JSONStatementFormatter exports the statement with its balances and totals as one JSON document
+type JSONStatementFormatter struct{}
+
+func (JSONStatementFormatter) ContentType() string { return "application/json" }
+func (JSONStatementFormatter) Extension() string   { return "json" }
+
+func (JSONStatementFormatter) Format(w io.Writer, statement Statement) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(statement)
+}
+
+// OFXStatementFormatter exports an OFX 1.0.2 bank statement, fees are separate transactions
+type OFXStatementFormatter struct{}
+
+func (OFXStatementFormatter) ContentType() string { return "application/x-ofx" }
+func (OFXStatementFormatter) Extension() string   { return "ofx" }
+
+func (OFXStatementFormatter) Format(w io.Writer, statement Statement) error {
+	writer := bufio.NewWriter(w)
+	ofxDate := func(dateTime int64) string {
+		return time.Unix(dateTime, 0).UTC().Format("20060102150405")
+	}
+	from := statement.From
+	if from == 0 && len(statement.Transactions) > 0 {
+		from = statement.Transactions[0].DateTime
+	}
+
+	writer.WriteString("OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\nSECURITY:NONE\r\nENCODING:USASCII\r\nCHARSET:1252\r\nCOMPRESSION:NONE\r\nOLDFILEUID:NONE\r\nNEWFILEUID:NONE\r\n\r\n")
+	writer.WriteString("<OFX>\r\n")
+	writer.WriteString("<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS>")
+	fmt.Fprintf(writer, "<DTSERVER>%s<LANGUAGE>ENG</SONRS></SIGNONMSGSRSV1>\r\n", ofxDate(statement.GeneratedAt))
+	writer.WriteString("<BANKMSGSRSV1><STMTTRNRS><TRNUID>0<STATUS><CODE>0<SEVERITY>INFO</STATUS>\r\n")
+	fmt.Fprintf(writer, "<STMTRS><CURDEF>%s<BANKACCTFROM><BANKID>ATM<ACCTID>%d<ACCTTYPE>CHECKING</BANKACCTFROM>\r\n", statementCurrency(statement), statement.AccountID)
+	fmt.Fprintf(writer, "<BANKTRANLIST><DTSTART>%s<DTEND>%s\r\n", ofxDate(from), ofxDate(statement.To))
+
+	writeTransaction := func(trnType string, dateTime int64, amount float64, id string, name string, memo string) {
+		fmt.Fprintf(writer, "<STMTTRN><TRNTYPE>%s<DTPOSTED>%s<TRNAMT>%.2f<FITID>%s<NAME>%s", trnType, ofxDate(dateTime), amount, id, ofxEscape(name))
+		if memo != "" {
+			fmt.Fprintf(writer, "<MEMO>%s", ofxEscape(memo))
+		}
+		writer.WriteString("</STMTTRN>\r\n")
+	}
+	for i, t := range statement.Transactions {
+		id := statementTransactionID(t, i)
+		trnType := "CREDIT"
+		if t.Amount < 0 {
+			trnType = "DEBIT"
+		}
+		writeTransaction(trnType, t.DateTime, t.Amount, id, statementKindName(t.Kind), t.Reason)
+		if t.Fee != 0 {
+			name, memo := statementFee(t)
+			trnType = "FEE"
+			if t.Fee < 0 {
+				trnType = "CREDIT"
+			}
+			writeTransaction(trnType, t.DateTime, -t.Fee, id+"-FEE", name, memo)
+		}
+	}
+
+	writer.WriteString("</BANKTRANLIST>\r\n")
+	fmt.Fprintf(writer, "<LEDGERBAL><BALAMT>%.2f<DTASOF>%s</LEDGERBAL>\r\n", statement.ClosingBalance, ofxDate(statement.To))
+	writer.WriteString("</STMTRS></STMTTRNRS></BANKMSGSRSV1>\r\n</OFX>\r\n")
+	return writer.Flush()
+}
+
+// QIFStatementFormatter exports a Quicken bank account, the opening balance is the first entry and fees are separate entries
+type QIFStatementFormatter struct{}
+
+func (QIFStatementFormatter) ContentType() string { return "application/qif" }
+func (QIFStatementFormatter) Extension() string   { return "qif" }
+
+func (QIFStatementFormatter) Format(w io.Writer, statement Statement) error {
+	writer := bufio.NewWriter(w)
+	qifDate := func(dateTime int64) string {
+		return time.Unix(dateTime, 0).Format("01/02/2006")
+	}
+	from := statement.From
+	if from == 0 && len(statement.Transactions) > 0 {
+		from = statement.Transactions[0].DateTime
+	}
+
+	writer.WriteString("!Type:Bank\n")
+	fmt.Fprintf(writer, "D%s\nT%.2f\nPOpening Balance\n^\n", qifDate(from), statement.OpeningBalance)
+	for i, t := range statement.Transactions {
+		fmt.Fprintf(writer, "D%s\nT%.2f\nN%s\nP%s\n", qifDate(t.DateTime), t.Amount, statementTransactionID(t, i), statementKindName(t.Kind))
+		if t.Reason != "" {
+			fmt.Fprintf(writer, "M%s\n", strings.NewReplacer("\n", " ").Replace(t.Reason))
+		}
+		writer.WriteString("^\n")
+		if t.Fee != 0 {
+			name, memo := statementFee(t)
+			fmt.Fprintf(writer, "D%s\nT%.2f\nP%s\n", qifDate(t.DateTime), -t.Fee, name)
+			if memo != "" {
+				fmt.Fprintf(writer, "M%s\n", memo)
+			}
+			writer.WriteString("^\n")
+		}
+	}
+	return writer.Flush()
+}
+
+// statementTransactionID returns the transaction ID or an ID from the time and position for transactions written before transaction IDs
+func statementTransactionID(t Transaction, i int) string {
+	if t.TransactionID != "" {
+		return t.TransactionID
+	}
+	return fmt.Sprintf("%d-%d", t.DateTime, i)
+}
+
+// statementFee returns the name and memo of the fee of a transaction.
+// A withdrawal that takes the account below zero is charged the overdraft fee and a reversal refunds the fees of the transaction it reverses
+func statementFee(t Transaction) (string, string) {
+	switch {
+	case t.Fee < 0 && t.ReversalOf != "":
+		return "Fee refund", "Refund of the fees of " + t.ReversalOf
+	case t.Fee < 0:
+		return "Fee refund", ""
+	case t.Kind == TransactionKindWithdrawal && t.Balance < 0:
+		return "Withdrawal fee", "Includes the overdraft fee"
+	}
+	return statementKindName(t.Kind) + " fee", ""
+}
+
+// statementCurrency returns the currency of the statement, DefaultCurrency if it has none
+func statementCurrency(statement Statement) string {
+	if statement.Currency == "" {
+		return DefaultCurrency
+	}
+	return statement.Currency
+}
+
+func statementKindName(kind string) string {
+	if kind == "" {
+		return "Transaction"
+	}
+	return strings.ToUpper(kind[:1]) + kind[1:]
+}
+
+func ofxEscape(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(value)
+}
@@ -0,0 +1,151 @@
+package atm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+// statement transactions of account 12345678 that was opened with 100.00 on day 1
+var statementTransactions = []atm.Transaction{
+	{AccountID: 12345678, DateTime: 86400 * 2, Amount: -20, Balance: 80, TransactionID: "A", Kind: atm.TransactionKindWithdrawal},
+	{AccountID: 12345678, DateTime: 86400 * 3, Amount: -100, Fee: 5, Balance: -25, TransactionID: "B", Kind: atm.TransactionKindWithdrawal},
+	{AccountID: 12345678, DateTime: 86400 * 4, Amount: 100, Fee: -5, Balance: 80, TransactionID: "C", Kind: atm.TransactionKindReversal, ReversalOf: "B", Reason: "Cash & card jam"},
+	{AccountID: 12345678, DateTime: 86400 * 5, Amount: 50, Balance: 130, TransactionID: "D", Kind: atm.TransactionKindDeposit},
+}
+
+func TestNewStatement(t *testing.T) {
+	account := atm.Account{AccountID: 12345678, Balance: 130}
+
+	statement := atm.NewStatement(account, statementTransactions, 86400*3, 86400*4)
+	if statement.OpeningBalance != 80 || statement.ClosingBalance != 80 {
+		t.Errorf("Balances are incorrect. %.2f %.2f", statement.OpeningBalance, statement.ClosingBalance)
+	}
+	if statement.TotalCredits != 100 || statement.TotalDebits != -100 || statement.TotalFees != 0 {
+		t.Errorf("Totals are incorrect. %+v", statement)
+	}
+	if len(statement.Transactions) != 2 || statement.Transactions[0].TransactionID != "B" {
+		t.Errorf("Transactions are incorrect. %+v", statement.Transactions)
+	}
+
+	// the whole history starts with the opening balance of the account
+	statement = atm.NewStatement(account, statementTransactions, 0, 86400*10)
+	if statement.OpeningBalance != 100 || statement.ClosingBalance != 130 || len(statement.Transactions) != 4 {
+		t.Errorf("Statement is incorrect. %+v", statement)
+	}
+
+	// an account without transactions in the period
+	statement = atm.NewStatement(account, statementTransactions, 86400*10, 86400*11)
+	if statement.OpeningBalance != 130 || statement.ClosingBalance != 130 || len(statement.Transactions) != 0 {
+		t.Errorf("Empty statement is incorrect. %+v", statement)
+	}
+}
+
+func TestParseStatementPeriod(t *testing.T) {
+	from, to, err := atm.ParseStatementPeriod("2020-10-01", "2020-10-31")
+	assertNoError(t, err)
+	if from != time.Date(2020, 10, 1, 0, 0, 0, 0, time.Local).Unix() || to != time.Date(2020, 11, 1, 0, 0, 0, 0, time.Local).Unix()-1 {
+		t.Errorf("Period is incorrect. %d %d", from, to)
+	}
+
+	from, to, err = atm.ParseStatementPeriod("", "")
+	assertNoError(t, err)
+	if from != 0 || to < time.Now().Unix()-1 {
+		t.Errorf("Default period is incorrect. %d %d", from, to)
+	}
+
+	_, _, err = atm.ParseStatementPeriod("2020-10-31", "2020-10-01")
+	if !errors.Is(err, atm.ErrStatementInvalidPeriod) {
+		t.Errorf("Period should be invalid. %v", err)
+	}
+	_, _, err = atm.ParseStatementPeriod("October", "")
+	if !errors.Is(err, atm.ErrStatementInvalidPeriod) {
+		t.Errorf("Period should be invalid. %v", err)
+	}
+}
+
+func formatStatement(t *testing.T, format string) string {
+	formatter, err := atm.LookupStatementFormatter(format)
+	assertNoError(t, err)
+	statement := atm.NewStatement(atm.Account{AccountID: 12345678, Balance: 130}, statementTransactions, 0, 86400*10)
+	output := &bytes.Buffer{}
+	assertNoError(t, formatter.Format(output, statement))
+	return output.String()
+}
+
+func TestStatementFormats(t *testing.T) {
+	csv := formatStatement(t, "CSV")
+	lines := strings.Split(strings.TrimSpace(csv), "\n")
+	if len(lines) != 5 || lines[0] != "DATE,TRANSACTION_ID,KIND,AMOUNT,FEE,BALANCE,REVERSAL_OF,REASON" || !strings.Contains(lines[2], ",B,withdrawal,-100.00,5.00,-25.00,,") {
+		t.Errorf("CSV is incorrect.\n%s", csv)
+	}
+
+	statement := atm.Statement{}
+	assertNoError(t, json.Unmarshal([]byte(formatStatement(t, "json")), &statement))
+	if statement.AccountID != 12345678 || statement.OpeningBalance != 100 || statement.ClosingBalance != 130 || len(statement.Transactions) != 4 {
+		t.Errorf("JSON is incorrect. %+v", statement)
+	}
+
+	ofx := formatStatement(t, "ofx")
+	for _, expected := range []string{
+		"OFXHEADER:100",
+		"<ACCTID>12345678",
+		"<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>19700104000000<TRNAMT>-100.00<FITID>B<NAME>Withdrawal</STMTTRN>",
+		"<CURDEF>USD<BANKACCTFROM>",
+		"<STMTTRN><TRNTYPE>FEE<DTPOSTED>19700104000000<TRNAMT>-5.00<FITID>B-FEE<NAME>Withdrawal fee<MEMO>Includes the overdraft fee</STMTTRN>",
+		"<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>19700105000000<TRNAMT>5.00<FITID>C-FEE<NAME>Fee refund<MEMO>Refund of the fees of B</STMTTRN>",
+		"<MEMO>Cash &amp; card jam",
+		"<LEDGERBAL><BALAMT>130.00",
+	} {
+		if !strings.Contains(ofx, expected) {
+			t.Errorf("OFX does not contain %s.\n%s", expected, ofx)
+		}
+	}
+
+	qif := formatStatement(t, "qif")
+	if !strings.HasPrefix(qif, "!Type:Bank\nD") || !strings.Contains(qif, "T100.00\nPOpening Balance\n^\n") || !strings.Contains(qif, "T-100.00\nNB\nPWithdrawal\n^\n") || !strings.Contains(qif, "T5.00\nPFee refund\nMRefund of the fees of B\n^\n") || strings.Count(qif, "^\n") != 7 {
+		t.Errorf("QIF is incorrect.\n%s", qif)
+	}
+}
+
+type textStatementFormatter struct{}
+
+func (textStatementFormatter) ContentType() string { return "text/plain" }
+func (textStatementFormatter) Extension() string   { return "txt" }
+func (textStatementFormatter) Format(w io.Writer, statement atm.Statement) error {
+	_, err := io.WriteString(w, "statement")
+	return err
+}
+
+func TestRegisterStatementFormatter(t *testing.T) {
+	_, err := atm.LookupStatementFormatter("txt")
+	if !errors.Is(err, atm.ErrStatementUnknownFormat) {
+		t.Errorf("Format should be unknown. %v", err)
+	}
+	atm.RegisterStatementFormatter("txt", textStatementFormatter{})
+	if formatStatement(t, "txt") != "statement" {
+		t.Errorf("Registered formatter was not used")
+	}
+}
+
+func TestHostStatement(t *testing.T) {
+	accountDB, transactionDB := newTestDBs(t, "12345678,1234,100.00\n", "")
+	host := &atm.Host{AccountDB: accountDB, TransactionDB: transactionDB}
+	_, err := host.Withdraw(12345678, 40, "")
+	assertNoError(t, err)
+
+	statement, err := host.Statement(12345678, 0, time.Now().Unix())
+	assertNoError(t, err)
+	if statement.OpeningBalance != 100 || statement.ClosingBalance != 60 || statement.TotalDebits != -40 {
+		t.Errorf("Statement is incorrect. %+v", statement)
+	}
+
+	_, err = host.Statement(87654321, 0, time.Now().Unix())
+	assertErrorIsError(t, err, atm.ErrAccountNotFound)
+}
@@ -3,30 +3,72 @@ package atm
 import (
 	"bufio"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// transaction kinds
+const (
+	TransactionKindWithdrawal = "withdrawal"
+	TransactionKindDeposit    = "deposit"
+	TransactionKindReversal   = "reversal"
+	// adjustments are written by the reconciliation to correct the ledger
+	TransactionKindAdjustment = "adjustment"
 )
 
 type Transaction struct {
-	AccountID int
-	DateTime  int64
-	Amount    float64
-	Balance   float64
+	AccountID int     `json:"account_id"`
+	DateTime  int64   `json:"date_time"`
+	Amount    float64 `json:"amount"`
+	Balance   float64 `json:"balance"`
+
+	TransactionID string `json:"transaction_id"`
+	Kind          string `json:"kind"`
+	// Fee charged to the account on top of the amount, negative if a fee was refunded
+	Fee float64 `json:"fee"`
+	// ReversalOf is the ID of the transaction this transaction reverses
+	ReversalOf string `json:"reversal_of,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	// Sequence is the 1-based position of the transaction in the ledger and Hash chains it to the transaction before it
+	Sequence int64  `json:"sequence,omitempty"`
+	Hash     string `json:"hash,omitempty"`
 }
 
 type ITransactionDB interface {
 	// return all transactions for a given account
 	Get(int) ([]Transaction, error)
+	// return the transactions of an account matching the query, sorted and paged
+	Query(HistoryQuery) ([]Transaction, error)
+	// return all transactions of every account in the order they were added
+	All() ([]Transaction, error)
 	// add a transaction return error if failure to add transaction
 	Set(Transaction) error
+	// add transactions in one write, used by the reconciliation to append its correcting entries
+	Append([]Transaction) error
 }
 
 type TransactionDB struct {
 	DBFile string
+	// CheckpointFile stores the signed checkpoints of the hash chain, no checkpoints are written if empty or without a key
+	CheckpointFile string
+	// CheckpointKey signs the checkpoints with HMAC-SHA256
+	CheckpointKey []byte
+	// CheckpointInterval is the number of transactions between checkpoints, DefaultCheckpointInterval if zero
+	CheckpointInterval int
+	// Logger records chaining and checkpoint failures, nothing is logged if not set
+	Logger *slog.Logger
+	// Metrics records the duration of reads and writes, nothing is recorded if not set
+	Metrics *Metrics
 }
 
-func (t TransactionDB) read() ([]Transaction, error) {
+// read returns the transactions of the CSV file that match, every transaction if match is nil
+func (t TransactionDB) read(match func(Transaction) bool) ([]Transaction, error) {
+	defer t.Metrics.observeStore(metricStoreTransactions, metricOperationRead, time.Now())
 	file, err := os.Open(t.DBFile)
 	if err != nil {
 		return []Transaction{}, err
@@ -48,6 +90,9 @@ func (t TransactionDB) read() ([]Transaction, error) {
 		}
 
 		columns := strings.Split(line, ",")
+		if len(columns) != 4 && len(columns) != 9 && len(columns) != 11 {
+			return []Transaction{}, fmt.Errorf("Invalid number of columns in the provided transactions CSV. %s", line)
+		}
 
 		// Validate all of the csv entries of are appropriate types
 		accountID, err := strconv.Atoi(columns[0])
@@ -75,6 +120,35 @@ func (t TransactionDB) read() ([]Transaction, error) {
 			DateTime:  dateTime,
 			Amount:    amount,
 			Balance:   balance,
+			Kind:      TransactionKindDeposit,
+		}
+		if amount < 0 {
+			transaction.Kind = TransactionKindWithdrawal
+		}
+
+		// Transactions written before transaction IDs only have the first 4 columns
+		if len(columns) >= 9 {
+			fee, err := strconv.ParseFloat(columns[6], 64)
+			if err != nil {
+				return []Transaction{}, ErrTransactionFeeNotFloat
+			}
+			transaction.TransactionID = columns[4]
+			transaction.Kind = columns[5]
+			transaction.Fee = fee
+			transaction.ReversalOf = columns[7]
+			transaction.Reason = columns[8]
+		}
+		// Transactions written before the hash chain only have the first 9 columns
+		if len(columns) == 11 {
+			sequence, err := strconv.ParseInt(columns[9], 10, 64)
+			if err != nil {
+				return []Transaction{}, ErrTransactionSequenceNotInteger
+			}
+			transaction.Sequence = sequence
+			transaction.Hash = columns[10]
+		}
+		if match != nil && !match(transaction) {
+			continue
 		}
 		transactions = append(transactions, transaction)
 	}
@@ -86,61 +160,240 @@ func (t TransactionDB) read() ([]Transaction, error) {
 	return transactions, nil
 }
 
+// write replaces the ledger with the transactions.
+// The ledger is written to a temporary file first so a crash or a full disk never leaves a partial ledger
 func (t TransactionDB) write(transactions []Transaction) error {
-	file, err := os.OpenFile(t.DBFile, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
+	defer t.Metrics.observeStore(metricStoreTransactions, metricOperationWrite, time.Now())
 
-	datawriter := bufio.NewWriter(file)
-	// Write the header
-	datawriter.WriteString("ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE\n")
-
-	// Write each transaction to file
+	var content strings.Builder
+	content.WriteString("ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE,TRANSACTION_ID,KIND,FEE,REVERSAL_OF,REASON,SEQUENCE,HASH\n")
 	for _, transaction := range transactions {
-		_, err = datawriter.WriteString(fmt.Sprintf("%d,%d,%.2f,%.2f\n", transaction.AccountID, transaction.DateTime, transaction.Amount, transaction.Balance))
-
-		if err != nil {
-			return err
-		}
+		content.WriteString(ledgerRecord(transaction) + "," + transaction.Hash + "\n")
 	}
-
-	datawriter.Flush()
-	file.Close()
-
-	return nil
+	return writeFileAtomic(t.DBFile, []byte(content.String()))
 }
 
 // Get retrieves a list of transactions for a given accountID from a CSV file
 // An error is returned on failure to read the CSV file
 func (t TransactionDB) Get(accountID int) ([]Transaction, error) {
-	transactions, err := t.read()
-	if err != nil {
+	return t.read(func(transaction Transaction) bool {
+		return transaction.AccountID == accountID
+	})
+}
+
+// Query retrieves the transactions of an account matching the query from a CSV file.
+// Transactions are filtered while the file is read, then sorted and paged
+// An error is returned if the query is invalid or on failure to read the CSV file
+func (t TransactionDB) Query(query HistoryQuery) ([]Transaction, error) {
+	if err := query.Validate(); err != nil {
 		return []Transaction{}, err
 	}
-
-	accountTransactions := []Transaction{}
-	for _, transaction := range transactions {
-		if transaction.AccountID == accountID {
-			accountTransactions = append(accountTransactions, transaction)
-		}
+	transactions, err := t.read(query.Match)
+	if err != nil {
+		return []Transaction{}, err
 	}
+	return query.page(transactions), nil
+}
 
-	return accountTransactions, err
+// All retrieves every transaction from the CSV file in the order they were added
+// An error is returned on failure to read the CSV file
+func (t TransactionDB) All() ([]Transaction, error) {
+	return t.read(nil)
 }
 
-// Set appends a transaction to the transactions CSV file
+// Set appends a transaction to the transactions CSV file chained to the transaction before it and signs the head of the ledger.
+// ErrLedgerNotMigrated is returned for a ledger written before the hash chain and ErrLedgerTampered if the
+// records signed by the last checkpoint were edited or deleted
 // An error is returned on failure to read or write the CSV file
 func (t TransactionDB) Set(transaction Transaction) error {
-	transactions, err := t.read()
+	transactions, checkpoints, err := t.readLedger()
 	if err != nil {
 		return err
 	}
+	if t.checkpointsEnabled() {
+		if err := t.verifyHead(transactions, checkpoints); err != nil {
+			return err
+		}
+	}
+	return t.add(transactions, checkpoints, []Transaction{transaction})
+}
 
-	transactions = append(transactions, transaction)
-	err = t.write(transactions)
+// Append adds the transactions to the end of the CSV file in one write, chained to the transaction before them.
+// ErrLedgerNotMigrated is returned for a ledger written before the hash chain and ErrLedgerTampered if the
+// ledger fails verification, so a tampered ledger is never signed again
+// An error is returned on failure to read or write the CSV files
+func (t TransactionDB) Append(added []Transaction) error {
+	transactions, checkpoints, err := t.readLedger()
 	if err != nil {
 		return err
 	}
+	if verification := VerifyLedger(transactions, checkpoints, t.verificationKey()); !verification.OK() {
+		return fmt.Errorf("%w %s", ErrLedgerTampered, verification.Message)
+	}
+	return t.add(transactions, checkpoints, added)
+}
+
+// readLedger reads the transactions and checkpoints a transaction is added to.
+// ErrLedgerNotMigrated is returned if the ledger was written before the hash chain
+func (t TransactionDB) readLedger() ([]Transaction, []LedgerCheckpoint, error) {
+	transactions, err := t.read(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(transactions) > 0 && !ledgerChained(transactions) {
+		return nil, nil, ErrLedgerNotMigrated
+	}
+	checkpoints, err := t.readCheckpoints()
+	if err != nil {
+		return nil, nil, err
+	}
+	return transactions, checkpoints, nil
+}
+
+// add chains the added transactions to the ledger, writes it and signs its head
+func (t TransactionDB) add(transactions []Transaction, checkpoints []LedgerCheckpoint, added []Transaction) error {
+	if len(added) == 0 {
+		return nil
+	}
+	previous := ""
+	if len(transactions) > 0 {
+		previous = transactions[len(transactions)-1].Hash
+	}
+	for _, transaction := range added {
+		transaction.Sequence = int64(len(transactions) + 1)
+		transaction.Hash = ledgerHash(previous, transaction)
+		transactions = append(transactions, transaction)
+		previous = transaction.Hash
+	}
+	if err := t.write(transactions); err != nil {
+		return err
+	}
+	// the transactions are written, an unsigned head is signed with the next transaction
+	if err := t.checkpoint(transactions, checkpoints); err != nil {
+		last := transactions[len(transactions)-1]
+		orDiscard(t.Logger).Error("ledger checkpoint not written", LogKeyTransactionID, last.TransactionID, "sequence", last.Sequence, logError(err))
+	}
 	return nil
 }
+
+// Migrate rewrites a ledger written before the hash chain in the current format, chained and checkpointed.
+// Transactions cannot be added to the ledger until it is migrated.
+// Returns the number of records chained, 0 if the ledger is empty or already chained
+// An error is returned on failure to read or write the CSV files
+func (t TransactionDB) Migrate() (int, error) {
+	transactions, err := t.read(nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(transactions) == 0 || ledgerChained(transactions) {
+		return 0, nil
+	}
+	checkpoints, err := t.readCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+	chainLedger(transactions)
+	if err := t.write(transactions); err != nil {
+		return 0, err
+	}
+	orDiscard(t.Logger).Info("ledger hash chained", "records", len(transactions))
+	return len(transactions), t.checkpoint(transactions, checkpoints)
+}
+
+// sort orders of a history query
+const (
+	SortOldestFirst = "asc"
+	SortNewestFirst = "desc"
+)
+
+// HistoryQuery selects the transactions of an account. Zero values do not filter
+type HistoryQuery struct {
+	AccountID int
+	// From and To are the date range in epoch seconds, both inclusive
+	From int64
+	To   int64
+	// Kind is one of the transaction kinds
+	Kind string
+	// MinAmount and MaxAmount are the range of the amount regardless of its sign, both inclusive
+	MinAmount float64
+	MaxAmount float64
+	// Limit is the most transactions returned after skipping Offset transactions, no limit if zero
+	Limit  int
+	Offset int
+	// Order is SortOldestFirst, the default, or SortNewestFirst
+	Order string
+}
+
+// Validate returns ErrHistoryQueryInvalid if the query cannot match or page transactions
+func (q HistoryQuery) Validate() error {
+	switch {
+	case q.Limit < 0 || q.Offset < 0:
+		return fmt.Errorf("%w limit and offset cannot be negative.", ErrHistoryQueryInvalid)
+	case q.Order != "" && q.Order != SortOldestFirst && q.Order != SortNewestFirst:
+		return fmt.Errorf("%w order must be %s or %s.", ErrHistoryQueryInvalid, SortOldestFirst, SortNewestFirst)
+	case q.Kind != "" && q.Kind != TransactionKindWithdrawal && q.Kind != TransactionKindDeposit && q.Kind != TransactionKindReversal && q.Kind != TransactionKindAdjustment:
+		return fmt.Errorf("%w kind must be %s, %s, %s or %s.", ErrHistoryQueryInvalid, TransactionKindWithdrawal, TransactionKindDeposit, TransactionKindReversal, TransactionKindAdjustment)
+	case q.From != 0 && q.To != 0 && q.From > q.To:
+		return fmt.Errorf("%w from is after to.", ErrHistoryQueryInvalid)
+	case q.MinAmount < 0 || q.MaxAmount < 0 || (q.MaxAmount != 0 && q.MinAmount > q.MaxAmount):
+		return fmt.Errorf("%w amount range is not valid.", ErrHistoryQueryInvalid)
+	}
+	return nil
+}
+
+// Match returns true if the transaction is of the account and passes every filter of the query
+func (q HistoryQuery) Match(transaction Transaction) bool {
+	amount := math.Abs(transaction.Amount)
+	switch {
+	case transaction.AccountID != q.AccountID:
+		return false
+	case q.From != 0 && transaction.DateTime < q.From:
+		return false
+	case q.To != 0 && transaction.DateTime > q.To:
+		return false
+	case q.Kind != "" && transaction.Kind != q.Kind:
+		return false
+	case amount < q.MinAmount:
+		return false
+	case q.MaxAmount != 0 && amount > q.MaxAmount:
+		return false
+	}
+	return true
+}
+
+// Apply filters, sorts and pages transactions for stores that cannot query themselves
+// An error is returned if the query is invalid
+func (q HistoryQuery) Apply(transactions []Transaction) ([]Transaction, error) {
+	if err := q.Validate(); err != nil {
+		return []Transaction{}, err
+	}
+	matched := []Transaction{}
+	for _, transaction := range transactions {
+		if q.Match(transaction) {
+			matched = append(matched, transaction)
+		}
+	}
+	return q.page(matched), nil
+}
+
+// page sorts the matched transactions and returns the page of the query.
+// Transactions at the same time keep the order they were added
+func (q HistoryQuery) page(transactions []Transaction) []Transaction {
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].DateTime < transactions[j].DateTime
+	})
+	if q.Order == SortNewestFirst {
+		for i, j := 0, len(transactions)-1; i < j; i, j = i+1, j-1 {
+			transactions[i], transactions[j] = transactions[j], transactions[i]
+		}
+	}
+
+	if q.Offset >= len(transactions) {
+		return []Transaction{}
+	}
+	transactions = transactions[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(transactions) {
+		transactions = transactions[:q.Limit]
+	}
+	return transactions
+}
@@ -1,14 +1,24 @@
 package atm_test
 
 import (
+	"errors"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/AndrewCopeland/atm"
 )
 
-var TransactionDB = atm.TransactionDB{
-	DBFile: "./transactions_test.csv",
+// newFixtureTransactionDB returns a transaction DB of a temporary copy of transactions_test.csv, so the tests never change the fixture
+func newFixtureTransactionDB(t *testing.T) atm.TransactionDB {
+	content, err := os.ReadFile("./transactions_test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rows, _ := strings.Cut(string(content), "\n")
+	_, transactionDB := newTestDBs(t, "", rows)
+	return transactionDB
 }
 
 var InvalidTransactionDB = atm.TransactionDB{
@@ -16,7 +26,7 @@ var InvalidTransactionDB = atm.TransactionDB{
 }
 
 func TestGetValidTransactions(t *testing.T) {
-	transactions, err := TransactionDB.Get(7089382418)
+	transactions, err := newFixtureTransactionDB(t).Get(7089382418)
 	assertNoError(t, err)
 
 	if len(transactions) != 3 {
@@ -31,7 +41,7 @@ func TestGetValidTransactions(t *testing.T) {
 }
 
 func TestGetTransactionsForNonExistentAccount(t *testing.T) {
-	transactions, err := TransactionDB.Get(12345678)
+	transactions, err := newFixtureTransactionDB(t).Get(12345678)
 	assertNoError(t, err)
 	if len(transactions) != 0 {
 		t.Errorf("Transactions were returned and should not have been")
@@ -46,10 +56,11 @@ func TestSetValidTransaction(t *testing.T) {
 		Amount:    1.00,
 		Balance:   2.00,
 	}
-	err := TransactionDB.Set(transaction)
+	transactionDB := newFixtureTransactionDB(t)
+	err := transactionDB.Set(transaction)
 	assertNoError(t, err)
 
-	transactions, err := TransactionDB.Get(transaction.AccountID)
+	transactions, err := transactionDB.Get(transaction.AccountID)
 	assertNoError(t, err)
 
 	// Validate transaction now exists in the transaction database using the time as the unique ID
@@ -65,7 +76,78 @@ func TestSetValidTransaction(t *testing.T) {
 	}
 }
 
+func TestSetTransactionWriteFails(t *testing.T) {
+	_, transactionDB := newTestDBs(t, "", "")
+	assertNoError(t, transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 1600000000, Amount: 20, Balance: 20}))
+	before, err := os.ReadFile(transactionDB.DBFile)
+	assertNoError(t, err)
+
+	// the temporary file cannot be created so the ledger is not written
+	assertNoError(t, os.Mkdir(transactionDB.DBFile+".tmp", 0755))
+	err = transactionDB.Set(atm.Transaction{AccountID: 12345678, DateTime: 1600000001, Amount: 1, Balance: 21})
+	assertError(t, err)
+
+	after, err := os.ReadFile(transactionDB.DBFile)
+	assertNoError(t, err)
+	if string(after) != string(before) {
+		t.Errorf("Ledger should be left as it was.\n%s", after)
+	}
+}
+
 func TestGetTransactionsInvalidDatabase(t *testing.T) {
 	_, err := InvalidTransactionDB.Get(12345678)
 	assertError(t, err)
 }
+
+func TestQueryTransactions(t *testing.T) {
+	_, transactionDB := newTestDBs(t, "", ""+
+		"12345678,100,-20.00,80.00,A,withdrawal,0.00,,\n"+
+		"12345678,200,50.00,130.00,B,deposit,0.00,,\n"+
+		"87654321,250,-20.00,0.00,C,withdrawal,0.00,,\n"+
+		"12345678,300,-100.00,30.00,D,withdrawal,0.00,,\n"+
+		"12345678,400,20.00,50.00,E,reversal,0.00,D,\n")
+
+	ids := func(query atm.HistoryQuery) string {
+		transactions, err := transactionDB.Query(query)
+		assertNoError(t, err)
+		result := ""
+		for _, transaction := range transactions {
+			result += transaction.TransactionID
+		}
+		return result
+	}
+
+	tests := []struct {
+		query    atm.HistoryQuery
+		expected string
+	}{
+		{atm.HistoryQuery{AccountID: 12345678}, "ABDE"},
+		{atm.HistoryQuery{AccountID: 12345678, Order: atm.SortNewestFirst}, "EDBA"},
+		{atm.HistoryQuery{AccountID: 12345678, From: 200, To: 300}, "BD"},
+		{atm.HistoryQuery{AccountID: 12345678, Kind: atm.TransactionKindWithdrawal}, "AD"},
+		// the amount range ignores the sign
+		{atm.HistoryQuery{AccountID: 12345678, MinAmount: 20, MaxAmount: 50}, "ABE"},
+		{atm.HistoryQuery{AccountID: 12345678, Limit: 2, Offset: 1}, "BD"},
+		{atm.HistoryQuery{AccountID: 12345678, Offset: 10}, ""},
+		{atm.HistoryQuery{AccountID: 87654321}, "C"},
+	}
+	for _, test := range tests {
+		if result := ids(test.query); result != test.expected {
+			t.Errorf("Query %+v returned %s and should return %s", test.query, result, test.expected)
+		}
+	}
+
+	invalid := []atm.HistoryQuery{
+		{AccountID: 12345678, Limit: -1},
+		{AccountID: 12345678, Order: "random"},
+		{AccountID: 12345678, Kind: "transfer"},
+		{AccountID: 12345678, From: 300, To: 200},
+		{AccountID: 12345678, MinAmount: 50, MaxAmount: 20},
+	}
+	for _, query := range invalid {
+		_, err := transactionDB.Query(query)
+		if !errors.Is(err, atm.ErrHistoryQueryInvalid) {
+			t.Errorf("Query %+v should be invalid. %v", query, err)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package atm_test
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/AndrewCopeland/atm"
 )
 
 func assertNoError(t *testing.T, err error) {
@@ -32,3 +36,22 @@ func assertErrorContains(t *testing.T, err error, contains string) {
 		t.Errorf("Incorrect error, should contains '%s' but is '%s'", contains, err)
 	}
 }
+
+// newTestDBs writes the accounts and transactions CSV content to a temporary directory
+// and returns databases backed by those files with the ledger migrated to the current format
+func newTestDBs(t *testing.T, accounts string, transactions string) (atm.AccountDB, atm.TransactionDB) {
+	dir := t.TempDir()
+	accountDB := atm.AccountDB{DBFile: filepath.Join(dir, "accounts.csv")}
+	transactionDB := atm.TransactionDB{DBFile: filepath.Join(dir, "transactions.csv")}
+
+	if err := os.WriteFile(accountDB.DBFile, []byte("ACCOUNT_ID,PIN,BALANCE\n"+accounts), 0644); err != nil {
+		t.Fatalf("failed writing accounts: %s", err)
+	}
+	if err := os.WriteFile(transactionDB.DBFile, []byte("ACCOUNT_ID,DATE_TIME,AMOUNT,BALANCE\n"+transactions), 0644); err != nil {
+		t.Fatalf("failed writing transactions: %s", err)
+	}
+	if _, err := transactionDB.Migrate(); err != nil {
+		t.Fatalf("failed migrating transactions: %s", err)
+	}
+	return accountDB, transactionDB
+}
@@ -0,0 +1,302 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhook headers
+const (
+	WebhookHeaderSignature = "X-ATM-Signature"
+	WebhookHeaderTimestamp = "X-ATM-Timestamp"
+	WebhookHeaderEvent     = "X-ATM-Event"
+	WebhookHeaderDelivery  = "X-ATM-Delivery"
+)
+
+// webhook defaults
+const (
+	DefaultWebhookMaxAttempts = 10
+	DefaultWebhookBackoff     = time.Second
+	// WebhookMaxBackoff is the longest wait between two attempts of a delivery
+	WebhookMaxBackoff = time.Hour
+)
+
+// SignWebhook returns the signature of a webhook body sent at the timestamp in epoch seconds,
+// sha256= followed by the hex HMAC-SHA256 of "<timestamp>.<body>" with the secret
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook returns true if the signature of a received webhook was made with the secret.
+// Receivers should also refuse timestamps that are too old to stop replays
+func VerifyWebhook(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// webhookDelivery is an event waiting in the outbox and its attempts so far
+type webhookDelivery struct {
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// WebhookDispatcher posts events as signed JSON to a URL.
+// Publish writes the event to a durable outbox directory first, so events published before a crash are delivered after a restart.
+// Deliveries that fail are retried with an exponential backoff and moved to <outbox>/failed after MaxAttempts
+type WebhookDispatcher struct {
+	URL    string
+	Secret []byte
+	// Outbox is the directory of the events waiting to be delivered, one file per event
+	Outbox string
+	// Client posts the events, a client with a 10 second timeout if not set
+	Client *http.Client
+	// MaxAttempts is the most deliveries of an event, DefaultWebhookMaxAttempts if zero
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, doubled after every attempt. DefaultWebhookBackoff if zero
+	Backoff time.Duration
+	// Logger records failed deliveries, nothing is logged if not set
+	Logger *slog.Logger
+
+	mutex  sync.Mutex
+	wake   chan struct{}
+	events int64
+	// dispatching stops two dispatches from delivering the same event
+	dispatching sync.Mutex
+}
+
+// Publish writes the event to the outbox and wakes the dispatcher.
+// An error is returned if the event could not be written to the outbox
+func (d *WebhookDispatcher) Publish(event Event) error {
+	if err := os.MkdirAll(d.Outbox, 0700); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.events++
+	// the name orders the outbox by the time the events were published
+	name := fmt.Sprintf("%020d-%06d-%s.json", event.Time.UnixNano(), d.events%1000000, event.ID)
+	d.mutex.Unlock()
+
+	if err := d.save(filepath.Join(d.Outbox, name), webhookDelivery{Event: event, NextAttempt: event.Time}); err != nil {
+		return err
+	}
+	select {
+	case d.wakeChannel() <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Dispatch attempts every delivery of the outbox that is due, oldest first, and returns the number delivered.
+// An error is returned on failure to read the outbox
+func (d *WebhookDispatcher) Dispatch(now time.Time) (int, error) {
+	d.dispatching.Lock()
+	defer d.dispatching.Unlock()
+
+	paths, err := d.pending()
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, path := range paths {
+		delivery, err := d.load(path)
+		if err != nil {
+			d.logger().Error("webhook delivery not read from the outbox", "path", path, logError(err))
+			continue
+		}
+		if now.Before(delivery.NextAttempt) {
+			continue
+		}
+
+		err = d.post(delivery.Event)
+		if err == nil {
+			if err := os.Remove(path); err != nil {
+				d.logger().Error("delivered webhook not removed from the outbox, it will be delivered again", "event_id", delivery.Event.ID, logError(err))
+			}
+			delivered++
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		if delivery.Attempts >= d.maxAttempts() {
+			d.logger().Error("webhook delivery failed and was moved to the failed deliveries", "event_id", delivery.Event.ID, "attempts", delivery.Attempts, logError(err))
+			if err := d.fail(path, delivery); err != nil {
+				d.logger().Error("failed webhook delivery not moved", "event_id", delivery.Event.ID, logError(err))
+			}
+			continue
+		}
+		d.logger().Warn("webhook delivery failed and will be retried", "event_id", delivery.Event.ID, "attempts", delivery.Attempts, "next_attempt", delivery.NextAttempt, logError(err))
+		if err := d.save(path, delivery); err != nil {
+			d.logger().Error("webhook delivery attempt not saved", "event_id", delivery.Event.ID, logError(err))
+		}
+	}
+	return delivered, nil
+}
+
+// Run dispatches the outbox when an event is published and when a retry is due until the context is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	wake := d.wakeChannel()
+	for {
+		if _, err := d.Dispatch(time.Now()); err != nil {
+			d.logger().Error("webhook outbox not read", logError(err))
+		}
+		timer := time.NewTimer(d.nextAttempt())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// post sends the event, any status other than 2xx is a failed delivery
+func (d *WebhookDispatcher) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookHeaderTimestamp, timestamp)
+	request.Header.Set(WebhookHeaderSignature, SignWebhook(d.Secret, timestamp, body))
+	request.Header.Set(WebhookHeaderEvent, event.Type)
+	request.Header.Set(WebhookHeaderDelivery, event.ID)
+
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s.", response.Status)
+	}
+	return nil
+}
+
+// pending returns the outbox files oldest first
+func (d *WebhookDispatcher) pending() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(d.Outbox, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// nextAttempt returns how long until the next retry is due, a minute if nothing is waiting.
+// The wait is at least 100ms so a delivery whose attempt could not be saved is not retried in a busy loop
+func (d *WebhookDispatcher) nextAttempt() time.Duration {
+	wait := time.Minute
+	paths, err := d.pending()
+	if err != nil {
+		return wait
+	}
+	for _, path := range paths {
+		delivery, err := d.load(path)
+		if err != nil {
+			continue
+		}
+		if until := time.Until(delivery.NextAttempt); until < wait {
+			wait = until
+		}
+	}
+	if wait < 100*time.Millisecond {
+		return 100 * time.Millisecond
+	}
+	return wait
+}
+
+func (d *WebhookDispatcher) load(path string) (webhookDelivery, error) {
+	delivery := webhookDelivery{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return delivery, err
+	}
+	return delivery, json.Unmarshal(content, &delivery)
+}
+
+func (d *WebhookDispatcher) save(path string, delivery webhookDelivery) error {
+	content, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// fail moves a delivery out of the outbox so it is kept for an operator and not attempted again
+func (d *WebhookDispatcher) fail(path string, delivery webhookDelivery) error {
+	failed := filepath.Join(d.Outbox, "failed")
+	if err := os.MkdirAll(failed, 0700); err != nil {
+		return err
+	}
+	if err := d.save(path, delivery); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(failed, filepath.Base(path)))
+}
+
+// backoff returns the wait after the attempts, doubled after every attempt up to WebhookMaxBackoff
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	if wait <= 0 {
+		wait = DefaultWebhookBackoff
+	}
+	for i := 1; i < attempts && wait < WebhookMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > WebhookMaxBackoff {
+		return WebhookMaxBackoff
+	}
+	return wait
+}
+
+func (d *WebhookDispatcher) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return DefaultWebhookMaxAttempts
+	}
+	return d.MaxAttempts
+}
+
+func (d *WebhookDispatcher) wakeChannel() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.wake == nil {
+		d.wake = make(chan struct{}, 1)
+	}
+	return d.wake
+}
+
+func (d *WebhookDispatcher) logger() *slog.Logger {
+	return orDiscard(d.Logger)
+}
@@ -0,0 +1,97 @@
+package atm_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndrewCopeland/atm"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	secret := []byte("secret")
+	var mutex sync.Mutex
+	received := []atm.Event{}
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if !atm.VerifyWebhook(secret, r.Header.Get(atm.WebhookHeaderTimestamp), body, r.Header.Get(atm.WebhookHeaderSignature)) {
+			t.Errorf("Signature is not valid. %s", r.Header.Get(atm.WebhookHeaderSignature))
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		event := atm.Event{}
+		assertNoError(t, json.Unmarshal(body, &event))
+		if r.Header.Get(atm.WebhookHeaderEvent) != event.Type || r.Header.Get(atm.WebhookHeaderDelivery) != event.ID {
+			t.Errorf("Headers are incorrect. %v", r.Header)
+		}
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	outbox := filepath.Join(t.TempDir(), "outbox")
+	now := time.Now()
+	dispatcher := &atm.WebhookDispatcher{URL: server.URL, Secret: secret, Outbox: outbox, Backoff: time.Minute}
+	assertNoError(t, dispatcher.Publish(atm.Event{ID: "first", Type: atm.EventWithdrawal, Time: now, AccountID: 12345678, Amount: 40}))
+	assertNoError(t, dispatcher.Publish(atm.Event{ID: "second", Type: atm.EventDeposit, Time: now.Add(time.Millisecond)}))
+
+	// the first attempt fails and is retried after the backoff, the event after it is not held back
+	now = now.Add(time.Second)
+	delivered, err := dispatcher.Dispatch(now)
+	assertNoError(t, err)
+	if delivered != 1 || len(received) != 1 || received[0].ID != "second" {
+		t.Fatalf("First dispatch is incorrect. %d %+v", delivered, received)
+	}
+	delivered, _ = dispatcher.Dispatch(now.Add(30 * time.Second))
+	if delivered != 0 {
+		t.Errorf("Retry should wait for the backoff.")
+	}
+
+	// a new dispatcher finds the events left in the outbox after a crash
+	restarted := &atm.WebhookDispatcher{URL: server.URL, Secret: secret, Outbox: outbox}
+	delivered, _ = restarted.Dispatch(now.Add(time.Minute))
+	if delivered != 1 || len(received) != 2 || received[1].ID != "first" || received[1].AccountID != 12345678 {
+		t.Errorf("Retry is incorrect. %d %+v", delivered, received)
+	}
+	pending, _ := filepath.Glob(filepath.Join(outbox, "*.json"))
+	if len(pending) != 0 {
+		t.Errorf("Delivered events are left in the outbox. %v", pending)
+	}
+}
+
+func TestWebhookDispatcherFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	outbox := t.TempDir()
+	dispatcher := &atm.WebhookDispatcher{URL: server.URL, Secret: []byte("secret"), Outbox: outbox, MaxAttempts: 3, Backoff: time.Second}
+	now := time.Now()
+	assertNoError(t, dispatcher.Publish(atm.Event{ID: "lost", Type: atm.EventLockout, Time: now}))
+	// the backoff doubles after every attempt
+	for _, wait := range []time.Duration{0, time.Second, 2 * time.Second} {
+		now = now.Add(wait)
+		delivered, err := dispatcher.Dispatch(now)
+		assertNoError(t, err)
+		if delivered != 0 {
+			t.Errorf("Event should not be delivered.")
+		}
+	}
+
+	failed, _ := filepath.Glob(filepath.Join(outbox, "failed", "*.json"))
+	pending, _ := filepath.Glob(filepath.Join(outbox, "*.json"))
+	if len(failed) != 1 || len(pending) != 0 {
+		t.Errorf("Event was not moved to the failed deliveries. %v %v", failed, pending)
+	}
+}